@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	rice "github.com/GeertJohan/go.rice"
+)
+
+// Versioned asset URLs never change, so they're cached for good.
+const immutableAssetCache = "public, max-age=31536000, immutable"
+
+// assetServer serves the static assets with an ETag of their content's hash
+// and cache headers. Templates link to assets with URLs versioned by the
+// hash (asset), which are cached for good as a new build changes the URL.
+// Unversioned URLs are cached for maxAge, or revalidated with the ETag
+// on every use if it's 0.
+type assetServer struct {
+	box    *rice.Box
+	files  http.Handler
+	maxAge time.Duration
+
+	mu     sync.Mutex
+	hashes map[string]assetHash
+}
+
+// assetHash is the hash of an asset, along with its modification time so
+// that assets read from disk in development are hashed again on changes.
+type assetHash struct {
+	hash    string
+	modTime time.Time
+}
+
+func newAssetServer(box *rice.Box, maxAge time.Duration) *assetServer {
+	return &assetServer{
+		box:    box,
+		files:  http.FileServer(box.HTTPBox()),
+		maxAge: maxAge,
+		hashes: make(map[string]assetHash),
+	}
+}
+
+// ServeHTTP serves an asset, with the /static/ prefix stripped off the path.
+func (a *assetServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if h := a.hash(name); h != "" {
+		// The ETag is weak as the compression of responses changes their
+		// bytes but not the asset.
+		w.Header().Set("ETag", `W/"`+h+`"`)
+		switch {
+		case a.maxAge > 0 && r.URL.Query().Get("v") == h:
+			w.Header().Set("Cache-Control", immutableAssetCache)
+		case a.maxAge > 0:
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(a.maxAge/time.Second)))
+		default:
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+	}
+	a.files.ServeHTTP(w, r)
+}
+
+// url returns the URL of an asset, versioned by its hash if it exists.
+func (a *assetServer) url(name string) string {
+	u := "/static/" + name
+	if h := a.hash(name); h != "" {
+		u += "?v=" + h
+	}
+	return u
+}
+
+// hash returns the hash of an asset's content, or "" if it doesn't exist.
+func (a *assetServer) hash(name string) string {
+	f, err := a.box.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || st.IsDir() {
+		return ""
+	}
+
+	a.mu.Lock()
+	h, ok := a.hashes[name]
+	a.mu.Unlock()
+	if ok && h.modTime.Equal(st.ModTime()) {
+		return h.hash
+	}
+
+	b, err := a.box.Bytes(name)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	h = assetHash{hash: hex.EncodeToString(sum[:8]), modTime: st.ModTime()}
+
+	a.mu.Lock()
+	a.hashes[name] = h
+	a.mu.Unlock()
+	return h.hash
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/knadh/niltalk/internal/hub"
+)
+
+// Identicons are grids of identiconCells x identiconCells, mirrored around
+// the vertical axis, of identiconCellSize px each.
+const (
+	identiconCells    = 5
+	identiconCellSize = 12
+	identiconMargin   = 6
+)
+
+// handleAvatar serves the identicon of a handle's hash. Identicons never
+// change, so they're cached for good.
+func handleAvatar(w http.ResponseWriter, r *http.Request) {
+	hash := chi.URLParam(r, "hash")
+	b, err := hex.DecodeString(hash)
+	if err != nil || len(hash) != hub.IdenticonHashLen {
+		respondJSON(w, nil, errors.New("avatar not found"), http.StatusNotFound)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, identicon(b)); err != nil {
+		logger.Errorf("error encoding identicon: %v", err)
+		respondJSON(w, nil, errors.New("error generating avatar"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(buf.Bytes())
+}
+
+// identicon draws the identicon of a hash. The colour is picked from the
+// first three bytes and the cells are filled by the bits of the rest.
+func identicon(hash []byte) image.Image {
+	var (
+		size = identiconCells*identiconCellSize + identiconMargin*2
+		fg   = color.RGBA{R: hash[0]/2 + 64, G: hash[1]/2 + 64, B: hash[2]/2 + 64, A: 0xff}
+		img  = image.NewPaletted(image.Rect(0, 0, size, size),
+			color.Palette{color.RGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}, fg})
+		bits = hash[3:]
+	)
+
+	half := (identiconCells + 1) / 2
+	for i := 0; i < identiconCells*half; i++ {
+		if bits[i/8]&(1<<uint(i%8)) == 0 {
+			continue
+		}
+		x, y := i%half, i/half
+		fillCell(img, x, y)
+		fillCell(img, identiconCells-1-x, y)
+	}
+	return img
+}
+
+// fillCell fills the cell at x, y of an identicon with the foreground colour.
+func fillCell(img *image.Paletted, x, y int) {
+	x0 := identiconMargin + x*identiconCellSize
+	y0 := identiconMargin + y*identiconCellSize
+	for py := y0; py < y0+identiconCellSize; py++ {
+		for px := x0; px < x0+identiconCellSize; px++ {
+			img.SetColorIndex(px, py, 1)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Proxies trusted by default when trust_proxy is set.
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// ipResolver resolves the IP addresses of clients, which are the addresses
+// that reverse proxies forward for requests that come through them.
+type ipResolver struct {
+	trustProxy bool
+	proxies    []*net.IPNet
+}
+
+// newIPResolver returns a resolver that reads the addresses forwarded by the
+// proxies in the given CIDRs if trustProxy is set.
+func newIPResolver(trustProxy bool, cidrs []string) (*ipResolver, error) {
+	if len(cidrs) == 0 {
+		cidrs = defaultTrustedProxies
+	}
+
+	x := &ipResolver{trustProxy: trustProxy}
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", c, err)
+		}
+		x.proxies = append(x.proxies, n)
+	}
+	return x, nil
+}
+
+// clientIP returns the IP address of the client that sent the request. It's
+// the TCP peer's address unless the peer is a trusted proxy, in which case
+// X-Forwarded-For is read from the right, skipping trusted proxies, as the
+// addresses to the left of the last untrusted one can be forged by the
+// client. X-Real-IP is used if X-Forwarded-For isn't set.
+func (x *ipResolver) clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if !x.trustProxy || !x.trusted(remote) {
+		return remote
+	}
+
+	var addrs []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		addrs = append(addrs, strings.Split(h, ",")...)
+	}
+	if len(addrs) == 0 {
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+			return ip
+		}
+		return remote
+	}
+
+	ip := remote
+	for i := len(addrs) - 1; i >= 0; i-- {
+		a := strings.TrimSpace(addrs[i])
+		if net.ParseIP(a) == nil {
+			break
+		}
+		ip = a
+		if !x.trusted(a) {
+			break
+		}
+	}
+	return ip
+}
+
+// trusted checks whether the IP address is of a trusted proxy.
+func (x *ipResolver) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range x.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
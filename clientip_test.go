@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		name       string
+		trustProxy bool
+		remote     string
+		xff        string
+		realIP     string
+		want       string
+	}{
+		{"direct", false, "1.1.1.1:1234", "", "", "1.1.1.1"},
+		{"untrusted flag ignores headers", false, "127.0.0.1:1234", "2.2.2.2", "3.3.3.3", "127.0.0.1"},
+		{"untrusted peer ignores headers", true, "1.1.1.1:1234", "2.2.2.2", "", "1.1.1.1"},
+		{"forwarded", true, "127.0.0.1:1234", "2.2.2.2", "", "2.2.2.2"},
+		{"forged left of client", true, "127.0.0.1:1234", "9.9.9.9, 2.2.2.2", "", "2.2.2.2"},
+		{"trusted proxies skipped", true, "127.0.0.1:1234", "2.2.2.2, 127.0.0.2", "", "2.2.2.2"},
+		{"invalid address", true, "127.0.0.1:1234", "2.2.2.2, junk", "", "127.0.0.1"},
+		{"real ip", true, "127.0.0.1:1234", "", "3.3.3.3", "3.3.3.3"},
+		{"ipv6", true, "[::1]:1234", "2001:db8::1", "", "2001:db8::1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			x, err := newIPResolver(c.trustProxy, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = c.remote
+			if c.xff != "" {
+				req.Header.Set("X-Forwarded-For", c.xff)
+			}
+			if c.realIP != "" {
+				req.Header.Set("X-Real-IP", c.realIP)
+			}
+			if got := x.clientIP(req); got != c.want {
+				t.Errorf("clientIP() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
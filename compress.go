@@ -0,0 +1,212 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Content types that are compressed besides text/*. Images other than SVG,
+// uploads and the like are compressed already.
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/atom+xml":   true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+// encoder is a pooled gzip or zlib (deflate) writer.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+	"deflate": {New: func() interface{} {
+		return zlib.NewWriter(nil)
+	}},
+}
+
+// compress compresses the responses of clients that accept gzip or deflate
+// if they're of a compressible type and at least minSize bytes long.
+// WebSocket upgrades, and range and HEAD requests are passed through.
+func compress(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			enc := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+			if enc == "" || r.Method == http.MethodHead ||
+				r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Accept-Encoding")
+			cw := &compressWriter{ResponseWriter: w, encoding: enc, minSize: minSize}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// acceptedEncoding returns the encoding to compress a response with from a
+// request's Accept-Encoding header, preferring gzip.
+func acceptedEncoding(h string) string {
+	accepted := acceptedEncodings(h)
+	for _, e := range []string{"gzip", "deflate"} {
+		if accepted[e] {
+			return e
+		}
+	}
+	return ""
+}
+
+// acceptedEncodings returns the encodings in a request's Accept-Encoding
+// header that the client accepts, leaving out those refused with q=0.
+func acceptedEncodings(h string) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, e := range strings.Split(h, ",") {
+		var (
+			parts = strings.Split(e, ";")
+			name  = strings.ToLower(strings.TrimSpace(parts[0]))
+			q     = 1.0
+		)
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, _ = strconv.ParseFloat(p[2:], 64)
+			}
+		}
+		if q > 0 {
+			accepted[name] = true
+		}
+	}
+	return accepted
+}
+
+// compressWriter buffers a response until it's minSize bytes long before
+// deciding to compress it, as small responses aren't worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	started bool
+	enc     encoder
+}
+
+// WriteHeader records the status, which is written once the response is
+// known to be compressed or not.
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.started {
+		if c.enc != nil {
+			return c.enc.Write(b)
+		}
+		return c.ResponseWriter.Write(b)
+	}
+
+	c.buf = append(c.buf, b...)
+	if len(c.buf) < c.minSize {
+		return len(b), nil
+	}
+	if err := c.start(true); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes out the response so far, for streaming responses.
+func (c *compressWriter) Flush() {
+	if !c.started {
+		c.start(false)
+	}
+	if c.enc != nil {
+		c.enc.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// start writes the header and the buffered response, compressing the
+// response if it's long enough and of a compressible type.
+func (c *compressWriter) start(long bool) error {
+	c.started = true
+	if c.status == 0 {
+		return nil
+	}
+
+	h := c.Header()
+	if h.Get("Content-Type") == "" && len(c.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(c.buf))
+	}
+	if long && c.compressible() {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", c.encoding)
+		c.enc = encoderPools[c.encoding].Get().(encoder)
+		c.enc.Reset(c.ResponseWriter)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+
+	if len(c.buf) == 0 {
+		return nil
+	}
+	var err error
+	if c.enc != nil {
+		_, err = c.enc.Write(c.buf)
+	} else {
+		_, err = c.ResponseWriter.Write(c.buf)
+	}
+	c.buf = nil
+	return err
+}
+
+// compressible checks whether the response can be compressed.
+func (c *compressWriter) compressible() bool {
+	switch c.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+
+	h := c.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	t, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if t == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(t, "text/") || compressibleTypes[t]
+}
+
+// close writes out a short response, or finishes a compressed one.
+func (c *compressWriter) close() {
+	if !c.started {
+		c.start(false)
+	}
+	if c.enc != nil {
+		c.enc.Close()
+		encoderPools[c.encoding].Put(c.enc)
+		c.enc = nil
+	}
+}
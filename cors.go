@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/knadh/niltalk/internal/hub"
+)
+
+// Methods and headers allowed by default in cross-origin API requests.
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodDelete}
+	defaultCORSHeaders = []string{"Content-Type", "Authorization"}
+)
+
+// How long browsers can cache preflight responses, in seconds.
+const corsMaxAge = "600"
+
+// cors lets pages on other origins, eg: SPAs, call the JSON API and log in
+// to rooms.
+type cors struct {
+	origins     []string
+	methods     string
+	headers     string
+	credentials bool
+}
+
+// newCORS returns the CORS policy for the configured origins.
+func newCORS(cfg *hub.Config) *cors {
+	c := &cors{
+		origins:     lowerOrigins(cfg.CORSOrigins),
+		methods:     strings.Join(defaultCORSMethods, ", "),
+		headers:     strings.Join(defaultCORSHeaders, ", "),
+		credentials: cfg.CORSCredentials,
+	}
+	if len(cfg.CORSMethods) > 0 {
+		c.methods = strings.ToUpper(strings.Join(cfg.CORSMethods, ", "))
+	}
+	if len(cfg.CORSHeaders) > 0 {
+		c.headers = strings.Join(cfg.CORSHeaders, ", ")
+	}
+	return c
+}
+
+// handler sets the CORS headers of API requests from allowed origins and
+// answers their preflight requests. It has to run before routing as there
+// are no OPTIONS routes.
+func (c *cors) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !corsPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		// Browsers block responses without the headers.
+		if !matchOrigin(c.origins, strings.ToLower(origin)) {
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", origin)
+		if c.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			h.Set("Access-Control-Expose-Headers", "Retry-After")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", c.methods)
+		h.Set("Access-Control-Allow-Headers", c.headers)
+		h.Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// corsPath checks whether a path is one of the JSON API's or a room's login.
+func corsPath(p string) bool {
+	if strings.HasPrefix(p, "/api/") {
+		return true
+	}
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	return len(parts) == 3 && parts[0] == "r" && parts[2] == "login"
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/knadh/niltalk/internal/hub"
+)
+
+func TestCORS(t *testing.T) {
+	policy := newCORS(&hub.Config{CORSOrigins: []string{"https://app.example"}})
+	h := policy.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	cases := []struct {
+		name, method, path, origin string
+		preflight                  bool
+
+		code        int
+		allowOrigin string
+		methods     string
+	}{
+		{"preflight", http.MethodOptions, "/api/rooms", "https://app.example", true,
+			http.StatusNoContent, "https://app.example", "GET, POST, DELETE"},
+		{"preflight of login", http.MethodOptions, "/r/abc/login", "https://App.example", true,
+			http.StatusNoContent, "https://App.example", "GET, POST, DELETE"},
+		{"preflight from other origin", http.MethodOptions, "/api/rooms", "https://evil.example", true,
+			http.StatusNoContent, "", ""},
+		{"request", http.MethodPost, "/api/rooms", "https://app.example", false,
+			http.StatusTeapot, "https://app.example", ""},
+		{"request from other origin", http.MethodPost, "/api/rooms", "https://evil.example", false,
+			http.StatusTeapot, "", ""},
+		{"same origin", http.MethodPost, "/api/rooms", "", false,
+			http.StatusTeapot, "", ""},
+		{"other path", http.MethodOptions, "/r/abc", "https://app.example", true,
+			http.StatusTeapot, "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.path, nil)
+			if c.origin != "" {
+				req.Header.Set("Origin", c.origin)
+			}
+			if c.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != c.code {
+				t.Errorf("status = %d, want %d", rec.Code, c.code)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != c.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, c.allowOrigin)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != c.methods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, c.methods)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/knadh/niltalk/internal/hub"
+)
+
+// Time format of transcript entries.
+const transcriptTimeFormat = "2006-01-02 15:04:05 MST"
+
+// transcriptWriter writes a room's transcript in an export format.
+type transcriptWriter interface {
+	begin(room *hub.Room) error
+	write(e hub.TranscriptEntry) error
+	end() error
+}
+
+// exportFormats are the content types and transcript writers of the export
+// formats by name.
+var exportFormats = map[string]struct {
+	contentType string
+	new         func(w io.Writer, app *App) transcriptWriter
+}{
+	"txt": {"text/plain; charset=utf-8", func(w io.Writer, _ *App) transcriptWriter {
+		return &txtTranscript{w: w}
+	}},
+	"json": {"application/json; charset=utf-8", func(w io.Writer, _ *App) transcriptWriter {
+		return &jsonTranscript{w: w}
+	}},
+	"html": {"text/html; charset=utf-8", func(w io.Writer, app *App) transcriptWriter {
+		return &htmlTranscript{w: w, app: app}
+	}},
+}
+
+// handleExport streams a room's stored history to a moderator as a file in
+// the requested format.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusNotFound)
+		return
+	}
+	if ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+	if !room.IsModerator(ctx.sess.Handle) {
+		respondJSON(w, nil, hub.ErrNotModerator, http.StatusForbidden)
+		return
+	}
+
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "txt"
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		respondJSON(w, nil, errors.New("format should be one of txt|json|html"), http.StatusBadRequest)
+		return
+	}
+
+	// The response is only started on the first entry so that errors before
+	// it can still be sent back.
+	var (
+		tw      = format.new(w, app)
+		started = false
+		start   = func() error {
+			started = true
+			w.Header().Set("Content-Type", format.contentType)
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, room.ID, name))
+			return tw.begin(room)
+		}
+	)
+	err := room.WalkTranscript(func(e hub.TranscriptEntry) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return tw.write(e)
+	})
+	if err == nil && !started {
+		err = start()
+	}
+	if err == nil {
+		err = tw.end()
+	}
+
+	if err != nil {
+		if !started {
+			if err == hub.ErrExportDisabled {
+				respondJSON(w, nil, err, http.StatusBadRequest)
+				return
+			}
+			app.logger.Errorf("error exporting %s: %v", room.ID, err)
+			respondJSON(w, nil, errors.New("error exporting messages"), http.StatusInternalServerError)
+			return
+		}
+		app.logger.Errorf("error exporting %s: %v", room.ID, err)
+	}
+}
+
+// describeTranscript returns who an entry is by and its text in a transcript,
+// eg: "<alice>" and "hello", or "--" and "alice joined" for events.
+func describeTranscript(e hub.TranscriptEntry) (string, string) {
+	switch e.Type {
+	case hub.TypeMessage, hub.TypeUpload:
+		return "<" + e.Handle + ">", e.Text
+	case hub.TypeAction:
+		return "* " + e.Handle, e.Text
+	case hub.TypePeerJoin:
+		return "--", e.Handle + " joined"
+	case hub.TypePeerLeave:
+		return "--", e.Handle + " left"
+	case hub.TypeHandle:
+		return "--", e.OldHandle + " is now " + e.Handle
+	case hub.TypeMessageEdit:
+		return "--", fmt.Sprintf("message %s was edited: %s", e.ID, e.Text)
+	case hub.TypeMessageDelete:
+		return "--", fmt.Sprintf("message %s was deleted", e.ID)
+	}
+	return "--", strings.TrimSpace(e.Handle + " " + e.Text)
+}
+
+// txtTranscript writes a transcript as plain text, one entry per line.
+type txtTranscript struct {
+	w io.Writer
+}
+
+func (t *txtTranscript) begin(room *hub.Room) error {
+	_, err := fmt.Fprintf(t.w, "# %s (%s)\n", room.Name, room.ID)
+	return err
+}
+
+func (t *txtTranscript) write(e hub.TranscriptEntry) error {
+	who, text := describeTranscript(e)
+	_, err := fmt.Fprintf(t.w, "[%s] %s %s\n", e.Timestamp.Format(transcriptTimeFormat), who, text)
+	return err
+}
+
+func (t *txtTranscript) end() error {
+	return nil
+}
+
+// jsonTranscript writes a transcript as a JSON array of entries.
+type jsonTranscript struct {
+	w io.Writer
+	n int
+}
+
+func (t *jsonTranscript) begin(room *hub.Room) error {
+	_, err := io.WriteString(t.w, "[")
+	return err
+}
+
+func (t *jsonTranscript) write(e hub.TranscriptEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if t.n > 0 {
+		b = append([]byte{','}, b...)
+	}
+	t.n++
+	_, err = t.w.Write(b)
+	return err
+}
+
+func (t *jsonTranscript) end() error {
+	_, err := io.WriteString(t.w, "]")
+	return err
+}
+
+// htmlTranscript writes a transcript as an HTML page with the export-*
+// templates.
+type htmlTranscript struct {
+	w   io.Writer
+	app *App
+	tpl *template.Template
+}
+
+func (t *htmlTranscript) begin(room *hub.Room) error {
+	tpl, err := t.app.getTpl()
+	if err != nil {
+		return err
+	}
+	t.tpl = tpl
+	return t.tpl.ExecuteTemplate(t.w, "export-header", room)
+}
+
+func (t *htmlTranscript) write(e hub.TranscriptEntry) error {
+	who, text := describeTranscript(e)
+	return t.tpl.ExecuteTemplate(t.w, "export-entry", struct {
+		Time string
+		Who  string
+		Text string
+	}{e.Timestamp.Format(transcriptTimeFormat), who, text})
+}
+
+func (t *htmlTranscript) end() error {
+	return t.tpl.ExecuteTemplate(t.w, "export-footer", nil)
+}
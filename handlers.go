@@ -2,26 +2,47 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"mime/multipart"
 	"net/http"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/internal/captcha"
 	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/log"
 	"github.com/knadh/niltalk/internal/upload"
+	"github.com/knadh/niltalk/store"
 	"golang.org/x/time/rate"
 )
 
+// Bounds of message history searches.
+const (
+	minSearchLen     = 2
+	maxSearchResults = 50
+)
+
+// Cookie holding the creator ID of the rooms created by the browser, which
+// lets the creator dispose of a room.
+const creatorCookie = "nilcreator"
+
 const (
 	hasAuth = 1 << iota
 	hasRoom
+	hasAdmin
 )
 
 type sess struct {
@@ -47,6 +68,53 @@ type tplData struct {
 	Description string
 	Room        interface{}
 	Auth        bool
+
+	// Max size of upload requests, 0 if unlimited.
+	MaxUploadSize int64
+
+	// Public key that browsers subscribe to push notifications with.
+	VAPIDPublicKey string
+}
+
+// reqPushSubscribe is a browser's PushSubscription.
+type reqPushSubscribe struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+type reqImport struct {
+	BatchID  string              `json:"batch_id"`
+	Messages []hub.ImportMessage `json:"messages"`
+}
+
+type reqPostMessage struct {
+	Handle string `json:"handle"`
+	Text   string `json:"text"`
+}
+
+// atomFeed represents an Atom feed of a room's messages.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string `xml:"id"`
+	Title   string `xml:"title"`
+	Updated string `xml:"updated"`
+	Author  string `xml:"author>name"`
+	Content string `xml:"content"`
 }
 
 type reqRoom struct {
@@ -54,11 +122,14 @@ type reqRoom struct {
 	Handle   string `json:"handle"`
 	Password string `json:"password"`
 	UserPwd  string `json:"userpwd"`
+
+	// Captcha token, required on room creation if captchas are enabled.
+	Captcha string `json:"captcha"`
 }
 
-var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
-	return true
-}}
+var wsScheme = regexp.MustCompile(`^http(s?)://`)
+
+var upgrader = websocket.Upgrader{}
 
 // handleIndex renders the homepage.
 func handleIndex(w http.ResponseWriter, r *http.Request) {
@@ -86,7 +157,7 @@ func handleRoomPage(w http.ResponseWriter, r *http.Request) {
 
 	al := r.URL.Query().Get("al")
 	if al != "" {
-		sessID, err := room.LoginWithToken(al, app.cfg.RoomAge)
+		sessID, err := room.LoginWithToken(al, app.ips.clientIP(r), app.hub.SessionTTL())
 		if err == nil {
 			ck := &http.Cookie{Name: app.cfg.SessionCookie, Value: sessID, Path: fmt.Sprintf("/r/%v", room.ID)}
 			http.SetCookie(w, ck)
@@ -96,8 +167,12 @@ func handleRoomPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	out := tplData{
-		Title: room.Name,
-		Room:  room,
+		Title:         room.Name,
+		Room:          room,
+		MaxUploadSize: app.maxUploadSize,
+	}
+	if app.hub.Push != nil {
+		out.VAPIDPublicKey = app.hub.Push.PublicKey
 	}
 	if ctx.sess.ID != "" {
 		out.Auth = true
@@ -132,17 +207,30 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	if req.Handle == "" {
 		h, err := hub.GenerateGUID(8)
 		if err != nil {
-			app.logger.Printf("error generating uniq handle: %v", err)
+			app.logger.Errorf("error generating uniq handle: %v", err)
 			respondJSON(w, nil, errors.New("error generating uniq handle"), http.StatusInternalServerError)
 			return
 		}
 		req.Handle = h
 	}
 
-	sessID, err := room.Login(req.Password, req.Handle, req.UserPwd, app.cfg.RoomAge)
+	// Keep banned peers out before a session is created.
+	if banned, err := room.IsBanned(req.Handle, app.ips.clientIP(r)); err != nil {
+		app.logger.Errorf("error checking ban: %v", err)
+		respondJSON(w, nil, errors.New("error checking ban"), http.StatusInternalServerError)
+		return
+	} else if banned {
+		respondJSON(w, nil, hub.ErrBanned, http.StatusForbidden)
+		return
+	}
+
+	sessID, err := room.Login(req.Password, req.Handle, req.UserPwd, app.hub.SessionTTL())
 	if err == hub.ErrInvalidRoomPassword || err == hub.ErrInvalidUserPassword {
 		respondJSON(w, nil, errors.New("incorrect password"), http.StatusForbidden)
 		return
+	} else if err == hub.ErrTooManySessions {
+		respondJSON(w, nil, err, http.StatusForbidden)
+		return
 	} else if err != nil {
 		respondJSON(w, nil, err, http.StatusInternalServerError)
 		return
@@ -168,10 +256,11 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := app.hub.Store.RemoveSession(ctx.sess.ID, room.ID); err != nil {
-		app.logger.Printf("error removing session: %v", err)
+		app.logger.Errorf("error removing session: %v", err)
 		respondJSON(w, nil, errors.New("error removing session"), http.StatusInternalServerError)
 		return
 	}
+	room.RemovePushSubscriptions(ctx.sess.Handle, ctx.sess.ID)
 
 	// Delete the session cookie.
 	ck := &http.Cookie{Name: app.cfg.SessionCookie, Value: "", MaxAge: -1, Path: fmt.Sprintf("/r/%v", room.ID)}
@@ -187,20 +276,232 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 		room = ctx.room
 	)
 
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusNotFound)
+		return
+	}
+
 	if ctx.sess.ID == "" {
 		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
 		return
 	}
 
+	// Sessions outlive bans made after they were created, eg: a banned
+	// handle logged in on another device.
+	if banned, err := room.IsBanned(ctx.sess.Handle, app.ips.clientIP(r)); err != nil {
+		app.logger.Errorf("error checking ban: %v", err)
+		respondJSON(w, nil, errors.New("error checking ban"), http.StatusInternalServerError)
+		return
+	} else if banned {
+		respondJSON(w, nil, hub.ErrBanned, http.StatusForbidden)
+		return
+	}
+
+	// Clients send the protocol version they speak.
+	version, _ := strconv.Atoi(r.URL.Query().Get("version"))
+	if v := r.Header.Get("X-Client-Version"); v != "" {
+		version, _ = strconv.Atoi(v)
+	}
+
+	// Reject WebSockets opened by other sites.
+	if !app.origins.allowed(r) {
+		respondJSON(w, nil, errors.New("origin not allowed"), http.StatusForbidden)
+		return
+	}
+
+	// Throttle reconnect storms.
+	release, err := app.hub.AcquireJoin()
+	if err != nil {
+		w.Header().Set("Retry-After", "1")
+		respondJSON(w, nil, err, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
 	// Create the WS connection.
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		app.logger.Printf("Websocket upgrade failed: %s: %v", r.RemoteAddr, err)
+		app.logger.Debugf("Websocket upgrade failed: %s: %v", app.ips.clientIP(r), err)
+		return
+	}
+
+	// Browsers can't read the response of a failed upgrade. Reject outdated
+	// clients with a close reason instead.
+	if version < app.cfg.MinClientVersion {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, hub.TypeClientOutdated), time.Time{})
+		ws.Close()
+		return
+	}
+
+	// Reject peers before they're registered if the room is full. The room
+	// checks again when the peer is added as it may fill up meanwhile.
+	if room.IsFull() {
+		app.hub.Store.RemoveSession(ctx.sess.ID, room.ID)
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, hub.TypeRoomFull), time.Time{})
+		ws.Close()
 		return
 	}
 
 	// Create a new peer instance and add to the room.
-	room.AddPeer(ctx.sess.ID, ctx.sess.Handle, ws)
+	var creatorID string
+	if ck, _ := r.Cookie(creatorCookie); ck != nil {
+		creatorID = ck.Value
+	}
+	lastSeq, _ := strconv.ParseUint(r.URL.Query().Get("last_seq"), 10, 64)
+	room.AddPeer(ctx.sess.ID, ctx.sess.Handle, app.ips.clientIP(r), r.URL.Query().Get("resume"), lastSeq, creatorID, ws)
+}
+
+// handleStream streams the room's messages to read-only observers as
+// server-sent events.
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusNotFound)
+		return
+	}
+	if ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		respondJSON(w, nil, errors.New("streaming is not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fl.Flush()
+
+	ch, stop := room.Observe()
+	defer stop()
+	for {
+		select {
+		// The client has gone away.
+		case <-r.Context().Done():
+			return
+
+		case b, ok := <-ch:
+			// The room has been disposed.
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", b)
+			fl.Flush()
+		}
+	}
+}
+
+// handleFeed serves an Atom feed of the room's recent messages.
+func handleFeed(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusNotFound)
+		return
+	}
+	if ctx.sess.ID == "" && !(app.cfg.PublicFeeds && room.IsPublic()) {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+
+	rootURL := app.cfg.RootURL
+	if rootURL == "" || strings.HasSuffix(r.Host, ".onion") {
+		rootURL = "http://" + r.Host
+	}
+	roomURL := fmt.Sprintf("%s/r/%s", rootURL, room.ID)
+
+	var (
+		msgs    = room.RecentMessages(app.cfg.MaxFeedEntries)
+		updated = room.CreatedAt
+		feed    = atomFeed{
+			ID:      roomURL,
+			Title:   room.Name,
+			Link:    atomLink{Href: roomURL},
+			Entries: make([]atomEntry, 0, len(msgs)),
+		}
+	)
+
+	// Newest entries first.
+	for i := len(msgs) - 1; i >= 0; i-- {
+		m := msgs[i]
+		if m.Timestamp.After(updated) {
+			updated = m.Timestamp
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      roomURL + "#" + m.ID,
+			Title:   m.Handle,
+			Updated: m.Timestamp.UTC().Format(time.RFC3339),
+			Author:  m.Handle,
+			Content: m.Text,
+		})
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+
+	b, err := xml.Marshal(feed)
+	if err != nil {
+		app.logger.Errorf("error marshalling feed: %v", err)
+		respondJSON(w, nil, errors.New("error generating feed"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
+
+// handleSearch searches a room's stored message history for messages
+// containing the query, newest first.
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusNotFound)
+		return
+	}
+	if ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len(q) < minSearchLen || len(q) > app.cfg.MaxMessageLen {
+		respondJSON(w, nil, fmt.Errorf("search query should be %d to %d characters", minSearchLen, app.cfg.MaxMessageLen), http.StatusBadRequest)
+		return
+	}
+
+	limit := maxSearchResults
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l < limit {
+		limit = l
+	}
+
+	msgs, err := room.SearchMessages(q, limit)
+	if err != nil {
+		if err == hub.ErrSearchDisabled {
+			respondJSON(w, nil, err, http.StatusBadRequest)
+			return
+		}
+		app.logger.Errorf("error searching %s: %v", room.ID, err)
+		respondJSON(w, nil, errors.New("error searching messages"), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, msgs, nil, http.StatusOK)
 }
 
 // respondJSON responds to an HTTP request with a generic payload or an error.
@@ -219,7 +520,7 @@ func respondJSON(w http.ResponseWriter, data interface{}, err error, statusCode
 	}
 	b, err := json.Marshal(out)
 	if err != nil {
-		logger.Printf("error marshalling JSON response: %v", err)
+		logger.Errorf("error marshalling JSON response: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -235,7 +536,7 @@ func respondHTML(tplName string, data tplData, statusCode int, w http.ResponseWr
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	tpl, err := app.getTpl()
 	if err != nil {
-		app.logger.Printf("error compiling template %s: %s", tplName, err)
+		app.logger.Errorf("error compiling template %s: %s", tplName, err)
 		w.Write([]byte("error compiling template"))
 		return
 	}
@@ -247,7 +548,7 @@ func respondHTML(tplName string, data tplData, statusCode int, w http.ResponseWr
 		Data:   data,
 	})
 	if err != nil {
-		app.logger.Printf("error rendering template %s: %s", tplName, err)
+		app.logger.Errorf("error rendering template %s: %s", tplName, err)
 		w.Write([]byte("error rendering template"))
 	}
 }
@@ -265,26 +566,319 @@ func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.Name = hub.NormalizeRoomName(req.Name)
 	if req.Name != "" && (len(req.Name) < 3 || len(req.Name) > 100) {
 		respondJSON(w, nil, errors.New("invalid room name (6 - 100 chars)"), http.StatusBadRequest)
 		return
 	}
 
-	if len(req.Password) < 6 || len(req.Password) > 100 {
-		respondJSON(w, nil, errors.New("invalid password (6 - 100 chars)"), http.StatusBadRequest)
+	// Rooms without passwords are open to anyone with the link.
+	if req.Password != "" || !app.cfg.AllowOpenRooms {
+		if err := app.hub.CheckPasswordStrength(req.Password); err != nil {
+			respondJSON(w, nil, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if app.captcha != nil {
+		switch err := app.captcha.Verify(req.Captcha, app.ips.clientIP(r)); err {
+		case nil:
+		case captcha.ErrMissing, captcha.ErrFailed:
+			respondJSON(w, nil, err, http.StatusForbidden)
+			return
+		default:
+			app.logger.Errorf("error verifying captcha: %v", err)
+			respondJSON(w, nil, errors.New("error verifying captcha"), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	name, err := app.hub.ResolveRoomName(req.Name)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusConflict)
 		return
 	}
 
 	// Create and activate the new room.
-	room, err := app.hub.AddRoom(req.Name, req.Password)
-	if err != nil {
+	room, err := app.hub.AddRoom(name, req.Password)
+	if err == hub.ErrRoomIDTaken {
+		respondJSON(w, nil, err, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		respondJSON(w, nil, err, http.StatusInternalServerError)
 		return
 	}
 
+	// URLs are built off the root URL unless the request came in
+	// through the onion service.
+	rootURL := app.cfg.RootURL
+	if strings.HasSuffix(r.Host, ".onion") {
+		rootURL = "http://" + r.Host
+	}
+	roomURL := fmt.Sprintf("%s/r/%s", rootURL, room.ID)
+
+	// Remember the creator on the browser for disposing of the room.
+	http.SetCookie(w, &http.Cookie{Name: creatorCookie, Value: room.CreatorID,
+		Path: fmt.Sprintf("/r/%v", room.ID), HttpOnly: true})
+
+	respondJSON(w, struct {
+		ID        string    `json:"id"`
+		Name      string    `json:"name"`
+		CreatedAt time.Time `json:"created_at"`
+		ExpiresAt time.Time `json:"expires_at"`
+		Protected bool      `json:"password_protected"`
+		URL       string    `json:"url"`
+		WSURL     string    `json:"ws_url"`
+	}{
+		ID:        room.ID,
+		Name:      room.Name,
+		CreatedAt: room.CreatedAt,
+		ExpiresAt: room.CreatedAt.Add(app.hub.RoomTTL()),
+		Protected: req.Password != "",
+		URL:       roomURL,
+		WSURL:     wsScheme.ReplaceAllString(roomURL, "ws$1://") + "/ws",
+	}, nil, http.StatusOK)
+}
+
+// handleCaptchaChallenge issues a proof-of-work challenge to be solved
+// before creating a room.
+func handleCaptchaChallenge(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+		pow = app.captcha.(*captcha.PoW)
+	)
+
+	c, err := pow.Challenge(app.ips.clientIP(r))
+	if err == captcha.ErrTooManyPoW {
+		respondJSON(w, nil, err, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		app.logger.Errorf("error generating captcha challenge: %v", err)
+		respondJSON(w, nil, errors.New("error generating challenge"), http.StatusInternalServerError)
+		return
+	}
+
+	// Challenges are single use.
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}{c, pow.Difficulty}, nil, http.StatusOK)
+}
+
+// handleImportMessages imports a batch of messages exported from another
+// chat system into a room's history.
+func handleImportMessages(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusNotFound)
+		return
+	}
+
+	var req reqImport
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	n, err := room.ImportMessages(req.BatchID, req.Messages)
+	switch err {
+	case nil:
+	case hub.ErrImportDisabled:
+		respondJSON(w, nil, err, http.StatusForbidden)
+		return
+	case hub.ErrImportDone:
+		respondJSON(w, nil, err, http.StatusConflict)
+		return
+	case hub.ErrImportTooLarge:
+		respondJSON(w, nil, err, http.StatusRequestEntityTooLarge)
+		return
+	default:
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+
+	respondJSON(w, struct {
+		Imported int `json:"imported"`
+	}{n}, nil, http.StatusOK)
+}
+
+// handlePostMessage posts a message to a room for clients that aren't
+// connected over WebSocket, eg: bots, authorized by the room's API token.
+func handlePostMessage(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusNotFound)
+		return
+	}
+	if !room.ValidAPIToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+		respondJSON(w, nil, errors.New("invalid API token"), http.StatusForbidden)
+		return
+	}
+
+	// JSON escaping can inflate the text up to six times.
+	r.Body = http.MaxBytesReader(w, r.Body, int64(room.MaxMessageLen())*6+1024)
+
+	var req reqPostMessage
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	id, err := room.PostMessage(req.Handle, req.Text)
+	switch err {
+	case nil:
+	case hub.ErrAPIRateLimited:
+		respondJSON(w, nil, err, http.StatusTooManyRequests)
+		return
+	case hub.ErrPostTooLong:
+		respondJSON(w, nil, err, http.StatusRequestEntityTooLarge)
+		return
+	case hub.ErrHandleTaken, hub.ErrRoomLocked:
+		respondJSON(w, nil, err, http.StatusForbidden)
+		return
+	default:
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+
 	respondJSON(w, struct {
 		ID string `json:"id"`
-	}{room.ID}, nil, http.StatusOK)
+	}{id}, nil, http.StatusOK)
+}
+
+// handleRoomStats returns the occupancy and activity of a room to anyone,
+// without starting it.
+func handleRoomStats(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	s, err := app.hub.RoomSummary(chi.URLParam(r, "roomID"))
+	if err != nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusNotFound)
+		return
+	}
+	respondJSON(w, s, nil, http.StatusOK)
+}
+
+// handleGetRooms returns the rooms active on the instance to admins.
+func handleGetRooms(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+	respondJSON(w, app.hub.ActiveRooms(), nil, http.StatusOK)
+}
+
+// handleDeleteRoom disposes of a room on an admin's request, disconnecting
+// its peers and removing it from the store.
+func handleDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx    = r.Context().Value("ctx").(*reqCtx)
+		app    = ctx.app
+		roomID = chi.URLParam(r, "roomID")
+	)
+
+	switch err := app.hub.DisposeRoom(roomID); err {
+	case nil:
+	case hub.ErrRoomNotFound:
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusNotFound)
+		return
+	default:
+		respondJSON(w, nil, errors.New("error disposing room"), http.StatusInternalServerError)
+		return
+	}
+	app.logger.Infof("room %s disposed by admin", roomID)
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleAdminStats returns the runtime statistics of the hub and its rooms.
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+	respondJSON(w, app.hub.Stats(), nil, http.StatusOK)
+}
+
+// handleSetLogLevel changes the level of the app's logs at runtime.
+func handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	var req struct {
+		Level string `json:"level"`
+	}
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	lvl, err := log.ParseLevel(req.Level)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+
+	app.logger.SetLevel(lvl)
+	app.logger.Infof("log level set to %s", lvl)
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleHealthz responds with 200 as long as the process is up.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleReadyz responds with 200 once the hub is initialized and the store
+// is reachable, and 503 with the failing dependency otherwise.
+func handleReadyz(app *App) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.hub == nil {
+			respondJSON(w, nil, errors.New("hub: not initialized"), http.StatusServiceUnavailable)
+			return
+		}
+		if err := app.hub.Store.Ping(); err != nil {
+			respondJSON(w, nil, fmt.Errorf("store: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		respondJSON(w, true, nil, http.StatusOK)
+	}
+}
+
+// handleVersion responds with the build and runtime info of the instance.
+// It's public, so it leaves out the config.
+func handleVersion(app *App) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		out := struct {
+			Build     string    `json:"build"`
+			GoVersion string    `json:"go_version"`
+			StartedAt time.Time `json:"started_at"`
+			Uptime    int64     `json:"uptime"`
+			Rooms     int       `json:"rooms"`
+		}{
+			Build:     buildString,
+			GoVersion: runtime.Version(),
+			StartedAt: app.startedAt,
+			Uptime:    int64(time.Since(app.startedAt) / time.Second),
+		}
+		if app.hub != nil {
+			out.Rooms = app.hub.NumRooms()
+		}
+		respondJSON(w, out, nil, http.StatusOK)
+	}
 }
 
 // wrap is a middleware that handles auth and room check for various HTTP handlers.
@@ -296,13 +890,23 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 			roomID = chi.URLParam(r, "roomID")
 		)
 
+		// Check if the request carries the admin token.
+		if opts&hasAdmin != 0 {
+			tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if app.cfg.AdminToken == "" ||
+				subtle.ConstantTimeCompare([]byte(tok), []byte(app.cfg.AdminToken)) != 1 {
+				respondJSON(w, nil, errors.New("invalid admin token"), http.StatusForbidden)
+				return
+			}
+		}
+
 		// Check if the request is authenticated.
 		if opts&hasAuth != 0 {
 			ck, _ := r.Cookie(app.cfg.SessionCookie)
 			if ck != nil && ck.Value != "" {
 				s, err := app.hub.Store.GetSession(ck.Value, roomID)
 				if err != nil {
-					app.logger.Printf("error checking session: %v", err)
+					app.logger.Errorf("error checking session: %v", err)
 					respondJSON(w, nil, errors.New("error checking session"), http.StatusForbidden)
 					return
 				}
@@ -310,6 +914,13 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 					ID:     s.ID,
 					Handle: s.Handle,
 				}
+
+				// Renew the session as long as it's used.
+				if s.ID != "" {
+					if err := app.hub.Store.ExtendSession(s.ID, roomID, app.hub.SessionTTL()); err != nil {
+						app.logger.Errorf("error renewing session: %v", err)
+					}
+				}
 			}
 		}
 
@@ -330,6 +941,52 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 	})
 }
 
+// handlePushSubscribe stores the push subscription of a peer's browser to
+// notify it of mentions and direct messages.
+func handlePushSubscribe(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+	if app.hub.Push == nil {
+		respondJSON(w, nil, errors.New("push notifications are disabled"), http.StatusBadRequest)
+		return
+	}
+
+	var req reqPushSubscribe
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	if !app.hub.Push.ValidEndpoint(req.Endpoint) || req.Keys.P256dh == "" || req.Keys.Auth == "" {
+		respondJSON(w, nil, errors.New("invalid push subscription"), http.StatusBadRequest)
+		return
+	}
+
+	s := store.PushSubscription{
+		Endpoint: req.Endpoint,
+		SessID:   ctx.sess.ID,
+		P256dh:   req.Keys.P256dh,
+		Auth:     req.Keys.Auth,
+	}
+	if err := app.hub.Store.AddPushSubscription(room.ID, strings.ToLower(ctx.sess.Handle), s); err != nil {
+		app.logger.Errorf("error adding push subscription: %v", err)
+		respondJSON(w, nil, errors.New("error adding push subscription"), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
 // readJSONReq reads the JSON body from a request and unmarshals it to the given target.
 func readJSONReq(r *http.Request, o interface{}) error {
 	defer r.Body.Close()
@@ -365,7 +1022,22 @@ func handleUpload(store *upload.Store) func(w http.ResponseWriter, r *http.Reque
 	}()
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Reject oversized requests before reading them, and stop reading
+		// the ones that don't declare their size once they go over.
+		if store.MaxSize > 0 {
+			if r.ContentLength > store.MaxSize {
+				respondJSON(w, nil, errTooLarge, http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, store.MaxSize)
+		}
+
 		err := r.ParseMultipartForm(store.MaxUploadSize)
+		errStatus := http.StatusBadRequest
+		if err != nil && store.MaxSize > 0 && strings.Contains(err.Error(), "request body too large") {
+			err = errTooLarge
+			errStatus = http.StatusRequestEntityTooLarge
+		}
 
 		if err == nil {
 			roomID := chi.URLParam(r, "roomID")
@@ -392,6 +1064,8 @@ func handleUpload(store *upload.Store) func(w http.ResponseWriter, r *http.Reque
 			Err      string `json:"err"`
 			MimeType string `json:"mimetype"`
 			Name     string `json:"name"`
+			Checksum string `json:"checksum,omitempty"`
+			ThumbURL string `json:"thumb_url,omitempty"`
 		}
 		res := map[string]fileRes{}
 		if err == nil {
@@ -414,59 +1088,173 @@ func handleUpload(store *upload.Store) func(w http.ResponseWriter, r *http.Reque
 				files = append(files, file)
 				handlers = append(handlers, handler)
 			}
+			if err == nil {
+				// Check the room's byte budget for the current interval.
+				var size int64
+				for _, h := range handlers {
+					size += h.Size
+				}
+				if ok, wait := store.AllowBytes(chi.URLParam(r, "roomID"), size); !ok {
+					err = errors.New(http.StatusText(http.StatusTooManyRequests))
+					errStatus = http.StatusTooManyRequests
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				}
+			}
+			var data [][]byte
 			if err == nil {
 				for i, file := range files {
 					handler := handlers[i]
 					b, e := ioutil.ReadAll(file)
 					if e != nil {
 						res[handler.Filename] = fileRes{Err: e.Error()}
+						data = append(data, nil)
+						continue
+					}
+
+					// Check the type sniffed from the contents as the one
+					// sent by the client can't be trusted.
+					if t := http.DetectContentType(b); !store.AllowedType(t) {
+						err = fmt.Errorf("file type %s of %s is not allowed", t, handler.Filename)
+						errStatus = http.StatusUnsupportedMediaType
+						break
+					}
+
+					// Verify the checksum sent by the client, if any, before
+					// accepting any of the files.
+					if store.VerifyChecksums {
+						sum := r.FormValue(fmt.Sprintf("file%v-sha256", i))
+						if sum != "" && !strings.EqualFold(sum, upload.Checksum(b)) {
+							err = fmt.Errorf("checksum mismatch for %s", handler.Filename)
+							errStatus = http.StatusUnprocessableEntity
+							break
+						}
+					}
+					data = append(data, b)
+				}
+			}
+			if err == nil {
+				for i, b := range data {
+					handler := handlers[i]
+					if b == nil {
 						continue
 					}
 					name := handler.Filename
 					mimeType := http.DetectContentType(b)
-					up, e := store.Add(name, mimeType, b)
+					up, e := store.Add(chi.URLParam(r, "roomID"), name, mimeType, b)
 					if e != nil {
 						res[handler.Filename] = fileRes{Err: e.Error(), MimeType: mimeType, Name: name}
 						continue
 					}
-					res[handler.Filename] = fileRes{ID: fmt.Sprintf("%v_%v", up.ID, up.Name), MimeType: mimeType, Name: name}
+					fr := fileRes{ID: fmt.Sprintf("%v_%v", up.ID, up.Name), MimeType: mimeType, Name: name, Checksum: up.Checksum}
+					if up.Thumb != nil {
+						fr.ThumbURL = fmt.Sprintf("/r/%v/uploaded/%v/thumb", chi.URLParam(r, "roomID"), fr.ID)
+					}
+					res[handler.Filename] = fr
 				}
 			}
 		}
 
 		s := http.StatusOK
 		if err != nil {
-			s = http.StatusBadRequest
+			s = errStatus
 		}
 		respondJSON(w, res, err, s)
 	}
 }
 
+// handleUploadedThumb serves the thumbnail of an uploaded image.
+func handleUploadedThumb(store *upload.Store) func(w http.ResponseWriter, r *http.Request) {
+	maxAgeHeader := fmt.Sprintf("max-age=%v", int64(store.MaxAge/time.Second))
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := strings.Split(chi.URLParam(r, "fileID"), "_")[0]
+		up, rd, err := store.Open(fileID, true)
+		if err != nil {
+			if err != upload.ErrFileNotFound {
+				logger.Errorf("failed to fetch thumbnail %q from the store: %v", fileID, err)
+			}
+			respondJSON(w, nil, errors.New("thumbnail not found"), http.StatusNotFound)
+			return
+		}
+		defer rd.Close()
+
+		w.Header().Add("Content-Type", up.ThumbType)
+		if up.Size >= 0 {
+			w.Header().Add("Content-Length", fmt.Sprint(up.Size))
+		}
+		if store.MaxAge > 0 {
+			w.Header().Add("Cache-Control", maxAgeHeader)
+		}
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, rd)
+	}
+}
+
+// errTooLarge is returned for upload requests over the max size.
+var errTooLarge = errors.New(http.StatusText(http.StatusRequestEntityTooLarge))
+
 // handleUploaded uploaded files display.
 func handleUploaded(store *upload.Store) func(w http.ResponseWriter, r *http.Request) {
 	maxAgeHeader := fmt.Sprintf("max-age=%v", int64(store.MaxAge/time.Second))
 	return func(w http.ResponseWriter, r *http.Request) {
 		fileID := chi.URLParam(r, "fileID")
 		fileID = strings.Split(fileID, "_")[0]
-		up, err := store.Get(fileID)
+		up, rd, err := store.Open(fileID, false)
 		if err != nil {
-			logger.Printf("failed to fetch uploaded file %q from the store: %v", fileID, err)
+			logger.Errorf("failed to fetch uploaded file %q from the store: %v", fileID, err)
 			respondJSON(w, nil, errors.New("file not found"), http.StatusNotFound)
 			return
 		}
+		defer rd.Close()
 		w.Header().Add("Content-Type", up.MimeType)
 		switch up.MimeType {
 		case "image/jpeg", "image/png", "image/gif", "application/pdf":
 		default:
 			w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", up.Name))
 			w.Header().Add("Content-Transfer-Encoding", "binary")
-			w.Header().Add("Accept-Ranges", "bytes")
 		}
-		w.Header().Add("Content-Length", fmt.Sprint(len(up.Data)))
+		if up.Checksum != "" {
+			w.Header().Add("X-Checksum-Sha256", up.Checksum)
+		}
 		if store.MaxAge > 0 {
 			w.Header().Add("Cache-Control", maxAgeHeader)
 		}
+
+		// Files that aren't kept in memory are streamed from the backend.
+		if up.Data == nil {
+			if up.Size >= 0 {
+				w.Header().Add("Content-Length", fmt.Sprint(up.Size))
+			}
+			w.WriteHeader(http.StatusOK)
+			if _, err := io.Copy(w, rd); err != nil {
+				logger.Warnf("failed to stream uploaded file %q: %v", fileID, err)
+			}
+			return
+		}
+
+		// Compressed files are served as is to clients that accept the
+		// encoding and decompressed for the others.
+		data := up.Data
+		if up.Encoding != "" {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if acceptedEncodings(r.Header.Get("Accept-Encoding"))[up.Encoding] {
+				w.Header().Set("Content-Encoding", up.Encoding)
+			} else if data, err = up.Decode(); err != nil {
+				logger.Warnf("failed to decode uploaded file %q: %v", fileID, err)
+				respondJSON(w, nil, errors.New("error reading file"), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Let seeking media and resumable downloads fetch parts of the file.
+		// Ranges are only advertised, by ServeContent, for the files served
+		// this way.
+		if store.RangeRequests && up.Encoding == "" {
+			http.ServeContent(w, r, up.Name, up.ModTime(), up.Reader())
+			return
+		}
+
+		w.Header().Add("Content-Length", fmt.Sprint(len(data)))
 		w.WriteHeader(http.StatusOK)
-		w.Write(up.Data)
+		w.Write(data)
 	}
 }
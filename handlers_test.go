@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/log"
+	"github.com/knadh/niltalk/store/mem"
+)
+
+func TestHandleWSRoomNotFound(t *testing.T) {
+	var (
+		req = httptest.NewRequest(http.MethodGet, "/r/room1/ws", nil)
+		rec = httptest.NewRecorder()
+		ctx = &reqCtx{app: &App{}, sess: sess{ID: "sess1", Handle: "alice"}}
+	)
+	handleWS(rec, req.WithContext(context.WithValue(req.Context(), "ctx", ctx)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestWrapRenewsSessions(t *testing.T) {
+	const ttl = time.Millisecond * 300
+	s, err := mem.New(mem.Config{})
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	cfg := &hub.Config{RoomAge: time.Hour, SessionTTL: ttl, SessionCookie: "sess"}
+	app := &App{cfg: cfg, hub: hub.NewHub(cfg, s, log.New(ioutil.Discard))}
+	room, err := app.hub.AddRoom("test", "password")
+	if err != nil {
+		t.Fatalf("error creating room: %v", err)
+	}
+	sessID, err := room.Login("password", "alice", "", app.hub.SessionTTL())
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	var got string
+	mux := chi.NewRouter()
+	mux.Get("/r/{roomID}", wrap(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Context().Value("ctx").(*reqCtx).sess.ID
+	}, app, hasAuth))
+	authed := func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/r/"+room.ID, nil)
+		req.AddCookie(&http.Cookie{Name: "sess", Value: sessID})
+		got = ""
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+		return got == sessID
+	}
+
+	// Sessions in use are renewed past their TTL.
+	for i := 0; i < 3; i++ {
+		if !authed() {
+			t.Fatalf("session expired while in use, on request %d", i+1)
+		}
+		time.Sleep(ttl * 2 / 3)
+	}
+
+	// Idle ones expire.
+	time.Sleep(ttl)
+	if authed() {
+		t.Error("idle session didn't expire")
+	}
+}
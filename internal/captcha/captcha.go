@@ -0,0 +1,231 @@
+// Package captcha verifies that rooms are created by people and not bots,
+// with hCaptcha, reCAPTCHA, or a proof-of-work challenge solved by the
+// browser.
+package captcha
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Captcha providers.
+const (
+	ProviderHCaptcha  = "hcaptcha"
+	ProviderReCaptcha = "recaptcha"
+	ProviderPoW       = "pow"
+)
+
+// Verification endpoints of the hosted providers.
+var siteVerifyURLs = map[string]string{
+	ProviderHCaptcha:  "https://api.hcaptcha.com/siteverify",
+	ProviderReCaptcha: "https://www.google.com/recaptcha/api/siteverify",
+}
+
+// Validity of proof-of-work challenges and the number of challenges that can
+// be pending at once, in all and per IP. An IP's oldest challenges are
+// dropped for new ones so that one client can't use up the rest.
+const (
+	challengeTTL       = time.Minute * 5
+	maxChallenges      = 10000
+	maxChallengesPerIP = 10
+)
+
+// Errors returned on failed verifications.
+var (
+	ErrMissing    = errors.New("captcha is required")
+	ErrFailed     = errors.New("captcha verification failed")
+	ErrTooManyPoW = errors.New("too many pending challenges, try again later")
+)
+
+// Verifier verifies the captcha token sent by a client.
+type Verifier interface {
+	Verify(token, remoteIP string) error
+}
+
+// SiteVerify verifies hCaptcha and reCAPTCHA tokens with the provider. The
+// providers only accept a token once.
+type SiteVerify struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// siteVerifyResp is the response of a provider's siteverify endpoint.
+type siteVerifyResp struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// NewSiteVerify returns a verifier for a hosted provider, hcaptcha or
+// recaptcha, with the site's secret key.
+func NewSiteVerify(provider, secret string) (*SiteVerify, error) {
+	u, ok := siteVerifyURLs[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown captcha provider %q", provider)
+	}
+	return &SiteVerify{
+		url:    u,
+		secret: secret,
+		client: &http.Client{Timeout: time.Second * 10},
+	}, nil
+}
+
+// Verify verifies a token with the provider.
+func (s *SiteVerify) Verify(token, remoteIP string) error {
+	if token == "" {
+		return ErrMissing
+	}
+
+	resp, err := s.client.PostForm(s.url, url.Values{
+		"secret":   {s.secret},
+		"response": {token},
+		"remoteip": {remoteIP},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	var out siteVerifyResp
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("error decoding response: %v", err)
+	}
+	if !out.Success {
+		return ErrFailed
+	}
+	return nil
+}
+
+// PoW issues proof-of-work challenges and verifies their solutions. A
+// challenge is solved by finding a nonce for which the SHA-256 hash of
+// "challenge:nonce" starts with the required number of zero bits. The
+// solution is sent as the token "challenge:nonce". Challenges are held in
+// memory and can only be used once.
+type PoW struct {
+	Difficulty int
+
+	mu     sync.Mutex
+	issued map[string]powChallenge
+
+	// Pending challenges of each IP, oldest first.
+	byIP map[string][]string
+}
+
+// powChallenge is a pending challenge.
+type powChallenge struct {
+	ip      string
+	expires time.Time
+}
+
+// NewPoW returns a proof-of-work verifier whose challenges need the given
+// number of leading zero bits.
+func NewPoW(difficulty int) *PoW {
+	return &PoW{
+		Difficulty: difficulty,
+		issued:     make(map[string]powChallenge),
+		byIP:       make(map[string][]string),
+	}
+}
+
+// Challenge issues a new challenge to an IP.
+func (p *PoW) Challenge(ip string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	c := hex.EncodeToString(b)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ids := p.byIP[ip]; len(ids) >= maxChallengesPerIP {
+		p.remove(ids[0])
+	}
+
+	now := time.Now()
+	if len(p.issued) >= maxChallenges {
+		for k, ch := range p.issued {
+			if now.After(ch.expires) {
+				p.remove(k)
+			}
+		}
+		if len(p.issued) >= maxChallenges {
+			return "", ErrTooManyPoW
+		}
+	}
+	p.issued[c] = powChallenge{ip: ip, expires: now.Add(challengeTTL)}
+	p.byIP[ip] = append(p.byIP[ip], c)
+	return c, nil
+}
+
+// remove removes a pending challenge. It's called with the lock held.
+func (p *PoW) remove(c string) {
+	ch, ok := p.issued[c]
+	if !ok {
+		return
+	}
+	delete(p.issued, c)
+
+	ids := p.byIP[ch.ip]
+	for i, id := range ids {
+		if id == c {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(p.byIP, ch.ip)
+	} else {
+		p.byIP[ch.ip] = ids
+	}
+}
+
+// Verify verifies the solution of a challenge. The challenge is used up
+// whether the solution is valid or not.
+func (p *PoW) Verify(token, remoteIP string) error {
+	if token == "" {
+		return ErrMissing
+	}
+	i := strings.IndexByte(token, ':')
+	if i < 0 {
+		return ErrFailed
+	}
+
+	p.mu.Lock()
+	ch, ok := p.issued[token[:i]]
+	p.remove(token[:i])
+	p.mu.Unlock()
+	if !ok || time.Now().After(ch.expires) {
+		return ErrFailed
+	}
+
+	if leadingZeros(sha256.Sum256([]byte(token))) < p.Difficulty {
+		return ErrFailed
+	}
+	return nil
+}
+
+// leadingZeros returns the number of leading zero bits of a hash.
+func leadingZeros(h [sha256.Size]byte) int {
+	n := 0
+	for _, b := range h {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package captcha
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// solve finds a nonce for a challenge, returning the token to verify.
+func solve(c string, difficulty int) string {
+	for n := 0; ; n++ {
+		t := fmt.Sprintf("%s:%d", c, n)
+		if leadingZeros(sha256.Sum256([]byte(t))) >= difficulty {
+			return t
+		}
+	}
+}
+
+func TestPoWVerify(t *testing.T) {
+	p := NewPoW(8)
+
+	c, err := p.Challenge("1.1.1.1")
+	if err != nil {
+		t.Fatalf("error issuing challenge: %v", err)
+	}
+	tok := solve(c, p.Difficulty)
+	if err := p.Verify(tok, "1.1.1.1"); err != nil {
+		t.Errorf("valid solution: %v", err)
+	}
+
+	// Challenges are single use.
+	if err := p.Verify(tok, "1.1.1.1"); err != ErrFailed {
+		t.Errorf("reused solution: got %v, want %v", err, ErrFailed)
+	}
+
+	cases := []struct {
+		name  string
+		token func() string
+		want  error
+	}{
+		{"missing", func() string { return "" }, ErrMissing},
+		{"malformed", func() string { return "abc" }, ErrFailed},
+		{"unknown challenge", func() string { return solve("abc", p.Difficulty) }, ErrFailed},
+		{"wrong nonce", func() string {
+			c, _ := p.Challenge("1.1.1.1")
+			for n := 0; ; n++ {
+				tok := fmt.Sprintf("%s:%d", c, n)
+				if leadingZeros(sha256.Sum256([]byte(tok))) < p.Difficulty {
+					return tok
+				}
+			}
+		}, ErrFailed},
+		{"expired", func() string {
+			c, _ := p.Challenge("1.1.1.1")
+			p.mu.Lock()
+			ch := p.issued[c]
+			ch.expires = time.Now().Add(-time.Second)
+			p.issued[c] = ch
+			p.mu.Unlock()
+			return solve(c, p.Difficulty)
+		}, ErrFailed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := p.Verify(c.token(), "1.1.1.1"); err != c.want {
+				t.Errorf("got %v, want %v", err, c.want)
+			}
+		})
+	}
+}
+
+func TestPoWChallengesPerIP(t *testing.T) {
+	p := NewPoW(1)
+
+	first, _ := p.Challenge("1.1.1.1")
+	for i := 0; i < maxChallengesPerIP; i++ {
+		if _, err := p.Challenge("1.1.1.1"); err != nil {
+			t.Fatalf("error issuing challenge: %v", err)
+		}
+	}
+	other, _ := p.Challenge("2.2.2.2")
+
+	// An IP's oldest challenge is dropped for new ones without touching the
+	// others'.
+	if err := p.Verify(solve(first, 1), "1.1.1.1"); err != ErrFailed {
+		t.Errorf("oldest challenge: got %v, want %v", err, ErrFailed)
+	}
+	if err := p.Verify(solve(other, 1), "2.2.2.2"); err != nil {
+		t.Errorf("other IP's challenge: %v", err)
+	}
+	if n := len(p.byIP["1.1.1.1"]); n != maxChallengesPerIP {
+		t.Errorf("%d pending challenges, want %d", n, maxChallengesPerIP)
+	}
+}
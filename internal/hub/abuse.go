@@ -0,0 +1,83 @@
+package hub
+
+import (
+	"sync"
+	"time"
+)
+
+// Actions taken on rooms whose peers trip too many errors.
+const (
+	ErrorActionDispose = "dispose"
+	ErrorActionLock    = "lock"
+)
+
+// errorWindow counts the errors (rate limits, invalid messages etc.) tripped
+// by a room's peers in a fixed window of time.
+type errorWindow struct {
+	mu     sync.Mutex
+	start  time.Time
+	count  int
+	locked bool
+
+	// Whether the room has been told to dispose of itself.
+	disposing bool
+}
+
+// recordError accounts an error tripped by a peer in the room. When the
+// errors in the window go over the configured threshold, the room is either
+// disposed or locked. Predefined rooms can only be locked.
+func (r *Room) recordError(p *Peer, reason string) {
+	var (
+		cfg = r.hub.cfg
+		now = time.Now()
+	)
+	if cfg.RoomErrorThreshold < 1 || (r.Predefined && !cfg.RoomErrorPredefined) {
+		return
+	}
+
+	r.errors.mu.Lock()
+	if r.errors.locked || r.errors.disposing {
+		r.errors.mu.Unlock()
+		return
+	}
+	if now.Sub(r.errors.start) > cfg.RoomErrorWindow {
+		r.errors.start = now
+		r.errors.count = 0
+	}
+	r.errors.count++
+
+	var (
+		exceeded = r.errors.count > cfg.RoomErrorThreshold
+		action   = cfg.RoomErrorAction
+	)
+	if r.Predefined {
+		action = ErrorActionLock
+	}
+	if exceeded {
+		if action == ErrorActionLock {
+			r.errors.locked = true
+		} else {
+			r.errors.disposing = true
+		}
+	}
+	r.errors.mu.Unlock()
+
+	if !exceeded {
+		return
+	}
+
+	r.log.Warnf("room %s exceeded %d errors in %v (last: %s by %s@%s), action: %s",
+		r.ID, cfg.RoomErrorThreshold, cfg.RoomErrorWindow, reason, p.Handle, p.ID, action)
+	if action == ErrorActionDispose {
+		// This may be invoked from the room's own goroutine.
+		go r.Dispose()
+	}
+}
+
+// isLocked returns true if the room has been locked for tripping too many
+// errors. Locked rooms don't accept new peers or messages.
+func (r *Room) isLocked() bool {
+	r.errors.mu.Lock()
+	defer r.errors.mu.Unlock()
+	return r.errors.locked
+}
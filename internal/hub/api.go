@@ -0,0 +1,78 @@
+package hub
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Errors returned on messages posted over the API.
+var (
+	ErrAPIRateLimited = errors.New("too many messages, try again later")
+	ErrInvalidPost    = fmt.Errorf("handle should be 1 to %d characters without spaces, and text should be set", maxHandleLen)
+	ErrPostTooLong    = errors.New("text is too long")
+)
+
+// ValidAPIToken checks whether the token is the room's API token. Rooms
+// without a token don't accept any.
+func (r *Room) ValidAPIToken(token string) bool {
+	return r.apiToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(r.apiToken)) == 1
+}
+
+// PostMessage posts a chat message to the room on behalf of a client that
+// isn't connected as a peer, eg: a bot, returning the message's ID. Posts
+// are subject to the same length and rate limits as peers' messages, the
+// rate limit being shared by all the room's API clients.
+func (r *Room) PostMessage(handle, text string) (string, error) {
+	if handle == "" || len(handle) > maxHandleLen || strings.IndexFunc(handle, unicode.IsSpace) >= 0 ||
+		strings.TrimSpace(text) == "" {
+		return "", ErrInvalidPost
+	}
+	if len(text) > r.maxMessageLen {
+		return "", ErrPostTooLong
+	}
+
+	// Predefined users' handles need a password.
+	for _, u := range r.PredefinedUsers {
+		if strings.EqualFold(u.Name, handle) {
+			return "", ErrHandleTaken
+		}
+	}
+
+	id, err := GenerateGUID(16)
+	if err != nil {
+		r.log.Errorf("error generating message ID: %v", err)
+		return "", errors.New("error generating message ID")
+	}
+
+	done := make(chan error, 1)
+	ok := r.do(func() {
+		if r.isLocked() {
+			done <- ErrRoomLocked
+			return
+		}
+		if !r.apiLimiter.allow(time.Now()) {
+			done <- ErrAPIRateLimited
+			return
+		}
+
+		r.trackMessage(id, msgMeta{sentAt: time.Now()})
+		r.emit(r.makePayload(payloadMsgChat{
+			ID:         id,
+			PeerHandle: handle,
+			Msg:        r.filterMessage(text),
+		}, TypeMessage), true)
+		r.numMessages++
+		done <- nil
+	})
+	if !ok {
+		return "", errors.New("room doesn't exist")
+	}
+	if err := <-done; err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,105 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Max length of an avatar URL set by a peer.
+const maxAvatarLen = 500
+
+// ErrInvalidAvatar is sent back to peers that set an invalid avatar.
+var ErrInvalidAvatar = errors.New("avatar should be the URL of a file uploaded to the room")
+
+// avatarPath matches the paths of the files uploaded to a room, with or
+// without the file's name after its ID, and their thumbnails, capturing the
+// room's ID and the file's ID.
+var avatarPath = regexp.MustCompile(`^/r/([^/]+)/uploaded/([0-9a-f]+)(_[^/]*)?(/thumb)?$`)
+
+// IdenticonHashLen is the length of the hex hashes of handles that identicons
+// are generated from.
+const IdenticonHashLen = 32
+
+// identiconURL returns the path of the identicon generated from a handle's
+// hash. Handles differing only in case get the same identicon.
+func identiconURL(handle string) string {
+	h := sha256.Sum256([]byte(strings.ToLower(handle)))
+	return "/avatar/" + hex.EncodeToString(h[:IdenticonHashLen/2]) + ".png"
+}
+
+// avatar returns the avatar of a peer, the URL it set or the identicon of
+// its handle, or "" if avatars are disabled.
+func (r *Room) avatar(p *Peer) string {
+	if !r.hub.cfg.Avatars {
+		return ""
+	}
+	if p.avatar != "" {
+		return p.avatar
+	}
+	return identiconURL(p.Handle)
+}
+
+// defaultAvatar returns the identicon of a handle, or "" if avatars are
+// disabled. It's the avatar of peers connected to other instances.
+func (r *Room) defaultAvatar(handle string) string {
+	if !r.hub.cfg.Avatars {
+		return ""
+	}
+	return identiconURL(handle)
+}
+
+// validAvatar parses an avatar URL set by a peer, returning the path that
+// it's served from. Only the files uploaded to the room are accepted, given
+// by their path or their URL on the app's root URL, as loading images from
+// anywhere else would give away the peers' IP addresses. The upload store is
+// checked as the IDs of files are their hashes, which are the same in all
+// rooms.
+func (r *Room) validAvatar(s string) (string, bool) {
+	if len(s) > maxAvatarLen {
+		return "", false
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", false
+	}
+	if u.Scheme != "" || u.Host != "" {
+		root, err := url.Parse(r.hub.cfg.RootURL)
+		if err != nil || u.Scheme != root.Scheme || u.Host != root.Host {
+			return "", false
+		}
+	}
+
+	m := avatarPath.FindStringSubmatch(u.Path)
+	if m == nil || m[1] != r.ID || r.hub.Uploads == nil || !r.hub.Uploads.UploadedTo(m[2], r.ID) {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// setAvatar sets the peer's avatar URL, or resets it to its identicon if
+// it's empty, and tells the room about it.
+func (r *Room) setAvatar(p *Peer, avatar string) {
+	if !r.hub.cfg.Avatars {
+		return
+	}
+	if avatar != "" {
+		a, ok := r.validAvatar(avatar)
+		if !ok {
+			p.SendData(r.makeErrorPayload(ErrInvalidAvatar))
+			return
+		}
+		avatar = a
+	}
+
+	r.do(func() {
+		if !r.peers[p] || p.avatar == avatar {
+			return
+		}
+		p.avatar = avatar
+		r.emit(r.makePeerUpdatePayload(p, TypeAvatar), false)
+	})
+}
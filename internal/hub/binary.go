@@ -0,0 +1,51 @@
+package hub
+
+import (
+	"encoding/binary"
+)
+
+// Types of binary WS frames, given by their first byte. Binary frames carry
+// frequent client messages in fewer bytes than their JSON equivalents.
+const (
+	// Upload progress: the upload's uid as a big endian uint64 followed by
+	// the percentage uploaded in a byte.
+	binUploading byte = 1
+)
+
+// Length of an upload progress frame.
+const binUploadingLen = 1 + 8 + 1
+
+// payloadUploading is the progress of an upload relayed from a binary
+// frame. The files being uploaded are sent by the client in the JSON
+// TypeUploading message that starts the upload.
+type payloadUploading struct {
+	UID     uint64 `json:"uid"`
+	Percent uint8  `json:"percent"`
+}
+
+// processBinary processes incoming binary frames from peers.
+func (p *Peer) processBinary(b []byte) {
+	if len(b) == 0 {
+		p.room.recordError(p, "invalid binary message")
+		return
+	}
+
+	switch b[0] {
+	case binUploading:
+		if len(b) != binUploadingLen || b[9] > 100 {
+			p.room.recordError(p, "invalid upload progress")
+			return
+		}
+		if !p.throttle() {
+			return
+		}
+		d := payloadUploading{
+			UID:     binary.BigEndian.Uint64(b[1:9]),
+			Percent: b[9],
+		}
+		p.room.Broadcast(p.room.makeUploadPayload(d, p, TypeUploading), false)
+
+	default:
+		p.room.recordError(p, "invalid binary message")
+	}
+}
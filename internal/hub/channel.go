@@ -0,0 +1,88 @@
+package hub
+
+import (
+	"errors"
+	"sort"
+)
+
+// Errors sent back to peers on invalid channel requests.
+var (
+	ErrChannelsDisabled = errors.New("channels are disabled")
+	ErrInvalidChannel   = errors.New("unknown channel")
+	ErrNotInChannel     = errors.New("not subscribed to the channel")
+)
+
+// initChannels subscribes a joining peer to the channels of the roles of the
+// predefined user it's logged in as.
+func (p *Peer) initChannels() {
+	p.channels = make(map[string]bool)
+	for _, u := range p.room.PredefinedUsers {
+		if u.Name != p.Handle {
+			continue
+		}
+		for _, r := range u.Roles {
+			p.channels[r] = true
+		}
+	}
+}
+
+// hasRole returns true if the peer is logged in as a predefined user with
+// the given role.
+func (p *Peer) hasRole(role string) bool {
+	for _, u := range p.room.PredefinedUsers {
+		if u.Name != p.Handle {
+			continue
+		}
+		for _, r := range u.Roles {
+			if r == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isOpenChannel returns true if any peer in the room can subscribe to
+// the channel.
+func (r *Room) isOpenChannel(ch string) bool {
+	for _, c := range r.openChannels {
+		if c == ch {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribe subscribes or unsubscribes a peer to/from a channel and sends
+// the peer its updated channel list. Only open channels can be subscribed
+// to. Channels derived from roles can't be unsubscribed from.
+func (r *Room) subscribe(p *Peer, ch string, sub bool) {
+	r.do(func() {
+		if !r.hub.cfg.Channels {
+			p.SendData(r.makeErrorPayload(ErrChannelsDisabled))
+			return
+		}
+		if !r.isOpenChannel(ch) {
+			p.SendData(r.makeErrorPayload(ErrInvalidChannel))
+			return
+		}
+
+		if sub {
+			p.channels[ch] = true
+		} else {
+			delete(p.channels, ch)
+		}
+		p.SendData(r.makeChannelListPayload(p))
+	})
+}
+
+// makeChannelListPayload prepares a message payload with the channels
+// a peer is subscribed to.
+func (r *Room) makeChannelListPayload(p *Peer) []byte {
+	out := make([]string, 0, len(p.channels))
+	for c := range p.channels {
+		out = append(out, c)
+	}
+	sort.Strings(out)
+	return r.makePayload(out, TypeChannelList)
+}
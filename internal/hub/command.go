@@ -0,0 +1,129 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Max length of a handle set with /nick.
+const maxHandleLen = 64
+
+// Errors sent back to peers whose commands fail.
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrInvalidHandle  = fmt.Errorf("handle should be 1 to %d characters without spaces", maxHandleLen)
+	ErrHandleTaken    = errors.New("handle is taken")
+)
+
+// payloadHandle is a peer's change of handle.
+type payloadHandle struct {
+	payloadMsgPeer
+	OldHandle string `json:"old_handle"`
+}
+
+// command runs a slash command sent by a peer in a chat message with the
+// arguments after the command's name, eg: "waves" for "/me waves".
+type command func(p *Peer, args string, m chatMessage)
+
+// commands are the slash commands that peers can run by their names. Messages
+// starting with "//" are posted as is with the leading slash removed.
+var commands = map[string]command{
+	"me":    cmdMe,
+	"nick":  cmdNick,
+	"shrug": cmdShrug,
+}
+
+// runCommand runs the slash command in a chat message from the peer.
+func (p *Peer) runCommand(m chatMessage) {
+	var (
+		line       = strings.TrimPrefix(m.msg, "/")
+		name, args = line, ""
+	)
+	if i := strings.IndexFunc(line, unicode.IsSpace); i >= 0 {
+		name, args = line[:i], strings.TrimSpace(line[i:])
+	}
+
+	cmd, ok := commands[strings.ToLower(name)]
+	if !ok {
+		p.SendData(p.room.makeErrorPayload(fmt.Errorf("%v: /%s", ErrUnknownCommand, name)))
+		return
+	}
+	cmd(p, args, m)
+}
+
+// cmdMe posts an action, eg: "/me waves" is shown as "* alice waves".
+func cmdMe(p *Peer, args string, m chatMessage) {
+	if args == "" || !p.checkRateLimit() {
+		return
+	}
+	m.msg = args
+	m.action = true
+	p.postChat(m)
+}
+
+// cmdShrug posts the message with a shrug appended.
+func cmdShrug(p *Peer, args string, m chatMessage) {
+	if !p.checkRateLimit() {
+		return
+	}
+	m.msg = strings.TrimSpace(args + ` ¯\_(ツ)_/¯`)
+	p.postChat(m)
+}
+
+// cmdNick changes the peer's handle.
+func cmdNick(p *Peer, args string, m chatMessage) {
+	p.room.changeHandle(p, args)
+}
+
+// changeHandle changes the peer's handle and tells the room about it. The
+// handle has to be unique in the room if unique handles are enforced, and
+// predefined users' handles can't be taken as they need a password. The
+// listener waits for the change as it reads the peer's handle.
+func (r *Room) changeHandle(p *Peer, handle string) {
+	if handle == "" || len(handle) > maxHandleLen || strings.IndexFunc(handle, unicode.IsSpace) >= 0 {
+		p.SendData(r.makeErrorPayload(ErrInvalidHandle))
+		return
+	}
+	for _, u := range r.PredefinedUsers {
+		if strings.EqualFold(u.Name, handle) {
+			p.SendData(r.makeErrorPayload(ErrHandleTaken))
+			return
+		}
+	}
+
+	done := make(chan struct{})
+	if !r.do(func() {
+		defer close(done)
+
+		old := p.Handle
+		if handle == old {
+			return
+		}
+		p.Handle = handle
+		if !r.resolveHandle(p) {
+			p.Handle = old
+			p.SendData(r.makeErrorPayload(ErrHandleTaken))
+			return
+		}
+
+		// Suffixed handles are already stored by resolveHandle.
+		if p.Handle == handle {
+			if err := r.hub.Store.AddSession(p.ID, handle, r.ID, r.hub.SessionTTL()); err != nil {
+				p.log.Errorf("error updating the handle of session %s in room %s: %v", p.ID, r.ID, err)
+			}
+		}
+		r.presence.join(p)
+		go r.RemovePushSubscriptions(old, p.ID)
+
+		r.emit(r.makePayload(payloadHandle{
+			payloadMsgPeer: payloadMsgPeer{ID: p.ID, Handle: p.Handle, Avatar: r.avatar(p)},
+			OldHandle:      old,
+		}, TypeHandle), true)
+		p.log.Infof("%s@%s is now %s in %s", old, p.ID, p.Handle, r.ID)
+	}) {
+		return
+	}
+	<-done
+}
@@ -0,0 +1,223 @@
+package hub
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Number of local broadcasts that can wait to be published to other
+// instances, over which they're dropped.
+const fanoutQueueSize = 1000
+
+// Number of broadcasts from other instances that can wait for a room, over
+// which they're dropped so that a busy room doesn't hold up the others.
+const remoteQueueSize = 100
+
+// Types of broadcasts that aren't published to other instances, as shared
+// presence relays them.
+var presenceTypes = map[string]bool{
+	TypePeerJoin:   true,
+	TypePeerLeave:  true,
+	TypeTyping:     true,
+	TypeTypingStop: true,
+}
+
+// fanoutMsg is a room broadcast published to other instances.
+type fanoutMsg struct {
+	Instance string          `json:"instance"`
+	Channel  string          `json:"channel,omitempty"`
+	Record   bool            `json:"record,omitempty"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// fanoutReq is a broadcast waiting to be published.
+type fanoutReq struct {
+	roomID string
+	data   []byte
+}
+
+// sharedBroadcast returns the store's pub/sub implementation if broadcasts
+// are to be shared across instances.
+func sharedBroadcast(cfg *Config, s store.Store) store.BroadcastStore {
+	if !cfg.SharedBroadcast {
+		return nil
+	}
+	b, _ := s.(store.BroadcastStore)
+	return b
+}
+
+// SharedBroadcast returns true if broadcasts are shared across instances.
+func (h *Hub) SharedBroadcast() bool {
+	return h.broadcasts != nil
+}
+
+// publish queues a local broadcast to be published to other instances. It's
+// only called from the room's goroutine.
+func (r *Room) publish(m broadcastReq) {
+	if r.hub.broadcasts == nil {
+		return
+	}
+
+	var t struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(m.data, &t); err != nil || presenceTypes[t.Type] {
+		return
+	}
+	b, err := json.Marshal(fanoutMsg{
+		Instance: r.hub.instanceID,
+		Channel:  m.channel,
+		Record:   m.record,
+		Data:     m.data,
+	})
+	if err != nil {
+		r.log.Errorf("error encoding broadcast of %s: %v", r.ID, err)
+		return
+	}
+
+	select {
+	case r.hub.fanoutQ <- fanoutReq{roomID: r.ID, data: b}:
+	default:
+		r.log.Errorf("dropped broadcast of %s to other instances: publish queue is full", r.ID)
+	}
+}
+
+// applyRemote applies a broadcast from another instance to the room's local
+// state as the originating instance has applied it to its own: chat messages
+// are tracked so that local peers can reply to them, and deletions, edits and
+// pins are applied to the cache and the pins. The originating instance has
+// stored them. It's only called from the room's goroutine.
+func (r *Room) applyRemote(b []byte) {
+	var m struct {
+		Type      string          `json:"type"`
+		Timestamp time.Time       `json:"timestamp"`
+		Data      json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return
+	}
+
+	switch {
+	case isChatType(m.Type):
+		var c payloadMsgChat
+		if json.Unmarshal(m.Data, &c) != nil || c.ID == "" || c.Burn > 0 {
+			return
+		}
+		r.trackMessage(c.ID, msgMeta{
+			authorID: c.PeerID,
+			replyTo:  c.ReplyTo,
+			channel:  c.Channel,
+			sentAt:   m.Timestamp,
+			depth:    c.ReplyDepth,
+		})
+
+	case m.Type == TypeMessageDelete:
+		var d payloadMutation
+		if json.Unmarshal(m.Data, &d) != nil || d.ID == "" {
+			return
+		}
+		r.untrackMessage(d.ID)
+		r.purgeMessage(d.ID)
+
+	case m.Type == TypeMessageEdit:
+		var e payloadMsgEdit
+		if json.Unmarshal(m.Data, &e) != nil {
+			return
+		}
+		for i, c := range r.payloadCache {
+			if out, ok := applyEdit(c, e); ok {
+				r.payloadCache[i] = out
+				break
+			}
+		}
+		for i, p := range r.pins {
+			if out, ok := applyEdit(p, e); ok {
+				r.pins[i] = out
+				break
+			}
+		}
+
+	case m.Type == TypePin:
+		id := pinID(m.Data)
+		for _, p := range r.pins {
+			if pinID(p) == id {
+				return
+			}
+		}
+		r.pins = append(r.pins, []byte(m.Data))
+
+	case m.Type == TypeUnpin:
+		var u payloadUnpin
+		json.Unmarshal(m.Data, &u)
+		for i, p := range r.pins {
+			if pinID(p) == u.ID {
+				r.pins = append(r.pins[:i:i], r.pins[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// runFanout is a blocking function that publishes local broadcasts to other
+// instances and relays theirs to the local peers, resubscribing if the
+// subscription fails. This should be invoked as a goroutine.
+func (h *Hub) runFanout() {
+	go func() {
+		for f := range h.fanoutQ {
+			if err := h.broadcasts.Publish(f.roomID, f.data); err != nil {
+				h.log.Errorf("error publishing broadcast of %s: %v", f.roomID, err)
+			}
+		}
+	}()
+
+	for {
+		err := h.broadcasts.Subscribe(h.fanoutStop, h.receiveFanout)
+		select {
+		case <-h.fanoutStop:
+			return
+		default:
+		}
+		h.log.Errorf("error subscribing to broadcasts, retrying: %v", err)
+
+		select {
+		case <-time.After(time.Second * 3):
+		case <-h.fanoutStop:
+			return
+		}
+	}
+}
+
+// receiveFanout relays a broadcast published by another instance to the
+// room's local peers. Broadcasts to rooms that aren't active locally have no
+// one to go to.
+func (h *Hub) receiveFanout(roomID string, b []byte) {
+	var m fanoutMsg
+	if err := json.Unmarshal(b, &m); err != nil {
+		h.log.Errorf("error decoding broadcast of %s: %v", roomID, err)
+		return
+	}
+
+	// Skip this instance's own broadcasts, which its peers have been sent.
+	if m.Instance == h.instanceID {
+		return
+	}
+	r := h.GetRoom(roomID)
+	if r == nil {
+		return
+	}
+
+	req := broadcastReq{
+		data:    m.Data,
+		record:  m.Record,
+		channel: m.Channel,
+		at:      r.broadcastTime(),
+		remote:  true,
+	}
+	select {
+	case r.remoteQ <- req:
+	default:
+		h.log.Errorf("dropped broadcast of %s from another instance: queue is full", roomID)
+	}
+}
@@ -0,0 +1,222 @@
+package hub
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/niltalk/internal/log"
+	"github.com/knadh/niltalk/store"
+	"github.com/knadh/niltalk/store/mem"
+)
+
+// fakeBus is an in-process pub/sub shared by the fake broadcast stores of
+// test hubs standing in for instances.
+type fakeBus struct {
+	mu   sync.Mutex
+	subs []func(roomID string, msg []byte)
+	seq  map[string]uint64
+}
+
+// fakeBroadcastStore is an in-memory store whose broadcasts go over a bus.
+type fakeBroadcastStore struct {
+	store.Store
+	bus *fakeBus
+}
+
+func (s *fakeBroadcastStore) Publish(roomID string, msg []byte) error {
+	s.bus.mu.Lock()
+	subs := append([]func(string, []byte){}, s.bus.subs...)
+	s.bus.mu.Unlock()
+	for _, fn := range subs {
+		fn(roomID, msg)
+	}
+	return nil
+}
+
+func (s *fakeBroadcastStore) Subscribe(stop <-chan struct{}, fn func(roomID string, msg []byte)) error {
+	s.bus.mu.Lock()
+	s.bus.subs = append(s.bus.subs, fn)
+	s.bus.mu.Unlock()
+	<-stop
+	return nil
+}
+
+func (s *fakeBroadcastStore) NextSeq(roomID string, floor uint64) (uint64, error) {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if s.bus.seq[roomID] < floor {
+		s.bus.seq[roomID] = floor
+	}
+	s.bus.seq[roomID]++
+	return s.bus.seq[roomID], nil
+}
+
+// newSharedTestHubs returns n hubs that share broadcasts over a bus, each
+// with its own in-memory store.
+func newSharedTestHubs(t *testing.T, n int) []*Hub {
+	t.Helper()
+
+	bus := &fakeBus{seq: make(map[string]uint64)}
+	out := make([]*Hub, n)
+	for i := range out {
+		s, err := mem.New(mem.Config{})
+		if err != nil {
+			t.Fatalf("error creating store: %v", err)
+		}
+		out[i] = NewHub(&Config{
+			MaxCachedMessages: 100,
+			MaxMessageLen:     1000,
+			WSTimeout:         time.Second * 5,
+			RoomAge:           time.Hour,
+			RateLimitInterval: time.Second,
+			RateLimitMessages: 10,
+			Replies:           true,
+			MaxPins:           10,
+			SharedBroadcast:   true,
+		}, &fakeBroadcastStore{Store: s, bus: bus}, log.New(ioutil.Discard))
+	}
+
+	// Wait for the hubs to subscribe.
+	for i := 0; i < 100; i++ {
+		bus.mu.Lock()
+		ok := len(bus.subs) == n
+		bus.mu.Unlock()
+		if ok {
+			return out
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("hubs didn't subscribe to broadcasts")
+	return nil
+}
+
+func TestFanoutRemoteMessages(t *testing.T) {
+	hubs := newSharedTestHubs(t, 2)
+	var (
+		sr = store.Room{ID: "room1", CreatedAt: time.Now()}
+		ra = hubs[0].initRoom(sr, false)
+		rb = hubs[1].initRoom(sr, false)
+		pa = joinTestPeer(ra, "peer1", "alice")
+		pb = joinTestPeer(rb, "peer2", "bob")
+	)
+
+	// A message posted on one instance reaches the other.
+	ra.postMessage(pa, chatMessage{msg: "hello"})
+	got := nextPayload(t, pb, TypeMessage)
+	msg := got.Data
+	if msg.Msg != "hello" || msg.ID == "" {
+		t.Fatalf("relayed message = %+v", msg)
+	}
+
+	// The sender's instance doesn't relay its own broadcast back to its peers.
+	if got := nextPayload(t, pa, TypeMessage); got.Data.ID != msg.ID {
+		t.Fatalf("sender got message %q, want %q", got.Data.ID, msg.ID)
+	}
+	select {
+	case m := <-pa.dataQ:
+		t.Fatalf("sender got an echo of its own broadcast: %s", m.data)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// Peers on the other instance can reply to it.
+	rb.postMessage(pb, chatMessage{msg: "hi", replyTo: msg.ID})
+	if r := nextPayload(t, pa, TypeMessage); r.Data.ReplyTo != msg.ID {
+		t.Errorf("reply from the other instance has reply_to %q, want %q", r.Data.ReplyTo, msg.ID)
+	}
+
+	// Sequence numbers don't overlap across instances.
+	if r := nextPayload(t, pb, TypeMessage); r.Seq == 0 || r.Seq <= got.Seq {
+		t.Errorf("reply seq = %d, message seq = %d", r.Seq, got.Seq)
+	}
+
+	// Pins made on its instance are applied to the other's.
+	pa.moderator = true
+	numPins := func() int {
+		var n int
+		runInRoom(rb, func() { n = len(rb.pins) })
+		return n
+	}
+	ra.pin(pa, msg.ID)
+	nextPayload(t, pb, TypePin)
+	if n := numPins(); n != 1 {
+		t.Errorf("other instance has %d pins after pinning, want 1", n)
+	}
+	ra.unpin(pa, msg.ID)
+	nextPayload(t, pb, TypeUnpin)
+	if n := numPins(); n != 0 {
+		t.Errorf("other instance has %d pins after unpinning, want 0", n)
+	}
+
+	// Deleting it on its instance removes it from the other's cache, which
+	// new peers are replayed.
+	ra.removeMessage(pa, msg.ID)
+	if d := nextPayload(t, pb, TypeMessageDelete); d.Data.ID != msg.ID {
+		t.Fatalf("deleted %q, want %q", d.Data.ID, msg.ID)
+	}
+	var (
+		cached  []string
+		tracked bool
+	)
+	runInRoom(rb, func() {
+		for _, b := range rb.history() {
+			var m struct {
+				Data payloadMsgChat `json:"data"`
+			}
+			json.Unmarshal(b, &m)
+			cached = append(cached, m.Data.ID)
+		}
+		_, tracked = rb.messages[msg.ID]
+	})
+	for _, id := range cached {
+		if id == msg.ID {
+			t.Errorf("deleted message %q is still in the other instance's cache", id)
+		}
+	}
+	if tracked {
+		t.Errorf("deleted message %q is still tracked on the other instance", msg.ID)
+	}
+}
+
+func TestFanoutRelaysOnce(t *testing.T) {
+	hubs := newSharedTestHubs(t, 2)
+	var (
+		sr = store.Room{ID: "room1", CreatedAt: time.Now()}
+		ra = hubs[0].initRoom(sr, false)
+		rb = hubs[1].initRoom(sr, false)
+		pa = joinTestPeer(ra, "peer1", "alice")
+		pb = joinTestPeer(rb, "peer2", "bob")
+	)
+
+	// Messages are relayed to bridges by the instance they were posted on
+	// and not again by the others that receive them.
+	relayed := make(chan string, 10)
+	for name, r := range map[string]*Room{"a": ra, "b": rb} {
+		name, r := name, r
+		runInRoom(r, func() {
+			r.BridgeHandler = func(handle, msg string) { relayed <- name + ":" + msg }
+		})
+	}
+
+	ra.postMessage(pa, chatMessage{msg: "hello"})
+	nextPayload(t, pb, TypeMessage)
+	rb.postMessage(pb, chatMessage{msg: "hi"})
+	nextPayload(t, pa, TypeMessage)
+
+	var got []string
+	timeout := time.After(time.Millisecond * 200)
+loop:
+	for {
+		select {
+		case s := <-relayed:
+			got = append(got, s)
+		case <-timeout:
+			break loop
+		}
+	}
+	if len(got) != 2 || got[0] != "a:hello" || got[1] != "b:hi" {
+		t.Errorf("relayed %v, want [a:hello b:hi]", got)
+	}
+}
@@ -0,0 +1,57 @@
+package hub
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ChatMessage represents a chat message in a room's history.
+type ChatMessage struct {
+	ID        string    `json:"id"`
+	Handle    string    `json:"handle"`
+	Text      string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// RecentMessages returns up to the last n chat messages in the room's
+// history, oldest first.
+func (r *Room) RecentMessages(n int) []ChatMessage {
+	var (
+		out  []ChatMessage
+		done = make(chan bool)
+	)
+	if !r.do(func() {
+		h := r.history()
+		for i := len(h) - 1; i >= 0 && len(out) < n; i-- {
+			var m struct {
+				Type      string         `json:"type"`
+				Timestamp time.Time      `json:"timestamp"`
+				Data      payloadMsgChat `json:"data"`
+			}
+			if err := json.Unmarshal(h[i], &m); err != nil || m.Type != TypeMessage {
+				continue
+			}
+			out = append(out, ChatMessage{
+				ID:        m.Data.ID,
+				Handle:    m.Data.PeerHandle,
+				Text:      m.Data.Msg,
+				Timestamp: m.Timestamp,
+			})
+		}
+		close(done)
+	}) {
+		return nil
+	}
+	<-done
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// IsPublic returns true if the room doesn't have a password, ie: it's an
+// open room that anyone with the link can join.
+func (r *Room) IsPublic() bool {
+	return r.public
+}
@@ -0,0 +1,74 @@
+package hub
+
+import (
+	"regexp"
+)
+
+// Formatting features that a format policy may allow in messages.
+const (
+	FormatEmphasis = "emphasis"
+	FormatCode     = "code"
+	FormatLinks    = "links"
+	FormatImages   = "images"
+)
+
+// DefaultFormatPolicy is the policy applied when none is configured.
+const DefaultFormatPolicy = "full"
+
+// formatPolicies are the named policies that the app and rooms can pick from,
+// each listing the formatting features it allows.
+var formatPolicies = map[string]map[string]bool{
+	"text": {},
+	"basic": {
+		FormatEmphasis: true,
+		FormatCode:     true,
+		FormatLinks:    true,
+	},
+	"full": {
+		FormatEmphasis: true,
+		FormatCode:     true,
+		FormatLinks:    true,
+		FormatImages:   true,
+	},
+}
+
+var (
+	reMarkdownImage    = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	reMarkdownLink     = regexp.MustCompile(`\[([^\]]*)\]\(([^)]*)\)`)
+	reMarkdownCode     = regexp.MustCompile("`+([^`]*)`+")
+	reMarkdownEmphasis = regexp.MustCompile(`(\*{1,3}|_{1,3}|~~)([^*_~]+)(\*{1,3}|_{1,3}|~~)`)
+)
+
+// ValidFormatPolicy checks whether the given name is a known format policy.
+// An empty name is valid and falls back to the default policy.
+func ValidFormatPolicy(name string) bool {
+	if name == "" {
+		return true
+	}
+	_, ok := formatPolicies[name]
+	return ok
+}
+
+// sanitizeMessage strips the markdown constructs that aren't allowed by the
+// given format policy, leaving their plain text content behind.
+func sanitizeMessage(msg, policy string) string {
+	allowed, ok := formatPolicies[policy]
+	if !ok {
+		allowed = formatPolicies[DefaultFormatPolicy]
+	}
+
+	// Images have to be handled before links as they share the syntax.
+	if !allowed[FormatImages] {
+		msg = reMarkdownImage.ReplaceAllString(msg, "$1")
+	}
+	if !allowed[FormatLinks] {
+		msg = reMarkdownLink.ReplaceAllString(msg, "$1")
+	}
+	if !allowed[FormatCode] {
+		msg = reMarkdownCode.ReplaceAllString(msg, "$1")
+	}
+	if !allowed[FormatEmphasis] {
+		msg = reMarkdownEmphasis.ReplaceAllString(msg, "$2")
+	}
+	return msg
+}
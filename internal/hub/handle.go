@@ -0,0 +1,56 @@
+package hub
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Ways of handling a joining peer's handle being the same as a connected
+// peer's.
+const (
+	HandleCollisionAllow  = "allow"
+	HandleCollisionReject = "reject"
+	HandleCollisionSuffix = "suffix"
+)
+
+// resolveHandle enforces unique handles in the room for a joining peer as
+// configured, suffixing its handle (eg: alice2) if it's taken. It returns
+// false if the peer has to be rejected. This should only be called from the
+// room's goroutine so that concurrent joins can't claim the same handle.
+func (r *Room) resolveHandle(p *Peer) bool {
+	mode := r.hub.cfg.UniqueHandles
+	if mode == "" || mode == HandleCollisionAllow || !r.handleTaken(p, p.Handle) {
+		return true
+	}
+	if mode == HandleCollisionReject {
+		return false
+	}
+
+	handle := p.Handle
+	for n := 2; r.handleTaken(p, handle); n++ {
+		handle = p.Handle + strconv.Itoa(n)
+	}
+	p.Handle = handle
+
+	// Store the new handle so that the peer keeps it when it reconnects.
+	if err := r.hub.Store.AddSession(p.ID, handle, r.ID, r.hub.SessionTTL()); err != nil {
+		p.log.Errorf("error updating the handle of session %s in room %s: %v", p.ID, r.ID, err)
+	}
+	return true
+}
+
+// handleTaken checks whether a handle is used, ignoring case, by a peer in
+// the room other than the ones of p's session.
+func (r *Room) handleTaken(p *Peer, handle string) bool {
+	for peer := range r.peers {
+		if peer.ID != p.ID && strings.EqualFold(peer.Handle, handle) {
+			return true
+		}
+	}
+	for _, peer := range r.presence.remotePeers() {
+		if peer.ID != p.ID && strings.EqualFold(peer.Handle, handle) {
+			return true
+		}
+	}
+	return false
+}
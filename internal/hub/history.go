@@ -0,0 +1,252 @@
+package hub
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Ways of replaying a room's history to joining peers.
+const (
+	// Messages are replayed in their final form with the mutation
+	// events (edits, deletions etc.) applied to them.
+	HistoryFolded = "folded"
+
+	// Messages are replayed as sent along with the raw mutation events.
+	HistoryEvents = "events"
+)
+
+// payloadMutation is the part of a mutation event payload that identifies the
+// message it applies to, and the new text of edits.
+type payloadMutation struct {
+	ID  string `json:"id"`
+	Msg string `json:"message"`
+}
+
+// payloadHistory is a recorded payload replayed from the history.
+type payloadHistory struct {
+	Seq         uint64          `json:"seq,omitempty"`
+	Type        string          `json:"type"`
+	Timestamp   time.Time       `json:"timestamp"`
+	TimestampMS int64           `json:"timestamp_ms,omitempty"`
+	Data        json.RawMessage `json:"data"`
+	History     bool            `json:"history"`
+}
+
+// time returns the server time of the payload in Unix milliseconds, falling
+// back to the timestamp for payloads recorded before it was added.
+func (m payloadHistory) time() int64 {
+	if m.TimestampMS > 0 {
+		return m.TimestampMS
+	}
+	return unixMillis(m.Timestamp)
+}
+
+// history returns the room's recorded payloads to be replayed, folded if
+// configured. It's only called from the room's goroutine.
+func (r *Room) history() [][]byte {
+	if r.hub.cfg.HistoryReplay == HistoryEvents {
+		return r.payloadCache
+	}
+	return foldHistory(r.payloadCache)
+}
+
+// recordHistory records a payload in the room's cache, and in the store's
+// history if it's enabled. It's only called from the room's goroutine.
+func (r *Room) recordHistory(b []byte) {
+	r.recordMsgPayload(b)
+	if r.hub.cfg.HistorySize > 0 {
+		// Chat messages and their edits are stored with the messages' IDs
+		// so that they can be deleted together.
+		var (
+			m struct {
+				Type string          `json:"type"`
+				Data payloadMutation `json:"data"`
+			}
+			id string
+		)
+		if err := json.Unmarshal(b, &m); err == nil && (isChatType(m.Type) || m.Type == TypeMessageEdit) {
+			id = m.Data.ID
+		}
+		r.queueHistory(historyOp{id: id, b: b})
+	}
+}
+
+// Number of writes to a room's stored history that can wait for the store.
+// Writes over it are dropped rather than holding up the room.
+const historyQueueSize = 1000
+
+// historyOp is a write to a room's stored history, either a payload to
+// append or the ID of a message to delete, or a flush that closes done once
+// the writes queued before it have been made.
+type historyOp struct {
+	id   string
+	b    []byte
+	del  bool
+	done chan struct{}
+}
+
+// runHistoryWriter is a blocking function that makes the writes to the
+// room's stored history in order, off the room's goroutine, until the room
+// stops. This should be invoked as a goroutine.
+func (r *Room) runHistoryWriter() {
+	for op := range r.historyQ {
+		switch {
+		case op.done != nil:
+			close(op.done)
+			continue
+		case op.del:
+			if err := r.hub.Store.DeleteMessage(r.ID, op.id); err != nil {
+				r.log.Errorf("error deleting message from history of %s: %v", r.ID, err)
+			}
+		default:
+			if err := r.hub.Store.AppendMessage(r.ID, op.id, op.b); err != nil {
+				r.log.Errorf("error appending message to history of %s: %v", r.ID, err)
+			}
+		}
+		atomic.AddInt64(&r.historyPending, -1)
+	}
+}
+
+// queueHistory queues a write to the room's stored history. It's only
+// called from the room's goroutine.
+func (r *Room) queueHistory(op historyOp) {
+	select {
+	case r.historyQ <- op:
+		atomic.AddInt64(&r.historyPending, 1)
+	default:
+		r.log.Errorf("dropping write to history of %s: queue is full", r.ID)
+	}
+}
+
+// flushHistory waits for the queued writes to the room's stored history so
+// that reading it sees them. It's only called from the room's goroutine.
+func (r *Room) flushHistory() {
+	if r.historyQ == nil || atomic.LoadInt64(&r.historyPending) == 0 {
+		return
+	}
+	done := make(chan struct{})
+	r.historyQ <- historyOp{done: done}
+	<-done
+}
+
+// sendHistory sends a joining peer the last messages in the room's history
+// from the store if it's enabled, or the cache otherwise, flagged as history.
+func (r *Room) sendHistory(p *Peer) {
+	var msgs [][]byte
+	if n := r.hub.cfg.HistorySize; n > 0 {
+		r.flushHistory()
+		m, err := r.hub.Store.GetMessages(r.ID, n)
+		if err != nil {
+			r.log.Errorf("error getting history of %s: %v", r.ID, err)
+			return
+		}
+		msgs = m
+		if r.hub.cfg.HistoryReplay != HistoryEvents {
+			msgs = foldHistory(msgs)
+		}
+	} else if r.hub.cfg.MaxCachedMessages > 0 {
+		msgs = r.history()
+	}
+
+	out := make([]payloadHistory, 0, len(msgs))
+	for _, b := range msgs {
+		var m payloadHistory
+		if err := json.Unmarshal(b, &m); err != nil {
+			continue
+		}
+		m.History = true
+		out = append(out, m)
+	}
+
+	// Payloads may be recorded out of order, eg: imported ones.
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].time() < out[j].time()
+	})
+	for _, m := range out {
+		b, _ := json.Marshal(m)
+		p.SendData(b)
+	}
+}
+
+// trackHistory tracks the chat messages in the room's stored history so that
+// replies to them keep their threads after a restart. Mutation events are
+// folded first so that deleted messages aren't tracked. This should only be
+// called from the room's goroutine.
+func (r *Room) trackHistory() {
+	n := r.hub.cfg.HistorySize
+	if n <= 0 || !r.hub.cfg.Replies {
+		return
+	}
+	msgs, err := r.hub.Store.GetMessages(r.ID, n)
+	if err != nil {
+		r.log.Errorf("error getting history of %s: %v", r.ID, err)
+		return
+	}
+
+	for _, b := range foldHistory(msgs) {
+		var m struct {
+			Type      string         `json:"type"`
+			Timestamp time.Time      `json:"timestamp"`
+			Data      payloadMsgChat `json:"data"`
+		}
+		if err := json.Unmarshal(b, &m); err != nil || !isChatType(m.Type) || m.Data.ID == "" {
+			continue
+		}
+		r.trackMessage(m.Data.ID, msgMeta{
+			authorID: m.Data.PeerID,
+			replyTo:  m.Data.ReplyTo,
+			sentAt:   m.Timestamp,
+			depth:    m.Data.ReplyDepth,
+		})
+	}
+}
+
+// foldHistory applies the mutation events in recorded payloads to the
+// messages they target, dropping the events themselves.
+func foldHistory(payloads [][]byte) [][]byte {
+	type event struct {
+		Type string          `json:"type"`
+		Data payloadMutation `json:"data"`
+	}
+
+	// Collect the mutations first as they follow the messages.
+	var (
+		events  = make([]event, len(payloads))
+		deleted = make(map[string]bool)
+		edited  = make(map[string]string)
+	)
+	for i, b := range payloads {
+		if err := json.Unmarshal(b, &events[i]); err != nil {
+			continue
+		}
+		switch e := events[i]; e.Type {
+		case TypeMessageDelete:
+			deleted[e.Data.ID] = true
+		case TypeMessageEdit:
+			edited[e.Data.ID] = e.Data.Msg
+		}
+	}
+	if len(deleted) == 0 && len(edited) == 0 {
+		return payloads
+	}
+
+	out := make([][]byte, 0, len(payloads))
+	for i, b := range payloads {
+		e := events[i]
+		switch e.Type {
+		case TypeMessageDelete, TypeMessageEdit:
+			continue
+		case TypeMessage, TypeAction:
+			if deleted[e.Data.ID] {
+				continue
+			}
+			if msg, ok := edited[e.Data.ID]; ok {
+				b, _ = applyEdit(b, payloadMsgEdit{ID: e.Data.ID, Msg: msg})
+			}
+		}
+		out = append(out, b)
+	}
+	return out
+}
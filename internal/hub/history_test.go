@@ -0,0 +1,38 @@
+package hub
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/knadh/niltalk/internal/log"
+	"github.com/knadh/niltalk/store"
+)
+
+func TestHistoryReplay(t *testing.T) {
+	h := newTestHub(t, func(c *Config) { c.HistorySize = 2 })
+	r := newTestRoom(t, h)
+	p := joinTestPeer(r, "peer1", "alice")
+
+	for _, msg := range []string{"one", "two", "three"} {
+		r.postMessage(p, chatMessage{msg: msg})
+		nextPayload(t, p, TypeMessage)
+	}
+
+	// Peers joining the room after a restart are sent the last messages
+	// from the store, flagged as history.
+	runInRoom(r, r.flushHistory)
+	sr, err := h.Store.GetRoom(r.ID)
+	if err != nil {
+		t.Fatalf("error getting room: %v", err)
+	}
+	h2 := NewHub(h.cfg, h.Store, log.New(ioutil.Discard))
+	r2 := h2.initRoom(store.Room{ID: sr.ID, CreatedAt: sr.CreatedAt}, false)
+	p2 := joinTestPeer(r2, "peer2", "bob")
+	runInRoom(r2, func() { r2.sendHistory(p2) })
+	for _, want := range []string{"two", "three"} {
+		got := nextPayload(t, p2, TypeMessage)
+		if got.Data.Msg != want || !got.History {
+			t.Errorf("replayed %q (history: %v), want %q", got.Data.Msg, got.History, want)
+		}
+	}
+}
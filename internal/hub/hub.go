@@ -3,71 +3,318 @@ package hub
 import (
 	"crypto/rand"
 	"errors"
-	"log"
 	"sync"
 	"time"
 
+	"github.com/knadh/niltalk/internal/i18n"
+	"github.com/knadh/niltalk/internal/log"
 	"github.com/knadh/niltalk/internal/notify"
+	"github.com/knadh/niltalk/internal/upload"
 	"github.com/knadh/niltalk/store"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Types of messages sent to peers.
 const (
 	TypeTyping          = "typing"
+	TypeTypingStop      = "typing.stop"
 	TypeMessage         = "message"
+	TypeAction          = "message.action"
 	TypeUploading       = "uploading"
 	TypeUpload          = "upload"
 	TypePeerList        = "peer.list"
 	TypePeerInfo        = "peer.info"
 	TypePeerJoin        = "peer.join"
 	TypePeerLeave       = "peer.leave"
+	TypeStatus          = "peer.status"
+	TypeAvatar          = "peer.avatar"
 	TypePeerRateLimited = "peer.ratelimited"
 	TypeRoomDispose     = "room.dispose"
 	TypeRoomFull        = "room.full"
+	TypeRoomLocked      = "room.locked"
+	TypeHandleTaken     = "handle.taken"
+	TypeClientOutdated  = "client.outdated"
 	TypeNotice          = "notice"
 	TypeHandle          = "handle"
 	TypeGrowl           = "growl"
 	TypePing            = "ping"
 	TypeWhisper         = "whisper"
 	TypeMotd            = "motd"
+	TypeError           = "error"
+	TypeChannelList     = "channel.list"
+	TypeMessageDelete   = "message.delete"
+	TypeMessageEdit     = "message.edit"
+	TypePin             = "message.pin"
+	TypeUnpin           = "message.unpin"
+	TypePinList         = "message.pins"
+	TypeDirectMessage   = "message.direct"
+	TypeMention         = "mention"
+	TypeKick            = "peer.kick"
+	TypePeerKicked      = "peer.kicked"
+	TypeSessionEvicted  = "session.evicted"
+	TypeBan             = "peer.ban"
+	TypeVerify          = "verify"
+	TypeSubscribe       = "channel.subscribe"
+	TypeUnsubscribe     = "channel.unsubscribe"
 )
 
+// Number of outbound messages queued per peer when app.peer_queue_size
+// isn't set.
+const defaultPeerQueueSize = 100
+
 // Config represents the app configuration.
 type Config struct {
 	Address string `koanf:"address"`
 	RootURL string `koanf:"root_url"`
 
+	// Derive the RootURL from the onion address when it's not set.
+	RootURLFromOnion bool `koanf:"root_url_from_onion"`
+
+	// Format of the logs, text or json, and the level below which entries
+	// are dropped, one of debug|info|warn|error.
+	LogFormat string `koanf:"log_format"`
+	LogLevel  string `koanf:"log_level"`
+
 	Name              string        `koanf:"name"`
 	RoomIDLen         int           `koanf:"room_id_length"`
+	RoomIDAlphabet    string        `koanf:"room_id_alphabet"`
 	MaxCachedMessages int           `koanf:"max_cached_messages"`
 	MaxMessageLen     int           `koanf:"max_message_length"`
 	WSTimeout         time.Duration `koanf:"websocket_timeout"`
+	PingInterval      time.Duration `koanf:"ping_interval"`
 	MaxMessageQueue   int           `koanf:"max_message_queue"`
+
+	// Sizes of the peers' WS I/O buffers in bytes (0 for the defaults) and
+	// the number of outbound messages that can be queued per peer.
+	WSReadBuffer  int `koanf:"ws_read_buffer"`
+	WSWriteBuffer int `koanf:"ws_write_buffer"`
+	PeerQueueSize int `koanf:"peer_queue_size"`
+
+	// Goroutines that share the sending of broadcasts to the peers of large
+	// rooms. 0 or 1 sends them from the room's goroutine.
+	BroadcastWorkers int `koanf:"broadcast_workers"`
+
 	RateLimitInterval time.Duration `koanf:"rate_limit_interval"`
 	RateLimitMessages int           `koanf:"rate_limit_messages"`
+
+	// Requests to create rooms, log in and upload per interval from each IP.
+	HTTPRateLimit         int           `koanf:"http_rate_limit"`
+	HTTPRateLimitInterval time.Duration `koanf:"http_rate_limit_interval"`
+
+	// Timeouts of the HTTP server, 0 for none. Uploads and history exports
+	// and imports get HTTPUploadTimeout instead of the read and write
+	// timeouts and WebSockets and event streams get none.
+	HTTPReadHeaderTimeout time.Duration `koanf:"http_read_header_timeout"`
+	HTTPReadTimeout       time.Duration `koanf:"http_read_timeout"`
+	HTTPWriteTimeout      time.Duration `koanf:"http_write_timeout"`
+	HTTPIdleTimeout       time.Duration `koanf:"http_idle_timeout"`
+	HTTPUploadTimeout     time.Duration `koanf:"http_upload_timeout"`
+
+	// Compress responses of at least CompressMinSize bytes.
+	Compress        bool `koanf:"compress"`
+	CompressMinSize int  `koanf:"compress_min_size"`
+
+	// How long browsers cache static assets linked without a version, 0 to
+	// revalidate them on every use.
+	StaticMaxAge time.Duration `koanf:"static_max_age"`
+
+	// Read client IPs from the headers set by reverse proxies in the
+	// TrustedProxies CIDRs if TrustProxy is set.
+	TrustProxy     bool     `koanf:"trust_proxy"`
+	TrustedProxies []string `koanf:"trusted_proxies"`
+
+	// Origins allowed to open WebSockets besides the chat's own.
+	AllowedOrigins []string `koanf:"allowed_origins"`
+
+	// CORS for the JSON API and logins. Disabled without CORSOrigins.
+	CORSOrigins     []string `koanf:"cors_origins"`
+	CORSMethods     []string `koanf:"cors_methods"`
+	CORSHeaders     []string `koanf:"cors_headers"`
+	CORSCredentials bool     `koanf:"cors_credentials"`
+
 	MaxRooms          int           `koanf:"max_rooms"`
 	MaxPeersPerRoom   int           `koanf:"max_peers_per_room"`
 	PeerHandleFormat  string        `koanf:"peer_handle_format"`
+	FormatPolicy      string        `koanf:"format_policy"`
+	DropLogSampling   int           `koanf:"drop_log_sampling"`
+	MaxImportMessages int           `koanf:"max_import_messages"`
+	AdminToken        string        `koanf:"admin_token"`
+	EventStream       bool          `koanf:"event_stream"`
+	ResumeTokenTTL    time.Duration `koanf:"resume_token_ttl"`
+	ResumeBufferSize  int           `koanf:"resume_buffer_size"`
+	MaxReplayMessages int           `koanf:"max_replay_messages"`
+	Replies           bool          `koanf:"replies"`
+	MaxReplyDepth     int           `koanf:"max_reply_depth"`
+	PeerSequence      bool          `koanf:"peer_sequence"`
+	Channels          bool          `koanf:"channels"`
+	MinClientVersion  int           `koanf:"min_client_version"`
+	AutoRoomNames     bool          `koanf:"auto_room_names"`
+	RoomNameCollision string        `koanf:"room_name_collision"`
+	UniqueHandles     string        `koanf:"unique_handles"`
+	IdleTimeout       time.Duration `koanf:"idle_timeout"`
+	TypingTimeout     time.Duration `koanf:"typing_timeout"`
+	MaxPins           int           `koanf:"max_pins"`
+	StatsPublic       bool          `koanf:"stats_public"`
+	Feeds             bool          `koanf:"feeds"`
+	PublicFeeds       bool          `koanf:"public_feeds"`
+	MaxFeedEntries    int           `koanf:"max_feed_entries"`
+	MaxBurnTTL        time.Duration `koanf:"max_burn_ttl"`
+	EditWindow        time.Duration `koanf:"edit_window"`
+	GrowlRateLimit    int           `koanf:"growl_rate_limit"`
+	GrowlRateInterval time.Duration `koanf:"growl_rate_interval"`
+	GrowlRateNotify   bool          `koanf:"growl_rate_notify"`
+	VerifyFirstPost   bool          `koanf:"verify_first_post"`
+	ProfanityWordList string        `koanf:"profanity_wordlist"`
+	TrackLatency      bool          `koanf:"track_latency"`
+	ShedQueueDepth    int           `koanf:"shed_queue_depth"`
+	ShedCPU           int           `koanf:"shed_cpu"`
+	HistoryReplay     string        `koanf:"history_replay"`
+	HistorySize       int           `koanf:"history_size"`
+	OpenChannels      []string      `koanf:"open_channels"`
 	RoomTimeout       time.Duration `koanf:"room_timeout"`
 	RoomAge           time.Duration `koanf:"room_age"`
 	SessionCookie     string        `koanf:"session_cookie"`
 	Storage           string        `koanf:"storage"`
+	JITFallback       bool          `koanf:"jit_fallback"`
+	ShutdownTimeout   time.Duration `koanf:"shutdown_timeout"`
+
+	// Rooms without peers and messages for this long are disposed of, and
+	// no longer expire by room_age. 0 disables it.
+	RoomIdleTimeout time.Duration `koanf:"room_idle_timeout"`
+
+	// How long sessions last since the peer's last request or connection.
+	// Sessions last RoomAge if it's 0.
+	SessionTTL time.Duration `koanf:"session_ttl"`
+
+	RoomErrorThreshold  int           `koanf:"room_error_threshold"`
+	RoomErrorWindow     time.Duration `koanf:"room_error_window"`
+	RoomErrorAction     string        `koanf:"room_error_action"`
+	RoomErrorPredefined bool          `koanf:"room_error_predefined"`
+
+	MaxConcurrentJoins int           `koanf:"max_concurrent_joins"`
+	MaxQueuedJoins     int           `koanf:"max_queued_joins"`
+	JoinQueueTimeout   time.Duration `koanf:"join_queue_timeout"`
+
+	SharedPresence   bool          `koanf:"shared_presence"`
+	PresenceInterval time.Duration `koanf:"presence_interval"`
+
+	// Relay broadcasts to the peers connected to other instances.
+	SharedBroadcast bool `koanf:"shared_broadcast"`
 
 	Rooms map[string]PredefinedRoom `koanf:"rooms"`
 
 	Tor        bool   `koanf:"tor"`
 	PrivateKey string `koanf:"privatekey"`
+
+	// Path to an existing onion private key (PKCS8 PEM), eg: a mounted
+	// secret. Takes precedence over PrivateKey, which is created if missing.
+	TorKeyPath string `koanf:"tor_key_path"`
+
+	// Port the onion service is published on, and the base32 x25519 public
+	// keys of the clients authorized to connect to it, if it's private.
+	TorRemotePort int      `koanf:"tor_remote_port"`
+	TorClientAuth []string `koanf:"tor_client_auth"`
+
+	// Serve HTTPS when both the certificate and key files are set, and
+	// optionally redirect HTTP requests on another address to it.
+	TLSCert            string `koanf:"tls_cert"`
+	TLSKey             string `koanf:"tls_key"`
+	TLSRedirect        bool   `koanf:"tls_redirect"`
+	TLSRedirectAddress string `koanf:"tls_redirect_address"`
+
+	// Send Web Push notifications of mentions and direct messages when the
+	// VAPID private key is set. The subject is the operator's contact.
+	PushVAPIDPrivateKey string `koanf:"push_vapid_private_key"`
+	PushSubject         string `koanf:"push_subject"`
+
+	// Hosts of the push services that subscriptions can point to. A
+	// leading dot matches subdomains. The major browsers' are allowed if
+	// it's empty.
+	PushHosts []string `koanf:"push_hosts"`
+
+	// Verify room creation with hCaptcha, reCAPTCHA, or a proof-of-work
+	// challenge of CaptchaDifficulty leading zero bits.
+	CaptchaProvider   string `koanf:"captcha_provider"`
+	CaptchaSiteKey    string `koanf:"captcha_site_key"`
+	CaptchaSecret     string `koanf:"captcha_secret"`
+	CaptchaDifficulty int    `koanf:"captcha_difficulty"`
+
+	// Hashing of room passwords with bcrypt or argon2id, and the checks of
+	// the passwords of new rooms.
+	PasswordHash        string `koanf:"password_hash"`
+	BcryptCost          int    `koanf:"bcrypt_cost"`
+	Argon2Time          int    `koanf:"argon2_time"`
+	Argon2Memory        int    `koanf:"argon2_memory"`
+	Argon2Threads       int    `koanf:"argon2_threads"`
+	RoomPasswordMinLen  int    `koanf:"room_password_min_length"`
+	RoomPasswordClasses int    `koanf:"room_password_classes"`
+
+	// Allow creating rooms without passwords that anyone with the link can
+	// join.
+	AllowOpenRooms bool `koanf:"allow_open_rooms"`
+
+	// Show peers' avatars, the URLs they set or identicons generated from
+	// their handles.
+	Avatars bool `koanf:"avatars"`
+
+	// Locale of the system messages sent to peers, and a directory with
+	// catalogs (<locale>.json) that take precedence over the bundled ones.
+	Locale    string `koanf:"locale"`
+	LocaleDir string `koanf:"locale_dir"`
+
+	// Maximum number of live sessions of a predefined user's handle in a
+	// room, 0 for no limit, and what happens to logins over it, reject or
+	// evict.
+	MaxSessionsPerHandle int    `koanf:"max_sessions_per_handle"`
+	SessionLimitAction   string `koanf:"session_limit_action"`
 }
 
 // PredefinedRoom are static rooms declared in the configuration file.
 type PredefinedRoom struct {
-	ID       string           `koanf:"id"`
-	Name     string           `koanf:"name"`
-	Password string           `koanf:"password"`
-	Growl    notify.Options   `koanf:"growl"`
-	Users    []PredefinedUser `koanf:"users"`
-	Motd     string           `koanf:"motd"`
+	ID       string                `koanf:"id"`
+	Name     string                `koanf:"name"`
+	Password string                `koanf:"password"`
+	Growl    notify.Options        `koanf:"growl"`
+	Webhook  notify.WebhookOptions `koanf:"webhook"`
+	Bridge   notify.BridgeOptions  `koanf:"bridge"`
+	Users    []PredefinedUser      `koanf:"users"`
+	Motd     string                `koanf:"motd"`
+
+	// Roles (channels) that the room's users can have besides moderator.
+	// Users with other roles are rejected at startup to catch typos.
+	Roles []string `koanf:"roles"`
+
+	// FormatPolicy overrides the app's format policy for the room.
+	FormatPolicy string `koanf:"format_policy"`
+
+	// OpenChannels overrides the app's open channels for the room.
+	OpenChannels []string `koanf:"open_channels"`
+
+	// MaxBurnTTL overrides the app's max burn TTL for the room if it's
+	// non-zero. A negative value disables burning messages in the room.
+	MaxBurnTTL time.Duration `koanf:"max_burn_ttl"`
+
+	// VerifyFirstPost makes new peers solve a challenge before their first
+	// message is posted, overriding the app's setting.
+	VerifyFirstPost *bool `koanf:"verify_first_post"`
+
+	// ProfanityWordList overrides the app's profanity word list file.
+	ProfanityWordList string `koanf:"profanity_wordlist"`
+
+	// MaxPeers overrides the app's max peers per room if it's non-zero.
+	MaxPeers int `koanf:"max_peers"`
+
+	// MaxMessageLen overrides the app's max message length for the room if
+	// it's non-zero, eg: for sharing code.
+	MaxMessageLen int `koanf:"max_message_length"`
+
+	// RateLimitMessages and RateLimitInterval override the app's message
+	// rate limits for the room if they're non-zero.
+	RateLimitMessages int           `koanf:"rate_limit_messages"`
+	RateLimitInterval time.Duration `koanf:"rate_limit_interval"`
+
+	// APIToken authorizes posting messages to the room over HTTP. Posting
+	// is disabled if it's empty.
+	APIToken string `koanf:"api_token"`
 }
 
 // PredefinedUser are static users declared in the configuration file.
@@ -75,13 +322,64 @@ type PredefinedUser struct {
 	Name     string `koanf:"name"`
 	Password string `koanf:"password"`
 	Growl    bool   `koanf:"growl"`
+
+	// Channels the user is subscribed to on joining.
+	Roles []string `koanf:"roles"`
+
+	// Moderators can kick peers and delete any message.
+	Moderator bool `koanf:"moderator"`
 }
 
 // Hub acts as the controller and container for all chat rooms.
 type Hub struct {
+	// Total depth of the rooms' broadcast queues, the percentage of the CPUs
+	// used, and whether load is being shed. Kept first for 64-bit alignment
+	// of atomic operations.
+	queueDepth int64
+	cpuLoad    int64
+	shedding   int32
+
 	Store store.Store
 	rooms map[string]*Room
 
+	// Web Push sender, if push notifications are enabled.
+	Push *notify.WebPush
+
+	// Uploaded files, which peers can set as their avatars.
+	Uploads *upload.Store
+
+	// System messages sent to peers in the app's locale.
+	Catalog *i18n.Catalog
+
+	// Delivery drops across all rooms.
+	drops dropCounter
+
+	// Message delivery latencies across all rooms.
+	latency latencyTracker
+
+	// Throttles concurrent peer joins.
+	joins *joinLimiter
+
+	// Profanity word lists by file path.
+	wordLists map[string]*wordList
+
+	// Whether room password hashes are of an empty password, so that
+	// re-activating a room, say, on every feed poll, doesn't rehash.
+	publicHashes sync.Map
+
+	// Presence shared with other instances, if enabled.
+	presence   store.PresenceStore
+	instanceID string
+
+	// Broadcasts shared with other instances, if enabled, and the queue of
+	// local broadcasts to publish.
+	broadcasts store.BroadcastStore
+	fanoutQ    chan fanoutReq
+	fanoutStop chan struct{}
+
+	// Shares of large rooms' peers for the broadcast workers.
+	broadcastJobs chan broadcastJob
+
 	cfg *Config
 	mut sync.RWMutex
 	log *log.Logger
@@ -89,64 +387,110 @@ type Hub struct {
 
 // NewHub returns a new instance of Hub.
 func NewHub(cfg *Config, store store.Store, l *log.Logger) *Hub {
-	return &Hub{
+	instanceID, _ := GenerateGUID(16)
+	h := &Hub{
 		rooms: make(map[string]*Room),
+		joins: newJoinLimiter(cfg.MaxConcurrentJoins, cfg.MaxQueuedJoins, cfg.JoinQueueTimeout),
+
+		presence:   sharedPresence(cfg, store),
+		instanceID: instanceID,
+		broadcasts: sharedBroadcast(cfg, store),
 
 		cfg:   cfg,
 		Store: store,
 		log:   l,
 	}
+	if n := roomIDLen(cfg.RoomIDAlphabet, cfg.RoomIDLen); n != cfg.RoomIDLen {
+		l.Warnf("room_id_length %d is too short for room IDs to have %d bits of randomness, using %d",
+			cfg.RoomIDLen, minRoomIDBits, n)
+	}
+	if cfg.ShedQueueDepth > 0 || cfg.ShedCPU > 0 {
+		go h.runLoadMonitor()
+	}
+	if cfg.RoomIdleTimeout > 0 {
+		go h.runIdleSweeper()
+	}
+	if cfg.BroadcastWorkers > 1 {
+		h.broadcastJobs = make(chan broadcastJob, cfg.BroadcastWorkers)
+		for i := 0; i < cfg.BroadcastWorkers; i++ {
+			go h.runBroadcastWorker()
+		}
+	}
+	if h.broadcasts != nil {
+		h.fanoutQ = make(chan fanoutReq, fanoutQueueSize)
+		h.fanoutStop = make(chan struct{})
+		go h.runFanout()
+	}
+	return h
 }
 
 // AddRoom creates a new room in the store, adds it to the hub, and
 // returns the room (which has to be .Run() on a goroutine then).
 func (h *Hub) AddRoom(name, password string) (*Room, error) {
 	// Hash the password.
-	pwdHash, err := bcrypt.GenerateFromPassword([]byte(password), 8)
+	pwdHash, err := h.hashPassword(password)
 	if err != nil {
-		h.log.Printf("error hashing password: %v", err)
+		h.log.Errorf("error hashing password: %v", err)
 		return nil, err
 	}
 
-	id, err := h.generateRoomID(h.cfg.RoomIDLen, 5)
+	creatorID, err := GenerateGUID(32)
 	if err != nil {
-		return nil, err
-	}
-
-	// Add the room to DB.
-	if err := h.Store.AddRoom(store.Room{ID: id,
-		Name:      name,
-		CreatedAt: time.Now(),
-		Password:  pwdHash}, h.cfg.RoomAge); err != nil {
-		h.log.Printf("error creating room in the store: %v", err)
+		h.log.Errorf("error generating creator ID: %v", err)
 		return nil, errors.New("error creating room")
 	}
 
-	// Initialize the room.
-	return h.initRoom(id, name, pwdHash, false), nil
+	// Add the room to DB under a random ID, retrying with a new ID if it's
+	// taken, including by a room created concurrently.
+	for i := 0; i < roomIDAttempts; i++ {
+		id, err := newRoomID(h.cfg.RoomIDAlphabet, roomIDLen(h.cfg.RoomIDAlphabet, h.cfg.RoomIDLen))
+		if err != nil {
+			h.log.Errorf("error generating room ID: %v", err)
+			return nil, errors.New("error generating room ID")
+		}
+
+		sr := store.Room{ID: id,
+			Name:      name,
+			CreatedAt: time.Now(),
+			Password:  pwdHash,
+			CreatorID: creatorID}
+		ok, err := h.Store.CreateRoomIfNotExists(sr, h.RoomTTL())
+		if err != nil {
+			h.log.Errorf("error creating room in the store: %v", err)
+			return nil, errors.New("error creating room")
+		}
+
+		// Initialize the room.
+		if ok {
+			return h.initRoom(sr, false), nil
+		}
+	}
+	h.log.Errorf("no free room ID after %d attempts, consider a longer room_id_length", roomIDAttempts)
+	return nil, ErrRoomIDTaken
 }
 
 // AddPredefinedRoom creates a predefined room in the store, adds it to the hub.
 // If it already exists, no error is returned.
 func (h *Hub) AddPredefinedRoom(ID, name, password string) (*Room, error) {
 	// Hash the password.
-	pwdHash, err := bcrypt.GenerateFromPassword([]byte(password), 8)
+	pwdHash, err := h.hashPassword(password)
 	if err != nil {
-		h.log.Printf("error hashing password: %v", err)
+		h.log.Errorf("error hashing password: %v", err)
 		return nil, err
 	}
 
 	// Add the room to DB.
-	if err := h.Store.AddRoom(store.Room{ID: ID,
+	sr := store.Room{ID: ID,
 		Name:      name,
 		CreatedAt: time.Now(),
-		Password:  pwdHash}, h.cfg.RoomAge); err != nil {
-		h.log.Printf("error creating room in the store: %v", err)
+		Password:  pwdHash}
+	if err := h.Store.AddRoom(sr, h.RoomTTL()); err != nil {
+		h.log.Errorf("error creating room in the store: %v", err)
 		return nil, errors.New("error creating room")
 	}
 
 	// Initialize the room.
-	return h.initRoom(ID, name, pwdHash, true), nil
+	return h.initRoom(sr, true), nil
 }
 
 // ActivateRoom loads a room from the store into the hub if it's not already active.
@@ -164,7 +508,58 @@ func (h *Hub) ActivateRoom(id string) (*Room, error) {
 	}
 
 	// Initialize the room.
-	return h.initRoom(r.ID, r.Name, r.Password, false), nil
+	return h.initRoom(r, false), nil
+}
+
+// msg returns a system message in the app's locale.
+func (h *Hub) msg(key string, args ...interface{}) string {
+	return h.Catalog.T(key, args...)
+}
+
+// RoomTTL returns how long rooms are kept in the store without being
+// renewed.
+func (h *Hub) RoomTTL() time.Duration {
+	if h.cfg.RoomIdleTimeout > 0 {
+		return h.cfg.RoomIdleTimeout
+	}
+	return h.cfg.RoomAge
+}
+
+// SessionTTL returns how long sessions last without being renewed.
+func (h *Hub) SessionTTL() time.Duration {
+	if h.cfg.SessionTTL > 0 {
+		return h.cfg.SessionTTL
+	}
+	return h.cfg.RoomAge
+}
+
+// peerQueueSize returns the number of outbound messages that can be queued
+// for a peer. Queues also fit the history or missed messages that joining
+// peers are sent at once, along with their info, the motd, and the pins.
+func (h *Hub) peerQueueSize() int {
+	n := h.cfg.PeerQueueSize
+	if n <= 0 {
+		n = defaultPeerQueueSize
+	}
+
+	backlog := h.cfg.HistorySize
+	if backlog == 0 {
+		backlog = h.cfg.MaxCachedMessages
+	}
+	if h.cfg.ResumeBufferSize > backlog {
+		backlog = h.cfg.ResumeBufferSize
+	}
+	if h.cfg.MaxReplayMessages > backlog {
+		backlog = h.cfg.MaxReplayMessages
+	}
+	return n + backlog + 3
+}
+
+// NumRooms returns the number of active rooms.
+func (h *Hub) NumRooms() int {
+	h.mut.RLock()
+	defer h.mut.RUnlock()
+	return len(h.rooms)
 }
 
 // GetRoom retrives an active room from the hub.
@@ -176,15 +571,59 @@ func (h *Hub) GetRoom(id string) *Room {
 }
 
 // initRoom initializes a room on the Hub.
-func (h *Hub) initRoom(id, name string, password []byte, predefined bool) *Room {
-	r := NewRoom(id, name, password, h, predefined)
+func (h *Hub) initRoom(sr store.Room, predefined bool) *Room {
+	id := sr.ID
+	r := NewRoom(id, sr.Name, sr.Password, h, predefined)
+	r.CreatedAt = sr.CreatedAt
+	r.CreatorID = sr.CreatorID
 	h.mut.Lock()
+	r.formatPolicy = h.cfg.FormatPolicy
+	r.openChannels = h.cfg.OpenChannels
+	r.maxBurnTTL = h.cfg.MaxBurnTTL
+	r.verifyFirstPost = h.cfg.VerifyFirstPost
+	r.wordList = h.wordLists[h.cfg.ProfanityWordList]
+	r.maxPeers = h.cfg.MaxPeersPerRoom
+	r.maxMessageLen = h.cfg.MaxMessageLen
+	r.rateLimitMessages = h.cfg.RateLimitMessages
+	r.rateLimitInterval = h.cfg.RateLimitInterval
 	if predefined {
 		r.motd = h.cfg.Rooms[id].Motd
+		if p := h.cfg.Rooms[id].FormatPolicy; p != "" {
+			r.formatPolicy = p
+		}
+		if c := h.cfg.Rooms[id].OpenChannels; len(c) > 0 {
+			r.openChannels = c
+		}
+		if t := h.cfg.Rooms[id].MaxBurnTTL; t != 0 {
+			r.maxBurnTTL = t
+		}
+		if v := h.cfg.Rooms[id].VerifyFirstPost; v != nil {
+			r.verifyFirstPost = *v
+		}
+		if p := h.cfg.Rooms[id].ProfanityWordList; p != "" {
+			r.wordList = h.wordLists[p]
+		}
+		if n := h.cfg.Rooms[id].MaxPeers; n != 0 {
+			r.maxPeers = n
+		}
+		if n := h.cfg.Rooms[id].MaxMessageLen; n != 0 {
+			r.maxMessageLen = n
+		}
+		if n := h.cfg.Rooms[id].RateLimitMessages; n != 0 {
+			r.rateLimitMessages = n
+		}
+		if t := h.cfg.Rooms[id].RateLimitInterval; t != 0 {
+			r.rateLimitInterval = t
+		}
+		r.apiToken = h.cfg.Rooms[id].APIToken
 	}
+	r.apiLimiter = newRateLimiter(r.rateLimitMessages, r.rateLimitInterval)
 	h.rooms[id] = r
 	h.mut.Unlock()
 	go r.run()
+	if h.presence != nil {
+		go r.runPresence()
+	}
 	return r
 }
 
@@ -202,39 +641,47 @@ func (h *Hub) getRooms() []*Room {
 // removeRoom removes a room from the hub and the store.
 func (h *Hub) removeRoom(id string) error {
 	h.mut.Lock()
+	if r, ok := h.rooms[id]; ok {
+		h.publicHashes.Delete(string(r.password))
+	}
 	delete(h.rooms, id)
 	h.mut.Unlock()
 
 	err := h.Store.RemoveRoom(id)
 	if err != nil {
-		h.log.Printf("error removing room from store: %v", err)
+		h.log.Errorf("error removing room from store: %v", err)
 		return err
 	}
 	return nil
 }
 
-// generateRoomID generates a random room ID while checking the store for
-// uniqueness up to numTries times.
-func (h *Hub) generateRoomID(length, numTries int) (string, error) {
-	for i := 0; i < numTries; i++ {
-		id, err := GenerateGUID(length)
-		if err != nil {
-			h.log.Printf("error generating room ID: %v", err)
-			return "", errors.New("error generating room ID")
-		}
+// Number of random IDs tried when creating a room before giving up.
+const roomIDAttempts = 5
 
-		exists, err := h.Store.RoomExists(id)
-		if err != nil {
-			h.log.Printf("error checking room ID in store: %v", err)
-			return "", errors.New("error checking room ID")
-		}
+// ErrRoomIDTaken is returned when all the IDs tried for a new room are
+// taken.
+var ErrRoomIDTaken = errors.New("unable to generate a unique room ID, try again")
 
-		// Got a unique ID.
-		if !exists {
-			return id, nil
-		}
+// ErrRoomNotFound is returned when disposing of a room that doesn't exist.
+var ErrRoomNotFound = errors.New("room doesn't exist")
+
+// DisposeRoom disposes of a room on an admin's request, regardless of its
+// peers. An active room disconnects its peers with a dispose close frame
+// and removes itself from the store, while an inactive one is removed from
+// the store directly. Disposed predefined rooms are recreated on startup.
+func (h *Hub) DisposeRoom(id string) error {
+	if r := h.GetRoom(id); r != nil {
+		r.ForceDispose()
+		return nil
+	}
+
+	if _, err := h.Store.GetRoom(id); err != nil {
+		return ErrRoomNotFound
+	}
+	if err := h.Store.ClearSessions(id); err != nil {
+		h.log.Errorf("error clearing sessions of room %s: %v", id, err)
 	}
-	return "", errors.New("unable to generate unique room ID")
+	return h.removeRoom(id)
 }
 
 // GenerateGUID generates a cryptographically random, alphanumeric string of length n.
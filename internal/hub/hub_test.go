@@ -0,0 +1,174 @@
+package hub
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/internal/log"
+	"github.com/knadh/niltalk/store/mem"
+)
+
+// newTestHub returns a hub with an in-memory store and the config modified
+// by fn, if it's set.
+func newTestHub(t testing.TB, fn func(*Config)) *Hub {
+	t.Helper()
+
+	cfg := &Config{
+		MaxCachedMessages: 100,
+		MaxMessageLen:     1000,
+		WSTimeout:         time.Second * 5,
+		RoomAge:           time.Hour,
+		RateLimitInterval: time.Second,
+		RateLimitMessages: 10,
+	}
+	if fn != nil {
+		fn(cfg)
+	}
+	s, err := mem.New(mem.Config{})
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	return NewHub(cfg, s, log.New(ioutil.Discard))
+}
+
+// newTestRoom creates a room in the hub's store and starts it.
+func newTestRoom(t testing.TB, h *Hub) *Room {
+	t.Helper()
+
+	r, err := h.AddRoom("test", "password")
+	if err != nil {
+		t.Fatalf("error creating room: %v", err)
+	}
+	return r
+}
+
+// joinTestPeer adds a peer to a running room without a connection. Its
+// payloads are read from its queue with nextPayload.
+func joinTestPeer(r *Room, id, handle string) *Peer {
+	return joinTestPeerConn(r, id, handle, nil)
+}
+
+// joinTestPeerConn adds a peer with a connection to a running room.
+func joinTestPeerConn(r *Room, id, handle string, ws *websocket.Conn) *Peer {
+	p := newPeer(id, handle, ws, r)
+	r.do(func() { r.peers[p] = true })
+	return p
+}
+
+// newTestConn returns both ends of a WebSocket connection, the server's
+// to be given to a peer and the client's to read what the peer is sent.
+// The returned function closes them.
+func newTestConn(t testing.TB) (*websocket.Conn, *websocket.Conn, func()) {
+	t.Helper()
+
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- ws
+	}))
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("error dialing test server: %v", err)
+	}
+	ws := <-conns
+	return ws, client, func() {
+		client.Close()
+		ws.Close()
+		srv.Close()
+	}
+}
+
+// closeReason reads a connection until it's closed, returning the reason.
+func closeReason(t testing.TB, ws *websocket.Conn) string {
+	t.Helper()
+
+	ws.SetReadDeadline(time.Now().Add(time.Second * 2))
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if e, ok := err.(*websocket.CloseError); ok {
+			return e.Text
+		}
+		t.Fatalf("connection wasn't closed: %v", err)
+	}
+}
+
+// runInRoom runs f on the room's goroutine and waits for it.
+func runInRoom(r *Room, f func()) {
+	done := make(chan struct{})
+	r.do(func() {
+		f()
+		close(done)
+	})
+	<-done
+}
+
+// testPayload is a payload queued to a test peer.
+type testPayload struct {
+	Seq     uint64         `json:"seq"`
+	Type    string         `json:"type"`
+	History bool           `json:"history"`
+	Data    payloadMsgChat `json:"data"`
+
+	// Error of error payloads.
+	Error string `json:"-"`
+}
+
+// nextPayload returns the next payload of the given type queued to the
+// peer, failing the test if none arrives in time.
+func nextPayload(t testing.TB, p *Peer, typ string) testPayload {
+	t.Helper()
+
+	timeout := time.After(time.Second * 2)
+	for {
+		select {
+		case m := <-p.dataQ:
+			var out testPayload
+			if json.Unmarshal(m.data, &out) != nil || out.Type != typ {
+				continue
+			}
+			if typ == TypeError {
+				var e struct {
+					Data payloadMsgError `json:"data"`
+				}
+				json.Unmarshal(m.data, &e)
+				out.Error = e.Data.Error
+			}
+			return out
+		case <-timeout:
+			t.Fatalf("%s didn't receive a %s payload", p.Handle, typ)
+		}
+	}
+}
+
+// noPayload fails the test if a payload of the given type is queued to the
+// peer in a while.
+func noPayload(t testing.TB, p *Peer, typ string) {
+	t.Helper()
+
+	timeout := time.After(time.Millisecond * 100)
+	for {
+		select {
+		case m := <-p.dataQ:
+			var out testPayload
+			if json.Unmarshal(m.data, &out) == nil && out.Type == typ {
+				t.Fatalf("%s received an unexpected %s payload: %s", p.Handle, typ, m.data)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package hub
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// runIdleSweeper is a blocking function that periodically disposes of rooms
+// that have had no peers and no messages for room_idle_timeout, and renews
+// the store TTL of rooms with peers, who may be connected without posting
+// anything. This should be invoked as a goroutine.
+func (h *Hub) runIdleSweeper() {
+	interval := h.cfg.RoomIdleTimeout / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for range t.C {
+		for _, r := range h.getRooms() {
+			if r.Predefined || r.stopped() {
+				continue
+			}
+			if atomic.LoadInt32(&r.numPeers) > 0 {
+				r.extendTTL()
+				continue
+			}
+			if time.Since(r.idleSince()) >= h.cfg.RoomIdleTimeout {
+				// A room that's busy is no longer idle, and is left to the
+				// next sweep rather than holding up the others.
+				select {
+				case r.disposeSig <- false:
+					h.log.Infof("disposing of idle room %s", r.ID)
+				default:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ImportMessage represents a message exported from another chat system that
+// is to be imported into a room's history.
+type ImportMessage struct {
+	Handle    string    `json:"handle"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Import related errors.
+var (
+	ErrImportDisabled = errors.New("message import is disabled")
+	ErrImportTooLarge = errors.New("too many messages in the import")
+	ErrImportDone     = errors.New("import batch has already been imported")
+)
+
+// ImportMessages validates and writes a batch of messages into the room's
+// history preserving their timestamps. Every batch is imported only once; a
+// repeated batch ID returns ErrImportDone.
+func (r *Room) ImportMessages(batchID string, msgs []ImportMessage) (int, error) {
+	if r.hub.cfg.MaxImportMessages < 1 {
+		return 0, ErrImportDisabled
+	}
+	if batchID == "" {
+		return 0, errors.New("invalid batch ID")
+	}
+	if len(msgs) > r.hub.cfg.MaxImportMessages {
+		return 0, ErrImportTooLarge
+	}
+
+	for i, m := range msgs {
+		if m.Handle == "" || m.Text == "" {
+			return 0, fmt.Errorf("message %d: empty handle or text", i)
+		}
+		if len(m.Text) > r.maxMessageLen {
+			return 0, fmt.Errorf("message %d: text too long", i)
+		}
+		if m.Timestamp.IsZero() {
+			return 0, fmt.Errorf("message %d: invalid timestamp", i)
+		}
+	}
+
+	// Prepare the payloads before handing them over to the room.
+	var (
+		ids      = make([]string, 0, len(msgs))
+		payloads = make([][]byte, 0, len(msgs))
+	)
+	for _, m := range msgs {
+		id, err := GenerateGUID(16)
+		if err != nil {
+			r.log.Errorf("error generating message ID: %v", err)
+			return 0, errors.New("error generating message ID")
+		}
+
+		ids = append(ids, id)
+		payloads = append(payloads, r.makePayloadAt(m.Timestamp, payloadMsgChat{
+			ID:         id,
+			PeerHandle: m.Handle,
+			Msg:        r.filterMessage(m.Text),
+		}, TypeMessage))
+	}
+
+	// Claim the batch ID, which concurrent retries of the batch race for.
+	key := fmt.Sprintf("import:%s:%s", r.ID, batchID)
+	ok, err := r.hub.Store.SetIfNotExists(key, []byte(time.Now().Format(time.RFC3339)))
+	if err != nil {
+		r.log.Errorf("error recording import batch: %v", err)
+		return 0, errors.New("error recording import batch")
+	}
+	if !ok {
+		return 0, ErrImportDone
+	}
+
+	// Write to the history on the room's goroutine.
+	done := make(chan bool)
+	ok = r.do(func() {
+		for i, b := range payloads {
+			r.trackMessage(ids[i], msgMeta{})
+			r.recordHistory(b)
+		}
+		close(done)
+	})
+	if !ok {
+		return 0, errors.New("room doesn't exist")
+	}
+	<-done
+
+	return len(payloads), nil
+}
@@ -0,0 +1,113 @@
+package hub
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrJoinsThrottled is returned when there are too many peers waiting to join.
+var ErrJoinsThrottled = errors.New("too many peers joining, retry shortly")
+
+// JoinStats represents the number and latency of peer joins.
+type JoinStats struct {
+	Joins      uint64        `json:"joins"`
+	Rejected   uint64        `json:"rejected_joins"`
+	AvgLatency time.Duration `json:"avg_join_latency"`
+	MaxLatency time.Duration `json:"max_join_latency"`
+}
+
+// joinLimiter bounds the number of peer joins processed concurrently so that
+// reconnect storms don't overwhelm the store. Joins over the limit wait in a
+// bounded queue.
+type joinLimiter struct {
+	// Total and max latencies in nanoseconds.
+	total    uint64
+	max      uint64
+	joins    uint64
+	rejected uint64
+
+	sem      chan struct{}
+	queued   int32
+	maxQueue int32
+	wait     time.Duration
+}
+
+func newJoinLimiter(concurrency, maxQueue int, wait time.Duration) *joinLimiter {
+	l := &joinLimiter{
+		maxQueue: int32(maxQueue),
+		wait:     wait,
+	}
+	if concurrency > 0 {
+		l.sem = make(chan struct{}, concurrency)
+	}
+	return l
+}
+
+// acquire waits for a join slot and returns the function that releases it.
+func (l *joinLimiter) acquire() (func(), error) {
+	start := time.Now()
+	if l.sem == nil {
+		return func() { l.record(start) }, nil
+	}
+
+	select {
+	case l.sem <- struct{}{}:
+	default:
+		if atomic.AddInt32(&l.queued, 1) > l.maxQueue {
+			atomic.AddInt32(&l.queued, -1)
+			atomic.AddUint64(&l.rejected, 1)
+			return nil, ErrJoinsThrottled
+		}
+
+		t := time.NewTimer(l.wait)
+		select {
+		case l.sem <- struct{}{}:
+			t.Stop()
+			atomic.AddInt32(&l.queued, -1)
+		case <-t.C:
+			atomic.AddInt32(&l.queued, -1)
+			atomic.AddUint64(&l.rejected, 1)
+			return nil, ErrJoinsThrottled
+		}
+	}
+
+	return func() {
+		<-l.sem
+		l.record(start)
+	}, nil
+}
+
+// record records the latency of a join.
+func (l *joinLimiter) record(start time.Time) {
+	d := uint64(time.Since(start))
+	atomic.AddUint64(&l.joins, 1)
+	atomic.AddUint64(&l.total, d)
+	for {
+		max := atomic.LoadUint64(&l.max)
+		if d <= max || atomic.CompareAndSwapUint64(&l.max, max, d) {
+			break
+		}
+	}
+}
+
+// AcquireJoin waits for a slot to process a peer join and returns the function
+// that has to be called once the join is done. ErrJoinsThrottled is returned
+// if the join can't be processed in time.
+func (h *Hub) AcquireJoin() (func(), error) {
+	return h.joins.acquire()
+}
+
+// JoinStats returns the number and latency of peer joins.
+func (h *Hub) JoinStats() JoinStats {
+	l := h.joins
+	s := JoinStats{
+		Joins:      atomic.LoadUint64(&l.joins),
+		Rejected:   atomic.LoadUint64(&l.rejected),
+		MaxLatency: time.Duration(atomic.LoadUint64(&l.max)),
+	}
+	if s.Joins > 0 {
+		s.AvgLatency = time.Duration(atomic.LoadUint64(&l.total) / s.Joins)
+	}
+	return s
+}
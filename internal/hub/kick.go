@@ -0,0 +1,146 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Errors sent back to peers on invalid moderation requests.
+var (
+	ErrNotModerator = errors.New("only moderators can do that")
+	ErrKickSelf     = errors.New("can't kick yourself")
+	ErrInvalidBan   = errors.New("invalid ban duration")
+	ErrNotDisposer  = errors.New("only the room's creator or moderators can dispose of it")
+	ErrPredefined   = errors.New("predefined rooms can only be disposed of by admins")
+	ErrBanned       = errors.New("you are banned from this room")
+)
+
+type payloadNotice struct {
+	Message string `json:"message"`
+}
+
+// initModerator flags the peer as a moderator if it's logged in as a
+// predefined user who is one, either explicitly or by role.
+func (p *Peer) initModerator() {
+	for _, u := range p.room.PredefinedUsers {
+		if u.Name == p.Handle && u.Moderator {
+			p.moderator = true
+			return
+		}
+	}
+	p.moderator = p.hasRole(RoleModerator)
+}
+
+// IsModerator returns true if the handle is that of a predefined user of the
+// room who is a moderator, either explicitly or by role.
+func (r *Room) IsModerator(handle string) bool {
+	for _, u := range r.PredefinedUsers {
+		if u.Name != handle {
+			continue
+		}
+		if u.Moderator {
+			return true
+		}
+		for _, role := range u.Roles {
+			if role == RoleModerator {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// kick disconnects the peer with the given ID on a moderator's request,
+// removing its session and notifying the room. If ban is non-zero, the
+// peer's handle and IP are banned from the room for that long.
+func (r *Room) kick(p *Peer, id string, ban time.Duration) {
+	r.do(func() {
+		if !p.moderator {
+			p.SendData(r.makeErrorPayload(ErrNotModerator))
+			r.recordError(p, "kick by non-moderator")
+			return
+		}
+		if id == p.ID {
+			p.SendData(r.makeErrorPayload(ErrKickSelf))
+			return
+		}
+
+		var target *Peer
+		for peer := range r.peers {
+			if peer.ID == id {
+				target = peer
+				break
+			}
+		}
+		if target == nil {
+			p.SendData(r.makeErrorPayload(ErrUnknownPeer))
+			return
+		}
+
+		var (
+			action = "kicked"
+			msg    = r.hub.msg("notice.kicked", target.Handle, p.Handle)
+		)
+		if ban > 0 {
+			if err := r.Ban(target.Handle, ban); err != nil {
+				r.log.Errorf("error banning %s from %s: %v", target.Handle, r.ID, err)
+			}
+			if target.ip != "" {
+				if err := r.hub.Store.AddBan(r.ID, banIP+target.ip, ban); err != nil {
+					r.log.Errorf("error banning %s from %s: %v", target.ip, r.ID, err)
+				}
+			}
+			action = fmt.Sprintf("banned for %v", ban)
+			msg = r.hub.msg("notice.banned", target.Handle, p.Handle, ban.String())
+		}
+
+		// The peer is removed from the room when its listener sees the
+		// connection closing.
+		r.hub.Store.RemoveSession(target.ID, r.ID)
+		target.writeWSControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerKicked))
+		target.ws.Close()
+
+		r.emit(r.makePayload(payloadNotice{Message: msg}, TypeNotice), true)
+		r.log.Infof("%s@%s was %s from %s by %s", target.Handle, target.ID, action, r.ID, p.Handle)
+	})
+}
+
+// Prefixes of the subjects of bans in the store.
+const (
+	banHandle = "handle:"
+	banIP     = "ip:"
+)
+
+// Ban bans a handle from the room for the given duration.
+func (r *Room) Ban(handle string, dur time.Duration) error {
+	return r.hub.Store.AddBan(r.ID, banHandle+handle, dur)
+}
+
+// IsBanned checks whether a handle or an IP address is banned from the room.
+func (r *Room) IsBanned(handle, ip string) (bool, error) {
+	ok, err := r.hub.Store.IsBanned(r.ID, banHandle+handle)
+	if err != nil || ok || ip == "" {
+		return ok, err
+	}
+	return r.hub.Store.IsBanned(r.ID, banIP+ip)
+}
+
+// dispose disposes of the room on the request of its creator or a moderator.
+// Predefined rooms are only disposed of by admins. This is invoked by the
+// listener as the room's goroutine handles the disposal.
+func (r *Room) dispose(p *Peer) {
+	if r.Predefined {
+		p.SendData(r.makeErrorPayload(ErrPredefined))
+		return
+	}
+	if !p.creator && !p.moderator {
+		p.SendData(r.makeErrorPayload(ErrNotDisposer))
+		r.recordError(p, "dispose by non-creator")
+		return
+	}
+	r.Dispose()
+}
@@ -0,0 +1,94 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKick(t *testing.T) {
+	h := newTestHub(t, nil)
+	r := newTestRoom(t, h)
+
+	sessID, err := r.Login("password", "bob", "", time.Hour)
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+	ws, client, closeConn := newTestConn(t)
+	defer closeConn()
+	var (
+		mod    = joinTestPeer(r, "peer1", "alice")
+		target = joinTestPeerConn(r, sessID, "bob", ws)
+	)
+
+	// Only moderators can kick peers.
+	r.kick(mod, target.ID, 0)
+	if e := nextPayload(t, mod, TypeError).Error; e != ErrNotModerator.Error() {
+		t.Errorf("kick by non-moderator: got %q, want %q", e, ErrNotModerator)
+	}
+
+	mod.moderator = true
+	r.kick(mod, mod.ID, 0)
+	if e := nextPayload(t, mod, TypeError).Error; e != ErrKickSelf.Error() {
+		t.Errorf("kick of self: got %q, want %q", e, ErrKickSelf)
+	}
+
+	// Kicked peers are disconnected with the reason and lose their
+	// sessions, and the room is told.
+	r.kick(mod, target.ID, 0)
+	if reason := closeReason(t, client); reason != TypePeerKicked {
+		t.Errorf("close reason = %q, want %q", reason, TypePeerKicked)
+	}
+	nextPayload(t, mod, TypeNotice)
+	if s, _ := h.Store.GetSession(sessID, r.ID); s.ID != "" {
+		t.Error("kicked peer's session wasn't removed")
+	}
+}
+
+func TestBan(t *testing.T) {
+	h := newTestHub(t, nil)
+	r := newTestRoom(t, h)
+
+	ws, client, closeConn := newTestConn(t)
+	defer closeConn()
+	var (
+		mod    = joinTestPeer(r, "peer1", "alice")
+		target = joinTestPeerConn(r, "peer2", "bob", ws)
+	)
+	mod.moderator = true
+	target.ip = "1.1.1.1"
+
+	// Kicks with a duration ban the peer's handle and IP.
+	r.kick(mod, target.ID, time.Hour)
+	if reason := closeReason(t, client); reason != TypePeerKicked {
+		t.Errorf("close reason = %q, want %q", reason, TypePeerKicked)
+	}
+	nextPayload(t, mod, TypeNotice)
+
+	cases := []struct {
+		handle, ip string
+		want       bool
+	}{
+		{"bob", "", true},
+		{"bob", "2.2.2.2", true},
+		{"carol", "1.1.1.1", true},
+		{"carol", "2.2.2.2", false},
+		{"carol", "", false},
+	}
+	for _, c := range cases {
+		if got, err := r.IsBanned(c.handle, c.ip); err != nil || got != c.want {
+			t.Errorf("IsBanned(%q, %q) = %v, %v, want %v", c.handle, c.ip, got, err, c.want)
+		}
+	}
+
+	// Bans expire.
+	if err := r.Ban("dave", time.Millisecond*10); err != nil {
+		t.Fatalf("error banning: %v", err)
+	}
+	if ok, _ := r.IsBanned("dave", ""); !ok {
+		t.Error("handle isn't banned")
+	}
+	time.Sleep(time.Millisecond * 20)
+	if ok, _ := r.IsBanned("dave", ""); ok {
+		t.Error("handle is still banned after the ban expired")
+	}
+}
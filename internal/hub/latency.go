@@ -0,0 +1,78 @@
+package hub
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of recent samples that latency percentiles are computed over.
+const latencySamples = 1024
+
+// LatencyStats represents the percentiles of message delivery latencies,
+// from a message entering the broadcast path to it being written to a peer.
+type LatencyStats struct {
+	Samples int           `json:"samples"`
+	P50     time.Duration `json:"p50"`
+	P95     time.Duration `json:"p95"`
+	P99     time.Duration `json:"p99"`
+}
+
+// latencyTracker keeps the most recent latency samples in a ring.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+// record records a latency sample.
+func (l *latencyTracker) record(d time.Duration) {
+	l.mu.Lock()
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+	} else {
+		l.samples[l.next] = d
+		l.next = (l.next + 1) % latencySamples
+	}
+	l.mu.Unlock()
+}
+
+// get returns the percentiles of the recorded samples.
+func (l *latencyTracker) get() LatencyStats {
+	l.mu.Lock()
+	s := make([]time.Duration, len(l.samples))
+	copy(s, l.samples)
+	l.mu.Unlock()
+
+	if len(s) == 0 {
+		return LatencyStats{}
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+
+	pc := func(p int) time.Duration {
+		return s[(len(s)-1)*p/100]
+	}
+	return LatencyStats{
+		Samples: len(s),
+		P50:     pc(50),
+		P95:     pc(95),
+		P99:     pc(99),
+	}
+}
+
+// recordLatency records the delivery latency of a message broadcast at t.
+func (r *Room) recordLatency(t time.Time) {
+	d := time.Since(t)
+	r.latency.record(d)
+	r.hub.latency.record(d)
+}
+
+// LatencyStats returns the message delivery latencies across all rooms.
+func (h *Hub) LatencyStats() LatencyStats {
+	return h.latency.get()
+}
+
+// LatencyStats returns the message delivery latencies in the room.
+func (r *Room) LatencyStats() LatencyStats {
+	return r.latency.get()
+}
@@ -0,0 +1,72 @@
+package hub
+
+import (
+	"regexp"
+	"strings"
+)
+
+var reMention = regexp.MustCompile(`@([^\s@]+)`)
+
+// payloadMention tells a peer that it was mentioned in a message.
+type payloadMention struct {
+	ID         string `json:"id"`
+	PeerID     string `json:"peer_id"`
+	PeerHandle string `json:"peer_handle"`
+	Channel    string `json:"channel,omitempty"`
+}
+
+// mentions returns the lowercased handles @mentioned in a message, ignoring
+// mentions inside code spans.
+func mentions(msg string) map[string]bool {
+	msg = reMarkdownCode.ReplaceAllString(msg, "")
+
+	out := make(map[string]bool)
+	for _, m := range reMention.FindAllStringSubmatch(msg, -1) {
+		// Trailing punctuation isn't part of the handle.
+		h := strings.TrimRight(m[1], ".,:;!?)")
+		if h != "" {
+			out[strings.ToLower(h)] = true
+		}
+	}
+	return out
+}
+
+// notifyMentions sends a mention event to the connected peers mentioned in a
+// message from the peer p. Only peers subscribed to the message's channel are
+// notified of channel messages. It's only called from the room's goroutine.
+func (r *Room) notifyMentions(p *Peer, id string, m chatMessage) {
+	handles := mentions(m.msg)
+	if len(handles) == 0 {
+		return
+	}
+
+	var b []byte
+	for peer := range r.peers {
+		if peer == p || !handles[strings.ToLower(peer.Handle)] {
+			continue
+		}
+		if m.channel != "" && !peer.channels[m.channel] {
+			continue
+		}
+		if b == nil {
+			b = r.makePayload(payloadMention{
+				ID:         id,
+				PeerID:     p.ID,
+				PeerHandle: p.Handle,
+				Channel:    m.channel,
+			}, TypeMention)
+		}
+		peer.SendData(b)
+	}
+
+	// Push notifications reach mentioned users with the room closed too.
+	// Channel messages aren't pushed as they may not be subscribed to it.
+	if m.channel == "" {
+		title := r.hub.msg("push.mention", p.Handle, r.Name)
+		for h := range handles {
+			if h != strings.ToLower(p.Handle) {
+				r.pushNotify(h, title, m.msg)
+			}
+		}
+	}
+}
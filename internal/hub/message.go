@@ -0,0 +1,398 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Errors sent back to peers whose messages are rejected.
+var (
+	ErrReplyTooDeep = errors.New("reply chain is too deep")
+	ErrMsgTooLong   = errors.New("message is too long")
+	ErrRoomLocked   = errors.New("room is locked")
+	ErrBurnDisabled = errors.New("burn after reading messages are disabled")
+	ErrBurnTooLong  = errors.New("burn after reading duration is too long")
+	ErrEditDisabled = errors.New("message editing is disabled")
+	ErrInvalidEdit  = errors.New("edited message doesn't exist")
+	ErrNotAuthor    = errors.New("only the author can edit a message")
+	ErrEditExpired  = errors.New("message is too old to be edited")
+	ErrNotDeletable = errors.New("only the author or a moderator can delete a message")
+	ErrUnknownPeer  = errors.New("peer isn't in the room")
+)
+
+// RoleModerator is the role of predefined users who are moderators.
+const RoleModerator = "moderator"
+
+// msgMeta is what a room keeps track of for its recent chat messages.
+type msgMeta struct {
+	authorID string
+	replyTo  string
+	channel  string
+	sentAt   time.Time
+
+	// Number of messages up the reply chain.
+	depth int
+}
+
+// payloadMsgEdit is the new text of an edited message.
+type payloadMsgEdit struct {
+	ID  string `json:"id"`
+	Msg string `json:"message"`
+}
+
+// payloadMsgDirect is a message sent to a single peer.
+type payloadMsgDirect struct {
+	payloadMsgChat
+	To string `json:"to"`
+}
+
+// chatMessage is a chat message sent by a peer.
+type chatMessage struct {
+	msg     string
+	replyTo string
+	channel string
+
+	// Burn after reading duration.
+	burn time.Duration
+
+	// Posted with /me and sent as an action.
+	action bool
+}
+
+// msgType returns the payload type of the chat message.
+func (m chatMessage) msgType() string {
+	if m.action {
+		return TypeAction
+	}
+	return TypeMessage
+}
+
+// isChatType returns true if a payload type is that of a chat message that
+// can be edited and deleted.
+func isChatType(typ string) bool {
+	return typ == TypeMessage || typ == TypeAction
+}
+
+// parseChatMessage reads a chat message sent by a peer, which is either the
+// plain text or an object with the text and an optional message to reply to
+// and channel to send to.
+func parseChatMessage(data interface{}) (chatMessage, bool) {
+	switch d := data.(type) {
+	case string:
+		return chatMessage{msg: d}, true
+	case map[string]interface{}:
+		msg, ok := d["message"].(string)
+		if !ok {
+			return chatMessage{}, false
+		}
+		replyTo, _ := d["reply_to"].(string)
+		channel, _ := d["channel"].(string)
+		burn, _ := d["burn"].(float64)
+		if burn < 0 {
+			return chatMessage{}, false
+		}
+		return chatMessage{
+			msg:     msg,
+			replyTo: replyTo,
+			channel: channel,
+			burn:    time.Duration(burn) * time.Second,
+		}, true
+	}
+	return chatMessage{}, false
+}
+
+// postMessage validates a chat message from a peer and broadcasts it to the
+// room with a server assigned ID.
+func (r *Room) postMessage(p *Peer, m chatMessage) {
+	r.do(func() {
+		if r.isLocked() {
+			p.SendData(r.makeErrorPayload(ErrRoomLocked))
+			return
+		}
+
+		// Peers can only post to channels they're subscribed to.
+		if m.channel != "" {
+			if !r.hub.cfg.Channels {
+				p.SendData(r.makeErrorPayload(ErrChannelsDisabled))
+				return
+			}
+			if !p.channels[m.channel] {
+				p.SendData(r.makeErrorPayload(ErrNotInChannel))
+				r.recordError(p, "invalid channel")
+				return
+			}
+		}
+
+		// Burnt messages are never recorded, and the TTL is bounded.
+		if m.burn > 0 {
+			if r.maxBurnTTL <= 0 {
+				p.SendData(r.makeErrorPayload(ErrBurnDisabled))
+				return
+			}
+			if m.burn > r.maxBurnTTL {
+				p.SendData(r.makeErrorPayload(ErrBurnTooLong))
+				return
+			}
+		}
+
+		// Replies can only reference recent messages in the same channel.
+		// Other references are dropped and the message posted as is.
+		depth := 0
+		if m.replyTo != "" {
+			parent, ok := r.messages[m.replyTo]
+			if !ok || !r.hub.cfg.Replies || parent.channel != m.channel {
+				m.replyTo = ""
+			}
+
+			// Depths are tracked along with messages so that the chain
+			// doesn't have to be walked (its head may be long gone).
+			if m.replyTo != "" {
+				depth = parent.depth + 1
+			}
+			if max := r.hub.cfg.MaxReplyDepth; max > 0 && depth > max {
+				p.SendData(r.makeErrorPayload(ErrReplyTooDeep))
+				r.recordError(p, "reply too deep")
+				return
+			}
+		}
+
+		id, err := GenerateGUID(16)
+		if err != nil {
+			r.log.Errorf("error generating message ID: %v", err)
+			return
+		}
+		if m.burn == 0 {
+			r.trackMessage(id, msgMeta{
+				authorID: p.ID,
+				replyTo:  m.replyTo,
+				channel:  m.channel,
+				sentAt:   time.Now(),
+				depth:    depth,
+			})
+		}
+
+		b := r.makePayload(payloadMsgChat{
+			ID:         id,
+			PeerID:     p.ID,
+			PeerHandle: p.Handle,
+			Msg:        r.filterMessage(m.msg),
+			ReplyTo:    m.replyTo,
+			ReplyDepth: depth,
+			Seq:        p.nextSeq(),
+			Channel:    m.channel,
+			Burn:       int(m.burn / time.Second),
+		}, m.msgType())
+
+		switch {
+		case m.channel != "":
+			r.emitChannel(b, m.channel)
+		case m.burn > 0:
+			r.emit(b, false)
+		default:
+			r.emit(b, true)
+		}
+		r.numMessages++
+		r.notifyMentions(p, id, m)
+
+		// Tell clients to remove burnt messages once they expire.
+		if m.burn > 0 {
+			r.burnTimers[id] = time.AfterFunc(m.burn, func() {
+				r.do(func() {
+					delete(r.burnTimers, id)
+					r.untrackMessage(id)
+					r.deleteMessage(id, m.channel)
+				})
+			})
+		}
+	})
+}
+
+// editMessage replaces the text of a message posted by the peer, rewriting
+// the cached copy and telling peers to update it.
+func (r *Room) editMessage(p *Peer, id, msg string) {
+	r.do(func() {
+		if r.isLocked() {
+			p.SendData(r.makeErrorPayload(ErrRoomLocked))
+			return
+		}
+		if r.hub.cfg.EditWindow <= 0 {
+			p.SendData(r.makeErrorPayload(ErrEditDisabled))
+			return
+		}
+
+		meta, ok := r.messages[id]
+		if !ok {
+			p.SendData(r.makeErrorPayload(ErrInvalidEdit))
+			r.recordError(p, "invalid edit")
+			return
+		}
+		if meta.authorID != p.ID {
+			p.SendData(r.makeErrorPayload(ErrNotAuthor))
+			r.recordError(p, "edit by non-author")
+			return
+		}
+		if time.Since(meta.sentAt) > r.hub.cfg.EditWindow {
+			p.SendData(r.makeErrorPayload(ErrEditExpired))
+			return
+		}
+
+		e := payloadMsgEdit{ID: id, Msg: r.filterMessage(msg)}
+		b := r.makePayload(e, TypeMessageEdit)
+		if meta.channel != "" {
+			r.emitChannel(b, meta.channel)
+			return
+		}
+
+		for i, c := range r.payloadCache {
+			if out, ok := applyEdit(c, e); ok {
+				r.payloadCache[i] = out
+				break
+			}
+		}
+		r.editPin(e)
+		r.emit(b, true)
+	})
+}
+
+// applyEdit replaces the text of a recorded chat message payload if it's the
+// one that was edited.
+func applyEdit(b []byte, e payloadMsgEdit) ([]byte, bool) {
+	var m struct {
+		Seq         uint64                     `json:"seq,omitempty"`
+		Type        string                     `json:"type"`
+		Timestamp   time.Time                  `json:"timestamp"`
+		TimestampMS int64                      `json:"timestamp_ms,omitempty"`
+		Data        map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil || !isChatType(m.Type) {
+		return b, false
+	}
+	var id string
+	if err := json.Unmarshal(m.Data["id"], &id); err != nil || id != e.ID {
+		return b, false
+	}
+
+	msg, _ := json.Marshal(e.Msg)
+	m.Data["message"] = msg
+	out, err := json.Marshal(m)
+	if err != nil {
+		return b, false
+	}
+	return out, true
+}
+
+// removeMessage deletes a message posted by the peer, or by anyone if the peer
+// is a moderator, along with its edits from the cache and the store's history
+// and tells peers to remove it. The authors of messages that are no longer
+// tracked are looked up in the history. Deleting a message that's already
+// gone is a no-op.
+func (r *Room) removeMessage(p *Peer, id string) {
+	r.do(func() {
+		meta, ok := r.messages[id]
+		if !ok {
+			b := r.findMessage(id)
+			if b == nil {
+				return
+			}
+			var m struct {
+				Data payloadMsgChat `json:"data"`
+			}
+			json.Unmarshal(b, &m)
+			meta = msgMeta{authorID: m.Data.PeerID}
+		}
+		if meta.authorID != p.ID && !p.moderator {
+			p.SendData(r.makeErrorPayload(ErrNotDeletable))
+			r.recordError(p, "delete by non-author")
+			return
+		}
+		r.untrackMessage(id)
+		r.purgeMessage(id)
+		if r.hub.cfg.HistorySize > 0 {
+			r.queueHistory(historyOp{id: id, del: true})
+		}
+		r.removePin(id)
+		if t, ok := r.burnTimers[id]; ok {
+			t.Stop()
+			delete(r.burnTimers, id)
+		}
+		r.deleteMessage(id, meta.channel)
+	})
+}
+
+// purgeMessage removes a deleted message and its edits from the cache. It's
+// only called from the room's goroutine.
+func (r *Room) purgeMessage(id string) {
+	out := r.payloadCache[:0]
+	for _, b := range r.payloadCache {
+		var m struct {
+			Type string          `json:"type"`
+			Data payloadMutation `json:"data"`
+		}
+		if json.Unmarshal(b, &m) == nil && (isChatType(m.Type) || m.Type == TypeMessageEdit) && m.Data.ID == id {
+			continue
+		}
+		out = append(out, b)
+	}
+	r.payloadCache = out
+}
+
+// sendDirect sends a message to the peer with the given ID, echoing it back
+// to the sender. Direct messages are never broadcast or recorded. It's only
+// called from the room's goroutine.
+func (r *Room) sendDirect(from *Peer, to, msg string) {
+	var toPeer *Peer
+	for p := range r.peers {
+		if p.ID == to {
+			toPeer = p
+			break
+		}
+	}
+	if toPeer == nil {
+		from.SendData(r.makeErrorPayload(ErrUnknownPeer))
+		return
+	}
+
+	b := r.makePayload(payloadMsgDirect{
+		payloadMsgChat: payloadMsgChat{
+			PeerID:     from.ID,
+			PeerHandle: from.Handle,
+			Msg:        r.filterMessage(msg),
+		},
+		To: to,
+	}, TypeDirectMessage)
+	toPeer.SendData(b)
+	if toPeer != from {
+		from.SendData(b)
+		r.pushNotify(toPeer.Handle, r.hub.msg("push.direct", from.Handle, r.Name), r.filterMessage(msg))
+	}
+}
+
+// deleteMessage tells peers to remove a message. It's only called from the
+// room's goroutine.
+func (r *Room) deleteMessage(id, channel string) {
+	b := r.makePayload(struct {
+		ID string `json:"id"`
+	}{id}, TypeMessageDelete)
+	if channel != "" {
+		r.emitChannel(b, channel)
+		return
+	}
+	r.emit(b, false)
+}
+
+// trackMessage records a message's metadata, forgetting the oldest messages
+// beyond the number of cached messages.
+func (r *Room) trackMessage(id string, m msgMeta) {
+	max := r.hub.cfg.MaxCachedMessages
+	if max < 100 {
+		max = 100
+	}
+	if len(r.msgOrder) >= max {
+		delete(r.messages, r.msgOrder[0])
+		r.msgOrder = r.msgOrder[1:]
+	}
+
+	r.messages[id] = m
+	r.msgOrder = append(r.msgOrder, id)
+}
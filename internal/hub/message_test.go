@@ -0,0 +1,102 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEditMessage(t *testing.T) {
+	h := newTestHub(t, func(c *Config) { c.EditWindow = time.Minute })
+	r := newTestRoom(t, h)
+	var (
+		pa = joinTestPeer(r, "peer1", "alice")
+		pb = joinTestPeer(r, "peer2", "bob")
+	)
+
+	r.postMessage(pa, chatMessage{msg: "helo"})
+	msg := nextPayload(t, pb, TypeMessage).Data
+
+	// Only the author can edit a message.
+	r.editMessage(pb, msg.ID, "hi")
+	if e := nextPayload(t, pb, TypeError).Error; e != ErrNotAuthor.Error() {
+		t.Errorf("edit by non-author: got %q, want %q", e, ErrNotAuthor)
+	}
+	r.editMessage(pa, "unknown", "hi")
+	if e := nextPayload(t, pa, TypeError).Error; e != ErrInvalidEdit.Error() {
+		t.Errorf("edit of unknown message: got %q, want %q", e, ErrInvalidEdit)
+	}
+
+	// Edits are sent to all peers and applied to the history.
+	r.editMessage(pa, msg.ID, "hello")
+	if e := nextPayload(t, pb, TypeMessageEdit).Data; e.ID != msg.ID || e.Msg != "hello" {
+		t.Errorf("edit = %+v", e)
+	}
+	p := joinTestPeer(r, "peer3", "carol")
+	runInRoom(r, func() { r.sendHistory(p) })
+	if m := nextPayload(t, p, TypeMessage).Data; m.Msg != "hello" {
+		t.Errorf("history has %q, want the edit", m.Msg)
+	}
+
+	// Messages can only be edited within the edit window.
+	runInRoom(r, func() {
+		m := r.messages[msg.ID]
+		m.sentAt = time.Now().Add(-time.Minute * 2)
+		r.messages[msg.ID] = m
+	})
+	r.editMessage(pa, msg.ID, "hey")
+	if e := nextPayload(t, pa, TypeError).Error; e != ErrEditExpired.Error() {
+		t.Errorf("expired edit: got %q, want %q", e, ErrEditExpired)
+	}
+}
+
+func TestRemoveMessage(t *testing.T) {
+	h := newTestHub(t, func(c *Config) { c.HistorySize = 10 })
+	r := newTestRoom(t, h)
+	var (
+		pa = joinTestPeer(r, "peer1", "alice")
+		pb = joinTestPeer(r, "peer2", "bob")
+	)
+
+	r.postMessage(pa, chatMessage{msg: "one"})
+	msg := nextPayload(t, pb, TypeMessage).Data
+	r.postMessage(pa, chatMessage{msg: "two"})
+	nextPayload(t, pb, TypeMessage)
+
+	// Only the author or a moderator can delete a message.
+	r.removeMessage(pb, msg.ID)
+	if e := nextPayload(t, pb, TypeError).Error; e != ErrNotDeletable.Error() {
+		t.Errorf("delete by non-author: got %q, want %q", e, ErrNotDeletable)
+	}
+
+	r.removeMessage(pa, msg.ID)
+	if d := nextPayload(t, pb, TypeMessageDelete).Data; d.ID != msg.ID {
+		t.Errorf("deleted %q, want %q", d.ID, msg.ID)
+	}
+
+	// Deleting it again is a no-op.
+	r.removeMessage(pa, msg.ID)
+	noPayload(t, pb, TypeMessageDelete)
+
+	// It's gone from the stored history.
+	runInRoom(r, r.flushHistory)
+	msgs, err := h.Store.GetMessages(r.ID, 10)
+	if err != nil {
+		t.Fatalf("error getting history: %v", err)
+	}
+	for _, b := range foldHistory(msgs) {
+		var m testPayload
+		if json.Unmarshal(b, &m); m.Data.ID == msg.ID {
+			t.Errorf("deleted message is still in the history: %s", b)
+		}
+	}
+
+	// Moderators can delete anyone's messages.
+	pb.moderator = true
+	r.postMessage(pa, chatMessage{msg: "three"})
+	msg = nextPayload(t, pb, TypeMessage).Data
+	r.removeMessage(pb, msg.ID)
+	if d := nextPayload(t, pb, TypeMessageDelete).Data; d.ID != msg.ID {
+		t.Errorf("deleted %q, want %q", d.ID, msg.ID)
+	}
+}
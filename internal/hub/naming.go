@@ -0,0 +1,89 @@
+package hub
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Ways of handling a new room's name colliding with an active room's.
+const (
+	NameCollisionAllow  = "allow"
+	NameCollisionReject = "reject"
+	NameCollisionSuffix = "suffix"
+)
+
+// ErrRoomNameTaken is returned when a room name collides with an active room's.
+var ErrRoomNameTaken = errors.New("room name is taken")
+
+var (
+	nameAdjectives = []string{"amber", "brisk", "calm", "dusty", "eager", "fuzzy",
+		"gentle", "hidden", "icy", "jolly", "keen", "lucky", "misty", "quiet", "rusty",
+		"silent", "tidy", "velvet", "witty", "young"}
+	nameNouns = []string{"badger", "canyon", "dune", "ember", "falcon", "grove",
+		"harbor", "island", "jungle", "lagoon", "meadow", "nebula", "orchid", "otter",
+		"pebble", "raven", "summit", "tundra", "willow", "zephyr"}
+)
+
+// NormalizeRoomName trims a room name and collapses its whitespace.
+func NormalizeRoomName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// ResolveRoomName returns the name for a new room. An empty name is replaced
+// with a random friendly one if configured, and a name colliding with an
+// active room's is rejected or suffixed as configured.
+func (h *Hub) ResolveRoomName(name string) (string, error) {
+	if name == "" {
+		if !h.cfg.AutoRoomNames {
+			return "", nil
+		}
+		name = randomRoomName()
+	}
+
+	if h.cfg.RoomNameCollision == "" || h.cfg.RoomNameCollision == NameCollisionAllow {
+		return name, nil
+	}
+
+	if !h.roomNameExists(name) {
+		return name, nil
+	}
+	if h.cfg.RoomNameCollision == NameCollisionReject {
+		return "", ErrRoomNameTaken
+	}
+
+	for i := 2; i <= 100; i++ {
+		n := fmt.Sprintf("%s-%d", name, i)
+		if !h.roomNameExists(n) {
+			return n, nil
+		}
+	}
+	return "", ErrRoomNameTaken
+}
+
+// roomNameExists checks if an active room has the given name (case insensitive).
+func (h *Hub) roomNameExists(name string) bool {
+	h.mut.RLock()
+	defer h.mut.RUnlock()
+	for _, r := range h.rooms {
+		if strings.EqualFold(r.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// randomRoomName generates a friendly room name like "misty-otter".
+func randomRoomName() string {
+	return pickWord(nameAdjectives) + "-" + pickWord(nameNouns)
+}
+
+func pickWord(words []string) string {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+	if err != nil {
+		return words[0]
+	}
+	return words[n.Int64()]
+}
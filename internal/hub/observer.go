@@ -0,0 +1,50 @@
+package hub
+
+// Observe subscribes to the room's broadcasts without joining it as a peer.
+// The cached messages are replayed into the returned channel first. The
+// channel is closed when the room is disposed or after the returned stop
+// function is called, which has to be called once the observer is done.
+func (r *Room) Observe() (<-chan []byte, func()) {
+	// Leave room for the replayed cache on top of the regular queue.
+	ch := make(chan []byte, 100+r.hub.cfg.MaxCachedMessages)
+	ok := r.do(func() {
+		r.observers[ch] = true
+		for _, b := range r.history() {
+			ch <- b
+		}
+	})
+	if !ok {
+		close(ch)
+		return ch, func() {}
+	}
+
+	// Observers left in a stopped room have been closed with it.
+	stop := func() {
+		r.do(func() {
+			if _, ok := r.observers[ch]; ok {
+				delete(r.observers, ch)
+				close(ch)
+			}
+		})
+	}
+	return ch, stop
+}
+
+// sendObservers fans out a payload to all observers. Observers that can't
+// keep up miss messages rather than blocking the room.
+func (r *Room) sendObservers(b []byte) {
+	for ch := range r.observers {
+		select {
+		case ch <- b:
+		default:
+		}
+	}
+}
+
+// closeObservers closes and removes all observers.
+func (r *Room) closeObservers() {
+	for ch := range r.observers {
+		delete(r.observers, ch)
+		close(ch)
+	}
+}
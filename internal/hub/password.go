@@ -0,0 +1,198 @@
+package hub
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Algorithms that room passwords are hashed with.
+const (
+	PasswordBcrypt   = "bcrypt"
+	PasswordArgon2id = "argon2id"
+)
+
+// Hashing parameters used when they're not configured. The bcrypt cost is
+// the one rooms were always hashed with.
+const (
+	defaultBcryptCost    = 8
+	defaultArgon2Time    = 1
+	defaultArgon2Memory  = 64 * 1024
+	defaultArgon2Threads = 2
+
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// Defaults of the password checks on room creation.
+const (
+	defaultMinPasswordLen = 6
+	maxPasswordLen        = 100
+)
+
+// argon2Params are the parameters of an argon2id hash.
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// Argon2id hashes are stored in the PHC string format.
+var argon2Prefix = []byte("$argon2id$")
+
+// hashPassword hashes a room password with the configured algorithm.
+func (h *Hub) hashPassword(password string) ([]byte, error) {
+	if h.cfg.PasswordHash != PasswordArgon2id {
+		return bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost())
+	}
+
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	p := h.argon2Params()
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, argon2KeyLen)
+
+	enc := base64.RawStdEncoding
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.memory, p.time, p.threads,
+		enc.EncodeToString(salt), enc.EncodeToString(key))), nil
+}
+
+// needsRehash checks whether a hash was made with an algorithm or
+// parameters other than the configured ones.
+func (h *Hub) needsRehash(hash []byte) bool {
+	if !bytes.HasPrefix(hash, argon2Prefix) {
+		if h.cfg.PasswordHash == PasswordArgon2id {
+			return true
+		}
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost != h.bcryptCost()
+	}
+
+	if h.cfg.PasswordHash != PasswordArgon2id {
+		return true
+	}
+	p, _, _, err := parseArgon2(hash)
+	return err != nil || p != h.argon2Params()
+}
+
+func (h *Hub) bcryptCost() int {
+	if h.cfg.BcryptCost > 0 {
+		return h.cfg.BcryptCost
+	}
+	return defaultBcryptCost
+}
+
+func (h *Hub) argon2Params() argon2Params {
+	p := argon2Params{
+		time:    defaultArgon2Time,
+		memory:  defaultArgon2Memory,
+		threads: defaultArgon2Threads,
+	}
+	if h.cfg.Argon2Time > 0 {
+		p.time = uint32(h.cfg.Argon2Time)
+	}
+	if h.cfg.Argon2Memory > 0 {
+		p.memory = uint32(h.cfg.Argon2Memory)
+	}
+	if h.cfg.Argon2Threads > 0 {
+		p.threads = uint8(h.cfg.Argon2Threads)
+	}
+	return p
+}
+
+// isPublic returns true if a room password hash is of an empty password.
+// The result is cached by hash as the check costs a full hash.
+func (h *Hub) isPublic(hash []byte) bool {
+	if v, ok := h.publicHashes.Load(string(hash)); ok {
+		return v.(bool)
+	}
+	ok := checkPassword(hash, "")
+	h.publicHashes.Store(string(hash), ok)
+	return ok
+}
+
+// checkPassword checks a password against its bcrypt or argon2id hash.
+func checkPassword(hash []byte, password string) bool {
+	if !bytes.HasPrefix(hash, argon2Prefix) {
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	}
+
+	p, salt, key, err := parseArgon2(hash)
+	if err != nil {
+		return false
+	}
+	k := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(k, key) == 1
+}
+
+// parseArgon2 parses an argon2id hash in the PHC string format.
+func parseArgon2(hash []byte) (argon2Params, []byte, []byte, error) {
+	var (
+		p     argon2Params
+		v     int
+		parts = strings.Split(string(hash), "$")
+	)
+	if len(parts) != 6 {
+		return p, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &v); err != nil || v != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id parameters: %v", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	return p, salt, key, nil
+}
+
+// CheckPasswordStrength checks a new room password against the configured
+// minimum length and number of character classes (lowercase, uppercase,
+// digits, and others).
+func (h *Hub) CheckPasswordStrength(password string) error {
+	min := h.cfg.RoomPasswordMinLen
+	if min == 0 {
+		min = defaultMinPasswordLen
+	}
+	if len(password) < min || len(password) > maxPasswordLen {
+		return fmt.Errorf("invalid password (%d - %d chars)", min, maxPasswordLen)
+	}
+
+	if h.cfg.RoomPasswordClasses == 0 {
+		return nil
+	}
+	var lower, upper, digit, other int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < h.cfg.RoomPasswordClasses {
+		return fmt.Errorf("password should have at least %d of lowercase and uppercase letters, digits, and symbols",
+			h.cfg.RoomPasswordClasses)
+	}
+	return nil
+}
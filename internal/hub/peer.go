@@ -2,13 +2,27 @@ package hub
 
 import (
 	"encoding/json"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/internal/log"
 )
 
 // Peer represents an individual peer / connection into a room.
 type Peer struct {
+	// Sequence number of the last message broadcast from the peer.
+	// Kept first for 64-bit alignment of atomic operations.
+	seq uint64
+
+	// Set to 1 when the peer is marked as away for idling.
+	idle int32
+
+	// Set to 1 when the peer is dropped for not keeping up with its queue
+	// or a failed write, so that the drop is only recorded once.
+	dropped int32
+
 	// Peer's chat handle.
 	ID     string
 	Handle string
@@ -16,29 +30,93 @@ type Peer struct {
 	ws *websocket.Conn
 
 	// Channel for outbound messages.
-	dataQ chan []byte
+	dataQ chan outMsg
 
 	// Peer's room.
 	room *Room
 
-	// Rate limiting.
-	numMessages int
-	lastMessage time.Time
+	// Logger that adds the room's and peer's IDs to structured entries.
+	log *log.Logger
+
+	// Rate limiting of messages and uploads, and the throttling of status,
+	// avatar and upload progress updates.
+	limiter       *rateLimiter
+	updateLimiter *rateLimiter
+
+	// Resume token presented on connection and the one issued to the peer,
+	// and the sequence number of the last message the peer received before
+	// reconnecting.
+	resumeWith  string
+	resumeToken string
+	lastSeq     uint64
+
+	// Channels the peer is subscribed to. Only accessed by the room.
+	channels map[string]bool
+
+	// First post verification. Only accessed by the listener.
+	verified     bool
+	verifyAnswer string
+	heldMsg      *chatMessage
+
+	// Closed when the writer exits.
+	done chan struct{}
+
+	// Moderators can kick peers and delete any message.
+	moderator bool
+
+	// Whether the peer created the room, which lets it dispose of the room.
+	creator bool
+
+	// IP address the peer is connected from.
+	ip string
+
+	// Peer's status, and whether it was set for idling. Only accessed by
+	// the room.
+	status   string
+	autoAway bool
+
+	// Avatar URL set by the peer. Only accessed by the room.
+	avatar string
+
+	// Marks the peer as away when it fires. Only accessed by the listener.
+	idleTimer *time.Timer
+
+	// Tells the room that the peer stopped typing when it fires. Only
+	// accessed by the listener.
+	typingTimer *time.Timer
+}
+
+// outMsg is a payload queued to be written to a peer.
+type outMsg struct {
+	data []byte
+
+	// Time the payload entered the broadcast path if latency is tracked.
+	at time.Time
+
+	// Close frame to write, after which the writer exits.
+	close []byte
 }
 
 type peerInfo struct {
 	ID     string `json:"id"`
 	Handle string `json:"handle"`
+	Status string `json:"status"`
 }
 
 // newPeer returns a new instance of Peer.
 func newPeer(id, handle string, ws *websocket.Conn, room *Room) *Peer {
 	return &Peer{
-		ID:     id,
-		Handle: handle,
-		ws:     ws,
-		dataQ:  make(chan []byte, 100),
-		room:   room,
+		ID:      id,
+		Handle:  handle,
+		ws:      ws,
+		dataQ:   make(chan outMsg, room.hub.peerQueueSize()),
+		room:    room,
+		log:     room.log.With("peer_id", id),
+		status:  StatusOnline,
+		done:    make(chan struct{}),
+		limiter: newRateLimiter(room.rateLimitMessages, room.rateLimitInterval),
+
+		updateLimiter: newRateLimiter(room.rateLimitMessages, room.rateLimitInterval),
 	}
 }
 
@@ -46,12 +124,37 @@ func newPeer(id, handle string, ws *websocket.Conn, room *Room) *Peer {
 // WS connection until its dropped or there's an error. This should be invoked
 // as a goroutine.
 func (p *Peer) RunListener() {
-	p.ws.SetReadLimit(int64(p.room.hub.cfg.MaxMessageLen))
+	// JSON escaping can inflate the text up to six times. Messages that are
+	// read but too long are rejected with an error, while frames over the
+	// limit close the connection.
+	p.ws.SetReadLimit(int64(p.room.maxMessageLen)*6 + 1024)
+
+	// Peers that don't answer pings in time are dropped.
+	if p.room.hub.cfg.PingInterval > 0 {
+		wait := p.room.hub.cfg.PingInterval + p.room.hub.cfg.WSTimeout
+		p.ws.SetReadDeadline(time.Now().Add(wait))
+		p.ws.SetPongHandler(func(string) error {
+			return p.ws.SetReadDeadline(time.Now().Add(wait))
+		})
+	}
+
+	// Peers that don't send anything for a while are marked as away.
+	if idle := p.room.hub.cfg.IdleTimeout; idle > 0 {
+		p.idleTimer = time.AfterFunc(idle, p.idled)
+		defer p.idleTimer.Stop()
+	}
+	defer p.stopTyping()
+
 	for {
-		_, m, err := p.ws.ReadMessage()
+		typ, m, err := p.ws.ReadMessage()
 		if err != nil {
 			break
 		}
+		p.active()
+		if typ == websocket.BinaryMessage {
+			p.processBinary(m)
+			continue
+		}
 		p.processMessage(m)
 	}
 
@@ -63,25 +166,90 @@ func (p *Peer) RunListener() {
 // RunWriter is a blocking function that writes messages in a peer's queue to the
 // peer's WS connection. This should be invoked as a goroutine.
 func (p *Peer) RunWriter() {
+	defer close(p.done)
 	defer p.ws.Close()
+
+	// Ping the peer periodically to detect dead connections.
+	var ping <-chan time.Time
+	if p.room.hub.cfg.PingInterval > 0 {
+		t := time.NewTicker(p.room.hub.cfg.PingInterval)
+		defer t.Stop()
+		ping = t.C
+	}
+
 	for {
 		select {
+		case <-ping:
+			if err := p.ws.WriteControl(websocket.PingMessage, nil,
+				time.Now().Add(p.room.hub.cfg.WSTimeout)); err != nil {
+				return
+			}
+
 		// Wait for outgoing message to appear in the channel.
 		case message, ok := <-p.dataQ:
 			if !ok {
 				p.writeWSData(websocket.CloseMessage, []byte{})
 				return
 			}
-			if err := p.writeWSData(websocket.TextMessage, message); err != nil {
+			if message.close != nil {
+				p.writeWSData(websocket.CloseMessage, message.close)
+				return
+			}
+			if err := p.writeWSData(websocket.TextMessage, message.data); err != nil {
+				// The peer is too slow or gone.
+				p.drop()
 				return
 			}
+			if !message.at.IsZero() {
+				p.room.recordLatency(message.at)
+			}
 		}
 	}
 }
 
 // SendData queues a message to be written to the peer's WS.
 func (p *Peer) SendData(b []byte) {
-	p.dataQ <- b
+	p.queue(outMsg{data: b})
+}
+
+// sendBroadcast queues a broadcast message that entered the broadcast
+// path at t to be written to the peer's WS.
+func (p *Peer) sendBroadcast(b []byte, t time.Time) {
+	p.queue(outMsg{data: b, at: t})
+}
+
+// queue queues a message without ever blocking the caller, which is usually
+// the room's goroutine. Peers whose queue is full can't keep up and are
+// dropped instead of holding up the room.
+func (p *Peer) queue(m outMsg) {
+	select {
+	case p.dataQ <- m:
+	default:
+		if atomic.LoadInt32(&p.dropped) == 0 {
+			p.log.Debugf("disconnecting slow peer %s@%s from %s", p.Handle, p.ID, p.room.ID)
+		}
+		p.drop()
+	}
+}
+
+// drop records the peer as dropped along with the message that failed and
+// those left in its queue, and closes its connection. The listener then
+// exits and queues the peer's TypePeerLeave.
+func (p *Peer) drop() {
+	if !atomic.CompareAndSwapInt32(&p.dropped, 0, 1) {
+		return
+	}
+	p.room.recordDrop(p, uint64(len(p.dataQ))+1)
+	p.ws.Close()
+}
+
+// nextSeq returns the sequence number for the next message broadcast from
+// the peer, or 0 if sequencing is disabled.
+func (p *Peer) nextSeq() uint64 {
+	if !p.room.hub.cfg.PeerSequence {
+		return 0
+	}
+	return atomic.AddUint64(&p.seq, 1)
 }
 
 // writeWSData writes the given payload to the peer's WS connection.
@@ -95,39 +263,94 @@ func (p *Peer) writeWSControl(control int, payload []byte) error {
 	return p.ws.WriteControl(websocket.CloseMessage, payload, time.Time{})
 }
 
+// postChat posts a chat message from the peer, holding it back if the peer
+// has to be verified first.
+func (p *Peer) postChat(m chatMessage) {
+	if p.needsVerification() {
+		// Only the first message is held back.
+		if p.heldMsg == nil {
+			p.challenge(m)
+		}
+		return
+	}
+	p.room.postMessage(p, m)
+}
+
 // processMessage processes incoming messages from peers.
 func (p *Peer) processMessage(b []byte) {
 	var m payloadMsgWrap
 
 	if err := json.Unmarshal(b, &m); err != nil {
 		// TODO: Respond
+		p.room.recordError(p, "invalid message")
 		return
 	}
 
 	switch m.Type {
 	// Message to the room.
 	case TypeMessage:
-		// Check rate limits and update counters.
-		now := time.Now()
-		if p.numMessages > 0 {
-			if (p.numMessages%p.room.hub.cfg.RateLimitMessages+1) >= p.room.hub.cfg.RateLimitMessages &&
-				time.Since(p.lastMessage) < p.room.hub.cfg.RateLimitInterval {
-				p.room.hub.Store.RemoveSession(p.ID, p.room.ID)
-				p.writeWSControl(websocket.CloseMessage,
-					websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerRateLimited))
-				p.ws.Close()
-				return
-			}
+		msg, ok := parseChatMessage(m.Data)
+		if !ok {
+			// TODO: Respond
+			p.room.recordError(p, "invalid message")
+			return
+		}
+		if len(msg.msg) > p.room.maxMessageLen {
+			p.SendData(p.room.makeErrorPayload(ErrMsgTooLong))
+			return
+		}
+
+		// Slash commands that post messages check the rate limit
+		// themselves.
+		if strings.HasPrefix(msg.msg, "/") && !strings.HasPrefix(msg.msg, "//") {
+			p.runCommand(msg)
+			return
+		}
+		if !p.checkRateLimit() {
+			return
+		}
+		msg.msg = strings.TrimPrefix(msg.msg, "/")
+		p.postChat(msg)
+
+	// Edit of a message the peer posted.
+	case TypeMessageEdit:
+		data, ok := m.Data.(map[string]interface{})
+		if !ok {
+			p.room.recordError(p, "invalid edit")
+			return
 		}
-		p.lastMessage = now
-		p.numMessages++
+		id, _ := data["id"].(string)
+		msg, ok := data["message"].(string)
+		if id == "" || !ok {
+			p.room.recordError(p, "invalid edit")
+			return
+		}
+		if len(msg) > p.room.maxMessageLen {
+			p.SendData(p.room.makeErrorPayload(ErrMsgTooLong))
+			return
+		}
+		if !p.checkRateLimit() {
+			return
+		}
+		p.room.editMessage(p, id, msg)
+
+	// Deletion of a message the peer posted.
+	case TypeMessageDelete:
+		id, ok := m.Data.(string)
+		if !ok || id == "" {
+			p.room.recordError(p, "invalid delete")
+			return
+		}
+		p.room.removeMessage(p, id)
 
-		msg, ok := m.Data.(string)
+	// Answer to the first post challenge.
+	case TypeVerify:
+		answer, ok := m.Data.(string)
 		if !ok {
-			// TODO: Respond
+			p.room.recordError(p, "invalid verification")
 			return
 		}
-		p.room.Broadcast(p.room.makeMessagePayload(msg, p, m.Type), true)
+		p.verify(answer)
 
 	case TypeUploading:
 		data, ok := m.Data.(map[string]interface{})
@@ -135,34 +358,74 @@ func (p *Peer) processMessage(b []byte) {
 			// TODO: Respond
 			return
 		}
+		if !p.throttle() {
+			return
+		}
 		p.room.Broadcast(p.room.makeUploadPayload(data, p, m.Type), false)
 
 	case TypeUpload:
-		// Check rate limits and update counters.
-		now := time.Now()
-		if p.numMessages > 0 {
-			if (p.numMessages%p.room.hub.cfg.RateLimitMessages+1) >= p.room.hub.cfg.RateLimitMessages &&
-				time.Since(p.lastMessage) < p.room.hub.cfg.RateLimitInterval {
-				p.room.hub.Store.RemoveSession(p.ID, p.room.ID)
-				p.writeWSControl(websocket.CloseMessage,
-					websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerRateLimited))
-				p.ws.Close()
-				return
-			}
+		if !p.checkRateLimit() {
+			return
 		}
-		p.lastMessage = now
-		p.numMessages++
 
 		msg, ok := m.Data.(map[string]interface{})
 		if !ok {
 			// TODO: Respond
+			p.room.recordError(p, "invalid upload")
 			return
 		}
-		p.room.Broadcast(p.room.makeUploadPayload(msg, p, m.Type), true)
+		if p.room.isLocked() {
+			p.SendData(p.room.makeErrorPayload(ErrRoomLocked))
+			return
+		}
+		p.room.Broadcast(p.room.makePayload(payloadUpload{
+			PeerID:     p.ID,
+			PeerHandle: p.Handle,
+			Data:       msg,
+			Seq:        p.nextSeq(),
+		}, m.Type), true)
 
 	// "Typing" status.
 	case TypeTyping:
+		if p.room.hub.Shedding() {
+			p.SendData(p.room.makeErrorPayload(ErrServerBusy))
+			return
+		}
+		p.room.presence.typed(p)
 		p.room.Broadcast(p.room.makePeerUpdatePayload(p, TypeTyping), false)
+		p.typing()
+
+	// Channel (un)subscription.
+	case TypeSubscribe, TypeUnsubscribe:
+		ch, ok := m.Data.(string)
+		if !ok {
+			p.room.recordError(p, "invalid channel")
+			return
+		}
+		p.room.subscribe(p, ch, m.Type == TypeSubscribe)
+
+	// Status (online, away, busy).
+	case TypeStatus:
+		status, ok := m.Data.(string)
+		if !ok || !validStatus(status) {
+			p.SendData(p.room.makeErrorPayload(ErrInvalidStatus))
+			return
+		}
+		if !p.throttle() {
+			return
+		}
+		p.room.setStatus(p, status)
+
+	case TypeAvatar:
+		avatar, ok := m.Data.(string)
+		if !ok {
+			p.SendData(p.room.makeErrorPayload(ErrInvalidAvatar))
+			return
+		}
+		if !p.throttle() {
+			return
+		}
+		p.room.setAvatar(p, avatar)
 
 	// Request for peers list
 	case TypePeerList:
@@ -170,6 +433,11 @@ func (p *Peer) processMessage(b []byte) {
 
 	// Request growl notification
 	case TypeGrowl:
+		if p.room.hub.Shedding() {
+			p.SendData(p.room.makeErrorPayload(ErrServerBusy))
+			return
+		}
+
 		data, ok := m.Data.(map[string]interface{})
 		if !ok {
 			// TODO: Respond
@@ -197,7 +465,7 @@ func (p *Peer) processMessage(b []byte) {
 			}
 		}
 
-		p.room.HandleGrowlNotifications(from, to, msg)
+		p.room.HandleGrowlNotifications(p, from, to, msg)
 
 	case TypePing:
 		data, ok := m.Data.(map[string]interface{})
@@ -214,9 +482,73 @@ func (p *Peer) processMessage(b []byte) {
 		}
 		p.room.forwardTo(m.Type, to, m.Data)
 
+	// Message to a single peer.
+	case TypeDirectMessage:
+		data, ok := m.Data.(map[string]interface{})
+		if !ok {
+			p.room.recordError(p, "invalid direct message")
+			return
+		}
+		to, _ := data["to"].(string)
+		msg, ok := data["message"].(string)
+		if to == "" || !ok {
+			p.room.recordError(p, "invalid direct message")
+			return
+		}
+		if len(msg) > p.room.maxMessageLen {
+			p.SendData(p.room.makeErrorPayload(ErrMsgTooLong))
+			return
+		}
+		if !p.checkRateLimit() {
+			return
+		}
+		if p.room.isLocked() {
+			p.SendData(p.room.makeErrorPayload(ErrRoomLocked))
+			return
+		}
+		p.room.forwardDirect(p, to, msg)
+
+	// Kick a peer out of the room.
+	case TypeKick:
+		id, ok := m.Data.(string)
+		if !ok || id == "" {
+			p.room.recordError(p, "invalid kick")
+			return
+		}
+		p.room.kick(p, id, 0)
+
+	// Kick a peer out of the room and ban it for a while.
+	case TypeBan:
+		data, ok := m.Data.(map[string]interface{})
+		if !ok {
+			p.room.recordError(p, "invalid ban")
+			return
+		}
+		id, _ := data["id"].(string)
+		d, _ := data["duration"].(string)
+		dur, err := time.ParseDuration(d)
+		if id == "" || err != nil || dur <= 0 {
+			p.SendData(p.room.makeErrorPayload(ErrInvalidBan))
+			return
+		}
+		p.room.kick(p, id, dur)
+
+	// Pin or unpin a message.
+	case TypePin, TypeUnpin:
+		id, ok := m.Data.(string)
+		if !ok || id == "" {
+			p.room.recordError(p, "invalid pin")
+			return
+		}
+		if m.Type == TypePin {
+			p.room.pin(p, id)
+		} else {
+			p.room.unpin(p, id)
+		}
+
 	// Dipose of a room.
 	case TypeRoomDispose:
-		p.room.Dispose()
+		p.room.dispose(p)
 	default:
 	}
 }
@@ -0,0 +1,165 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Errors sent back to peers on invalid pin requests.
+var (
+	ErrPinsDisabled = errors.New("pinning messages is disabled")
+	ErrInvalidPin   = errors.New("pinned message doesn't exist")
+	ErrTooManyPins  = errors.New("too many pinned messages, unpin one first")
+)
+
+// payloadPinList is the list of a room's pinned messages, oldest first.
+type payloadPinList []json.RawMessage
+
+// payloadUnpin identifies an unpinned message.
+type payloadUnpin struct {
+	ID string `json:"id"`
+}
+
+// pinID returns the ID of a pinned message's payload.
+func pinID(b []byte) string {
+	var m struct {
+		Data payloadMutation `json:"data"`
+	}
+	json.Unmarshal(b, &m)
+	return m.Data.ID
+}
+
+// loadPins loads the room's pinned messages from the store. This should only
+// be called from the room's goroutine.
+func (r *Room) loadPins() {
+	if r.hub.cfg.MaxPins <= 0 {
+		return
+	}
+	pins, err := r.hub.Store.GetPins(r.ID)
+	if err != nil {
+		r.log.Errorf("error getting pins of %s: %v", r.ID, err)
+		return
+	}
+	r.pins = pins
+}
+
+// pin pins a message on a moderator's request so that peers see it at the
+// top of the room. Only messages in the room's recorded history can be
+// pinned as the pin carries the message along.
+func (r *Room) pin(p *Peer, id string) {
+	r.do(func() {
+		if r.hub.cfg.MaxPins <= 0 {
+			p.SendData(r.makeErrorPayload(ErrPinsDisabled))
+			return
+		}
+		if !p.moderator {
+			p.SendData(r.makeErrorPayload(ErrNotModerator))
+			r.recordError(p, "pin by non-moderator")
+			return
+		}
+		for _, b := range r.pins {
+			if pinID(b) == id {
+				return
+			}
+		}
+		if len(r.pins) >= r.hub.cfg.MaxPins {
+			p.SendData(r.makeErrorPayload(ErrTooManyPins))
+			return
+		}
+
+		b := r.findMessage(id)
+		if b == nil {
+			p.SendData(r.makeErrorPayload(ErrInvalidPin))
+			return
+		}
+		r.pins = append(r.pins, b)
+		r.savePins()
+		r.emit(r.makePayload(json.RawMessage(b), TypePin), false)
+	})
+}
+
+// unpin unpins a message on a moderator's request.
+func (r *Room) unpin(p *Peer, id string) {
+	r.do(func() {
+		if !p.moderator {
+			p.SendData(r.makeErrorPayload(ErrNotModerator))
+			r.recordError(p, "unpin by non-moderator")
+			return
+		}
+		r.removePin(id)
+	})
+}
+
+// removePin unpins a message if it's pinned, telling peers about it. This
+// should only be called from the room's goroutine.
+func (r *Room) removePin(id string) {
+	for i, b := range r.pins {
+		if pinID(b) == id {
+			r.pins = append(r.pins[:i:i], r.pins[i+1:]...)
+			r.savePins()
+			r.emit(r.makePayload(payloadUnpin{ID: id}, TypeUnpin), false)
+			return
+		}
+	}
+}
+
+// editPin updates the pinned copy of an edited message.
+func (r *Room) editPin(e payloadMsgEdit) {
+	for i, b := range r.pins {
+		if out, ok := applyEdit(b, e); ok {
+			r.pins[i] = out
+			r.savePins()
+			return
+		}
+	}
+}
+
+// savePins stores the room's pinned messages.
+func (r *Room) savePins() {
+	if err := r.hub.Store.SetPins(r.ID, r.pins); err != nil {
+		r.log.Errorf("error storing pins of %s: %v", r.ID, err)
+	}
+}
+
+// makePinListPayload prepares a message payload with the room's pinned
+// messages.
+func (r *Room) makePinListPayload() []byte {
+	out := make(payloadPinList, 0, len(r.pins))
+	for _, b := range r.pins {
+		out = append(out, json.RawMessage(b))
+	}
+	return r.makePayload(out, TypePinList)
+}
+
+// findMessage returns the recorded payload of a chat message from the
+// message cache, or the store's history, with its edits applied. Deleted
+// messages aren't found.
+func (r *Room) findMessage(id string) []byte {
+	match := func(b []byte) bool {
+		var m struct {
+			Type string          `json:"type"`
+			Data payloadMutation `json:"data"`
+		}
+		return json.Unmarshal(b, &m) == nil && isChatType(m.Type) && m.Data.ID == id
+	}
+
+	for _, b := range foldHistory(r.payloadCache) {
+		if match(b) {
+			return b
+		}
+	}
+	if n := r.hub.cfg.HistorySize; n > 0 {
+		r.flushHistory()
+		msgs, err := r.hub.Store.GetMessages(r.ID, n)
+		if err != nil {
+			r.log.Errorf("error getting history of %s: %v", r.ID, err)
+			return nil
+		}
+		for _, b := range foldHistory(msgs) {
+			if match(b) {
+				return b
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// presence tracks a room's peers so that they can be shared with, and the
+// peers connected to other instances picked up from, a store that's shared
+// across instances.
+type presence struct {
+	mu sync.Mutex
+
+	// Local and remote (connected to other instances) peers, ID => handle.
+	local  map[string]string
+	remote map[string]string
+
+	// Local peers that have been typing since the last sync.
+	typing map[string]bool
+}
+
+func newPresence() *presence {
+	return &presence{
+		local:  make(map[string]string),
+		remote: make(map[string]string),
+		typing: make(map[string]bool),
+	}
+}
+
+// sharedPresence returns the store's presence implementation if presence is
+// to be shared across instances.
+func sharedPresence(cfg *Config, s store.Store) store.PresenceStore {
+	if !cfg.SharedPresence {
+		return nil
+	}
+	p, _ := s.(store.PresenceStore)
+	return p
+}
+
+// SharedPresence returns true if presence is shared across instances.
+func (h *Hub) SharedPresence() bool {
+	return h.presence != nil
+}
+
+func (p *presence) join(peer *Peer) {
+	p.mu.Lock()
+	p.local[peer.ID] = peer.Handle
+	p.mu.Unlock()
+}
+
+func (p *presence) leave(peer *Peer) {
+	p.mu.Lock()
+	delete(p.local, peer.ID)
+	delete(p.typing, peer.ID)
+	p.mu.Unlock()
+}
+
+func (p *presence) typed(peer *Peer) {
+	p.mu.Lock()
+	p.typing[peer.ID] = true
+	p.mu.Unlock()
+}
+
+// remotePeers returns the peers connected to other instances that aren't
+// also connected locally.
+func (p *presence) remotePeers() []payloadMsgPeer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([]payloadMsgPeer, 0, len(p.remote))
+	for id, h := range p.remote {
+		if _, ok := p.local[id]; !ok {
+			out = append(out, payloadMsgPeer{ID: id, Handle: h})
+		}
+	}
+	return out
+}
+
+// runPresence is a blocking function that periodically syncs the room's
+// presence with other instances until the room is removed. This should be
+// invoked as a goroutine.
+func (r *Room) runPresence() {
+	t := time.NewTicker(r.hub.cfg.PresenceInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			if err := r.hub.presence.RemovePresence(r.ID, r.hub.instanceID); err != nil {
+				r.log.Errorf("error removing presence of %s: %v", r.ID, err)
+			}
+			return
+		case <-t.C:
+			r.syncPresence()
+		}
+	}
+}
+
+// syncPresence publishes the room's local peers to the store, picks up the
+// peers connected to other instances, and notifies local peers of remote
+// joins, leaves, and typing.
+func (r *Room) syncPresence() {
+	p := r.presence
+
+	// Snapshot the local presence.
+	p.mu.Lock()
+	own := store.Presence{
+		Peers:  make([]store.Sess, 0, len(p.local)),
+		Typing: make([]string, 0, len(p.typing)),
+	}
+	for id, h := range p.local {
+		own.Peers = append(own.Peers, store.Sess{ID: id, Handle: h})
+	}
+	for id := range p.typing {
+		own.Typing = append(own.Typing, id)
+	}
+	p.typing = make(map[string]bool)
+	p.mu.Unlock()
+
+	ttl := r.hub.cfg.PresenceInterval * 3
+	if err := r.hub.presence.SetPresence(r.ID, r.hub.instanceID, own, ttl); err != nil {
+		r.log.Errorf("error setting presence of %s: %v", r.ID, err)
+		return
+	}
+	all, err := r.hub.presence.GetPresence(r.ID)
+	if err != nil {
+		r.log.Errorf("error getting presence of %s: %v", r.ID, err)
+		return
+	}
+
+	// Aggregate the peers on other instances. Dead instances' presence
+	// has expired and isn't returned.
+	var (
+		remote = make(map[string]string)
+		typing []payloadMsgPeer
+	)
+	for inst, pr := range all {
+		if inst == r.hub.instanceID {
+			continue
+		}
+		for _, s := range pr.Peers {
+			remote[s.ID] = s.Handle
+		}
+		for _, id := range pr.Typing {
+			if h, ok := remote[id]; ok {
+				typing = append(typing, payloadMsgPeer{ID: id, Handle: h})
+			}
+		}
+	}
+
+	// Diff against the previous sync, ignoring peers that are connected
+	// locally as well.
+	var payloads [][]byte
+	p.mu.Lock()
+	for id, h := range remote {
+		if _, ok := p.remote[id]; ok {
+			continue
+		}
+		if _, ok := p.local[id]; !ok {
+			payloads = append(payloads, r.makePayload(payloadMsgPeer{ID: id, Handle: h, Avatar: r.defaultAvatar(h)}, TypePeerJoin))
+		}
+	}
+	for id, h := range p.remote {
+		if _, ok := remote[id]; ok {
+			continue
+		}
+		if _, ok := p.local[id]; !ok {
+			payloads = append(payloads, r.makePayload(payloadMsgPeer{ID: id, Handle: h}, TypePeerLeave))
+		}
+	}
+	p.remote = remote
+	p.mu.Unlock()
+
+	if len(payloads) == 0 && len(typing) == 0 {
+		return
+	}
+
+	r.do(func() {
+		for _, b := range payloads {
+			r.emit(b, true)
+		}
+		for _, t := range typing {
+			r.emit(r.makePayload(t, TypeTyping), false)
+		}
+	})
+}
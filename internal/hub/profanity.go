@@ -0,0 +1,104 @@
+package hub
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// wordList is a list of words that are masked in messages.
+type wordList struct {
+	re *regexp.Regexp
+}
+
+// loadWordList loads a word list file with one word or phrase per line.
+// Blank lines and lines starting with # are ignored.
+func loadWordList(path string) (*wordList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		w := strings.TrimSpace(sc.Text())
+		if w == "" || strings.HasPrefix(w, "#") {
+			continue
+		}
+		words = append(words, regexp.QuoteMeta(w))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return &wordList{}, nil
+	}
+
+	re, err := regexp.Compile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+	if err != nil {
+		return nil, err
+	}
+	return &wordList{re: re}, nil
+}
+
+// mask replaces the listed words in a message with asterisks.
+func (w *wordList) mask(msg string) string {
+	if w == nil || w.re == nil {
+		return msg
+	}
+	return w.re.ReplaceAllStringFunc(msg, func(s string) string {
+		return strings.Repeat("*", len([]rune(s)))
+	})
+}
+
+// LoadWordLists loads the profanity word lists of the app and the predefined
+// rooms. It has to be called before the predefined rooms are added.
+func (h *Hub) LoadWordLists() error {
+	paths := []string{h.cfg.ProfanityWordList}
+	for _, r := range h.cfg.Rooms {
+		paths = append(paths, r.ProfanityWordList)
+	}
+
+	lists := make(map[string]*wordList)
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if _, ok := lists[p]; ok {
+			continue
+		}
+		l, err := loadWordList(p)
+		if err != nil {
+			return fmt.Errorf("error loading word list %q: %v", p, err)
+		}
+		lists[p] = l
+	}
+
+	h.mut.Lock()
+	h.wordLists = lists
+	h.mut.Unlock()
+	return nil
+}
+
+// WordListFiles returns the word list files in use so that they can be
+// watched for changes along with the config.
+func (h *Hub) WordListFiles() []string {
+	h.mut.RLock()
+	defer h.mut.RUnlock()
+
+	out := make([]string, 0, len(h.wordLists))
+	for p := range h.wordLists {
+		out = append(out, p)
+	}
+	return out
+}
+
+// filterMessage applies the room's format policy and profanity word list
+// to a chat message.
+func (r *Room) filterMessage(msg string) string {
+	return r.wordList.mask(sanitizeMessage(msg, r.formatPolicy))
+}
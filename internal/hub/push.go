@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/knadh/niltalk/internal/notify"
+)
+
+// Max length of the message text in push notifications as the encrypted
+// payload has to fit in a single record.
+const maxPushBody = 200
+
+// pushNotify sends a push notification to the subscriptions of a handle in
+// the room in the background, removing the ones that are gone. Subscriptions
+// are only notified while the session they were made in is live and still
+// has the handle, so that whoever takes a handle later doesn't get them.
+func (r *Room) pushNotify(handle, title, msg string) {
+	if r.hub.Push == nil {
+		return
+	}
+
+	m := notify.PushMessage{
+		Title: title,
+		Body:  truncate(msg, maxPushBody),
+		URL:   fmt.Sprintf("%s/r/%s", r.hub.cfg.RootURL, r.ID),
+	}
+	handle = strings.ToLower(handle)
+	go func() {
+		subs, err := r.hub.Store.GetPushSubscriptions(r.ID, handle)
+		if err != nil {
+			r.log.Errorf("error getting push subscriptions in %s: %v", r.ID, err)
+			return
+		}
+		for _, s := range subs {
+			sess, err := r.hub.Store.GetSession(s.SessID, r.ID)
+			if err != nil {
+				r.log.Errorf("error getting session of push subscription in %s: %v", r.ID, err)
+				continue
+			}
+			if sess.ID == "" || strings.ToLower(sess.Handle) != handle {
+				r.hub.Store.RemovePushSubscription(r.ID, handle, s.Endpoint)
+				continue
+			}
+
+			err = r.hub.Push.Send(s, m)
+			if err == notify.ErrPushGone {
+				r.hub.Store.RemovePushSubscription(r.ID, handle, s.Endpoint)
+			} else if err != nil {
+				r.log.Errorf("error sending push notification in %s: %v", r.ID, err)
+			}
+		}
+	}()
+}
+
+// RemovePushSubscriptions removes the push subscriptions of a handle made
+// in a session, when it logs out or changes its handle.
+func (r *Room) RemovePushSubscriptions(handle, sessID string) {
+	if r.hub.Push == nil {
+		return
+	}
+
+	handle = strings.ToLower(handle)
+	subs, err := r.hub.Store.GetPushSubscriptions(r.ID, handle)
+	if err != nil {
+		r.log.Errorf("error getting push subscriptions in %s: %v", r.ID, err)
+		return
+	}
+	for _, s := range subs {
+		if s.SessID != sessID {
+			continue
+		}
+		if err := r.hub.Store.RemovePushSubscription(r.ID, handle, s.Endpoint); err != nil {
+			r.log.Errorf("error removing push subscription in %s: %v", r.ID, err)
+		}
+	}
+}
+
+// truncate truncates a string to n runes, adding an ellipsis if it's longer.
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// rateLimiter is a sliding window limiter that allows up to limit events in
+// any interval, or any number of events if limit is 0. It's not safe for
+// concurrent use.
+type rateLimiter struct {
+	limit    int
+	interval time.Duration
+
+	// Times of the events in the current window, oldest first.
+	times []time.Time
+}
+
+func newRateLimiter(limit int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:    limit,
+		interval: interval,
+		times:    make([]time.Time, 0, limit),
+	}
+}
+
+// allow records an event at now and returns false if it's over the limit.
+// Events over the limit aren't recorded.
+func (l *rateLimiter) allow(now time.Time) bool {
+	if l.limit <= 0 {
+		return true
+	}
+
+	// Forget the events that have slid out of the window.
+	n := 0
+	for n < len(l.times) && now.Sub(l.times[n]) >= l.interval {
+		n++
+	}
+	l.times = append(l.times[:0], l.times[n:]...)
+
+	if len(l.times) >= l.limit {
+		return false
+	}
+	l.times = append(l.times, now)
+	return true
+}
+
+// checkRateLimit accounts a message from the peer and kicks it out of the
+// room if it's over the room's rate limit, returning false.
+func (p *Peer) checkRateLimit() bool {
+	if p.limiter.allow(time.Now()) {
+		return true
+	}
+
+	p.room.hub.Store.RemoveSession(p.ID, p.room.ID)
+	p.writeWSControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerRateLimited))
+	p.ws.Close()
+	p.room.recordError(p, "rate limited")
+	return false
+}
+
+// throttle accounts a status, avatar or upload progress update from the
+// peer, returning false if it's over the room's rate limit. Unlike messages,
+// updates over the limit are dropped without kicking the peer as clients
+// send them on their own.
+func (p *Peer) throttle() bool {
+	return p.updateLimiter.allow(time.Now())
+}
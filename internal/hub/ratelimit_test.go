@@ -0,0 +1,46 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(0, 0)
+	at := func(ms ...int) []time.Time {
+		out := make([]time.Time, len(ms))
+		for i, m := range ms {
+			out[i] = start.Add(time.Duration(m) * time.Millisecond)
+		}
+		return out
+	}
+
+	cases := []struct {
+		name   string
+		limit  int
+		events []time.Time
+		want   []bool
+	}{
+		{"under the limit", 3, at(0, 100, 200), []bool{true, true, true}},
+		{"over the limit", 2, at(0, 100, 200), []bool{true, true, false}},
+		{"window slides", 2, at(0, 500, 1000, 1100), []bool{true, true, true, false}},
+		{"window slides past all", 2, at(0, 10, 2000, 2010), []bool{true, true, true, true}},
+
+		// Refused events aren't recorded, so they don't hold the window
+		// back.
+		{"refused not recorded", 1, at(0, 900, 1000), []bool{true, false, true}},
+
+		// 0 doesn't limit at all.
+		{"unlimited", 0, at(0, 1, 2, 3), []bool{true, true, true, true}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l := newRateLimiter(c.limit, time.Second)
+			for i, e := range c.events {
+				if got := l.allow(e); got != c.want[i] {
+					t.Errorf("event %d at %v: allow() = %v, want %v", i, e.Sub(start), got, c.want[i])
+				}
+			}
+		})
+	}
+}
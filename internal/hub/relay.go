@@ -0,0 +1,31 @@
+package hub
+
+import (
+	"encoding/json"
+
+	"github.com/knadh/niltalk/internal/notify"
+)
+
+// relayMessage passes a broadcast payload to the room's webhook and bridge
+// handlers if it's a chat message from a peer. Burn after reading messages
+// aren't relayed as they'd outlive their burn time there.
+func (r *Room) relayMessage(b []byte) {
+	var m struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil || m.Type != TypeMessage {
+		return
+	}
+	var c payloadMsgChat
+	if err := json.Unmarshal(m.Data, &c); err != nil || c.Burn > 0 {
+		return
+	}
+
+	if r.WebhookHandler != nil {
+		r.WebhookHandler(notify.EventMessage, m.Data)
+	}
+	if r.BridgeHandler != nil {
+		r.BridgeHandler(c.PeerHandle, c.Msg)
+	}
+}
@@ -0,0 +1,99 @@
+package hub
+
+import (
+	"time"
+)
+
+// resumeToken lets a peer that dropped off pick up the messages it missed
+// when it reconnects with the same session.
+type resumeToken struct {
+	sessID string
+
+	// Zero while the peer is connected. Once the peer leaves, messages
+	// are buffered until the token expires.
+	expires time.Time
+	buf     [][]byte
+}
+
+// resumeStore holds the resume tokens of a room. It's only accessed from
+// the room's goroutine.
+type resumeStore struct {
+	ttl     time.Duration
+	maxBuf  int
+	tokens  map[string]*resumeToken
+	lastRun time.Time
+}
+
+func newResumeStore(ttl time.Duration, maxBuf int) *resumeStore {
+	return &resumeStore{
+		ttl:    ttl,
+		maxBuf: maxBuf,
+		tokens: make(map[string]*resumeToken),
+	}
+}
+
+// enabled returns true if resuming is configured.
+func (s *resumeStore) enabled() bool {
+	return s.ttl > 0 && s.maxBuf > 0
+}
+
+// issue creates a new resume token for a connected peer session.
+func (s *resumeStore) issue(sessID string) string {
+	tok, _ := GenerateGUID(32)
+	s.tokens[tok] = &resumeToken{sessID: sessID}
+	return tok
+}
+
+// detach starts buffering messages for a token whose peer has left.
+func (s *resumeStore) detach(tok string) {
+	t, ok := s.tokens[tok]
+	if !ok {
+		return
+	}
+	t.expires = time.Now().Add(s.ttl)
+}
+
+// claim validates a token presented by a reconnecting peer and returns the
+// messages buffered for it. The token is removed either way.
+func (s *resumeStore) claim(tok, sessID string) ([][]byte, bool) {
+	t, ok := s.tokens[tok]
+	if !ok {
+		return nil, false
+	}
+	delete(s.tokens, tok)
+
+	if t.sessID != sessID || t.expires.IsZero() || t.expires.Before(time.Now()) {
+		return nil, false
+	}
+	return t.buf, true
+}
+
+// record appends a message to the buffers of all detached tokens, dropping
+// the oldest messages beyond the buffer size.
+func (s *resumeStore) record(b []byte) {
+	s.sweep()
+	for _, t := range s.tokens {
+		if t.expires.IsZero() {
+			continue
+		}
+		if len(t.buf) >= s.maxBuf {
+			t.buf = t.buf[1:]
+		}
+		t.buf = append(t.buf, b)
+	}
+}
+
+// sweep removes expired tokens and their buffers (at most once a second).
+func (s *resumeStore) sweep() {
+	now := time.Now()
+	if now.Sub(s.lastRun) < time.Second {
+		return
+	}
+	s.lastRun = now
+
+	for k, t := range s.tokens {
+		if !t.expires.IsZero() && t.expires.Before(now) {
+			delete(s.tokens, k)
+		}
+	}
+}
@@ -1,36 +1,71 @@
 package hub
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/knadh/niltalk/internal/log"
+	"github.com/knadh/niltalk/internal/notify"
+	"github.com/knadh/niltalk/store"
 )
 
 type payloadMsgWrap struct {
-	Type      string      `json:"type"`
-	Timestamp time.Time   `json:"timestamp"`
-	Data      interface{} `json:"data"`
+	// Sequence number of payloads recorded in the room's history, added
+	// by the room when they're broadcast.
+	Seq uint64 `json:"seq,omitempty"`
+
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// Server time of the payload in Unix milliseconds.
+	TimestampMS int64       `json:"timestamp_ms,omitempty"`
+	Data        interface{} `json:"data"`
 }
 
 type payloadMsgPeer struct {
 	ID     string `json:"id"`
 	Handle string `json:"handle"`
+	Status string `json:"status,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+type payloadMsgPeerInfo struct {
+	payloadMsgPeer
+	ResumeToken string `json:"resume_token,omitempty"`
+	Moderator   bool   `json:"moderator,omitempty"`
+	Creator     bool   `json:"creator,omitempty"`
 }
 
 type payloadMsgChat struct {
+	ID         string `json:"id,omitempty"`
 	PeerID     string `json:"peer_id"`
 	PeerHandle string `json:"peer_handle"`
 	Msg        string `json:"message"`
+	ReplyTo    string `json:"reply_to,omitempty"`
+	ReplyDepth int    `json:"reply_depth,omitempty"`
+	Seq        uint64 `json:"seq,omitempty"`
+	Channel    string `json:"channel,omitempty"`
+
+	// Seconds after which clients should remove the message.
+	Burn int `json:"burn,omitempty"`
+}
+
+type payloadMsgError struct {
+	Error string `json:"error"`
 }
 
 type payloadUpload struct {
 	PeerID     string      `json:"peer_id"`
 	PeerHandle string      `json:"peer_handle"`
 	Data       interface{} `json:"data"`
+	Seq        uint64      `json:"seq,omitempty"`
 }
 
 // peerReq represents a peer request (join, leave etc.) that's processed
@@ -40,20 +75,55 @@ type peerReq struct {
 	peer    *Peer
 }
 
+// broadcastReq represents a payload to be fanned out to all peers, or only
+// to the peers subscribed to a channel.
+type broadcastReq struct {
+	data    []byte
+	record  bool
+	channel string
+
+	// Time the broadcast was queued if latency is tracked.
+	at time.Time
+
+	// Whether the broadcast was relayed from another instance, which has
+	// stamped and stored it already.
+	remote bool
+}
+
 // forwardReq represents a message forwarding from a peer to another peer.
 type forwardReq struct {
 	reqType string
 	to      string
 	data    interface{}
+
+	// Sender of direct messages.
+	from *Peer
 }
 
 // Room represents a chat room.
 type Room struct {
+	// When the room last had activity, in Unix nanoseconds, for the idle
+	// sweeper. Kept first for 64-bit alignment of atomic operations.
+	lastActive int64
+
 	ID              string
 	Name            string
-	Password        []byte
 	Predefined      bool
 	PredefinedUsers []PredefinedUser
+	CreatedAt       time.Time
+
+	// Secret token of the room's creator, empty for predefined rooms.
+	CreatorID string
+
+	// Hash of the room's password, which is upgraded on logins when the
+	// hashing config changes, and whether the password is empty.
+	pwdMu    sync.Mutex
+	password []byte
+	public   bool
+
+	// Serialises the check of a handle's session limit with the addition
+	// of the new session.
+	sessMu sync.Mutex
 
 	hub *Hub
 
@@ -62,14 +132,34 @@ type Room struct {
 	// List of connected peers.
 	peers map[*Peer]bool
 
+	// Read-only subscribers to the room's broadcasts.
+	observers map[chan []byte]bool
+
 	// Broadcast channel for messages.
-	broadcastQ chan []byte
+	broadcastQ chan broadcastReq
+
+	// Broadcasts from other instances waiting to be relayed to the peers.
+	// It's never closed as it's written to from outside the room.
+	remoteQ chan broadcastReq
 
 	// GrowlHandler is an async callback fired when a peer notifies an offline predefined users.
 	GrowlHandler func(msg, handle, token string)
 	GrowlEnabler []string
 	growlTokens  *tokenStore
 
+	// Growl notifications triggered in the room in the current interval
+	// of the rate limit, and when the interval started.
+	numGrowls  int
+	growlStart time.Time
+
+	// WebhookHandler is a callback fired on room events that should
+	// return quickly.
+	WebhookHandler func(event string, data interface{})
+
+	// BridgeHandler is a callback fired with the chat messages of peers to
+	// mirror them to another chat service. It should return quickly.
+	BridgeHandler func(handle, msg string)
+
 	// Peer related requests.
 	peerQ    chan peerReq
 	forwardQ chan forwardReq
@@ -78,41 +168,140 @@ type Room struct {
 	disposeSig chan bool
 	closed     bool
 
+	// Closed when the room stops, after which ops are no longer run.
+	stop chan bool
+
 	op chan func()
 
 	// Message / payload cache.
 	payloadCache [][]byte
 
+	// Buffer of the peers that broadcasts are sent to, reused across
+	// broadcasts.
+	peerList []*Peer
+
+	// Payloads of the pinned messages, oldest first.
+	pins [][]byte
+
+	// Recent chat messages by ID and the order in which they were sent.
+	messages map[string]msgMeta
+	msgOrder []string
+
+	// Timers that remove burn after reading messages once they expire,
+	// by message ID.
+	burnTimers map[string]*time.Timer
+
+	// Writes to the stored history, if it's enabled, waiting to be made,
+	// and their number.
+	historyQ       chan historyOp
+	historyPending int64
+
 	timestamp time.Time
 
+	// Sequence number of the last payload recorded in the room's history.
+	// Only accessed from the room's goroutine.
+	seq uint64
+
 	// Message Of The Day
 	motd string
+
+	// Tokens for peers to resume after a disconnection.
+	resume *resumeStore
+
+	// Name of the format policy applied to chat messages.
+	formatPolicy string
+
+	// Delivery drops in the room.
+	drops dropCounter
+
+	// Errors tripped by peers.
+	errors errorWindow
+
+	// Peers shared with other instances.
+	presence *presence
+
+	// Channels that any peer can subscribe to.
+	openChannels []string
+
+	// Max TTL of burn after reading messages. <= 0 disables them.
+	maxBurnTTL time.Duration
+
+	// New peers have to solve a challenge before their first post.
+	verifyFirstPost bool
+
+	// Words masked in chat messages.
+	wordList *wordList
+
+	// Message delivery latencies in the room.
+	latency latencyTracker
+
+	// Max number of peers in the room (<= 0 is unlimited), and the number
+	// of peers, which can be read outside the room's goroutine.
+	maxPeers int
+	numPeers int32
+
+	// Max length of chat messages in bytes.
+	maxMessageLen int
+
+	// Logger that adds the room's ID to structured entries.
+	log *log.Logger
+
+	// Number of chat messages posted since the room was started.
+	numMessages int
+
+	// Max messages a peer can send per interval.
+	rateLimitMessages int
+	rateLimitInterval time.Duration
+
+	// Token for posting messages over the API, and the rate limiter of the
+	// posts, which is only used from the room's goroutine.
+	apiToken   string
+	apiLimiter *rateLimiter
 }
 
 // NewRoom returns a new instance of Room.
 func NewRoom(id, name string, password []byte, h *Hub, predefined bool) *Room {
-	return &Room{
+	r := &Room{
 		ID:           id,
 		Name:         name,
-		Password:     password,
+		password:     password,
+		public:       h.isPublic(password),
 		Predefined:   predefined,
 		hub:          h,
+		log:          h.log.With("room_id", id),
 		peers:        make(map[*Peer]bool, 100),
-		broadcastQ:   make(chan []byte, 100),
+		observers:    make(map[chan []byte]bool),
+		broadcastQ:   make(chan broadcastReq, 100),
+		remoteQ:      make(chan broadcastReq, remoteQueueSize),
 		peerQ:        make(chan peerReq, 100),
 		forwardQ:     make(chan forwardReq, 100),
 		disposeSig:   make(chan bool),
 		payloadCache: make([][]byte, 0, h.cfg.MaxCachedMessages),
+		messages:     make(map[string]msgMeta),
+		burnTimers:   make(map[string]*time.Timer),
 		growlTokens:  newTokenStore(),
 		op:           make(chan func()),
+		stop:         make(chan bool),
+		resume:       newResumeStore(h.cfg.ResumeTokenTTL, h.cfg.ResumeBufferSize),
+		presence:     newPresence(),
+		lastActive:   time.Now().UnixNano(),
+	}
+	if h.cfg.HistorySize > 0 {
+		r.historyQ = make(chan historyOp, historyQueueSize)
 	}
+	return r
 }
 
 // Login an user into the room. It chekcs for room password,
 // user password is the handle belongs to a predefined user.
 // Generates a session ID and stores it into the store.
-func (r *Room) Login(roomPwd, handle, handlePwd string, roomAge time.Duration) (string, error) {
-	if err := bcrypt.CompareHashAndPassword(r.Password, []byte(roomPwd)); err != nil {
+func (r *Room) Login(roomPwd, handle, handlePwd string, ttl time.Duration) (string, error) {
+	// Open rooms don't have passwords to check, but peers still need
+	// sessions.
+	r.pwdMu.Lock()
+	hash := r.password
+	r.pwdMu.Unlock()
+	if !r.public && !checkPassword(hash, roomPwd) {
 		return "", ErrInvalidRoomPassword
 	}
 
@@ -122,30 +311,52 @@ func (r *Room) Login(roomPwd, handle, handlePwd string, roomAge time.Duration) (
 		}
 	}
 
-	// Register a new session for the peer in the DB.
-	sessID, err := GenerateGUID(32)
+	sessID, err := r.addSession(handle, ttl)
 	if err != nil {
-		r.hub.log.Printf("error generating session ID: %v", err)
-		return "", errors.New("error generating session ID")
+		return "", err
 	}
 
-	if err := r.hub.Store.AddSession(sessID, handle, r.ID, roomAge); err != nil {
-		r.hub.log.Printf("error creating session: %v", err)
-		return "", errors.New("error storing session")
+	if !r.public && r.hub.needsRehash(hash) {
+		r.rehashPassword(hash, roomPwd)
 	}
-
 	return sessID, nil
 }
 
+// rehashPassword hashes the room's password again with the configured
+// algorithm and parameters, replacing the old hash unless another login
+// already did. Failures are only logged as the old hash still works.
+func (r *Room) rehashPassword(old []byte, password string) {
+	hash, err := r.hub.hashPassword(password)
+	if err != nil {
+		r.log.Errorf("error rehashing password of %s: %v", r.ID, err)
+		return
+	}
+
+	r.pwdMu.Lock()
+	defer r.pwdMu.Unlock()
+	if !bytes.Equal(r.password, old) {
+		return
+	}
+	if err := r.hub.Store.SetRoomPassword(r.ID, hash); err != nil {
+		r.log.Errorf("error storing rehashed password of %s: %v", r.ID, err)
+		return
+	}
+	r.password = hash
+	r.log.Infof("rehashed password of %s", r.ID)
+}
+
 // Predefined common errors.
 var (
 	ErrInvalidRoomPassword = fmt.Errorf("invalid room password")
 	ErrInvalidUserPassword = fmt.Errorf("invalid user password")
 	ErrInvalidToken        = fmt.Errorf("invalid autologin token")
+	ErrGrowlRateLimited    = fmt.Errorf("too many notifications, try again later")
 )
 
 // HandleGrowlNotifications sends growl notification if target user is offline.
-func (r *Room) HandleGrowlNotifications(fromPeer, to, msg string) {
+// Notifications triggered in the room are rate limited, and the peer p is
+// told if its notification is dropped.
+func (r *Room) HandleGrowlNotifications(p *Peer, fromPeer, to, msg string) {
 	if r.GrowlHandler == nil {
 		return
 	}
@@ -160,21 +371,53 @@ func (r *Room) HandleGrowlNotifications(fromPeer, to, msg string) {
 		return
 	}
 
-	r.op <- func() {
+	r.do(func() {
 		// check if user is online
-		for p := range r.peers {
-			if p.Handle == to {
+		for peer := range r.peers {
+			if peer.Handle == to {
 				return
 			}
 		}
+
+		if !r.allowGrowl() {
+			if r.hub.cfg.GrowlRateNotify {
+				p.SendData(r.makeErrorPayload(ErrGrowlRateLimited))
+			}
+			return
+		}
+
 		// user is offline, generate a login token, send the notification
 		tok := r.growlTokens.getOrCreateToken(to)
 		go r.GrowlHandler(msg, fromPeer, tok)
+	})
+}
+
+// allowGrowl accounts a notification triggered in the room and returns false
+// if the room has exceeded its limit in the current interval. The limit is
+// kept by the room rather than by the peer so that reconnecting or joining
+// under more handles doesn't get around it. It's only called from the room's
+// goroutine.
+func (r *Room) allowGrowl() bool {
+	max := r.hub.cfg.GrowlRateLimit
+	if max < 1 {
+		return true
 	}
+
+	now := time.Now()
+	if now.Sub(r.growlStart) > r.hub.cfg.GrowlRateInterval {
+		r.growlStart = now
+		r.numGrowls = 0
+	}
+	if r.numGrowls >= max {
+		return false
+	}
+	r.numGrowls++
+	return true
 }
 
-// LoginWithToken allows for automatic login using a temporary token.
-func (r *Room) LoginWithToken(token string, roomAge time.Duration) (string, error) {
+// LoginWithToken allows for automatic login using a temporary token. Banned
+// handles and IP addresses are kept out as they are on logins.
+func (r *Room) LoginWithToken(token, ip string, ttl time.Duration) (string, error) {
 
 	handle := r.growlTokens.checkToken(token)
 
@@ -182,45 +425,100 @@ func (r *Room) LoginWithToken(token string, roomAge time.Duration) (string, erro
 		return "", ErrInvalidToken
 	}
 
-	// Register a new session for the peer in the DB.
-	sessID, err := GenerateGUID(32)
-	if err != nil {
-		r.hub.log.Printf("error generating session ID: %v", err)
-		return "", errors.New("error generating session ID")
-	}
-
-	if err := r.hub.Store.AddSession(sessID, handle, r.ID, roomAge); err != nil {
-		r.hub.log.Printf("error creating session: %v", err)
-		return "", errors.New("error storing session")
+	if banned, err := r.IsBanned(handle, ip); err != nil {
+		r.log.Errorf("error checking ban: %v", err)
+		return "", errors.New("error checking ban")
+	} else if banned {
+		return "", ErrBanned
 	}
 
-	return sessID, nil
+	return r.addSession(handle, ttl)
 }
 
 // AddPeer adds a new peer to the room given a WS connection from an HTTP
 // handler.
-func (r *Room) AddPeer(id, handle string, ws *websocket.Conn) {
-	r.queuePeerReq(TypePeerJoin, newPeer(id, handle, ws, r))
+func (r *Room) AddPeer(id, handle, ip, resumeToken string, lastSeq uint64, creatorID string, ws *websocket.Conn) {
+	p := newPeer(id, handle, ws, r)
+	p.resumeWith = resumeToken
+	p.lastSeq = lastSeq
+	p.creator = r.IsCreator(creatorID)
+	p.ip = ip
+	p.initChannels()
+	p.initModerator()
+	r.queuePeerReq(TypePeerJoin, p)
 }
 
 // Dispose signals the room to notify all connected peer messages, and dispose
-// of itself.
+// of itself. Predefined rooms ignore it.
 func (r *Room) Dispose() {
-	r.disposeSig <- true
+	r.signalDispose(false)
+}
+
+// ForceDispose disposes of the room like Dispose, including predefined rooms,
+// on an admin's request.
+func (r *Room) ForceDispose() {
+	r.signalDispose(true)
+}
+
+// signalDispose signals the room to dispose of itself, giving up if it has
+// already stopped, which leaves no one to receive the signal.
+func (r *Room) signalDispose(force bool) {
+	select {
+	case r.disposeSig <- force:
+	case <-r.stop:
+	}
+}
+
+// IsCreator checks whether the token is the room creator's.
+func (r *Room) IsCreator(creatorID string) bool {
+	return r.CreatorID != "" &&
+		subtle.ConstantTimeCompare([]byte(creatorID), []byte(r.CreatorID)) == 1
 }
 
 // Broadcast broadcasts a message to all connected peers.
 func (r *Room) Broadcast(data []byte, record bool) {
-	r.broadcastQ <- data
-	if record {
-		r.recordMsgPayload(data)
+	r.broadcastQ <- broadcastReq{data: data, record: record, at: r.broadcastTime()}
+	if r.WebhookHandler != nil || r.BridgeHandler != nil {
+		r.relayMessage(data)
+	}
+}
+
+// emit broadcasts a message from the room's goroutine, which can't queue it
+// with Broadcast as it's the one that drains the queue.
+func (r *Room) emit(data []byte, record bool) {
+	r.fanout(broadcastReq{data: data, record: record, at: r.broadcastTime()})
+	if r.WebhookHandler != nil || r.BridgeHandler != nil {
+		r.relayMessage(data)
+	}
+}
+
+// emitChannel broadcasts a message to the peers subscribed to a channel from
+// the room's goroutine. Channel messages aren't recorded or sent to
+// observers.
+func (r *Room) emitChannel(data []byte, channel string) {
+	r.fanout(broadcastReq{data: data, channel: channel, at: r.broadcastTime()})
+}
+
+// broadcastTime returns the time to track a broadcast's delivery latency
+// from, if it's tracked.
+func (r *Room) broadcastTime() time.Time {
+	if !r.hub.cfg.TrackLatency {
+		return time.Time{}
 	}
+	return time.Now()
 }
 
 // run is a blocking function that starts the main event loop for a room that
 // handles peer connection events and message broadcasts. This should be invoked
 // as a goroutine.
 func (r *Room) run() {
+	if r.historyQ != nil {
+		go r.runHistoryWriter()
+	}
+	r.trackHistory()
+	r.loadSeq()
+	r.loadPins()
+
 loop:
 	for {
 		select {
@@ -228,8 +526,8 @@ loop:
 			op()
 
 		// Dispose request.
-		case <-r.disposeSig:
-			if r.Predefined {
+		case force := <-r.disposeSig:
+			if r.Predefined && !force {
 				continue
 			}
 			r.hub.Store.ClearSessions(r.ID)
@@ -239,6 +537,11 @@ loop:
 			if !ok {
 				break loop
 			}
+			if fw.reqType == TypeDirectMessage {
+				r.sendDirect(fw.from, fw.to, fw.data.(string))
+				continue
+			}
+
 			var toPeer *Peer
 			for p := range r.peers {
 				if p.Handle == fw.to {
@@ -262,8 +565,16 @@ loop:
 			switch req.reqType {
 			// A new peer has joined.
 			case TypePeerJoin:
+				// The room has been locked for abuse. Keep new peers out.
+				if r.isLocked() {
+					req.peer.writeWSControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypeRoomLocked))
+					req.peer.ws.Close()
+					continue
+				}
+
 				// Room's capacity is exchausted. Kick the peer out.
-				if len(r.peers) >= r.hub.cfg.MaxPeersPerRoom {
+				if r.maxPeers > 0 && len(r.peers) >= r.maxPeers {
 					r.hub.Store.RemoveSession(req.peer.ID, r.ID)
 					req.peer.writeWSControl(websocket.CloseMessage,
 						websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypeRoomFull))
@@ -271,33 +582,66 @@ loop:
 					continue
 				}
 
+				// The peer's handle is taken and unique handles are enforced.
+				if !r.resolveHandle(req.peer) {
+					r.hub.Store.RemoveSession(req.peer.ID, r.ID)
+					req.peer.writeWSControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypeHandleTaken))
+					req.peer.ws.Close()
+					continue
+				}
+
 				r.peers[req.peer] = true
+				atomic.StoreInt32(&r.numPeers, int32(len(r.peers)))
+				r.touch()
+				r.presence.join(req.peer)
 				go req.peer.RunListener()
 				go req.peer.RunWriter()
 
-				// Send the peer its info.
-				req.peer.SendData(r.makePeerUpdatePayload(req.peer, TypePeerInfo))
+				// Send the peer its info along with a fresh resume token.
+				missed, resumed := r.resumePeer(req.peer)
+				req.peer.SendData(r.makePeerInfoPayload(req.peer))
 
-				// Send the peer last N message.
-				if r.hub.cfg.MaxCachedMessages > 0 {
-					for _, b := range r.payloadCache {
+				// Send the peer the messages it missed if it's resuming,
+				// either with its resume token or the sequence number of
+				// the last message it received, or the last N messages
+				// otherwise.
+				if resumed {
+					for _, b := range missed {
 						req.peer.SendData(b)
 					}
+				} else if !r.replaySince(req.peer, req.peer.lastSeq) {
+					r.sendHistory(req.peer)
 				}
 
 				if len(r.motd) > 0 {
 					req.peer.SendData(r.makeMessagePayload(r.motd, req.peer, TypeMotd))
 				}
+				if len(r.pins) > 0 {
+					req.peer.SendData(r.makePinListPayload())
+				}
 
 				// Notify all peers of the new addition.
-				r.Broadcast(r.makePeerUpdatePayload(req.peer, TypePeerJoin), true)
-				r.hub.log.Printf("%s@%s joined %s", req.peer.Handle, req.peer.ID, r.ID)
+				r.emit(r.makePeerUpdatePayload(req.peer, TypePeerJoin), true)
+				r.webhookPeer(notify.EventPeerJoin, req.peer)
+				req.peer.log.Debugf("%s@%s joined %s from %s", req.peer.Handle, req.peer.ID, r.ID, req.peer.ip)
 
 			// A peer has left.
 			case TypePeerLeave:
 				r.removePeer(req.peer)
-				r.Broadcast(r.makePeerUpdatePayload(req.peer, TypePeerLeave), true)
-				r.hub.log.Printf("%s@%s left %s", req.peer.Handle, req.peer.ID, r.ID)
+				r.presence.leave(req.peer)
+				r.touch()
+				if r.resume.enabled() {
+					r.detachResume(req.peer)
+				}
+				r.emit(r.makePeerUpdatePayload(req.peer, TypePeerLeave), true)
+
+				// Sessions last from the peer's last connection.
+				if err := r.hub.Store.ExtendSession(req.peer.ID, r.ID, r.hub.SessionTTL()); err != nil {
+					req.peer.log.Errorf("error renewing session of %s in %s: %v", req.peer.ID, r.ID, err)
+				}
+				r.webhookPeer(notify.EventPeerLeave, req.peer)
+				req.peer.log.Debugf("%s@%s left %s", req.peer.Handle, req.peer.ID, r.ID)
 
 			// A peer has requested the room's peer list.
 			case TypePeerList:
@@ -309,31 +653,153 @@ loop:
 			if !ok {
 				break loop
 			}
-			for p := range r.peers {
-				p.SendData(m)
-			}
+			r.fanout(m)
 
-			// Extend the room's expiry (once every 30 seconds).
-			if !r.Predefined {
-				if time.Since(r.timestamp) > time.Duration(30)*time.Second {
-					r.timestamp = time.Now()
-					r.extendTTL()
-				}
-			}
+		// Relay a broadcast from another instance.
+		case m := <-r.remoteQ:
+			r.fanout(m)
 
-		// Kill the room after the inactivity period.
-		case <-time.After(r.hub.cfg.RoomAge):
+		// Kill the room after the inactivity period, unless idle rooms are
+		// disposed of by the hub's sweeper.
+		case <-r.ageTimeout():
 			break loop
 		}
 	}
 
-	r.hub.log.Printf("stopped room: %v", r.ID)
+	r.log.Infof("stopped room: %v", r.ID)
 	r.remove()
 }
 
+// fanout sends a broadcast to the room's peers and records it. Local
+// broadcasts are published to other instances if broadcasts are shared.
+// It's only called from the room's goroutine.
+func (r *Room) fanout(m broadcastReq) {
+	if m.record && m.channel == "" {
+		if m.remote {
+			r.syncSeq(m.data)
+		} else {
+			m.data = r.stampSeq(m.data)
+		}
+	}
+	if m.remote {
+		r.applyRemote(m.data)
+	} else {
+		r.publish(m)
+	}
+
+	r.sendBroadcast(m.data, m.channel, m.at)
+	if m.channel == "" {
+		r.sendObservers(m.data)
+	}
+
+	if m.record && m.channel == "" {
+		r.touch()
+
+		// The originating instance has stored remote broadcasts.
+		if m.remote {
+			r.recordMsgPayload(m.data)
+		} else {
+			r.recordHistory(m.data)
+		}
+		if r.resume.enabled() {
+			r.resume.record(m.data)
+		}
+	}
+
+	// Extend the room's expiry (once every 30 seconds).
+	if !r.Predefined {
+		if time.Since(r.timestamp) > time.Duration(30)*time.Second {
+			r.timestamp = time.Now()
+			r.extendTTL()
+		}
+	}
+}
+
+// resumePeer claims the resume token presented by a joining peer, if any,
+// returning the messages it missed, and issues the peer a new token. Peers
+// that left another instance, or this one before a restart, only have their
+// token in the store, and are replayed the messages they missed from the
+// history instead.
+func (r *Room) resumePeer(p *Peer) ([][]byte, bool) {
+	if !r.resume.enabled() {
+		return nil, false
+	}
+
+	var (
+		missed  [][]byte
+		resumed bool
+	)
+	if p.resumeWith != "" {
+		missed, resumed = r.resume.claim(p.resumeWith, p.ID)
+
+		// The stored token is claimed either way so that it can't be used
+		// again.
+		t, ok, err := r.hub.Store.ClaimResumeToken(r.ID, p.resumeWith)
+		if err != nil {
+			r.log.Errorf("error claiming resume token in %s: %v", r.ID, err)
+		}
+		if !resumed && ok && t.SessID == p.ID && p.lastSeq == 0 {
+			p.lastSeq = t.Seq
+		}
+	}
+	p.resumeToken = r.resume.issue(p.ID)
+	return missed, resumed
+}
+
+// detachResume starts buffering the messages that a peer that left misses,
+// and stores its token so that it can resume on another instance or after a
+// restart. It's only called from the room's goroutine.
+func (r *Room) detachResume(p *Peer) {
+	if p.resumeToken == "" {
+		return
+	}
+	r.resume.detach(p.resumeToken)
+
+	t := store.ResumeToken{SessID: p.ID, Seq: r.seq}
+	if err := r.hub.Store.SetResumeToken(r.ID, p.resumeToken, t, r.resume.ttl); err != nil {
+		r.log.Errorf("error storing resume token in %s: %v", r.ID, err)
+	}
+}
+
+// untrackMessage forgets a deleted message's metadata. It's only called from
+// the room's goroutine.
+func (r *Room) untrackMessage(id string) {
+	if _, ok := r.messages[id]; !ok {
+		return
+	}
+	delete(r.messages, id)
+	for i, mid := range r.msgOrder {
+		if mid == id {
+			r.msgOrder = append(r.msgOrder[:i], r.msgOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// touch records activity in the room, which keeps it from being disposed of
+// as idle.
+func (r *Room) touch() {
+	atomic.StoreInt64(&r.lastActive, time.Now().UnixNano())
+}
+
+// idleSince returns when the room last had activity.
+func (r *Room) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&r.lastActive))
+}
+
+// ageTimeout returns a channel that fires once the room's goroutine has had
+// nothing to do for room_age, or nil if idle rooms are disposed of by the
+// hub's sweeper instead.
+func (r *Room) ageTimeout() <-chan time.Time {
+	if r.hub.cfg.RoomIdleTimeout > 0 {
+		return nil
+	}
+	return time.After(r.hub.cfg.RoomAge)
+}
+
 // extendTTL extends a room's TTL in the store.
 func (r *Room) extendTTL() {
-	r.hub.Store.ExtendRoomTTL(r.ID, r.hub.cfg.RoomAge)
+	r.hub.Store.ExtendRoomTTL(r.ID, r.hub.RoomTTL())
 }
 
 // remove disposes a room by notifying and disconnecting all peers and
@@ -341,20 +807,53 @@ func (r *Room) extendTTL() {
 func (r *Room) remove() {
 	r.closed = true
 
+	for id, t := range r.burnTimers {
+		t.Stop()
+		delete(r.burnTimers, id)
+	}
+
 	// Close all peer WS connections.
 	for peer := range r.peers {
 		peer.writeWSControl(websocket.CloseMessage,
 			websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypeRoomDispose))
 		delete(r.peers, peer)
 	}
+	atomic.StoreInt32(&r.numPeers, 0)
+	r.closeObservers()
 
 	// Close all room channels.
 	close(r.broadcastQ)
 	close(r.peerQ)
 	close(r.forwardQ)
+	close(r.stop)
+	if r.historyQ != nil {
+		close(r.historyQ)
+	}
 	r.hub.removeRoom(r.ID)
 }
 
+// stopped returns true if the room has stopped. Unlike r.closed, it's safe
+// to call off the room's goroutine.
+func (r *Room) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// do runs f on the room's goroutine. It returns false without running f if
+// the room has stopped.
+func (r *Room) do(f func()) bool {
+	select {
+	case r.op <- f:
+		return true
+	case <-r.stop:
+		return false
+	}
+}
+
 // recordMsgPayload records message payloads (events) sent out. It maintains last
 // N messages to be sent to new users when they join.
 func (r *Room) recordMsgPayload(b []byte) {
@@ -370,6 +869,17 @@ func (r *Room) recordMsgPayload(b []byte) {
 	r.payloadCache = append(r.payloadCache, b)
 }
 
+// MaxMessageLen returns the max length of chat messages in the room in
+// bytes.
+func (r *Room) MaxMessageLen() int {
+	return r.maxMessageLen
+}
+
+// IsFull returns true if the room has reached its max number of peers.
+func (r *Room) IsFull() bool {
+	return r.maxPeers > 0 && int(atomic.LoadInt32(&r.numPeers)) >= r.maxPeers
+}
+
 // queuePeerReq queues a peer addition / removal request to the room.
 func (r *Room) queuePeerReq(reqType string, p *Peer) {
 	if r.closed {
@@ -383,6 +893,7 @@ func (r *Room) queuePeerReq(reqType string, p *Peer) {
 func (r *Room) removePeer(p *Peer) {
 	close(p.dataQ)
 	delete(r.peers, p)
+	atomic.StoreInt32(&r.numPeers, int32(len(r.peers)))
 }
 
 // sendPeerList sends the peer list to the given peer.
@@ -390,6 +901,11 @@ func (r *Room) forwardTo(typ, to string, data interface{}) {
 	r.forwardQ <- forwardReq{reqType: typ, to: to, data: data}
 }
 
+// forwardDirect sends a direct message from a peer to another peer by ID.
+func (r *Room) forwardDirect(from *Peer, to, msg string) {
+	r.forwardQ <- forwardReq{reqType: TypeDirectMessage, to: to, data: msg, from: from}
+}
+
 // sendPeerList sends the peer list to the given peer.
 func (r *Room) sendPeerList(p *Peer) {
 	r.peerQ <- peerReq{reqType: TypePeerList, peer: p}
@@ -399,31 +915,65 @@ func (r *Room) sendPeerList(p *Peer) {
 func (r *Room) makePeerListPayload() []byte {
 	peers := make([]payloadMsgPeer, 0, len(r.peers))
 	for p := range r.peers {
-		peers = append(peers, payloadMsgPeer{ID: p.ID, Handle: p.Handle})
+		peers = append(peers, payloadMsgPeer{ID: p.ID, Handle: p.Handle, Status: p.status, Avatar: r.avatar(p)})
+	}
+
+	// Peers connected to other instances.
+	for _, p := range r.presence.remotePeers() {
+		p.Avatar = r.defaultAvatar(p.Handle)
+		peers = append(peers, p)
 	}
 	return r.makePayload(peers, TypePeerList)
 }
 
 // makePeerUpdatePayload prepares a message payload representing a peer
-// join / leave event.
+// join / leave / status / avatar event.
 func (r *Room) makePeerUpdatePayload(p *Peer, peerUpdateType string) []byte {
 	d := payloadMsgPeer{
 		ID:     p.ID,
 		Handle: p.Handle,
+		Status: p.status,
+		Avatar: r.avatar(p),
 	}
 	return r.makePayload(d, peerUpdateType)
 }
 
-// makeMessagePayload prepares a chat message.
+// makePeerInfoPayload prepares a message payload with the peer's own info.
+func (r *Room) makePeerInfoPayload(p *Peer) []byte {
+	d := payloadMsgPeerInfo{
+		payloadMsgPeer: payloadMsgPeer{
+			ID:     p.ID,
+			Handle: p.Handle,
+			Status: p.status,
+			Avatar: r.avatar(p),
+		},
+		ResumeToken: p.resumeToken,
+		Moderator:   p.moderator,
+		Creator:     p.creator,
+	}
+	return r.makePayload(d, TypePeerInfo)
+}
+
+// makeMessagePayload prepares a chat message with a server assigned ID.
 func (r *Room) makeMessagePayload(msg string, p *Peer, typ string) []byte {
+	id, err := GenerateGUID(16)
+	if err != nil {
+		r.log.Errorf("error generating message ID: %v", err)
+	}
 	d := payloadMsgChat{
+		ID:         id,
 		PeerID:     p.ID,
 		PeerHandle: p.Handle,
-		Msg:        msg,
+		Msg:        r.filterMessage(msg),
 	}
 	return r.makePayload(d, typ)
 }
 
+// makeErrorPayload prepares an error message for a peer.
+func (r *Room) makeErrorPayload(err error) []byte {
+	return r.makePayload(payloadMsgError{Error: err.Error()}, TypeError)
+}
+
 // makeUploadPayload prepares an upload message.
 func (r *Room) makeUploadPayload(data interface{}, p *Peer, typ string) []byte {
 	d := payloadUpload{
@@ -436,10 +986,21 @@ func (r *Room) makeUploadPayload(data interface{}, p *Peer, typ string) []byte {
 
 // makePayload prepares a message payload.
 func (r *Room) makePayload(data interface{}, typ string) []byte {
+	return r.makePayloadAt(time.Now(), data, typ)
+}
+
+// unixMillis returns t in Unix milliseconds.
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// makePayloadAt prepares a message payload with the given timestamp.
+func (r *Room) makePayloadAt(t time.Time, data interface{}, typ string) []byte {
 	m := payloadMsgWrap{
-		Timestamp: time.Now(),
-		Type:      typ,
-		Data:      data,
+		Timestamp:   t,
+		TimestampMS: unixMillis(t),
+		Type:        typ,
+		Data:        data,
 	}
 	b, _ := json.Marshal(m)
 	return b
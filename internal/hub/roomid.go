@@ -0,0 +1,135 @@
+package hub
+
+import (
+	"crypto/rand"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// RoomIDWords is the room ID alphabet for IDs made of words instead of
+// characters, eg: "maple-otter-quartz".
+const RoomIDWords = "words"
+
+// roomIDChars are the characters that custom room ID alphabets can use. Room
+// IDs appear in URLs and store keys.
+const roomIDChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-_"
+
+// idWords are the words that room IDs are made of with the words alphabet.
+var idWords = []string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alder",
+	"alloy", "amber", "angle", "ankle", "anvil", "apple", "apron", "arena",
+	"arrow", "aspen", "atlas", "attic", "award", "bacon", "badge", "bagel",
+	"baker", "bamboo", "banjo", "barge", "barn", "basil", "basin", "beach",
+	"beacon", "beard", "bell", "bench", "berry", "bison", "blade", "blaze",
+	"bloom", "board", "boat", "bolt", "bonus", "boot", "brass", "bread",
+	"brick", "bridge", "brook", "broom", "brush", "bucket", "buffalo",
+	"cabin", "cable", "cactus", "camel", "canal", "candle", "canoe", "canyon",
+	"cargo", "carpet", "carrot", "castle", "cedar", "chalk", "cherry",
+	"chess", "chime", "cider", "cinema", "circle", "citrus", "clay", "cliff",
+	"cloud", "clover", "cobalt", "cocoa", "comet", "copper", "coral",
+	"cotton", "crane", "crater", "crayon", "creek", "crown", "crystal",
+	"cube", "daisy", "delta", "desert", "diamond", "dinner", "dolphin",
+	"domino", "dragon", "drum", "dune", "eagle", "easel", "echo", "elbow",
+	"ember", "engine", "falcon", "fern", "ferry", "fiddle", "field", "flame",
+	"flute", "forest", "fossil", "fox", "garden", "garlic", "gecko", "geyser",
+	"ginger", "glacier", "globe", "grape", "gravel", "guitar", "harbor",
+	"harvest", "hazel", "helmet", "heron", "hill", "honey", "horizon",
+	"hotel", "igloo", "island", "ivory", "jacket", "jade", "jasmine", "jelly",
+	"jungle", "kayak", "kettle", "kite", "koala", "ladder", "lagoon", "lake",
+	"lantern", "laser", "lemon", "lily", "lime", "linen", "lion", "lizard",
+	"llama", "lobster", "locket", "lotus", "magnet", "mango", "maple",
+	"marble", "meadow", "melon", "mint", "mirror", "moose", "mosaic", "moss",
+	"mountain", "muffin", "needle", "nest", "nickel", "noodle", "oak",
+	"oasis", "ocean", "olive", "onion", "orange", "orbit", "orchid", "otter",
+	"owl", "paddle", "palm", "panda", "paper", "parrot", "pasta", "peach",
+	"pearl", "pebble", "pepper", "piano", "pilot", "pine", "planet", "plum",
+	"pocket", "pony", "poppy", "puzzle", "quartz", "quill", "rabbit", "radar",
+	"radish", "raven", "reef", "ribbon", "river", "robin", "rocket", "rose",
+	"ruby", "saddle", "salmon", "sand", "satin", "scarf", "shell", "silver",
+	"sketch", "sled", "slope", "spark", "spider", "spoon", "spruce", "squash",
+	"star", "stone", "storm", "sugar", "summit", "sun", "swan", "table",
+	"tango", "temple", "thunder", "tiger", "timber", "toast", "tomato",
+	"torch", "tower", "trail", "tulip", "tunnel", "turtle", "valley",
+	"velvet", "violin", "walnut", "walrus", "wave", "whale", "willow",
+	"window", "winter", "wolf", "yacht", "zebra",
+}
+
+// minRoomIDBits is the least randomness that room IDs have so that rooms
+// can't be found by guessing their IDs.
+const minRoomIDBits = 64
+
+// roomIDLen returns the length of the room IDs generated from the alphabet,
+// n, or more if n is too short for the IDs to have minRoomIDBits of
+// randomness.
+func roomIDLen(alphabet string, n int) int {
+	size := len(alphabet)
+	switch alphabet {
+	case "":
+		size = 62
+	case RoomIDWords:
+		size = len(idWords)
+	}
+	if size < 2 {
+		return n
+	}
+	if min := int(math.Ceil(minRoomIDBits / math.Log2(float64(size)))); n < min {
+		return min
+	}
+	return n
+}
+
+// validRoomIDAlphabet checks whether room IDs can be generated from the
+// alphabet. Custom alphabets need at least two distinct, URL safe characters.
+func validRoomIDAlphabet(a string) bool {
+	if a == "" || a == RoomIDWords {
+		return true
+	}
+	seen := make(map[rune]bool)
+	for _, c := range a {
+		if !strings.ContainsRune(roomIDChars, c) || seen[c] {
+			return false
+		}
+		seen[c] = true
+	}
+	return len(seen) >= 2
+}
+
+// newRoomID generates a cryptographically random room ID of n characters of
+// the alphabet, or n hyphenated words with the words alphabet. An empty
+// alphabet generates alphanumeric IDs.
+func newRoomID(alphabet string, n int) (string, error) {
+	switch alphabet {
+	case "":
+		return GenerateGUID(n)
+	case RoomIDWords:
+		out := make([]string, n)
+		for i := range out {
+			j, err := randIndex(len(idWords))
+			if err != nil {
+				return "", err
+			}
+			out[i] = idWords[j]
+		}
+		return strings.Join(out, "-"), nil
+	}
+
+	out := make([]byte, n)
+	for i := range out {
+		j, err := randIndex(len(alphabet))
+		if err != nil {
+			return "", err
+		}
+		out[i] = alphabet[j]
+	}
+	return string(out), nil
+}
+
+// randIndex returns a uniformly random index in [0, n).
+func randIndex(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
@@ -0,0 +1,53 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrSearchDisabled is returned on searches when message history isn't
+// stored.
+var ErrSearchDisabled = errors.New("search is disabled as message history isn't stored")
+
+// SearchMessages returns up to limit chat messages in the room's stored
+// history that contain the query, ignoring case, newest first. Edits and
+// deletions are applied to the messages before matching them, so that
+// messages are found by their current text and deleted ones aren't found.
+func (r *Room) SearchMessages(query string, limit int) ([]ChatMessage, error) {
+	if r.hub.cfg.HistorySize <= 0 {
+		return nil, ErrSearchDisabled
+	}
+
+	msgs, err := r.hub.Store.GetMessages(r.ID, r.hub.cfg.HistorySize)
+	if err != nil {
+		return nil, err
+	}
+	msgs = foldHistory(msgs)
+
+	var (
+		q   = strings.ToLower(query)
+		out = []ChatMessage{}
+	)
+	for i := len(msgs) - 1; i >= 0 && len(out) < limit; i-- {
+		var m struct {
+			Type      string         `json:"type"`
+			Timestamp time.Time      `json:"timestamp"`
+			Data      payloadMsgChat `json:"data"`
+		}
+		if err := json.Unmarshal(msgs[i], &m); err != nil || !isChatType(m.Type) || m.Data.ID == "" {
+			continue
+		}
+		if !strings.Contains(strings.ToLower(m.Data.Msg), q) {
+			continue
+		}
+		out = append(out, ChatMessage{
+			ID:        m.Data.ID,
+			Handle:    m.Data.PeerHandle,
+			Text:      m.Data.Msg,
+			Timestamp: m.Timestamp,
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,115 @@
+package hub
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// stampSeq adds the room's next sequence number to a payload recorded in
+// its history. Sequence numbers let peers that reconnect ask for the
+// messages they missed. It's only called from the room's goroutine.
+func (r *Room) stampSeq(b []byte) []byte {
+	if len(b) < 2 || b[0] != '{' {
+		return b
+	}
+	r.seq = r.nextSeq()
+
+	out := make([]byte, 0, len(b)+24)
+	out = append(out, `{"seq":`...)
+	out = strconv.AppendUint(out, r.seq, 10)
+	out = append(out, ',')
+	return append(out, b[1:]...)
+}
+
+// nextSeq returns the room's next sequence number. With shared broadcasts,
+// it's taken from the store so that instances don't stamp their payloads
+// with the same numbers, falling back to the local sequence if that fails.
+// It's only called from the room's goroutine.
+func (r *Room) nextSeq() uint64 {
+	if r.hub.broadcasts != nil {
+		s, err := r.hub.broadcasts.NextSeq(r.ID, r.seq)
+		if err == nil {
+			return s
+		}
+		r.log.Errorf("error getting the next sequence number of %s: %v", r.ID, err)
+	}
+	return r.seq + 1
+}
+
+// loadSeq picks up the room's sequence from the last sequence number in the
+// stored history so that it keeps increasing across restarts. It's only
+// called from the room's goroutine.
+func (r *Room) loadSeq() {
+	n := r.hub.cfg.HistorySize
+	if n <= 0 {
+		return
+	}
+	msgs, err := r.hub.Store.GetMessages(r.ID, n)
+	if err != nil {
+		r.log.Errorf("error getting history of %s: %v", r.ID, err)
+		return
+	}
+	for _, b := range msgs {
+		if s := payloadSeq(b); s > r.seq {
+			r.seq = s
+		}
+	}
+}
+
+// syncSeq catches the room's sequence up with a payload stamped by another
+// instance so that the next local payloads are numbered after it. It's only
+// called from the room's goroutine.
+func (r *Room) syncSeq(b []byte) {
+	if s := payloadSeq(b); s > r.seq {
+		r.seq = s
+	}
+}
+
+// payloadSeq returns the sequence number of a recorded payload, 0 for
+// payloads without one, eg: imported ones.
+func payloadSeq(b []byte) uint64 {
+	var m struct {
+		Seq uint64 `json:"seq"`
+	}
+	json.Unmarshal(b, &m)
+	return m.Seq
+}
+
+// replaySince sends a reconnecting peer the recorded payloads after the
+// sequence number it last received, from the store's history if it's
+// enabled, or the cache otherwise. At most max_replay_messages of the latest
+// payloads are sent. It returns false if the sequence number isn't one the
+// room issued, eg: when the room was restarted without a stored history, in
+// which case the peer should be sent the history instead. It's only called
+// from the room's goroutine.
+func (r *Room) replaySince(p *Peer, seq uint64) bool {
+	max := r.hub.cfg.MaxReplayMessages
+	if max <= 0 || seq == 0 || seq > r.seq {
+		return false
+	}
+
+	msgs := r.payloadCache
+	if n := r.hub.cfg.HistorySize; n > 0 {
+		r.flushHistory()
+		m, err := r.hub.Store.GetMessages(r.ID, n)
+		if err != nil {
+			r.log.Errorf("error getting history of %s: %v", r.ID, err)
+			return false
+		}
+		msgs = m
+	}
+
+	var missed [][]byte
+	for _, b := range msgs {
+		if payloadSeq(b) > seq {
+			missed = append(missed, b)
+		}
+	}
+	if len(missed) > max {
+		missed = missed[len(missed)-max:]
+	}
+	for _, b := range missed {
+		p.SendData(b)
+	}
+	return true
+}
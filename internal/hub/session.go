@@ -0,0 +1,108 @@
+package hub
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Actions on logins over the handle's session limit.
+const (
+	SessionLimitReject = "reject"
+	SessionLimitEvict  = "evict"
+)
+
+// ErrTooManySessions is returned on logins over the handle's session limit
+// when they're rejected.
+var ErrTooManySessions = errors.New("too many sessions for this handle, log out elsewhere first")
+
+// addSession registers a new session of a handle in the store after making
+// room for it under the handle's session limit, returning its ID.
+func (r *Room) addSession(handle string, ttl time.Duration) (string, error) {
+	r.sessMu.Lock()
+	defer r.sessMu.Unlock()
+
+	if err := r.limitSessions(handle); err != nil {
+		return "", err
+	}
+
+	// Register a new session for the peer in the DB.
+	sessID, err := GenerateGUID(32)
+	if err != nil {
+		r.log.Errorf("error generating session ID: %v", err)
+		return "", errors.New("error generating session ID")
+	}
+
+	if err := r.hub.Store.AddSession(sessID, handle, r.ID, ttl); err != nil {
+		r.log.Errorf("error creating session: %v", err)
+		return "", errors.New("error storing session")
+	}
+	return sessID, nil
+}
+
+// limitSessions makes room for a new session of a handle if it's at the
+// limit of sessions, either rejecting the login or evicting the handle's
+// oldest sessions. Only predefined users' handles are limited as they're
+// the only ones owned by someone, guarded by a password. Anyone could take
+// any other handle and lock out or evict whoever else is using it.
+func (r *Room) limitSessions(handle string) error {
+	max := r.hub.cfg.MaxSessionsPerHandle
+	if max < 1 || !r.isPredefinedUser(handle) {
+		return nil
+	}
+
+	ids, err := r.hub.Store.HandleSessions(r.ID, handle)
+	if err != nil {
+		r.log.Errorf("error getting sessions of %s: %v", handle, err)
+		return errors.New("error getting sessions")
+	}
+	if len(ids) < max {
+		return nil
+	}
+	if r.hub.cfg.SessionLimitAction != SessionLimitEvict {
+		return ErrTooManySessions
+	}
+
+	ids = ids[:len(ids)-max+1]
+	for _, id := range ids {
+		if err := r.hub.Store.RemoveSession(id, r.ID); err != nil {
+			r.log.Errorf("error removing session: %v", err)
+			return errors.New("error removing session")
+		}
+	}
+	r.evictSessions(ids)
+	r.log.Infof("evicted %d session(s) of %s from %s", len(ids), handle, r.ID)
+	return nil
+}
+
+// evictSessions disconnects the peers of evicted sessions. The peers are
+// removed from the room when their listeners see the connections closing.
+func (r *Room) evictSessions(ids []string) {
+	evicted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		evicted[id] = true
+	}
+
+	r.do(func() {
+		for p := range r.peers {
+			if !evicted[p.ID] {
+				continue
+			}
+			p.writeWSControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypeSessionEvicted))
+			p.ws.Close()
+		}
+	})
+}
+
+// isPredefinedUser returns true if the handle is one of the room's
+// predefined users'.
+func (r *Room) isPredefinedUser(handle string) bool {
+	for _, u := range r.PredefinedUsers {
+		if u.Name == handle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionLimit(t *testing.T) {
+	login := func(t *testing.T, r *Room, handle string) string {
+		t.Helper()
+		id, err := r.Login("password", handle, "secret", time.Hour)
+		if err != nil {
+			t.Fatalf("error logging in as %s: %v", handle, err)
+		}
+		return id
+	}
+	users := []PredefinedUser{{Name: "alice", Password: "secret"}}
+
+	t.Run("evict", func(t *testing.T) {
+		h := newTestHub(t, func(c *Config) {
+			c.MaxSessionsPerHandle = 2
+			c.SessionLimitAction = SessionLimitEvict
+		})
+		r := newTestRoom(t, h)
+		r.PredefinedUsers = users
+
+		first := login(t, r, "alice")
+		ws, client, closeConn := newTestConn(t)
+		defer closeConn()
+		joinTestPeerConn(r, first, "alice", ws)
+		second := login(t, r, "alice")
+
+		// The oldest session is evicted and its peer disconnected.
+		third := login(t, r, "alice")
+		if reason := closeReason(t, client); reason != TypeSessionEvicted {
+			t.Errorf("close reason = %q, want %q", reason, TypeSessionEvicted)
+		}
+		ids, err := h.Store.HandleSessions(r.ID, "alice")
+		if err != nil {
+			t.Fatalf("error getting sessions: %v", err)
+		}
+		if len(ids) != 2 || ids[0] != second || ids[1] != third {
+			t.Errorf("sessions = %v, want %v", ids, []string{second, third})
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		h := newTestHub(t, func(c *Config) {
+			c.MaxSessionsPerHandle = 1
+			c.SessionLimitAction = SessionLimitReject
+		})
+		r := newTestRoom(t, h)
+		r.PredefinedUsers = users
+
+		login(t, r, "alice")
+		if _, err := r.Login("password", "alice", "secret", time.Hour); err != ErrTooManySessions {
+			t.Errorf("login over the limit: got %v, want %v", err, ErrTooManySessions)
+		}
+
+		// Handles that aren't predefined users' aren't limited.
+		login(t, r, "bob")
+		login(t, r, "bob")
+	})
+}
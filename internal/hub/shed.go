@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerBusy is sent back to peers whose non-essential messages (typing,
+// growl) are rejected while the hub is shedding load.
+var ErrServerBusy = errors.New("server busy")
+
+// runLoadMonitor is a blocking function that periodically checks the depth
+// of the broadcast queues of all rooms and the CPU used by the process, and
+// turns load shedding on when either goes over its configured threshold. It's
+// turned off once the depth drops below half of its threshold and the CPU
+// below three quarters of its. This should be invoked as a goroutine.
+func (h *Hub) runLoadMonitor() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	var (
+		lastCPU, _ = processCPUTime()
+		lastTick   = time.Now()
+	)
+	for now := range t.C {
+		depth := 0
+		for _, r := range h.getRooms() {
+			depth += len(r.broadcastQ) + len(r.remoteQ)
+		}
+		atomic.StoreInt64(&h.queueDepth, int64(depth))
+
+		// Percentage of all the CPUs used by the process since the last
+		// tick.
+		cpu := 0
+		if c, ok := processCPUTime(); ok {
+			cpu = int(100 * (c - lastCPU) / (now.Sub(lastTick) * time.Duration(runtime.NumCPU())))
+			lastCPU = c
+		}
+		lastTick = now
+		atomic.StoreInt64(&h.cpuLoad, int64(cpu))
+
+		var (
+			maxDepth = h.cfg.ShedQueueDepth
+			maxCPU   = h.cfg.ShedCPU
+			shedding = h.Shedding()
+		)
+		if !shedding && ((maxDepth > 0 && depth > maxDepth) || (maxCPU > 0 && cpu > maxCPU)) {
+			atomic.StoreInt32(&h.shedding, 1)
+			h.log.Warnf("shedding load: broadcast queue depth %d (max %d), CPU %d%% (max %d%%)", depth, maxDepth, cpu, maxCPU)
+		} else if shedding && (maxDepth <= 0 || depth < maxDepth/2) && (maxCPU <= 0 || cpu < maxCPU*3/4) {
+			atomic.StoreInt32(&h.shedding, 0)
+			h.log.Infof("stopped shedding load: broadcast queue depth %d, CPU %d%%", depth, cpu)
+		}
+	}
+}
+
+// Shedding returns true if the hub is shedding load and rejecting
+// non-essential messages.
+func (h *Hub) Shedding() bool {
+	return atomic.LoadInt32(&h.shedding) == 1
+}
@@ -0,0 +1,62 @@
+package hub
+
+import (
+	"context"
+
+	"github.com/gorilla/websocket"
+)
+
+// Shutdown tells all peers that the server is going away once their queued
+// messages are written, and waits for that to happen or for ctx to be done.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	// Stop relaying other instances' broadcasts to the closing rooms.
+	if h.fanoutStop != nil {
+		close(h.fanoutStop)
+	}
+
+	var peers []*Peer
+	for _, r := range h.getRooms() {
+		ch := make(chan []*Peer, 1)
+		select {
+		case r.op <- func() { ch <- r.closePeers() }:
+		case <-r.stop:
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case p := <-ch:
+			peers = append(peers, p...)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for _, p := range peers {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// closePeers removes all peers from the room and queues a going away close
+// frame after their pending messages. Their resume tokens are stored so that
+// they can resume once the server is back. It returns the removed peers. It's
+// only called from the room's goroutine.
+func (r *Room) closePeers() []*Peer {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+
+	out := make([]*Peer, 0, len(r.peers))
+	for p := range r.peers {
+		delete(r.peers, p)
+		if r.resume.enabled() {
+			r.detachResume(p)
+		}
+		p.queue(outMsg{close: msg})
+		out = append(out, p)
+	}
+	return out
+}
@@ -0,0 +1,182 @@
+package hub
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DropStats represents the number of messages and peers dropped while
+// delivering messages to peers.
+type DropStats struct {
+	Messages uint64 `json:"dropped_messages"`
+	Peers    uint64 `json:"dropped_peers"`
+}
+
+// dropCounter keeps DropStats that can be updated concurrently.
+type dropCounter struct {
+	messages uint64
+	peers    uint64
+}
+
+// add increments the counters and returns the updated number of dropped peers.
+func (d *dropCounter) add(peers, messages uint64) uint64 {
+	atomic.AddUint64(&d.messages, messages)
+	return atomic.AddUint64(&d.peers, peers)
+}
+
+// get returns a snapshot of the counters.
+func (d *dropCounter) get() DropStats {
+	return DropStats{
+		Messages: atomic.LoadUint64(&d.messages),
+		Peers:    atomic.LoadUint64(&d.peers),
+	}
+}
+
+// DropStats returns the number of messages and peers dropped across all rooms.
+func (h *Hub) DropStats() DropStats {
+	return h.drops.get()
+}
+
+// DropStats returns the number of messages and peers dropped in the room.
+func (r *Room) DropStats() DropStats {
+	return r.drops.get()
+}
+
+// recordDrop records a peer that was dropped along with the messages in its
+// queue that could not be delivered. Drops are logged at the configured
+// sampling rate.
+func (r *Room) recordDrop(p *Peer, messages uint64) {
+	r.drops.add(1, messages)
+	n := r.hub.drops.add(1, messages)
+
+	if s := r.hub.cfg.DropLogSampling; s > 0 && n%uint64(s) == 0 {
+		st := r.hub.drops.get()
+		p.log.Warnf("dropped %s@%s from %s with %d undelivered messages (total: %d peers, %d messages)",
+			p.Handle, p.ID, r.ID, messages, st.Peers, st.Messages)
+	}
+}
+
+// Stats represents the runtime statistics of the hub and its active rooms.
+type Stats struct {
+	Shedding   bool                 `json:"shedding"`
+	QueueDepth int64                `json:"queue_depth"`
+	CPU        int64                `json:"cpu_percent"`
+	Drops      DropStats            `json:"drops"`
+	Joins      JoinStats            `json:"joins"`
+	Latency    LatencyStats         `json:"delivery_latency"`
+	Rooms      map[string]RoomStats `json:"rooms"`
+}
+
+// RoomStats represents the runtime statistics of a room.
+type RoomStats struct {
+	Drops   DropStats    `json:"drops"`
+	Latency LatencyStats `json:"delivery_latency"`
+}
+
+// Stats returns the runtime statistics of the hub and its active rooms.
+func (h *Hub) Stats() Stats {
+	rooms := h.getRooms()
+	out := Stats{
+		Shedding:   h.Shedding(),
+		QueueDepth: atomic.LoadInt64(&h.queueDepth),
+		CPU:        atomic.LoadInt64(&h.cpuLoad),
+		Drops:      h.DropStats(),
+		Joins:      h.JoinStats(),
+		Latency:    h.LatencyStats(),
+		Rooms:      make(map[string]RoomStats, len(rooms)),
+	}
+	for _, r := range rooms {
+		out.Rooms[r.ID] = RoomStats{
+			Drops:   r.DropStats(),
+			Latency: r.LatencyStats(),
+		}
+	}
+	return out
+}
+
+// RoomSummary represents the occupancy and activity of a room.
+type RoomSummary struct {
+	// Peers connected to the room on all instances.
+	Peers int `json:"peers"`
+
+	// Whether the room is running on this instance. Rooms in the store
+	// are started when peers join them.
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Chat messages posted since the room was started.
+	Messages int `json:"messages"`
+}
+
+// RoomSummary returns the summary of a room without starting it if it isn't
+// active.
+func (h *Hub) RoomSummary(id string) (RoomSummary, error) {
+	if r := h.GetRoom(id); r != nil {
+		if s, ok := r.Summary(); ok {
+			return s, nil
+		}
+	}
+
+	r, err := h.Store.GetRoom(id)
+	if err != nil {
+		return RoomSummary{}, errors.New("room doesn't exist")
+	}
+	return RoomSummary{CreatedAt: r.CreatedAt}, nil
+}
+
+// Summary returns the summary of the room, read on the room's goroutine. It
+// returns false if the room has been disposed.
+func (r *Room) Summary() (RoomSummary, bool) {
+	var (
+		out  RoomSummary
+		done = make(chan bool)
+	)
+	if !r.do(func() {
+		out = RoomSummary{
+			Peers:     len(r.peers) + len(r.presence.remotePeers()),
+			Active:    true,
+			CreatedAt: r.CreatedAt,
+			Messages:  r.numMessages,
+		}
+		close(done)
+	}) {
+		return RoomSummary{}, false
+	}
+	<-done
+	return out, true
+}
+
+// RoomInfo represents an active room in the list of rooms for admins.
+type RoomInfo struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Predefined bool   `json:"predefined"`
+	RoomSummary
+
+	// Seconds since the room was created.
+	Age int64 `json:"age"`
+}
+
+// ActiveRooms returns the rooms active on this instance sorted by ID.
+func (h *Hub) ActiveRooms() []RoomInfo {
+	rooms := h.getRooms()
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+
+	out := make([]RoomInfo, 0, len(rooms))
+	for _, r := range rooms {
+		s, ok := r.Summary()
+		if !ok {
+			continue
+		}
+		out = append(out, RoomInfo{
+			ID:          r.ID,
+			Name:        r.Name,
+			Predefined:  r.Predefined,
+			RoomSummary: s,
+			Age:         int64(time.Since(r.CreatedAt) / time.Second),
+		})
+	}
+	return out
+}
@@ -0,0 +1,35 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+func TestRecordDrop(t *testing.T) {
+	h := newTestHub(t, nil)
+	r := h.initRoom(store.Room{ID: "room1", CreatedAt: time.Now()}, false)
+	p := newPeer("peer1", "alice", nil, r)
+
+	tests := []struct {
+		messages uint64
+		want     DropStats
+	}{
+		{0, DropStats{Messages: 0, Peers: 1}},
+		{5, DropStats{Messages: 5, Peers: 2}},
+		{3, DropStats{Messages: 8, Peers: 3}},
+	}
+	for _, tt := range tests {
+		r.recordDrop(p, tt.messages)
+		if got := r.DropStats(); got != tt.want {
+			t.Errorf("room drops after %d messages: got %+v, want %+v", tt.messages, got, tt.want)
+		}
+		if got := h.Stats().Rooms[r.ID].Drops; got != tt.want {
+			t.Errorf("room stats drops after %d messages: got %+v, want %+v", tt.messages, got, tt.want)
+		}
+		if got := h.Stats().Drops; got != tt.want {
+			t.Errorf("hub drops after %d messages: got %+v, want %+v", tt.messages, got, tt.want)
+		}
+	}
+}
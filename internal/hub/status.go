@@ -0,0 +1,72 @@
+package hub
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Statuses of peers.
+const (
+	StatusOnline = "online"
+	StatusAway   = "away"
+	StatusBusy   = "busy"
+)
+
+// ErrInvalidStatus is sent back to peers that set an unknown status.
+var ErrInvalidStatus = errors.New("status should be one of online|away|busy")
+
+// validStatus checks whether a status can be set by peers.
+func validStatus(s string) bool {
+	return s == StatusOnline || s == StatusAway || s == StatusBusy
+}
+
+// setStatus sets the peer's status and tells the room about it.
+func (r *Room) setStatus(p *Peer, status string) {
+	r.do(func() {
+		if !r.peers[p] || p.status == status {
+			return
+		}
+		p.status = status
+		p.autoAway = false
+		r.emit(r.makePeerUpdatePayload(p, TypeStatus), false)
+	})
+}
+
+// idled marks the peer as away as it hasn't sent anything for the idle
+// timeout. Peers that have set a status themselves are left alone. This is
+// invoked by the peer's idle timer.
+func (p *Peer) idled() {
+	atomic.StoreInt32(&p.idle, 1)
+	r := p.room
+	r.do(func() {
+		// The peer may have become active since.
+		if !r.peers[p] || p.status != StatusOnline || atomic.LoadInt32(&p.idle) == 0 {
+			return
+		}
+		p.status = StatusAway
+		p.autoAway = true
+		r.emit(r.makePeerUpdatePayload(p, TypeStatus), false)
+	})
+}
+
+// active restarts the peer's idle timer, bringing it back online if it was
+// marked as away for idling. This should only be called from the listener.
+func (p *Peer) active() {
+	if p.idleTimer == nil {
+		return
+	}
+	p.idleTimer.Reset(p.room.hub.cfg.IdleTimeout)
+	if !atomic.CompareAndSwapInt32(&p.idle, 1, 0) {
+		return
+	}
+
+	r := p.room
+	r.do(func() {
+		if !r.peers[p] || !p.autoAway {
+			return
+		}
+		p.status = StatusOnline
+		p.autoAway = false
+		r.emit(r.makePeerUpdatePayload(p, TypeStatus), false)
+	})
+}
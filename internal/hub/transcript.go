@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrExportDisabled is returned on exports when message history isn't stored.
+var ErrExportDisabled = errors.New("export is disabled as message history isn't stored")
+
+// TranscriptEntry is an event in a room's stored history.
+type TranscriptEntry struct {
+	Type string `json:"type"`
+
+	// ID of the message for chat messages and their mutations.
+	ID        string    `json:"id,omitempty"`
+	Handle    string    `json:"handle,omitempty"`
+	OldHandle string    `json:"old_handle,omitempty"`
+	Text      string    `json:"message,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// WalkTranscript calls fn with each event in the room's stored history,
+// oldest first, as it's read from the store.
+func (r *Room) WalkTranscript(fn func(e TranscriptEntry) error) error {
+	if r.hub.cfg.HistorySize <= 0 {
+		return ErrExportDisabled
+	}
+
+	return r.hub.Store.WalkMessages(r.ID, func(b []byte) error {
+		var m struct {
+			Type      string    `json:"type"`
+			Timestamp time.Time `json:"timestamp"`
+			Data      struct {
+				ID         string `json:"id"`
+				PeerHandle string `json:"peer_handle"`
+				Handle     string `json:"handle"`
+				OldHandle  string `json:"old_handle"`
+				Msg        string `json:"message"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(b, &m); err != nil {
+			r.log.Errorf("error decoding history of %s: %v", r.ID, err)
+			return nil
+		}
+
+		e := TranscriptEntry{
+			Type:      m.Type,
+			Handle:    m.Data.PeerHandle,
+			OldHandle: m.Data.OldHandle,
+			Text:      m.Data.Msg,
+			Timestamp: m.Timestamp,
+		}
+		if e.Handle == "" {
+			e.Handle = m.Data.Handle
+		}
+		if isChatType(m.Type) || m.Type == TypeMessageEdit || m.Type == TypeMessageDelete {
+			e.ID = m.Data.ID
+		}
+		return fn(e)
+	})
+}
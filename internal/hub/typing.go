@@ -0,0 +1,41 @@
+package hub
+
+import "time"
+
+// typing (re)starts the peer's typing timer after a typing event so that
+// the room is told when the peer stops typing. This should only be called
+// from the listener.
+func (p *Peer) typing() {
+	d := p.room.hub.cfg.TypingTimeout
+	if d <= 0 {
+		return
+	}
+	if p.typingTimer == nil {
+		p.typingTimer = time.AfterFunc(d, p.stoppedTyping)
+		return
+	}
+	p.typingTimer.Reset(d)
+}
+
+// stopTyping cancels the peer's typing timer when it disconnects. Peers
+// leaving are announced anyway. This should only be called from the
+// listener.
+func (p *Peer) stopTyping() {
+	if p.typingTimer != nil {
+		p.typingTimer.Stop()
+	}
+}
+
+// stoppedTyping tells the room that the peer stopped typing as it hasn't sent
+// a typing event for the typing timeout. This is invoked by the peer's typing
+// timer.
+func (p *Peer) stoppedTyping() {
+	r := p.room
+	r.do(func() {
+		// The peer may have left since.
+		if !r.peers[p] {
+			return
+		}
+		r.emit(r.makePeerUpdatePayload(p, TypeTypingStop), false)
+	})
+}
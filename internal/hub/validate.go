@@ -0,0 +1,365 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/knadh/niltalk/internal/captcha"
+	"github.com/knadh/niltalk/internal/log"
+	"github.com/knadh/niltalk/internal/notify"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Validate checks the config for missing and invalid values, returning an
+// error that lists all the problems found, one per line.
+func (c *Config) Validate() error {
+	var errs []string
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+
+	minTime := time.Duration(3) * time.Second
+	if c.WSTimeout < minTime {
+		add("app.websocket_timeout should be >= 3s")
+	}
+	if c.RoomAge < minTime {
+		add("app.room_age should be >= 3s")
+	}
+	if c.RoomIdleTimeout != 0 && c.RoomIdleTimeout < minTime {
+		add("app.room_idle_timeout should be 0 or >= 3s")
+	}
+	if c.SessionTTL != 0 && c.SessionTTL < minTime {
+		add("app.session_ttl should be 0 or >= 3s")
+	}
+
+	switch c.Storage {
+	case "redis", "memory", "fs":
+	case "":
+		add("app.storage is required: one of redis|memory|fs")
+	default:
+		add("app.storage should be one of redis|memory|fs, not %q", c.Storage)
+	}
+
+	if c.Address == "" {
+		add("app.address is required, eg: 0.0.0.0:9000")
+	}
+	if c.RoomIDLen < 1 {
+		add("app.room_id_length should be > 0")
+	}
+	if !validRoomIDAlphabet(c.RoomIDAlphabet) {
+		add("app.room_id_alphabet should be %q or at least two distinct letters, digits, - or _", RoomIDWords)
+	}
+	if c.MaxMessageLen < 1 {
+		add("app.max_message_length should be > 0")
+	}
+
+	switch c.PasswordHash {
+	case "", PasswordBcrypt, PasswordArgon2id:
+	default:
+		add("app.password_hash should be one of %s|%s", PasswordBcrypt, PasswordArgon2id)
+	}
+	if c.BcryptCost != 0 && (c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost) {
+		add("app.bcrypt_cost should be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if c.Argon2Threads < 0 || c.Argon2Threads > 255 {
+		add("app.argon2_threads should be between 0 and 255")
+	}
+	if c.RoomPasswordMinLen < 0 || c.RoomPasswordMinLen > maxPasswordLen {
+		add("app.room_password_min_length should be between 0 and %d", maxPasswordLen)
+	}
+	if c.RoomPasswordClasses < 0 || c.RoomPasswordClasses > 4 {
+		add("app.room_password_classes should be between 0 and 4")
+	}
+
+	// Limits that can't be negative.
+	for _, l := range []struct {
+		key string
+		val int
+	}{
+		{"max_cached_messages", c.MaxCachedMessages},
+		{"max_message_queue", c.MaxMessageQueue},
+		{"rate_limit_messages", c.RateLimitMessages},
+		{"max_rooms", c.MaxRooms},
+		{"argon2_time", c.Argon2Time},
+		{"argon2_memory", c.Argon2Memory},
+		{"max_peers_per_room", c.MaxPeersPerRoom},
+		{"max_import_messages", c.MaxImportMessages},
+		{"resume_buffer_size", c.ResumeBufferSize},
+		{"max_replay_messages", c.MaxReplayMessages},
+		{"max_reply_depth", c.MaxReplyDepth},
+		{"max_feed_entries", c.MaxFeedEntries},
+		{"growl_rate_limit", c.GrowlRateLimit},
+		{"shed_queue_depth", c.ShedQueueDepth},
+		{"shed_cpu", c.ShedCPU},
+		{"history_size", c.HistorySize},
+		{"room_error_threshold", c.RoomErrorThreshold},
+		{"max_concurrent_joins", c.MaxConcurrentJoins},
+		{"max_queued_joins", c.MaxQueuedJoins},
+		{"max_pins", c.MaxPins},
+		{"http_rate_limit", c.HTTPRateLimit},
+		{"compress_min_size", c.CompressMinSize},
+		{"ws_read_buffer", c.WSReadBuffer},
+		{"ws_write_buffer", c.WSWriteBuffer},
+		{"peer_queue_size", c.PeerQueueSize},
+		{"broadcast_workers", c.BroadcastWorkers},
+		{"max_sessions_per_handle", c.MaxSessionsPerHandle},
+	} {
+		if l.val < 0 {
+			add("app.%s should be >= 0", l.key)
+		}
+	}
+
+	if c.ShedCPU > 100 {
+		add("app.shed_cpu should be a percentage <= 100")
+	}
+	if c.StaticMaxAge < 0 {
+		add("app.static_max_age should be >= 0")
+	}
+	if c.HTTPRateLimit > 0 && c.HTTPRateLimitInterval <= 0 {
+		add("app.http_rate_limit_interval should be > 0")
+	}
+
+	for _, p := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil {
+			add("app.trusted_proxies: %q should be a CIDR, eg: 10.0.0.0/8", p)
+		}
+	}
+
+	for _, o := range c.AllowedOrigins {
+		if !validOrigin(o) {
+			add("app.allowed_origins: %q should be an origin, eg: https://*.example.com", o)
+		}
+	}
+	for _, o := range c.CORSOrigins {
+		if !validOrigin(o) {
+			add("app.cors_origins: %q should be an origin, eg: https://*.example.com", o)
+		}
+		if o == "*" && c.CORSCredentials {
+			add("app.cors_origins: \"*\" can't be used with app.cors_credentials")
+		}
+	}
+
+	if c.IdleTimeout < 0 {
+		add("app.idle_timeout should be >= 0")
+	}
+	for _, t := range []struct {
+		key string
+		val time.Duration
+	}{
+		{"http_read_header_timeout", c.HTTPReadHeaderTimeout},
+		{"http_read_timeout", c.HTTPReadTimeout},
+		{"http_write_timeout", c.HTTPWriteTimeout},
+		{"http_idle_timeout", c.HTTPIdleTimeout},
+		{"http_upload_timeout", c.HTTPUploadTimeout},
+	} {
+		if t.val < 0 {
+			add("app.%s should be >= 0", t.key)
+		}
+	}
+	if c.TypingTimeout < 0 {
+		add("app.typing_timeout should be >= 0")
+	}
+
+	if c.RoomErrorThreshold > 0 &&
+		c.RoomErrorAction != ErrorActionDispose && c.RoomErrorAction != ErrorActionLock {
+		add("app.room_error_action should be one of dispose|lock")
+	}
+
+	if c.SharedPresence {
+		if c.Storage != "redis" {
+			add("app.shared_presence requires a store that's shared across instances (redis)")
+		}
+		if c.PresenceInterval < time.Second {
+			add("app.presence_interval should be >= 1s")
+		}
+	}
+	if c.SharedBroadcast && !c.SharedPresence {
+		add("app.shared_broadcast requires app.shared_presence")
+	}
+
+	switch c.LogFormat {
+	case "", log.FormatText, log.FormatJSON:
+	default:
+		add("app.log_format should be one of text|json")
+	}
+	if c.LogLevel != "" {
+		if _, err := log.ParseLevel(c.LogLevel); err != nil {
+			add("app.log_level should be one of debug|info|warn|error")
+		}
+	}
+
+	switch c.HistoryReplay {
+	case "", HistoryFolded, HistoryEvents:
+	default:
+		add("app.history_replay should be one of folded|events")
+	}
+
+	switch c.RoomNameCollision {
+	case "", NameCollisionAllow, NameCollisionReject, NameCollisionSuffix:
+	default:
+		add("app.room_name_collision should be one of allow|reject|suffix")
+	}
+
+	switch c.UniqueHandles {
+	case "", HandleCollisionAllow, HandleCollisionReject, HandleCollisionSuffix:
+	default:
+		add("app.unique_handles should be one of allow|reject|suffix")
+	}
+	if c.Locale != "" && !validLocale(c.Locale) {
+		add("app.locale should be a locale, eg: en or pt-BR")
+	}
+	switch c.SessionLimitAction {
+	case "", SessionLimitReject, SessionLimitEvict:
+	default:
+		add("app.session_limit_action should be one of %s|%s", SessionLimitReject, SessionLimitEvict)
+	}
+
+	if !ValidFormatPolicy(c.FormatPolicy) {
+		add("unknown app.format_policy %q", c.FormatPolicy)
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		add("app.tls_cert and app.tls_key should be set together")
+	}
+	if c.TLSRedirect && c.TLSCert == "" {
+		add("app.tls_redirect requires app.tls_cert and app.tls_key")
+	}
+
+	if c.TorRemotePort < 0 || c.TorRemotePort > 65535 {
+		add("app.tor_remote_port should be between 1 and 65535")
+	}
+
+	if c.PushVAPIDPrivateKey != "" &&
+		!strings.HasPrefix(c.PushSubject, "mailto:") && !strings.HasPrefix(c.PushSubject, "https:") {
+		add("app.push_subject should be a mailto: or https: contact when push notifications are enabled")
+	}
+
+	switch c.CaptchaProvider {
+	case "":
+	case captcha.ProviderHCaptcha, captcha.ProviderReCaptcha:
+		if c.CaptchaSiteKey == "" || c.CaptchaSecret == "" {
+			add("app.captcha_site_key and app.captcha_secret are required for app.captcha_provider %s", c.CaptchaProvider)
+		}
+	case captcha.ProviderPoW:
+		if c.CaptchaDifficulty < 1 || c.CaptchaDifficulty > 32 {
+			add("app.captcha_difficulty should be between 1 and 32")
+		}
+		// Challenges are held in the memory of the instance that issued
+		// them, which the solution may not reach behind a load balancer.
+		if c.SharedPresence {
+			add("app.captcha_provider pow can't be used with multiple instances (app.shared_presence)")
+		}
+	default:
+		add("app.captcha_provider should be one of hcaptcha|recaptcha|pow")
+	}
+
+	names := make([]string, 0, len(c.Rooms))
+	for name := range c.Rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		errs = append(errs, c.Rooms[name].validate(name)...)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "\n"))
+}
+
+// validate returns the problems with a predefined room's config.
+func (r PredefinedRoom) validate(name string) []string {
+	var errs []string
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf("rooms.%s.", name)+fmt.Sprintf(format, a...))
+	}
+
+	if r.ID == "" {
+		add("id is required")
+	}
+	if r.Name == "" {
+		add("name is required")
+	}
+	if !ValidFormatPolicy(r.FormatPolicy) {
+		add("format_policy: unknown policy %q", r.FormatPolicy)
+	}
+	if r.MaxPeers < 0 {
+		add("max_peers should be >= 0")
+	}
+	if r.MaxMessageLen < 0 {
+		add("max_message_length should be >= 0")
+	}
+	if r.RateLimitMessages < 0 {
+		add("rate_limit_messages should be >= 0")
+	}
+
+	roles := map[string]bool{RoleModerator: true}
+	for _, role := range r.Roles {
+		if strings.TrimSpace(role) == "" {
+			add("roles: role names can't be empty")
+		}
+		roles[role] = true
+	}
+	for _, u := range r.Users {
+		for _, role := range u.Roles {
+			if !roles[role] {
+				add("users.%s.roles: unknown role %q, should be %s or one of the room's roles", u.Name, role, RoleModerator)
+			}
+		}
+	}
+
+	for _, u := range r.Webhook.URLs {
+		if !validHTTPURL(u) {
+			add("webhook.urls: %q should be an http(s) URL", u)
+		}
+	}
+	if r.Webhook.Retries < 0 {
+		add("webhook.retries should be >= 0")
+	}
+
+	if r.Bridge.URL != "" {
+		if !validHTTPURL(r.Bridge.URL) {
+			add("bridge.url: %q should be an http(s) URL", r.Bridge.URL)
+		}
+		switch r.Bridge.Provider {
+		case notify.BridgeSlack, notify.BridgeDiscord:
+		default:
+			add("bridge.provider should be one of slack|discord")
+		}
+	}
+	return errs
+}
+
+// validLocale checks whether s is a locale name made of letters, digits, - and
+// _, which also keeps it from escaping the locale directory.
+func validLocale(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// validHTTPURL checks whether s is an absolute http(s) URL.
+func validHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validOrigin checks whether s is "*" or an origin pattern, eg:
+// https://*.example.com.
+func validOrigin(s string) bool {
+	if s == "*" {
+		return true
+	}
+	_, err := path.Match(s, "")
+	return err == nil && strings.Contains(s, "://")
+}
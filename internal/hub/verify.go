@@ -0,0 +1,67 @@
+package hub
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+type payloadVerify struct {
+	Question string `json:"question,omitempty"`
+	Verified bool   `json:"verified"`
+}
+
+// needsVerification returns true if the peer has to solve a challenge before
+// its first message is posted. Predefined users are trusted.
+func (p *Peer) needsVerification() bool {
+	if p.verified || !p.room.verifyFirstPost {
+		return false
+	}
+	for _, u := range p.room.PredefinedUsers {
+		if u.Name == p.Handle {
+			return false
+		}
+	}
+	return true
+}
+
+// challenge holds back the peer's message and sends the peer a challenge
+// that it has to solve for the message to be posted.
+func (p *Peer) challenge(m chatMessage) {
+	p.heldMsg = &m
+
+	a, b := randInt(10), randInt(10)
+	p.verifyAnswer = strconv.Itoa(a + b)
+	p.SendData(p.room.makePayload(payloadVerify{
+		Question: p.room.hub.msg("verify.question", a, b),
+	}, TypeVerify))
+}
+
+// verify checks the peer's answer to its challenge, posting the held back
+// message on success and sending a new challenge otherwise.
+func (p *Peer) verify(answer string) {
+	if p.verified || p.heldMsg == nil {
+		return
+	}
+	if strings.TrimSpace(answer) != p.verifyAnswer {
+		p.room.recordError(p, "failed verification")
+		p.challenge(*p.heldMsg)
+		return
+	}
+
+	p.verified = true
+	p.SendData(p.room.makePayload(payloadVerify{Verified: true}, TypeVerify))
+
+	m := *p.heldMsg
+	p.heldMsg = nil
+	p.room.postMessage(p, m)
+}
+
+func randInt(max int64) int {
+	n, err := rand.Int(rand.Reader, big.NewInt(max))
+	if err != nil {
+		return 1
+	}
+	return int(n.Int64())
+}
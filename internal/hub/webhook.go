@@ -0,0 +1,9 @@
+package hub
+
+// webhookPeer fires a peer join or leave webhook.
+func (r *Room) webhookPeer(event string, p *Peer) {
+	if r.WebhookHandler == nil {
+		return
+	}
+	r.WebhookHandler(event, payloadMsgPeer{ID: p.ID, Handle: p.Handle})
+}
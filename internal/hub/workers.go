@@ -0,0 +1,80 @@
+package hub
+
+import (
+	"sync"
+	"time"
+)
+
+// Rooms with fewer peers than this are broadcast to from the room's
+// goroutine, as handing the peers off to workers costs more than it saves.
+const minParallelPeers = 256
+
+// broadcastJob is a share of a room's peers that a worker sends a broadcast
+// to.
+type broadcastJob struct {
+	peers   []*Peer
+	data    []byte
+	channel string
+	at      time.Time
+	wg      *sync.WaitGroup
+}
+
+// runBroadcastWorker is a blocking function that queues broadcasts to the
+// peers handed to it by rooms. This should be invoked as a goroutine.
+func (h *Hub) runBroadcastWorker() {
+	for j := range h.broadcastJobs {
+		sendPeers(j.peers, j.data, j.channel, j.at)
+		j.wg.Done()
+	}
+}
+
+// sendBroadcast queues a broadcast to the room's peers, or to those
+// subscribed to a channel if it's set. The peers of large rooms are split
+// among the hub's broadcast workers, and the room waits for them so that
+// every peer gets the room's broadcasts in order. It's only called from the
+// room's goroutine.
+func (r *Room) sendBroadcast(data []byte, channel string, at time.Time) {
+	n := r.hub.cfg.BroadcastWorkers
+	if n < 2 || len(r.peers) < minParallelPeers {
+		for p := range r.peers {
+			if channel == "" || p.channels[channel] {
+				p.sendBroadcast(data, at)
+			}
+		}
+		return
+	}
+
+	r.peerList = r.peerList[:0]
+	for p := range r.peers {
+		r.peerList = append(r.peerList, p)
+	}
+	var (
+		wg   sync.WaitGroup
+		size = (len(r.peerList) + n - 1) / n
+	)
+	for i := 0; i < len(r.peerList); i += size {
+		end := i + size
+		if end > len(r.peerList) {
+			end = len(r.peerList)
+		}
+		wg.Add(1)
+		r.hub.broadcastJobs <- broadcastJob{
+			peers:   r.peerList[i:end],
+			data:    data,
+			channel: channel,
+			at:      at,
+			wg:      &wg,
+		}
+	}
+	wg.Wait()
+}
+
+// sendPeers queues a broadcast to the given peers, or to those subscribed to
+// a channel if it's set.
+func sendPeers(peers []*Peer, data []byte, channel string, at time.Time) {
+	for _, p := range peers {
+		if channel == "" || p.channels[channel] {
+			p.sendBroadcast(data, at)
+		}
+	}
+}
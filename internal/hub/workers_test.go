@@ -0,0 +1,39 @@
+package hub
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// BenchmarkSendBroadcast compares queueing a broadcast to a large room from
+// the room's goroutine with splitting its peers among broadcast workers.
+func BenchmarkSendBroadcast(b *testing.B) {
+	for _, workers := range []int{0, 4} {
+		for _, n := range []int{300, 1000, 5000} {
+			b.Run(fmt.Sprintf("workers=%d/peers=%d", workers, n), func(b *testing.B) {
+				h := newTestHub(b, func(c *Config) { c.BroadcastWorkers = workers })
+				r := NewRoom("bench", "bench", nil, h, false)
+
+				for i := 0; i < n; i++ {
+					p := newPeer(fmt.Sprintf("p%d", i), "peer", nil, r)
+					r.peers[p] = true
+				}
+
+				data := []byte(`{"type":"message","data":{"message":"hello"}}`)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					r.sendBroadcast(data, "", time.Now())
+
+					// Empty the queues, as the peers' writers would, so that
+					// none of the peers is dropped.
+					b.StopTimer()
+					for p := range r.peers {
+						<-p.dataQ
+					}
+					b.StartTimer()
+				}
+			})
+		}
+	}
+}
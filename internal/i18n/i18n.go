@@ -0,0 +1,55 @@
+// Package i18n translates the system messages that the hub sends to peers,
+// eg: kick notices, with catalogs of messages per locale.
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// DefaultLocale is the locale whose catalog has all the messages. Messages
+// missing in other catalogs fall back to it.
+const DefaultLocale = "en"
+
+// Catalog holds the messages of a locale by their keys. Messages are fmt
+// format strings whose arguments can be reordered with explicit indexes,
+// eg: "%[2]s kicked %[1]s".
+type Catalog struct {
+	Locale string
+	msgs   map[string]string
+}
+
+// New returns the catalog of a locale from the JSON objects of messages by
+// key of the default locale and the locale, which are the same for the
+// default locale.
+func New(locale string, base, msgs []byte) (*Catalog, error) {
+	c := &Catalog{Locale: locale, msgs: make(map[string]string)}
+	if err := json.Unmarshal(base, &c.msgs); err != nil {
+		return nil, fmt.Errorf("error parsing %s messages: %v", DefaultLocale, err)
+	}
+
+	var m map[string]string
+	if err := json.Unmarshal(msgs, &m); err != nil {
+		return nil, fmt.Errorf("error parsing %s messages: %v", locale, err)
+	}
+	for k, v := range m {
+		if _, ok := c.msgs[k]; !ok {
+			return nil, fmt.Errorf("unknown %s message %q", locale, k)
+		}
+		c.msgs[k] = v
+	}
+	return c, nil
+}
+
+// T returns the message of a key formatted with the arguments, or the key
+// if there's no such message.
+func (c *Catalog) T(key string, args ...interface{}) string {
+	if c == nil {
+		return key
+	}
+	f, ok := c.msgs[key]
+	if !ok {
+		return key
+	}
+	return fmt.Sprintf(f, args...)
+}
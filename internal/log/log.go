@@ -0,0 +1,176 @@
+// Package log is a leveled logger shared by the app's components. It writes
+// plain text lines like the standard logger, or structured JSON entries, one
+// per line, for ingesting into log aggregators.
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of an entry. Entries below a logger's level are
+// dropped.
+type Level int32
+
+// Levels in increasing severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// String returns the name of the level.
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", l)
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level by its name, one of debug|info|warn|error.
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Formats of the output.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// output is the destination shared by a logger and the loggers derived
+// from it.
+type output struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	// Plain text lines are written by the standard logger.
+	std *log.Logger
+
+	level int32
+	json  int32
+}
+
+// Logger writes entries at or above its level. It's safe for concurrent use.
+type Logger struct {
+	out *output
+
+	// Fields added to JSON entries, eg: a room's ID.
+	fields map[string]string
+}
+
+// New returns a logger that writes plain text lines at the info level to w.
+func New(w io.Writer) *Logger {
+	return &Logger{out: &output{
+		w:     w,
+		std:   log.New(w, "", log.Ldate|log.Ltime|log.Lshortfile),
+		level: int32(LevelInfo),
+	}}
+}
+
+// SetLevel sets the level of the logger and the loggers derived from it.
+func (l *Logger) SetLevel(lvl Level) {
+	atomic.StoreInt32(&l.out.level, int32(lvl))
+}
+
+// SetFormat sets the format, text or json, of the logger and the loggers
+// derived from it.
+func (l *Logger) SetFormat(format string) {
+	var v int32
+	if format == FormatJSON {
+		v = 1
+	}
+	atomic.StoreInt32(&l.out.json, v)
+}
+
+// With returns a logger to the same output that adds a field to its JSON
+// entries.
+func (l *Logger) With(key, val string) *Logger {
+	fields := make(map[string]string, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = val
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled returns true if entries at the level are written.
+func (l *Logger) Enabled(lvl Level) bool {
+	return lvl >= Level(atomic.LoadInt32(&l.out.level))
+}
+
+// Debugf logs a debug entry.
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.log(LevelDebug, false, fmt.Sprintf(format, v...))
+}
+
+// Infof logs an info entry.
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.log(LevelInfo, false, fmt.Sprintf(format, v...))
+}
+
+// Warnf logs a warning entry.
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.log(LevelWarn, false, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs an error entry.
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.log(LevelError, false, fmt.Sprintf(format, v...))
+}
+
+// Fatal logs an error entry regardless of the level and exits.
+func (l *Logger) Fatal(v ...interface{}) {
+	l.log(LevelError, true, fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+// Fatalf logs an error entry regardless of the level and exits.
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.log(LevelError, true, fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+// log writes an entry if it's at or above the level, or if it's forced. It
+// should only be called by the logging methods so that the standard logger
+// reports their callers.
+func (l *Logger) log(lvl Level, force bool, msg string) {
+	if !force && !l.Enabled(lvl) {
+		return
+	}
+	if atomic.LoadInt32(&l.out.json) == 0 {
+		l.out.std.Output(3, msg)
+		return
+	}
+
+	e := make(map[string]string, len(l.fields)+3)
+	for k, v := range l.fields {
+		e[k] = v
+	}
+	e["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	e["level"] = lvl.String()
+	e["msg"] = msg
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.out.mu.Lock()
+	l.out.w.Write(append(b, '\n'))
+	l.out.mu.Unlock()
+}
@@ -0,0 +1,169 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	tparse "github.com/karrick/tparse/v2"
+	"github.com/knadh/niltalk/internal/log"
+	"golang.org/x/time/rate"
+)
+
+// Chat services that messages can be bridged to.
+const (
+	BridgeSlack   = "slack"
+	BridgeDiscord = "discord"
+)
+
+// Number of messages that can wait to be forwarded while rate limited.
+// Messages over it are dropped.
+const bridgeQueueSize = 100
+
+// BridgeOptions are the options of a room's outbound bridge.
+type BridgeOptions struct {
+	// Chat service, slack or discord, and its incoming webhook URL.
+	Provider string `koanf:"provider"`
+	URL      string `koanf:"url"`
+
+	RateLimitPeriod string `koanf:"rate-limit-period"`
+	RateLimitCount  string `koanf:"rate-limit-count"`
+	RateLimitBurst  string `koanf:"rate-limit-burst"`
+}
+
+// Bridge mirrors a room's chat messages to a Slack or Discord channel
+// through an incoming webhook.
+type Bridge struct {
+	RoomID  string
+	Logger  *log.Logger
+	Options BridgeOptions
+
+	q       chan bridgeMsg
+	limiter *rate.Limiter
+	client  *http.Client
+}
+
+type bridgeMsg struct {
+	handle string
+	msg    string
+}
+
+// NewBridge returns a new outbound bridge for a room.
+func NewBridge(opt BridgeOptions, roomID string, logger *log.Logger) *Bridge {
+	return &Bridge{
+		Options: opt,
+		RoomID:  roomID,
+		Logger:  logger,
+	}
+}
+
+// Init parses the bridge options and starts forwarding messages.
+func (b *Bridge) Init() error {
+	switch b.Options.Provider {
+	case BridgeSlack, BridgeDiscord:
+	default:
+		return fmt.Errorf("unknown bridge provider %q", b.Options.Provider)
+	}
+
+	// Stay under the webhook limits of both services by default.
+	rlPeriod := time.Minute
+	if b.Options.RateLimitPeriod != "" {
+		x, err := tparse.AbsoluteDuration(time.Now(), b.Options.RateLimitPeriod)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling 'bridge.rate-limit-period' config: %v", err)
+		}
+		rlPeriod = x
+	}
+
+	rlCount := 30.0
+	if b.Options.RateLimitCount != "" {
+		x, err := strconv.ParseFloat(b.Options.RateLimitCount, 64)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling 'bridge.rate-limit-count' config: %v", err)
+		}
+		if x <= 0 {
+			return fmt.Errorf("error unmarshalling 'bridge.rate-limit-count' config: should be > 0, not %v", b.Options.RateLimitCount)
+		}
+		rlCount = x
+	}
+
+	rlBurst := 1
+	if b.Options.RateLimitBurst != "" {
+		x, err := strconv.Atoi(b.Options.RateLimitBurst)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling 'bridge.rate-limit-burst' config: %v", err)
+		}
+		if x < 1 {
+			return fmt.Errorf("error unmarshalling 'bridge.rate-limit-burst' config: should be > 0, not %v", b.Options.RateLimitBurst)
+		}
+		rlBurst = x
+	}
+
+	b.limiter = rate.NewLimiter(rate.Every(time.Duration(float64(rlPeriod)/rlCount)), rlBurst)
+	b.client = &http.Client{Timeout: time.Second * 10}
+	b.q = make(chan bridgeMsg, bridgeQueueSize)
+	go b.run()
+	return nil
+}
+
+// OnMessage queues a chat message to be forwarded. It's dropped if too
+// many messages are waiting on the rate limit.
+func (b *Bridge) OnMessage(handle, msg string) {
+	select {
+	case b.q <- bridgeMsg{handle: handle, msg: msg}:
+	default:
+		b.Logger.Warnf("dropping bridged message for room %q: queue is full", b.RoomID)
+	}
+}
+
+// run is a blocking function that forwards queued messages as the rate
+// limit allows. This should be invoked as a goroutine.
+func (b *Bridge) run() {
+	for m := range b.q {
+		b.limiter.Wait(context.Background())
+		if err := b.post(m); err != nil {
+			b.Logger.Errorf("error bridging message for room %q: %v", b.RoomID, err)
+		}
+	}
+}
+
+// post posts a message to the incoming webhook.
+func (b *Bridge) post(m bridgeMsg) error {
+	var body interface{}
+	switch b.Options.Provider {
+	case BridgeSlack:
+		body = map[string]interface{}{
+			"text": fmt.Sprintf("*%s*: %s", m.handle, m.msg),
+		}
+	case BridgeDiscord:
+		// Mentions in the message aren't resolved so that they don't
+		// ping anyone in the Discord server.
+		body = map[string]interface{}{
+			"username":         m.handle,
+			"content":          m.msg,
+			"allowed_mentions": map[string][]string{"parse": {}},
+		}
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Post(b.Options.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
@@ -6,7 +6,6 @@ import (
 	"html/template"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"path/filepath"
 	"strconv"
@@ -22,6 +21,7 @@ import (
 	"github.com/faiface/beep/wav"
 	"github.com/gen2brain/beeep"
 	tparse "github.com/karrick/tparse/v2"
+	"github.com/knadh/niltalk/internal/log"
 	"golang.org/x/time/rate"
 )
 
@@ -61,7 +61,7 @@ func (n *Notifier) Init() error {
 	{
 		t, err := template.New("").Parse(n.Options.Message)
 		if err != nil {
-			n.Logger.Printf("error compiling growl template for room %q: %v", n.RoomID, err)
+			n.Logger.Errorf("error compiling growl template for room %q: %v", n.RoomID, err)
 			return err
 		}
 		n.tpl = t
@@ -84,7 +84,7 @@ func (n *Notifier) Init() error {
 			r, err = n.box.Open(n.Options.Sound)
 		}
 		if err != nil {
-			n.Logger.Printf("error loading growl sound for room %q: %v", n.RoomID, err)
+			n.Logger.Errorf("error loading growl sound for room %q: %v", n.RoomID, err)
 			return err
 		}
 		var (
@@ -100,12 +100,12 @@ func (n *Notifier) Init() error {
 			streamer, format, err = flac.Decode(r)
 		}
 		if err != nil {
-			n.Logger.Printf("error loading growl sound for room %q: %v", n.RoomID, err)
+			n.Logger.Errorf("error loading growl sound for room %q: %v", n.RoomID, err)
 			return err
 		}
 		err = speaker.Init(format.SampleRate, format.SampleRate.N(time.Second/10))
 		if err != nil {
-			n.Logger.Printf("error initializing sound system for room %q: %v", n.RoomID, err)
+			n.Logger.Errorf("error initializing sound system for room %q: %v", n.RoomID, err)
 			return err
 		}
 		buffer := beep.NewBuffer(format)
@@ -167,13 +167,13 @@ func (n *Notifier) OnGrowlMessage(msg, handle, token string) {
 		"UserName": handle,
 	})
 	if err != nil {
-		n.Logger.Printf("error executing growl template for room %q: %v", n.RoomID, err)
+		n.Logger.Errorf("error executing growl template for room %q: %v", n.RoomID, err)
 	} else {
 		body = s.String()
 	}
 	err = beeep.Notify(n.Options.Title, body, "")
 	if err != nil {
-		n.Logger.Printf("error sending notification for room %q: %v", n.RoomID, err)
+		n.Logger.Errorf("error sending notification for room %q: %v", n.RoomID, err)
 	}
 	speaker.Play(n.soundBuffer.Streamer(0, n.soundBuffer.Len()))
 }
@@ -0,0 +1,206 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	tparse "github.com/karrick/tparse/v2"
+	"github.com/knadh/niltalk/internal/log"
+)
+
+// Room events that webhooks are fired for.
+const (
+	EventRoomCreated = "room.created"
+	EventPeerJoin    = "peer.join"
+	EventPeerLeave   = "peer.leave"
+	EventMessage     = "message"
+)
+
+// Number of deliveries that can wait for the webhook endpoints. Events over
+// it are dropped.
+const webhookQueueSize = 100
+
+// WebhookOptions are the webhook options of a room.
+type WebhookOptions struct {
+	// Endpoints the events are POSTed to.
+	URLs []string `koanf:"urls"`
+
+	// Events to fire webhooks for. All events are fired if it's empty.
+	Events []string `koanf:"events"`
+
+	// Secret that the payloads are signed with.
+	Secret string `koanf:"secret"`
+
+	// Failed deliveries are retried after the backoff, doubling it with
+	// every retry.
+	Retries      int    `koanf:"retries"`
+	RetryBackoff string `koanf:"retry-backoff"`
+	Timeout      string `koanf:"timeout"`
+}
+
+// WebhookNotifier POSTs room events as JSON to the webhook endpoints.
+type WebhookNotifier struct {
+	RoomID  string
+	Logger  *log.Logger
+	Options WebhookOptions
+
+	events  map[string]bool
+	backoff time.Duration
+	client  *http.Client
+	q       chan webhookDelivery
+}
+
+// webhookDelivery is a payload waiting to be POSTed to an endpoint.
+type webhookDelivery struct {
+	url   string
+	event string
+	body  []byte
+	sig   string
+}
+
+type webhookPayload struct {
+	Event     string      `json:"event"`
+	RoomID    string      `json:"room_id"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// NewWebhook returns a new webhook notifier for a room.
+func NewWebhook(opt WebhookOptions, roomID string, logger *log.Logger) *WebhookNotifier {
+	return &WebhookNotifier{
+		Options: opt,
+		RoomID:  roomID,
+		Logger:  logger,
+	}
+}
+
+// Init parses the webhook options and starts delivering events.
+func (n *WebhookNotifier) Init() error {
+	n.events = make(map[string]bool)
+	for _, e := range n.Options.Events {
+		switch e {
+		case EventRoomCreated, EventPeerJoin, EventPeerLeave, EventMessage:
+			n.events[e] = true
+		default:
+			return fmt.Errorf("unknown webhook event %q", e)
+		}
+	}
+
+	n.backoff = time.Second
+	if n.Options.RetryBackoff != "" {
+		x, err := tparse.AbsoluteDuration(time.Now(), n.Options.RetryBackoff)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling 'webhook.retry-backoff' config: %v", err)
+		}
+		n.backoff = x
+	}
+
+	timeout := time.Second * 5
+	if n.Options.Timeout != "" {
+		x, err := tparse.AbsoluteDuration(time.Now(), n.Options.Timeout)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling 'webhook.timeout' config: %v", err)
+		}
+		timeout = x
+	}
+	n.client = &http.Client{Timeout: timeout}
+	n.q = make(chan webhookDelivery, webhookQueueSize)
+	go n.run()
+	return nil
+}
+
+// Notify queues the webhooks of an event to be fired in the background.
+// They're dropped if too many deliveries are waiting.
+func (n *WebhookNotifier) Notify(event string, data interface{}) {
+	if len(n.events) > 0 && !n.events[event] {
+		return
+	}
+
+	b, err := json.Marshal(webhookPayload{
+		Event:     event,
+		RoomID:    n.RoomID,
+		Timestamp: time.Now(),
+		Data:      data,
+	})
+	if err != nil {
+		n.Logger.Errorf("error marshalling webhook payload for room %q: %v", n.RoomID, err)
+		return
+	}
+
+	var sig string
+	if n.Options.Secret != "" {
+		h := hmac.New(sha256.New, []byte(n.Options.Secret))
+		h.Write(b)
+		sig = "sha256=" + hex.EncodeToString(h.Sum(nil))
+	}
+
+	for _, u := range n.Options.URLs {
+		select {
+		case n.q <- webhookDelivery{url: u, event: event, body: b, sig: sig}:
+		default:
+			n.Logger.Warnf("dropping %s webhook for room %q to %s: queue is full", event, n.RoomID, u)
+		}
+	}
+}
+
+// run is a blocking function that delivers queued webhooks one at a time,
+// so that failing endpoints being retried don't pile up goroutines. This
+// should be invoked as a goroutine.
+func (n *WebhookNotifier) run() {
+	for d := range n.q {
+		n.deliver(d.url, d.event, d.body, d.sig)
+	}
+}
+
+// deliver POSTs a payload to an endpoint, retrying with backoff on network
+// errors and 5xx or 429 responses.
+func (n *WebhookNotifier) deliver(url, event string, b []byte, sig string) {
+	wait := n.backoff
+	for i := 0; ; i++ {
+		retry, err := n.post(url, event, b, sig)
+		if err == nil {
+			return
+		}
+		if !retry || i >= n.Options.Retries {
+			n.Logger.Errorf("error firing %s webhook for room %q to %s: %v", event, n.RoomID, url, err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// post makes a single delivery attempt, returning whether a failed one can
+// be retried.
+func (n *WebhookNotifier) post(url, event string, b []byte, sig string) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Niltalk-Event", event)
+	if sig != "" {
+		req.Header.Set("X-Niltalk-Signature", sig)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unexpected response: %s", resp.Status)
+}
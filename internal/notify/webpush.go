@@ -0,0 +1,276 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrPushGone is returned when a push subscription has expired or been
+// unsubscribed, and should be removed.
+var ErrPushGone = errors.New("push subscription is gone")
+
+// DefaultPushHosts are the hosts of the browsers' push services that push
+// messages are sent to when they're not configured. A leading dot matches
+// all subdomains.
+var DefaultPushHosts = []string{
+	"fcm.googleapis.com",
+	"android.googleapis.com",
+	"updates.push.services.mozilla.com",
+	".push.apple.com",
+	".notify.windows.com",
+}
+
+// Record size of the encrypted push messages.
+const pushRecordSize = 4096
+
+var b64 = base64.RawURLEncoding
+
+// WebPush sends Web Push messages encrypted as per RFC 8291 and
+// authenticated with VAPID (RFC 8292).
+type WebPush struct {
+	// Base64url encoded public key that browsers subscribe with.
+	PublicKey string
+
+	// Hosts of the push services that subscriptions can point to, so that
+	// the server can't be made to POST anywhere else.
+	Hosts []string
+
+	key     *ecdsa.PrivateKey
+	subject string
+	client  *http.Client
+}
+
+// PushMessage is the JSON payload of the push messages shown by the
+// service worker.
+type PushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url"`
+}
+
+// NewWebPush returns a Web Push sender for the base64url encoded VAPID
+// private key. The subject is a mailto: or https: contact of the operator.
+func NewWebPush(privateKey, subject string) (*WebPush, error) {
+	d, err := b64.DecodeString(privateKey)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("invalid VAPID private key")
+	}
+
+	c := elliptic.P256()
+	k := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	k.Curve = c
+	k.X, k.Y = c.ScalarBaseMult(d)
+
+	return &WebPush{
+		PublicKey: b64.EncodeToString(elliptic.Marshal(c, k.X, k.Y)),
+		key:       k,
+		Hosts:     DefaultPushHosts,
+		subject:   subject,
+		client: &http.Client{
+			Timeout: time.Second * 10,
+
+			// Push services don't redirect, and following redirects
+			// would get around the allowed hosts.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+// ValidEndpoint checks whether a subscription's endpoint is an https URL of
+// one of the allowed push services.
+func (w *WebPush) ValidEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.User != nil || u.Port() != "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range w.Hosts {
+		h = strings.ToLower(h)
+		if host == h || (strings.HasPrefix(h, ".") && strings.HasSuffix(host, h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateVAPIDKeys generates a base64url encoded VAPID key pair.
+func GenerateVAPIDKeys() (string, string, error) {
+	c := elliptic.P256()
+	d, x, y, err := elliptic.GenerateKey(c, rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return b64.EncodeToString(elliptic.Marshal(c, x, y)), b64.EncodeToString(d), nil
+}
+
+// Send sends a push message to a subscription.
+func (w *WebPush) Send(s store.PushSubscription, m PushMessage) error {
+	// Subscriptions stored before the hosts changed are removed.
+	if !w.ValidEndpoint(s.Endpoint) {
+		return ErrPushGone
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	body, err := encryptPush(s, b)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return err
+	}
+	tok, err := w.vapidToken(u.Scheme + "://" + u.Host)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", "86400")
+	req.Header.Set("Urgency", "high")
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", tok, w.PublicKey))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return ErrPushGone
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("unexpected push service response: %s", resp.Status)
+	}
+	return nil
+}
+
+// vapidToken returns a signed VAPID JWT for the push service's origin.
+func (w *WebPush) vapidToken(aud string) (string, error) {
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": aud,
+		"exp": time.Now().Add(time.Hour * 12).Unix(),
+		"sub": w.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	in := b64.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." + b64.EncodeToString(claims)
+	h := sha256.Sum256([]byte(in))
+	r, s, err := ecdsa.Sign(rand.Reader, w.key, h[:])
+	if err != nil {
+		return "", err
+	}
+
+	// ES256 signatures are the 32 byte big-endian R and S concatenated.
+	sig := append(padBytes(r, 32), padBytes(s, 32)...)
+	return in + "." + b64.EncodeToString(sig), nil
+}
+
+// encryptPush encrypts a push message payload for a subscription with the
+// aes128gcm content encoding in a single record.
+func encryptPush(s store.PushSubscription, payload []byte) ([]byte, error) {
+	uaPub, err := b64.DecodeString(s.P256dh)
+	if err != nil {
+		return nil, errors.New("invalid subscription key")
+	}
+	auth, err := b64.DecodeString(s.Auth)
+	if err != nil {
+		return nil, errors.New("invalid subscription auth secret")
+	}
+
+	c := elliptic.P256()
+	ux, uy := elliptic.Unmarshal(c, uaPub)
+	if ux == nil {
+		return nil, errors.New("invalid subscription key")
+	}
+
+	// Ephemeral key pair of the application server.
+	d, x, y, err := elliptic.GenerateKey(c, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPub := elliptic.Marshal(c, x, y)
+	sx, _ := c.ScalarMult(ux, uy, d)
+	secret := padBytes(sx, 32)
+
+	// Combine the ECDH secret with the auth secret.
+	info := append(append([]byte("WebPush: info\x00"), uaPub...), asPub...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, auth, info), ikm); err != nil {
+		return nil, err
+	}
+
+	// Derive the content encryption key and nonce.
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	var (
+		cek   = make([]byte, 16)
+		nonce = make([]byte, 12)
+	)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The header is followed by the single, and so last, record that ends
+	// with the 0x02 delimiter.
+	var out bytes.Buffer
+	out.Write(salt)
+	binary.Write(&out, binary.BigEndian, uint32(pushRecordSize))
+	out.WriteByte(byte(len(asPub)))
+	out.Write(asPub)
+	out.Write(gcm.Seal(nil, nonce, append(payload, 0x02), nil))
+	return out.Bytes(), nil
+}
+
+// padBytes returns n as big-endian bytes left padded to size.
+func padBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
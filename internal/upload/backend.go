@@ -0,0 +1,94 @@
+package upload
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// Upload backends.
+const (
+	ProviderMemory = "memory"
+	ProviderS3     = "s3"
+)
+
+// Backend stores the data of uploaded files.
+type Backend interface {
+	// Put stores a file along with its thumbnail, if any, returning the
+	// stored file. Files are identified by their contents, so a file that
+	// already exists may be returned as is.
+	Put(f File) (File, error)
+
+	// Get returns a file, or its thumbnail, along with a reader for its
+	// data that has to be closed. ErrFileNotFound is returned if the file
+	// doesn't exist.
+	Get(id string, thumb bool) (File, io.ReadCloser, error)
+
+	// Delete deletes a file along with its thumbnail.
+	Delete(id string) error
+}
+
+// memBackend stores files in the store's memory, evicting the oldest ones
+// to stay under the max memory.
+type memBackend struct {
+	s *Store
+}
+
+func (b memBackend) Put(up File) (File, error) {
+	s := b.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.items[up.ID]; ok {
+		return f, nil
+	}
+	s.items[up.ID] = up
+	s.size += int64(len(up.Data) + len(up.Thumb))
+	for s.size > s.MaxMemory {
+		var oldest *File
+		for _, up := range s.items {
+			if oldest == nil {
+				oldest = &up
+			} else if up.CreatedAt.Before(oldest.CreatedAt) {
+				oldest = &up
+			}
+		}
+		if oldest != nil {
+			s.size -= int64(len(oldest.Data) + len(oldest.Thumb))
+			delete(s.items, oldest.ID)
+			delete(s.rooms, oldest.ID)
+		}
+	}
+	if len(s.items) < 1 {
+		return up, ErrFileTooLarge
+	}
+	return up, nil
+}
+
+func (b memBackend) Get(id string, thumb bool) (File, io.ReadCloser, error) {
+	b.s.mu.Lock()
+	up, ok := b.s.items[id]
+	b.s.mu.Unlock()
+	if !ok || (thumb && up.Thumb == nil) {
+		return File{}, nil, ErrFileNotFound
+	}
+
+	data := up.Data
+	if thumb {
+		data = up.Thumb
+	}
+	up.Size = int64(len(data))
+	return up, ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b memBackend) Delete(id string) error {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	if f, ok := b.s.items[id]; ok {
+		b.s.size -= int64(len(f.Data) + len(f.Thumb))
+		delete(b.s.items, id)
+	}
+	delete(b.s.rooms, id)
+	return nil
+}
@@ -0,0 +1,89 @@
+package upload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// EncodingGzip is the content encoding of compressed files.
+const EncodingGzip = "gzip"
+
+// compressible are the non-text mime types that are worth compressing.
+var compressible = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-yaml":     true,
+	"application/x-sh":       true,
+	"image/svg+xml":          true,
+	"image/bmp":              true,
+}
+
+// isCompressible returns true if the mime type isn't already compressed.
+func isCompressible(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "text/") || compressible[mimeType]
+}
+
+// Decode returns the file's uncompressed data.
+func (f File) Decode() ([]byte, error) {
+	if f.Encoding != EncodingGzip {
+		return f.Data, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(f.Data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// runCompressor is a blocking function that periodically compresses files
+// older than the configured age. This should be invoked as a goroutine.
+func (s *Store) runCompressor() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for range t.C {
+		s.compressOld()
+	}
+}
+
+// compressOld gzips compressible files older than the configured age,
+// keeping the compressed data only if it's smaller.
+func (s *Store) compressOld() {
+	s.mu.Lock()
+	var old []File
+	for _, f := range s.items {
+		if !f.compressed && isCompressible(f.MimeType) && time.Since(f.CreatedAt) > s.CompressAge {
+			old = append(old, f)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, f := range old {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(f.Data); err != nil {
+			continue
+		}
+		if err := w.Close(); err != nil {
+			continue
+		}
+
+		s.mu.Lock()
+		cur, ok := s.items[f.ID]
+		if ok && !cur.compressed {
+			cur.compressed = true
+			if b.Len() < len(cur.Data) {
+				s.size -= int64(len(cur.Data) - b.Len())
+				cur.Data = b.Bytes()
+				cur.Encoding = EncodingGzip
+			}
+			s.items[f.ID] = cur
+		}
+		s.mu.Unlock()
+	}
+}
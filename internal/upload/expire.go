@@ -0,0 +1,46 @@
+package upload
+
+import "time"
+
+// expired returns true if the file has outlived the TTL.
+func (s *Store) expired(f File) bool {
+	return s.TTL > 0 && time.Since(f.CreatedAt) > s.TTL
+}
+
+// runSweeper is a blocking function that periodically deletes files that
+// have outlived the TTL. This should be invoked as a goroutine.
+func (s *Store) runSweeper() {
+	t := time.NewTicker(s.SweepInterval)
+	defer t.Stop()
+	for range t.C {
+		s.sweep()
+	}
+}
+
+// sweep deletes the files in memory that have outlived the TTL along with
+// their thumbnails. Expired files in other backends are only hidden, and
+// are to be deleted by the backend (eg: S3 lifecycle rules).
+func (s *Store) sweep() {
+	s.mu.Lock()
+	var ids []string
+	for id, f := range s.items {
+		if s.expired(f) {
+			ids = append(ids, id)
+		}
+	}
+	for id, rooms := range s.rooms {
+		for roomID, at := range rooms {
+			if s.expired(File{CreatedAt: at}) {
+				delete(rooms, roomID)
+			}
+		}
+		if len(rooms) == 0 {
+			delete(s.rooms, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		s.backend.Delete(id)
+	}
+}
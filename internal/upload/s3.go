@@ -0,0 +1,298 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hex encoded SHA-256 of an empty payload.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Backend stores files in an S3 compatible bucket (eg: AWS S3, MinIO).
+// Objects are addressed path style and requests are signed with AWS
+// Signature Version 4. The file's metadata is stored in the object's
+// metadata so that any instance can serve it.
+type s3Backend struct {
+	bucket    string
+	region    string
+	endpoint  string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Backend(cfg Config) (*s3Backend, error) {
+	if cfg.S3Bucket == "" {
+		return nil, errors.New("error unmarshalling 'upload.s3-bucket' config: bucket is required")
+	}
+
+	region := cfg.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := cfg.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("error unmarshalling 'upload.s3-endpoint' config: invalid endpoint %q", endpoint)
+	}
+
+	return &s3Backend{
+		bucket:    cfg.S3Bucket,
+		region:    region,
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+
+		// Only the response headers are timed out as the body of served
+		// files is streamed.
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				ResponseHeaderTimeout: time.Second * 30,
+			},
+		},
+	}, nil
+}
+
+func (b *s3Backend) Put(f File) (File, error) {
+	h := http.Header{}
+	h.Set("X-Amz-Meta-Name", url.PathEscape(f.Name))
+	h.Set("X-Amz-Meta-Checksum", f.Checksum)
+	h.Set("X-Amz-Meta-Created", strconv.FormatInt(f.CreatedAt.UnixNano()/int64(time.Millisecond), 10))
+
+	// The thumbnail is stored first so that it exists once the file does.
+	if f.Thumb != nil {
+		if err := b.put(thumbKey(f.ID), f.ThumbType, f.Thumb, h); err != nil {
+			return f, err
+		}
+		h.Set("X-Amz-Meta-Thumb-Type", f.ThumbType)
+	}
+	if err := b.put(f.ID, f.MimeType, f.Data, h); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+func (b *s3Backend) Get(id string, thumb bool) (File, io.ReadCloser, error) {
+	key := id
+	if thumb {
+		key = thumbKey(id)
+	}
+	resp, err := b.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return File{}, nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return File{}, nil, ErrFileNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return File{}, nil, b.error(resp, http.MethodGet, key)
+	}
+
+	h := resp.Header
+	f := File{
+		ID:        id,
+		MimeType:  h.Get("Content-Type"),
+		Checksum:  h.Get("X-Amz-Meta-Checksum"),
+		ThumbType: h.Get("X-Amz-Meta-Thumb-Type"),
+		Size:      resp.ContentLength,
+	}
+	if thumb {
+		f.ThumbType = f.MimeType
+	}
+	if name, err := url.PathUnescape(h.Get("X-Amz-Meta-Name")); err == nil {
+		f.Name = name
+	}
+	if ms, err := strconv.ParseInt(h.Get("X-Amz-Meta-Created"), 10, 64); err == nil {
+		f.CreatedAt = time.Unix(0, ms*int64(time.Millisecond))
+	} else if t, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+		f.CreatedAt = t
+	}
+	return f, resp.Body, nil
+}
+
+func (b *s3Backend) Delete(id string) error {
+	for _, key := range []string{thumbKey(id), id} {
+		resp, err := b.do(http.MethodDelete, key, nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK &&
+			resp.StatusCode != http.StatusNotFound {
+			return b.error(resp, http.MethodDelete, key)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// put stores an object with the given content type and metadata headers.
+func (b *s3Backend) put(key, contentType string, data []byte, meta http.Header) error {
+	h := http.Header{}
+	for k, v := range meta {
+		h[k] = v
+	}
+	h.Set("Content-Type", contentType)
+
+	resp, err := b.do(http.MethodPut, key, data, h)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return b.error(resp, http.MethodPut, key)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request for an object in the bucket.
+func (b *s3Backend) do(method, key string, body []byte, h http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.endpoint+"/"+b.bucket+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+
+	hash := emptyPayloadHash
+	if body != nil {
+		sum := sha256.Sum256(body)
+		hash = hex.EncodeToString(sum[:])
+	}
+	b.sign(req, hash, time.Now().UTC())
+	return b.client.Do(req)
+}
+
+// sign signs a request with AWS Signature Version 4. The host and every
+// header set on the request, eg: Content-Type and the x-amz-meta-* headers,
+// are signed so that none of them can be changed in transit.
+func (b *s3Backend) sign(req *http.Request, payloadHash string, now time.Time) {
+	var (
+		amzDate = now.Format("20060102T150405Z")
+		date    = now.Format("20060102")
+		scope   = date + "/" + b.region + "/s3/aws4_request"
+	)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "authorization" {
+			continue
+		}
+		vals := make([]string, len(v))
+		for i, s := range v {
+			vals[i] = strings.Join(strings.Fields(s), " ")
+		}
+		headers[k] = strings.Join(vals, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	reqHash := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.secretKey), date)
+	for _, s := range []string{b.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signed, sig))
+}
+
+// canonicalQuery returns the query parameters sorted by name and escaped
+// for signing.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, k := range keys {
+		vals := append([]string{}, q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			params = append(params, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters of
+// RFC 3986, and slashes unless escapeSlash is set, as signing requires.
+func s3Escape(s string, escapeSlash bool) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			out.WriteByte(c)
+		default:
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
+
+// error closes the response of a failed request and returns an error with
+// the start of the response body, which has the S3 error code.
+func (b *s3Backend) error(resp *http.Response, method, key string) error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("s3 %s %s/%s: %s: %s", method, b.bucket, key, resp.Status, bytes.TrimSpace(body))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// thumbKey returns the object key of a file's thumbnail.
+func thumbKey(id string) string {
+	return id + "/thumb"
+}
@@ -1,10 +1,14 @@
 package upload
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,21 +24,93 @@ type Config struct {
 	RateLimitPeriod string `koanf:"rate-limit-period"`
 	RateLimitCount  string `koanf:"rate-limit-count"`
 	RateLimitBurst  string `koanf:"rate-limit-burst"`
+
+	// Total bytes that may be uploaded to a room per period.
+	RateLimitBytes       string `koanf:"rate-limit-bytes"`
+	RateLimitBytesPeriod string `koanf:"rate-limit-bytes-period"`
+
+	// Reject uploads whose SHA-256 doesn't match the one sent by the client.
+	VerifyChecksums bool `koanf:"verify-checksums"`
+
+	// Serve files with support for range and conditional requests.
+	RangeRequests bool `koanf:"range-requests"`
+
+	// Compress compressible files older than the age.
+	CompressOld bool   `koanf:"compress-old"`
+	CompressAge string `koanf:"compress-age"`
+
+	// Max size of an upload request. Larger ones are rejected.
+	MaxSize string `koanf:"max-size"`
+
+	// MIME types (eg: image/png, image/*) that can be uploaded, detected
+	// from the file contents. All types are allowed if it's empty.
+	AllowedTypes []string `koanf:"allowed-types"`
+
+	// Max width and height of the thumbnails generated for images.
+	// Thumbnails aren't generated if it's empty.
+	ThumbSize string `koanf:"thumb-size"`
+
+	// Max width x height of the images that thumbnails are generated for.
+	ThumbMaxPixels string `koanf:"thumb-max-pixels"`
+
+	// Files are deleted once they're older than the TTL, checked every
+	// sweep interval. Files are kept until they're evicted if it's empty.
+	TTL           string `koanf:"ttl"`
+	SweepInterval string `koanf:"sweep-interval"`
+
+	// Backend the files are stored in, memory or s3.
+	Provider string `koanf:"provider"`
+
+	// S3 (or an S3 compatible service like MinIO) bucket and credentials.
+	// The endpoint defaults to AWS S3 in the region.
+	S3Bucket    string `koanf:"s3-bucket"`
+	S3Region    string `koanf:"s3-region"`
+	S3Endpoint  string `koanf:"s3-endpoint"`
+	S3AccessKey string `koanf:"s3-access-key"`
+	S3SecretKey string `koanf:"s3-secret-key"`
 }
 
-// Store file uploads in memory.
+// Store file uploads in the configured backend.
 type Store struct {
-	cfg   Config
+	cfg     Config
+	backend Backend
+
+	// Files stored in memory by the memory backend.
 	mu    sync.Mutex
 	items map[string]File
 	size  int64
 
+	// IDs of the rooms each file was uploaded to, and when. Files are
+	// identified by their contents, so the same file may be uploaded to
+	// several rooms.
+	rooms map[string]map[string]time.Time
+
+	// Bytes uploaded per key in the current window.
+	byteWindows map[string]byteWindow
+
 	MaxMemory     int64
 	MaxUploadSize int64
 	MaxAge        time.Duration
 	RlPeriod      time.Duration
 	RlCount       float64
 	RlBurst       int
+	RlBytes       int64
+	RlBytesPeriod time.Duration
+
+	VerifyChecksums bool
+	RangeRequests   bool
+	CompressAge     time.Duration
+	MaxSize         int64
+	ThumbSize       int
+	ThumbMaxPixels  int
+	TTL             time.Duration
+	SweepInterval   time.Duration
+}
+
+// byteWindow tracks the bytes uploaded in a fixed window.
+type byteWindow struct {
+	start time.Time
+	used  int64
 }
 
 //Init the store, parsing configuration values.
@@ -92,6 +168,98 @@ func (s *Store) Init() error {
 		}
 		s.RlBurst = x
 	}
+
+	// Byte rate limiting is disabled by default.
+	if s.cfg.RateLimitBytes != "" {
+		x, err := units.ParseStrictBytes(s.cfg.RateLimitBytes)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling 'upload.rate-limit-bytes' config: %v", err)
+		}
+		s.RlBytes = x
+	}
+
+	s.RlBytesPeriod = time.Hour
+	if s.cfg.RateLimitBytesPeriod != "" {
+		x, err := tparse.AbsoluteDuration(time.Now(), s.cfg.RateLimitBytesPeriod)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling 'upload.rate-limit-bytes-period' config: %v", err)
+		}
+		s.RlBytesPeriod = x
+	}
+
+	if s.cfg.ThumbSize != "" {
+		x, err := strconv.Atoi(s.cfg.ThumbSize)
+		if err != nil || x < 1 {
+			return fmt.Errorf("error unmarshalling 'upload.thumb-size' config: %v", s.cfg.ThumbSize)
+		}
+		s.ThumbSize = x
+	}
+
+	s.ThumbMaxPixels = defaultThumbMaxPixels
+	if s.cfg.ThumbMaxPixels != "" {
+		x, err := strconv.Atoi(s.cfg.ThumbMaxPixels)
+		if err != nil || x < 1 {
+			return fmt.Errorf("error unmarshalling 'upload.thumb-max-pixels' config: %v", s.cfg.ThumbMaxPixels)
+		}
+		s.ThumbMaxPixels = x
+	}
+
+	if s.cfg.TTL != "" {
+		x, err := tparse.AbsoluteDuration(time.Now(), s.cfg.TTL)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling 'upload.ttl' config: %v", err)
+		}
+		s.TTL = x
+
+		s.SweepInterval = time.Minute
+		if s.cfg.SweepInterval != "" {
+			x, err := tparse.AbsoluteDuration(time.Now(), s.cfg.SweepInterval)
+			if err != nil {
+				return fmt.Errorf("error unmarshalling 'upload.sweep-interval' config: %v", err)
+			}
+			if x <= 0 {
+				return fmt.Errorf("error unmarshalling 'upload.sweep-interval' config: %v", s.cfg.SweepInterval)
+			}
+			s.SweepInterval = x
+		}
+		go s.runSweeper()
+	}
+
+	// Request sizes are unlimited by default.
+	if s.cfg.MaxSize != "" {
+		x, err := units.ParseStrictBytes(s.cfg.MaxSize)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling 'upload.max-size' config: %v", err)
+		}
+		s.MaxSize = x
+	}
+
+	switch s.cfg.Provider {
+	case "", ProviderMemory:
+	case ProviderS3:
+		b, err := newS3Backend(s.cfg)
+		if err != nil {
+			return err
+		}
+		s.backend = b
+	default:
+		return fmt.Errorf("error unmarshalling 'upload.provider' config: unknown provider %q", s.cfg.Provider)
+	}
+
+	s.VerifyChecksums = s.cfg.VerifyChecksums
+	s.RangeRequests = s.cfg.RangeRequests
+
+	if s.cfg.CompressOld {
+		s.CompressAge = time.Hour * 24
+		if s.cfg.CompressAge != "" {
+			x, err := tparse.AbsoluteDuration(time.Now(), s.cfg.CompressAge)
+			if err != nil {
+				return fmt.Errorf("error unmarshalling 'upload.compress-age' config: %v", err)
+			}
+			s.CompressAge = x
+		}
+		go s.runCompressor()
+	}
 	return nil
 }
 
@@ -102,67 +270,175 @@ type File struct {
 	ID        string
 	Name      string
 	MimeType  string
+
+	// Hex encoded SHA-256 of the data.
+	Checksum string
+
+	// Size of the data as read from the backend, -1 if it's unknown.
+	Size int64
+
+	// Content encoding of Data if it has been compressed.
+	Encoding string
+
+	// Downscaled image of image uploads.
+	Thumb     []byte
+	ThumbType string
+
+	// Whether compressing the file has been attempted.
+	compressed bool
+}
+
+// Reader returns a seekable reader for the file's data.
+func (f File) Reader() io.ReadSeeker {
+	return bytes.NewReader(f.Data)
+}
+
+// ModTime returns the time the file was last modified.
+func (f File) ModTime() time.Time {
+	return f.CreatedAt
 }
 
 // New returns a new file uplod store.
 func New(cfg Config) *Store {
-	return &Store{
-		cfg:   cfg,
-		items: make(map[string]File),
+	s := &Store{
+		cfg:         cfg,
+		items:       make(map[string]File),
+		rooms:       make(map[string]map[string]time.Time),
+		byteWindows: make(map[string]byteWindow),
 	}
+	s.backend = memBackend{s}
+	return s
 }
 
-// Add a new item to the store.
-func (s *Store) Add(name, mimeType string, data []byte) (File, error) {
+// Add a new item uploaded to a room to the store.
+func (s *Store) Add(roomID, name, mimeType string, data []byte) (File, error) {
 	if int64(len(data)) > s.MaxUploadSize {
 		return File{}, ErrFileTooLarge
 	}
 	h := sha1.New()
 	h.Write(data)
 	id := fmt.Sprintf("%x", h.Sum(nil))
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	up, ok := s.items[id]
-	if ok {
-		return up, nil
+
+	// Generate the thumbnail before locking as it may take a while.
+	var (
+		thumb     []byte
+		thumbType string
+	)
+	if s.ThumbSize > 0 && thumbTypes[mimeType] {
+		var err error
+		if thumb, thumbType, err = Thumbnail(data, s.ThumbSize, s.ThumbMaxPixels); err != nil {
+			thumb, thumbType = nil, ""
+		}
 	}
+
+	var up File
 	up.CreatedAt = time.Now()
 	up.ID = id
 	up.Name = name
 	up.MimeType = mimeType
+	up.Checksum = Checksum(data)
+	up.Size = int64(len(data))
 	up.Data = make([]byte, len(data), len(data))
 	copy(up.Data, data)
-	s.items[id] = up
-	s.size += int64(len(data))
-	for s.size > s.MaxMemory {
-		var oldest *File
-		for _, up := range s.items {
-			if oldest == nil {
-				oldest = &up
-			} else if up.CreatedAt.Before(oldest.CreatedAt) {
-				oldest = &up
-			}
-		}
-		if oldest != nil {
-			s.size -= int64(len(oldest.Data))
-			delete(s.items, oldest.ID)
-		}
+	up.Thumb = thumb
+	up.ThumbType = thumbType
+	up, err := s.backend.Put(up)
+	if err != nil {
+		return File{}, err
 	}
-	if len(s.items) < 1 {
-		return up, ErrFileTooLarge
+
+	s.mu.Lock()
+	if s.rooms[id] == nil {
+		s.rooms[id] = make(map[string]time.Time)
 	}
+	s.rooms[id][roomID] = time.Now()
+	s.mu.Unlock()
 	return up, nil
 }
 
-// Get the file with given id.
-func (s *Store) Get(id string) (File, error) {
+// UploadedTo returns true if the file with the given ID was uploaded to the
+// room and is still stored. Files in backends other than memory are taken
+// to be stored as long as they haven't expired.
+func (s *Store) UploadedTo(id, roomID string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	up, ok := s.items[id]
+
+	at, ok := s.rooms[id][roomID]
+	if !ok || s.expired(File{CreatedAt: at}) {
+		return false
+	}
+	if _, ok := s.backend.(memBackend); ok {
+		f, ok := s.items[id]
+		return ok && !s.expired(f)
+	}
+	return true
+}
+
+// AllowBytes accounts n bytes to be uploaded under the given key (eg: a room)
+// against the byte budget of the current window. If the budget would be
+// exceeded, nothing is accounted and the time until the window rolls over is
+// returned.
+func (s *Store) AllowBytes(key string, n int64) (bool, time.Duration) {
+	if s.RlBytes <= 0 {
+		return true, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, w := range s.byteWindows {
+		if now.Sub(w.start) >= s.RlBytesPeriod {
+			delete(s.byteWindows, k)
+		}
+	}
+
+	w, ok := s.byteWindows[key]
 	if !ok {
-		return up, ErrFileNotFound
+		w = byteWindow{start: now}
 	}
-	return up, nil
+	if w.used+n > s.RlBytes {
+		return false, w.start.Add(s.RlBytesPeriod).Sub(now)
+	}
+	w.used += n
+	s.byteWindows[key] = w
+	return true, 0
+}
+
+// AllowedType checks whether a detected MIME type can be uploaded. Parameters
+// (eg: charset) are ignored and a type/* entry allows all subtypes.
+func (s *Store) AllowedType(mimeType string) bool {
+	if len(s.cfg.AllowedTypes) == 0 {
+		return true
+	}
+
+	t := strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	for _, a := range s.cfg.AllowedTypes {
+		a = strings.ToLower(a)
+		if a == t || (strings.HasSuffix(a, "/*") && strings.HasPrefix(t, strings.TrimSuffix(a, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checksum returns the hex encoded SHA-256 of the given data.
+func Checksum(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// Open the file with given id, or its thumbnail, returning it along with a
+// reader for its data that has to be closed.
+func (s *Store) Open(id string, thumb bool) (File, io.ReadCloser, error) {
+	up, rd, err := s.backend.Get(id, thumb)
+	if err != nil {
+		return File{}, nil, err
+	}
+	if s.expired(up) {
+		rd.Close()
+		return File{}, nil, ErrFileNotFound
+	}
+	return up, rd, nil
 }
 
 // ErrFileNotFound indicates that the requested file was not found.
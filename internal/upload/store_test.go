@@ -0,0 +1,71 @@
+package upload
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowedType(t *testing.T) {
+	cases := []struct {
+		name    string
+		allowed []string
+		typ     string
+		want    bool
+	}{
+		{"empty allows all", nil, "application/x-msdownload", true},
+		{"exact", []string{"image/png"}, "image/png", true},
+		{"not listed", []string{"image/png"}, "image/gif", false},
+		{"wildcard", []string{"image/*"}, "image/jpeg", true},
+		{"wildcard other type", []string{"image/*"}, "text/plain", false},
+		{"wildcard prefix only", []string{"image/*"}, "imagex/png", false},
+		{"params ignored", []string{"text/plain"}, "text/plain; charset=utf-8", true},
+		{"case insensitive", []string{"Image/PNG"}, "image/png", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &Store{cfg: Config{AllowedTypes: c.allowed}}
+			if got := s.AllowedType(c.typ); got != c.want {
+				t.Errorf("AllowedType(%q) = %v, want %v", c.typ, got, c.want)
+			}
+		})
+	}
+}
+
+func TestUploadedTo(t *testing.T) {
+	s := New(Config{})
+	s.MaxMemory = 1 << 20
+	s.MaxUploadSize = 1 << 10
+	s.TTL = time.Hour
+
+	up, err := s.Add("room1", "a.txt", "text/plain", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error adding file: %v", err)
+	}
+	if !s.UploadedTo(up.ID, "room1") {
+		t.Error("file isn't reported as uploaded to its room")
+	}
+	if s.UploadedTo(up.ID, "room2") {
+		t.Error("file is reported as uploaded to another room")
+	}
+
+	// The same file uploaded to another room is shared by both.
+	if _, err := s.Add("room2", "b.txt", "text/plain", []byte("hello")); err != nil {
+		t.Fatalf("error adding file: %v", err)
+	}
+	if !s.UploadedTo(up.ID, "room1") || !s.UploadedTo(up.ID, "room2") {
+		t.Error("file isn't reported as uploaded to both rooms")
+	}
+
+	// Deleted files aren't.
+	s.backend.Delete(up.ID)
+	if s.UploadedTo(up.ID, "room1") {
+		t.Error("deleted file is reported as uploaded")
+	}
+
+	// Nor are expired ones.
+	up, _ = s.Add("room1", "c.txt", "text/plain", []byte("bye"))
+	s.rooms[up.ID]["room1"] = time.Now().Add(-time.Hour * 2)
+	if s.UploadedTo(up.ID, "room1") {
+		t.Error("expired upload is reported as uploaded")
+	}
+}
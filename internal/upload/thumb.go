@@ -0,0 +1,115 @@
+package upload
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+
+	// Decoders of the image types that thumbnails are generated for.
+	_ "image/gif"
+)
+
+// Max pixels of the images that thumbnails are generated for when it's not
+// configured. Decoding takes 4 to 8 bytes per pixel.
+const defaultThumbMaxPixels = 40000000
+
+// ErrImageTooLarge is returned for images with more pixels than thumbnails
+// are generated for.
+var ErrImageTooLarge = errors.New("image is too large")
+
+// thumbTypes are the mime types of images that thumbnails are generated for.
+var thumbTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// Thumbnail decodes a JPEG, PNG or GIF image and downscales it to fit in a
+// size x size box. JPEGs are encoded as JPEG and other images as PNG to keep
+// their transparency. The encoded thumbnail and its mime type are returned.
+// Images with more than maxPixels pixels are rejected before they're
+// decoded, as a small file can declare huge dimensions.
+func Thumbnail(data []byte, size, maxPixels int) ([]byte, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > int64(maxPixels) {
+		return nil, "", ErrImageTooLarge
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var (
+		b    = src.Bounds()
+		w, h = b.Dx(), b.Dy()
+	)
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+	dst := downscale(src, w, h)
+
+	var out bytes.Buffer
+	if format == "jpeg" {
+		if err := jpeg.Encode(&out, dst, &jpeg.Options{Quality: 80}); err != nil {
+			return nil, "", err
+		}
+		return out.Bytes(), "image/jpeg", nil
+	}
+	if err := png.Encode(&out, dst); err != nil {
+		return nil, "", err
+	}
+	return out.Bytes(), "image/png", nil
+}
+
+// downscale resizes an image to w x h by averaging the source pixels that
+// each destination pixel covers.
+func downscale(src image.Image, w, h int) *image.NRGBA {
+	var (
+		b      = src.Bounds()
+		sw, sh = b.Dx(), b.Dy()
+		dst    = image.NewNRGBA(image.Rect(0, 0, w, h))
+	)
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(b.Min.X+sx, b.Min.Y+sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -4,16 +4,21 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -21,11 +26,17 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/go-chi/chi"
 	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/parsers/json"
 	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/confmap"
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/posflag"
+	"github.com/knadh/niltalk/internal/captcha"
 	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/i18n"
+	"github.com/knadh/niltalk/internal/log"
 	"github.com/knadh/niltalk/internal/notify"
 	"github.com/knadh/niltalk/internal/upload"
 	"github.com/knadh/niltalk/store"
@@ -36,21 +47,54 @@ import (
 )
 
 var (
-	logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
+	logger = log.New(os.Stdout)
 	ko     = koanf.New(".")
 
 	// Version of the build injected at build time.
 	buildString = "unknown"
 )
 
+// Strategies for merging multiple config files.
+const (
+	// Top level blocks (eg: [store]) in a file replace the ones loaded
+	// before it entirely.
+	mergeOverride = "override"
+
+	// Nested maps are merged and lists are replaced.
+	mergeMerge = "merge"
+
+	// Nested maps are merged and lists are appended to.
+	mergeDeep = "deep-merge"
+)
+
 // App is the global app context that's passed around.
 type App struct {
 	hub    *hub.Hub
 	cfg    *hub.Config
 	tpl    *template.Template
+	tplErr error
+	tplMu  sync.RWMutex
 	tplBox *rice.Box
 	jit    bool
 	logger *log.Logger
+
+	// Max size of upload requests, shown to clients.
+	maxUploadSize int64
+
+	// Verifies room creation if a captcha provider is set.
+	captcha captcha.Verifier
+
+	// Resolves client IPs behind reverse proxies.
+	ips *ipResolver
+
+	// Checks the origins of WebSocket upgrades.
+	origins *originChecker
+
+	// Time the app was started at.
+	startedAt time.Time
+
+	// Serves the static assets and versions their URLs in templates.
+	assets *assetServer
 }
 
 func loadConfig() {
@@ -61,10 +105,16 @@ func loadConfig() {
 		os.Exit(0)
 	}
 	f.StringSlice("config", []string{"config.toml"},
-		"Path to one or more TOML config files to load in order")
+		"Path to one or more config files (.toml, .yaml/.yml, .json) to load in order. "+
+			"Later files take precedence over earlier ones, env vars (NILTALK_*) over files, and flags over env vars")
+	f.String("config-merge", mergeMerge,
+		"How later config files are merged into earlier ones: override|merge|deep-merge")
 	f.Bool("new-config", false, "generate sample config file")
+	f.String("format", "toml", "format of the config file generated by --new-config: toml|yaml|json")
 	f.Bool("new-unit", false, "generate systemd unit file")
+	f.Bool("new-vapid-keys", false, "generate a VAPID key pair for push notifications")
 	f.Bool("onion", false, "Show the onion URL")
+	f.Bool("rotate-onion", false, "Regenerate the onion private key, changing the onion URL")
 	f.Bool("version", false, "Show build version")
 	f.Bool("jit", defaultJIT, "build templates just in time")
 	f.Parse(os.Args[1:])
@@ -77,29 +127,50 @@ func loadConfig() {
 
 	// Generate new config.
 	if ok, _ := f.GetBool("new-config"); ok {
-		if err := newConfigFile(); err != nil {
-			logger.Println(err)
+		format, _ := f.GetString("format")
+		fname, err := newConfigFile(format)
+		if err != nil {
+			logger.Errorf("%v", err)
 			os.Exit(1)
 		}
-		logger.Println("generated config.toml. Edit and run the app.")
+		logger.Infof("generated %s. Edit and run the app.", fname)
 		os.Exit(0)
 	}
 
 	// Generate new unit.
 	if ok, _ := f.GetBool("new-unit"); ok {
 		if err := newUnitFile(); err != nil {
-			logger.Println(err)
+			logger.Errorf("%v", err)
 			os.Exit(1)
 		}
-		logger.Println("generated niltalk.service. Edit and install the service.")
+		logger.Infof("generated niltalk.service. Edit and install the service.")
+		os.Exit(0)
+	}
+
+	// Generate new VAPID keys.
+	if ok, _ := f.GetBool("new-vapid-keys"); ok {
+		pub, priv, err := notify.GenerateVAPIDKeys()
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+		fmt.Printf("public key: %s\nprivate key: %s\n", pub, priv)
+		logger.Infof("set push_vapid_private_key in the config to the private key.")
 		os.Exit(0)
 	}
 
 	// Read the config files.
+	strategy, _ := f.GetString("config-merge")
+	switch strategy {
+	case mergeOverride, mergeMerge, mergeDeep:
+	default:
+		logger.Fatal("--config-merge should be one of override|merge|deep-merge")
+	}
+
 	cFiles, _ := f.GetStringSlice("config")
 	for _, f := range cFiles {
-		logger.Printf("reading config: %s", f)
-		if err := ko.Load(file.Provider(f), toml.Parser()); err != nil {
+		logger.Infof("reading config: %s", f)
+		if err := loadConfigFile(f, strategy); err != nil {
 			if os.IsNotExist(err) {
 				logger.Fatal("config file not found. If there isn't one yet, run --new-config to generate one.")
 			}
@@ -112,16 +183,94 @@ func loadConfig() {
 		return strings.Replace(strings.ToLower(
 			strings.TrimPrefix(s, "NILTALK_")), "__", ".", -1)
 	}), nil); err != nil {
-		logger.Printf("error loading env config: %v", err)
+		logger.Errorf("error loading env config: %v", err)
 	}
 
 	// Merge command line flags into config.
 	ko.Load(posflag.Provider(f, ".", ko), nil)
 }
 
-func newConfigFile() error {
-	if _, err := os.Stat("config.toml"); !os.IsNotExist(err) {
-		return errors.New("config.toml exists. Remove it to generate a new one")
+// loadConfigFile loads a config file and merges it into the config loaded
+// so far with the given strategy.
+func loadConfigFile(path, strategy string) error {
+	p, err := configParser(path)
+	if err != nil {
+		return err
+	}
+	fk := koanf.New(".")
+	if err := fk.Load(file.Provider(path), p); err != nil {
+		return err
+	}
+
+	switch strategy {
+	case mergeOverride:
+		base := ko.Raw()
+		for k := range fk.Raw() {
+			delete(base, k)
+		}
+		ko = koanf.New(".")
+		ko.Load(confmap.Provider(base, ""), nil)
+
+	case mergeDeep:
+		in := fk.Raw()
+		appendLists(in, ko.Raw())
+		fk = koanf.New(".")
+		fk.Load(confmap.Provider(in, ""), nil)
+	}
+
+	ko.Merge(fk)
+	return nil
+}
+
+// appendLists prepends the lists in base to the lists at the same paths
+// in the nested map in, so that merging in over base appends to them.
+func appendLists(in, base map[string]interface{}) {
+	for k, v := range in {
+		switch val := v.(type) {
+		case map[string]interface{}:
+			if b, ok := base[k].(map[string]interface{}); ok {
+				appendLists(val, b)
+			}
+		case []interface{}:
+			if b, ok := base[k].([]interface{}); ok {
+				in[k] = append(append([]interface{}{}, b...), val...)
+			}
+		}
+	}
+}
+
+// configParser returns the parser for a config file based on its extension.
+func configParser(path string) (koanf.Parser, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return toml.Parser(), nil
+	case ".yaml", ".yml":
+		return yaml.Parser(), nil
+	case ".json":
+		return json.Parser(), nil
+	}
+	return nil, fmt.Errorf("unknown config format of %q, use .toml, .yaml/.yml or .json", path)
+}
+
+// newConfigFile generates a sample config file in the given format,
+// converting the TOML sample for the other formats, and returns its name.
+func newConfigFile(format string) (string, error) {
+	var p interface {
+		Marshal(map[string]interface{}) ([]byte, error)
+	}
+	switch format {
+	case "toml":
+	case "yaml":
+		p = yaml.Parser()
+	case "json":
+		p = json.Parser()
+	default:
+		return "", errors.New("--format should be one of toml|yaml|json")
+	}
+
+	fname := "config." + format
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		return "", fmt.Errorf("%s exists. Remove it to generate a new one", fname)
 	}
 
 	// Initialize the static file system into which all
@@ -129,10 +278,21 @@ func newConfigFile() error {
 	sampleBox := rice.MustFindBox("static/samples")
 	b, err := sampleBox.Bytes("config.toml")
 	if err != nil {
-		return fmt.Errorf("error reading sample config (is binary stuffed?): %v", err)
+		return "", fmt.Errorf("error reading sample config (is binary stuffed?): %v", err)
 	}
 
-	return ioutil.WriteFile("config.toml", b, 0644)
+	// The comments in the sample are lost in the conversion.
+	if p != nil {
+		c, err := toml.Parser().Unmarshal(b)
+		if err != nil {
+			return "", fmt.Errorf("error parsing sample config: %v", err)
+		}
+		if b, err = p.Marshal(c); err != nil {
+			return "", fmt.Errorf("error converting sample config to %s: %v", format, err)
+		}
+	}
+
+	return fname, ioutil.WriteFile(fname, b, 0644)
 }
 
 func newUnitFile() error {
@@ -162,59 +322,99 @@ func main() {
 
 	// Initialize global app context.
 	app := &App{
-		logger: logger,
-		tplBox: tplBox,
+		logger:    logger,
+		tplBox:    tplBox,
+		startedAt: time.Now(),
 	}
 	if err := ko.Unmarshal("app", &app.cfg); err != nil {
 		logger.Fatalf("error unmarshalling 'app' config: %v", err)
 	}
 
-	minTime := time.Duration(3) * time.Second
-	if app.cfg.RoomAge < minTime || app.cfg.WSTimeout < minTime {
-		logger.Fatal("app.websocket_timeout and app.roomage should be > 3s")
+	if err := ko.Unmarshal("rooms", &app.cfg.Rooms); err != nil {
+		logger.Fatalf("error unmarshalling 'rooms' config: %v", err)
 	}
 
-	// Initialize store.
-	var store store.Store
-	if app.cfg.Storage == "redis" {
-		var storeCfg redis.Config
-		if err := ko.Unmarshal("store", &storeCfg); err != nil {
+	// Validate the config and the store config, reporting all the problems
+	// at once.
+	var (
+		redisCfg redis.Config
+		memCfg   mem.Config
+		fsCfg    fs.Config
+		errs     []string
+	)
+	if err := app.cfg.Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	switch app.cfg.Storage {
+	case "redis":
+		if err := ko.Unmarshal("store", &redisCfg); err != nil {
 			logger.Fatalf("error unmarshalling 'store' config: %v", err)
 		}
-
-		s, err := redis.New(storeCfg)
-		if err != nil {
-			log.Fatalf("error initializing store: %v", err)
+		if err := redisCfg.Validate(); err != nil {
+			errs = append(errs, err.Error())
 		}
-		store = s
-
-	} else if app.cfg.Storage == "memory" {
-		var storeCfg mem.Config
-		if err := ko.Unmarshal("store", &storeCfg); err != nil {
+	case "memory":
+		if err := ko.Unmarshal("store", &memCfg); err != nil {
+			logger.Fatalf("error unmarshalling 'store' config: %v", err)
+		}
+	case "fs":
+		if err := ko.Unmarshal("store", &fsCfg); err != nil {
 			logger.Fatalf("error unmarshalling 'store' config: %v", err)
 		}
+		if err := fsCfg.Validate(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if app.cfg.RootURL != "" {
+		if _, err := sanitizeRootURL(app.cfg.RootURL); err != nil {
+			errs = append(errs, fmt.Sprintf("app.root_url: %v", err))
+		}
+	}
+	for _, k := range app.cfg.TorClientAuth {
+		if _, err := parseClientAuthKey(k); err != nil {
+			errs = append(errs, fmt.Sprintf("app.tor_client_auth: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		logger.Fatalf("invalid config:\n%s", strings.Join(errs, "\n"))
+	}
 
-		s, err := mem.New(storeCfg)
+	// The log level and format are validated.
+	if app.cfg.LogLevel != "" {
+		lvl, _ := log.ParseLevel(app.cfg.LogLevel)
+		logger.SetLevel(lvl)
+	}
+	logger.SetFormat(app.cfg.LogFormat)
+
+	// Initialize store.
+	var store store.Store
+	switch app.cfg.Storage {
+	case "redis":
+		s, err := redis.New(redisCfg)
 		if err != nil {
-			log.Fatalf("error initializing store: %v", err)
+			logger.Fatalf("error initializing store: %v", err)
 		}
+		c := s.Config()
+		logger.Infof("redis pool: active_conns=%d idle_conns=%d min_idle_conns=%d idle_timeout=%v max_conn_lifetime=%v "+
+			"dial_timeout=%v read_timeout=%v write_timeout=%v max_retries=%d read_replica=%v",
+			c.ActiveConns, c.IdleConns, c.MinIdleConns, c.IdleTimeout, c.MaxConnLifetime,
+			c.DialTimeout, c.ReadTimeout, c.WriteTimeout, c.MaxRetries, c.ReadAddress != "")
 		store = s
 
-	} else if app.cfg.Storage == "fs" {
-		var storeCfg fs.Config
-		if err := ko.Unmarshal("store", &storeCfg); err != nil {
-			logger.Fatalf("error unmarshalling 'store' config: %v", err)
+	case "memory":
+		s, err := mem.New(memCfg)
+		if err != nil {
+			logger.Fatalf("error initializing store: %v", err)
 		}
+		store = s
 
-		s, err := fs.New(storeCfg, logger)
+	case "fs":
+		s, err := fs.New(fsCfg, logger)
 		if err != nil {
-			log.Fatalf("error initializing store: %v", err)
+			logger.Fatalf("error initializing store: %v", err)
 		}
 		store = s
 		defer s.Close()
-
-	} else {
-		logger.Fatal("app.storage must be one of redis|memory|fs")
 	}
 
 	if ko.Bool("onion") {
@@ -222,20 +422,106 @@ func main() {
 		if err != nil {
 			logger.Fatalf("could not read or write the private key: %v", err)
 		}
-		fmt.Printf("http://%v.onion\n", onionAddr(pk))
+		fmt.Println(onionURL(pk, app.cfg.TorRemotePort))
+		if len(app.cfg.TorClientAuth) > 0 {
+			fmt.Println("client authorization is required: clients need one of the keys in tor_client_auth")
+		}
+		return // to allow for defers to execute
+	}
+
+	if ko.Bool("rotate-onion") {
+		if pk, err := loadTorPK(app.cfg, store); err == nil {
+			fmt.Printf("current onion URL: %s\n", onionURL(pk, app.cfg.TorRemotePort))
+		}
+		fmt.Print("the onion URL will change and the current key will be overwritten. continue? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Println("aborted")
+			return
+		}
+
+		pk, err := rotateTorPK(app.cfg, store)
+		if err != nil {
+			logger.Fatalf("error rotating the onion private key: %v", err)
+		}
+		fmt.Printf("new onion URL: %s\n", onionURL(pk, app.cfg.TorRemotePort))
 		return // to allow for defers to execute
 	}
 
+	// Validate the root URL that's used to build links.
+	if app.cfg.RootURL == "" && app.cfg.Tor && app.cfg.RootURLFromOnion {
+		pk, err := loadTorPK(app.cfg, store)
+		if err != nil {
+			logger.Fatalf("could not read or write the private key: %v", err)
+		}
+		app.cfg.RootURL = onionURL(pk, app.cfg.TorRemotePort)
+	}
+	if app.cfg.RootURL != "" {
+		u, err := sanitizeRootURL(app.cfg.RootURL)
+		if err != nil {
+			logger.Fatalf("invalid app.root_url: %v", err)
+		}
+		app.cfg.RootURL = u
+	}
+
 	app.hub = hub.NewHub(app.cfg, store, logger)
 
-	if err := ko.Unmarshal("rooms", &app.cfg.Rooms); err != nil {
-		logger.Fatalf("error unmarshalling 'rooms' config: %v", err)
+	// Setup Web Push notifications.
+	if app.cfg.PushVAPIDPrivateKey != "" {
+		p, err := notify.NewWebPush(app.cfg.PushVAPIDPrivateKey, app.cfg.PushSubject)
+		if err != nil {
+			logger.Fatalf("error setting up push notifications: %v", err)
+		}
+		if len(app.cfg.PushHosts) > 0 {
+			p.Hosts = app.cfg.PushHosts
+		}
+		app.hub.Push = p
+	}
+
+	ips, err := newIPResolver(app.cfg.TrustProxy, app.cfg.TrustedProxies)
+	if err != nil {
+		logger.Fatalf("error setting up trusted proxies: %v", err)
+	}
+	app.ips = ips
+	app.origins = newOriginChecker(app.cfg.AllowedOrigins)
+
+	// Setup captchas on room creation.
+	switch app.cfg.CaptchaProvider {
+	case "":
+	case captcha.ProviderPoW:
+		app.captcha = captcha.NewPoW(app.cfg.CaptchaDifficulty)
+	default:
+		c, err := captcha.NewSiteVerify(app.cfg.CaptchaProvider, app.cfg.CaptchaSecret)
+		if err != nil {
+			logger.Fatalf("error setting up captcha: %v", err)
+		}
+		app.captcha = c
+	}
+
+	if app.cfg.SharedPresence && !app.hub.SharedPresence() {
+		logger.Fatal("app.shared_presence requires a store that's shared across instances (redis)")
+	}
+	if app.cfg.SharedBroadcast && !app.hub.SharedBroadcast() {
+		logger.Fatal("app.shared_broadcast requires a store that's shared across instances (redis)")
+	}
+
+	// Load and validate the profanity word lists.
+	if err := app.hub.LoadWordLists(); err != nil {
+		logger.Fatal(err)
 	}
+
+	// Load the system messages in the app's locale.
+	cat, err := loadCatalog(rConf.MustFindBox("static/i18n"), app.cfg.Locale, app.cfg.LocaleDir)
+	if err != nil {
+		logger.Fatalf("error loading messages: %v", err)
+	}
+	app.hub.Catalog = cat
+
 	// setup predefined rooms
 	for _, room := range app.cfg.Rooms {
 		r, err := app.hub.AddPredefinedRoom(room.ID, room.Name, room.Password)
 		if err != nil {
-			logger.Printf("error creating a predefined room %q: %v", room.Name, err)
+			logger.Errorf("error creating a predefined room %q: %v", room.Name, err)
 			continue
 		}
 		r.PredefinedUsers = make([]hub.PredefinedUser, len(room.Users), len(room.Users))
@@ -248,26 +534,52 @@ func main() {
 		if len(r.GrowlEnabler) > 0 {
 			n := notify.New(room.Growl, app.cfg.RootURL, r.ID, app.logger, assetBox)
 			if err = n.Init(); err != nil {
-				logger.Printf("error setting up growl notifications for the predefined room %q: %v", room.Name, err)
+				logger.Errorf("error setting up growl notifications for the predefined room %q: %v", room.Name, err)
 				continue
 			}
 			r.GrowlHandler = n.OnGrowlMessage
 		}
+		if len(room.Webhook.URLs) > 0 {
+			n := notify.NewWebhook(room.Webhook, r.ID, app.logger)
+			if err = n.Init(); err != nil {
+				logger.Errorf("error setting up webhooks for the predefined room %q: %v", room.Name, err)
+				continue
+			}
+			r.WebhookHandler = n.Notify
+			n.Notify(notify.EventRoomCreated, map[string]string{"id": r.ID, "name": room.Name})
+		}
+		if room.Bridge.URL != "" {
+			b := notify.NewBridge(room.Bridge, r.ID, app.logger)
+			if err = b.Init(); err != nil {
+				logger.Errorf("error setting up the bridge for the predefined room %q: %v", room.Name, err)
+				continue
+			}
+			r.BridgeHandler = b.OnMessage
+		}
 		_, err = app.hub.ActivateRoom(r.ID)
 		if err != nil {
-			logger.Printf("error activating a predefined room %q: %v", room.Name, err)
+			logger.Errorf("error activating a predefined room %q: %v", room.Name, err)
 			continue
 		}
 	}
 
 	// Compile static templates.
+	app.assets = newAssetServer(assetBox, app.cfg.StaticMaxAge)
 	tpl, err := app.buildTpl()
 	if err != nil {
 		logger.Fatalf("error compiling templates: %v", err)
 	}
-	app.jit = ko.Bool("jit")
 	app.tpl = tpl
 
+	// In jit mode, rebuild the templates when they change on disk, or on
+	// every request if they can't be watched.
+	if ko.Bool("jit") {
+		if err := app.watchTemplates(); err != nil {
+			logger.Warnf("rebuilding templates on every request as they can't be watched: %v", err)
+			app.jit = true
+		}
+	}
+
 	// Setup the file upload store.
 	var uploadCfg upload.Config
 	if err := ko.Unmarshal("upload", &uploadCfg); err != nil {
@@ -278,26 +590,97 @@ func main() {
 	if err := uploadStore.Init(); err != nil {
 		logger.Fatalf("error initializing upload store: %v", err)
 	}
+	app.maxUploadSize = uploadStore.MaxSize
+	app.hub.Uploads = uploadStore
+
+	upgrader.ReadBufferSize = app.cfg.WSReadBuffer
+	upgrader.WriteBufferSize = app.cfg.WSWriteBuffer
+	upgrader.CheckOrigin = app.origins.allowed
 
 	// Register HTTP routes.
 	r := chi.NewRouter()
+	if app.cfg.Compress {
+		r.Use(compress(app.cfg.CompressMinSize))
+	}
+	if len(app.cfg.CORSOrigins) > 0 {
+		r.Use(newCORS(app.cfg).handler)
+	}
 	r.Get("/", wrap(handleIndex, app, 0))
-	r.Get("/r/{roomID}/ws", wrap(handleWS, app, hasAuth|hasRoom))
+
+	// WebSockets and event streams stay open without the server's timeouts.
+	longLived := r.With(extendDeadlines(0))
+	longLived.Get("/r/{roomID}/ws", wrap(handleWS, app, hasAuth|hasRoom))
+	if app.cfg.EventStream {
+		longLived.Get("/r/{roomID}/stream", wrap(handleStream, app, hasAuth|hasRoom))
+	}
+
+	if app.cfg.Feeds {
+		r.Get("/r/{roomID}/feed.atom", wrap(handleFeed, app, hasAuth|hasRoom))
+	}
+	if app.cfg.StatsPublic {
+		r.Get("/r/{roomID}/stats", wrap(handleRoomStats, app, 0))
+	}
+	// History exports and imports can take longer than the server's
+	// timeouts allow, like uploads.
+	transfers := r.With(extendDeadlines(app.cfg.HTTPUploadTimeout))
+	if app.cfg.HistorySize > 0 {
+		r.Get("/r/{roomID}/search", wrap(handleSearch, app, hasAuth|hasRoom))
+		transfers.Get("/r/{roomID}/export", wrap(handleExport, app, hasAuth|hasRoom))
+	}
+
+	// Endpoints that are rate limited by IP to keep bots from creating rooms,
+	// brute forcing passwords and flooding uploads.
+	limited := chi.Router(r)
+	if app.cfg.HTTPRateLimit > 0 {
+		l := newIPLimiter(app.cfg.HTTPRateLimit, app.cfg.HTTPRateLimitInterval, app.ips)
+		limited = r.With(l.handler)
+	}
 
 	// API.
-	r.Post("/api/rooms", wrap(handleCreateRoom, app, 0))
-	r.Post("/r/{roomID}/login", wrap(handleLogin, app, hasRoom))
+	limited.Post("/api/rooms", wrap(handleCreateRoom, app, 0))
+	if app.cfg.CaptchaProvider == captcha.ProviderPoW {
+		limited.Get("/api/captcha", wrap(handleCaptchaChallenge, app, 0))
+	}
+	r.Get("/api/rooms", wrap(handleGetRooms, app, hasAdmin))
+	r.Delete("/api/rooms/{roomID}", wrap(handleDeleteRoom, app, hasAdmin))
+	limited.Post("/r/{roomID}/login", wrap(handleLogin, app, hasRoom))
 	r.Delete("/r/{roomID}/login", wrap(handleLogout, app, hasAuth|hasRoom))
+	r.Post("/r/{roomID}/push/subscribe", wrap(handlePushSubscribe, app, hasAuth|hasRoom))
+	r.Post("/r/{roomID}/messages", wrap(handlePostMessage, app, hasRoom))
 
-	r.Post("/r/{roomID}/upload", handleUpload(uploadStore))
+	// Admin API.
+	transfers.Post("/api/admin/rooms/{roomID}/import", wrap(handleImportMessages, app, hasAdmin|hasRoom))
+	r.Get("/api/admin/stats", wrap(handleAdminStats, app, hasAdmin))
+	r.Post("/api/admin/log-level", wrap(handleSetLogLevel, app, hasAdmin))
+
+	limited.With(extendDeadlines(app.cfg.HTTPUploadTimeout)).Post("/r/{roomID}/upload", handleUpload(uploadStore))
 	r.Get("/r/{roomID}/uploaded/{fileID}", handleUploaded(uploadStore))
+	r.Get("/r/{roomID}/uploaded/{fileID}/thumb", handleUploadedThumb(uploadStore))
 
 	// Views.
 	r.Get("/r/{roomID}", wrap(handleRoomPage, app, hasAuth|hasRoom))
 
+	// Health checks for load balancers.
+	r.Get("/healthz", handleHealthz)
+	r.Get("/readyz", handleReadyz(app))
+
+	// Build and runtime info for checking what's deployed.
+	r.Get("/version", handleVersion(app))
+
 	// Assets.
-	assets := http.StripPrefix("/static/", http.FileServer(assetBox.HTTPBox()))
+	assets := http.StripPrefix("/static/", app.assets)
 	r.Get("/static/*", assets.ServeHTTP)
+	if app.cfg.Avatars {
+		r.Get("/avatar/{hash}.png", handleAvatar)
+	}
+
+	// Fail fast on a bad TLS certificate / key pair.
+	useTLS := app.cfg.TLSCert != "" && app.cfg.TLSKey != ""
+	if useTLS {
+		if _, err := tls.LoadX509KeyPair(app.cfg.TLSCert, app.cfg.TLSKey); err != nil {
+			logger.Fatalf("error loading TLS certificate %q and key %q: %v", app.cfg.TLSCert, app.cfg.TLSKey, err)
+		}
+	}
 
 	// Start the app.
 	lnAddr := ko.String("app.address")
@@ -306,6 +689,7 @@ func main() {
 		logger.Fatalf("couldn't listen address %q: %v", lnAddr, err)
 	}
 
+	var torSrv *torServer
 	if app.cfg.Tor {
 		pk, err := loadTorPK(app.cfg, store)
 		if err != nil {
@@ -314,49 +698,110 @@ func main() {
 
 		srv := &torServer{
 			PrivateKey: pk,
-			Handler:    r,
+			Server:     newHTTPServer(app.cfg, r),
+			RemotePort: app.cfg.TorRemotePort,
+		}
+		for _, k := range app.cfg.TorClientAuth {
+			key, err := parseClientAuthKey(k)
+			if err != nil {
+				logger.Fatalf("invalid app.tor_client_auth: %v", err)
+			}
+			srv.ClientAuth = append(srv.ClientAuth, key)
+		}
+		if len(srv.ClientAuth) > 0 {
+			logger.Infof("starting private hidden service on %s (%d authorized clients)", onionURL(pk, srv.RemotePort), len(srv.ClientAuth))
+		} else {
+			logger.Infof("starting hidden service on %s", onionURL(pk, srv.RemotePort))
 		}
-		logger.Printf("starting hidden service on http://%v.onion", onionAddr(pk))
 		go func() {
-			if err := srv.Serve(ln); err != nil {
+			if err := srv.Serve(); err != nil && err != http.ErrServerClosed {
 				logger.Fatalf("couldn't serve: %v", err)
 			}
 		}()
+		torSrv = srv
 	}
 
-	srv := http.Server{
-		Handler: r,
-	}
-	logger.Printf("starting server on http://%v", ln.Addr().String())
+	srv := newHTTPServer(app.cfg, r)
 	go func() {
-		if err := srv.Serve(ln); err != nil {
+		var err error
+		if useTLS {
+			logger.Infof("starting server on https://%v", ln.Addr().String())
+			err = srv.ServeTLS(ln, app.cfg.TLSCert, app.cfg.TLSKey)
+		} else {
+			logger.Infof("starting server on http://%v", ln.Addr().String())
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatalf("couldn't serve: %v", err)
 		}
 	}()
 
+	// Redirect plain HTTP requests to HTTPS.
+	if useTLS && app.cfg.TLSRedirect {
+		addr := app.cfg.TLSRedirectAddress
+		if addr == "" {
+			addr = ":80"
+		}
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		logger.Infof("redirecting http://%v to https", addr)
+		rs := newHTTPServer(app.cfg, redirectHTTPS(port))
+		rs.Addr = addr
+		go func() {
+			if err := rs.ListenAndServe(); err != nil {
+				logger.Fatalf("couldn't serve HTTPS redirects: %v", err)
+			}
+		}()
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 	var cFiles []string
 	ko.Unmarshal("config", &cFiles)
+
+	// Changes to the word lists are picked up like config changes.
+	cFiles = append(cFiles, app.hub.WordListFiles()...)
 	select {
 	case <-fileWatcher(cFiles...):
 	case sig := <-c:
-		logger.Printf("shutting down: %v", sig)
+		logger.Infof("shutting down: %v", sig)
+	}
+
+	// Stop accepting connections and let peers drain their queues.
+	timeout := app.cfg.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Errorf("error shutting down server: %v", err)
+	}
+	if torSrv != nil {
+		if err := torSrv.Server.Shutdown(ctx); err != nil {
+			logger.Errorf("error shutting down onion service: %v", err)
+		}
+	}
+	if err := app.hub.Shutdown(ctx); err != nil {
+		logger.Errorf("error draining connections: %v", err)
 	}
 }
 
+// Max time to wait for peers to drain on shutdown when it's not configured.
+// Without it, shutdown wouldn't wait at all.
+const defaultShutdownTimeout = time.Second * 10
+
 func fileWatcher(files ...string) chan struct{} {
 	out := make(chan struct{})
 	if len(files) > 0 {
 		watcher, err := fsnotify.NewWatcher()
 		if err != nil {
-			logger.Printf("failed to initialize configuration file watcher: %v", err)
+			logger.Warnf("failed to initialize configuration file watcher: %v", err)
 			return out
 		}
 		for _, f := range files {
 			err = watcher.Add(f)
 			if err != nil {
-				logger.Printf("failed to add configuration file %q watcher: %v", f, err)
+				logger.Warnf("failed to add configuration file %q watcher: %v", f, err)
 			}
 		}
 		go func() {
@@ -367,14 +812,14 @@ func fileWatcher(files ...string) chan struct{} {
 						return
 					}
 					// if event.Op&fsnotify.Write == fsnotify.Write {
-					logger.Printf("configuration file %q was modified", event.Name)
+					logger.Debugf("configuration file %q was modified", event.Name)
 					out <- struct{}{}
 					// }
 				case err, ok := <-watcher.Errors:
 					if !ok {
 						return
 					}
-					logger.Printf("watcher error: %v", err)
+					logger.Warnf("watcher error: %v", err)
 				}
 			}
 		}()
@@ -382,15 +827,162 @@ func fileWatcher(files ...string) chan struct{} {
 	return out
 }
 
+// redirectHTTPS returns a handler that redirects requests to the same URL
+// over HTTPS on the given port.
+func redirectHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+// sanitizeRootURL validates a root URL and strips its trailing slashes.
+func sanitizeRootURL(s string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%q should be an http(s) URL", s)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("%q has no host", s)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%q should not have a query or fragment", s)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// loadCatalog loads the catalog of system messages of a locale, reading the
+// catalogs from the locale directory if it has them, or the bundled ones
+// otherwise.
+func loadCatalog(box *rice.Box, locale, dir string) (*i18n.Catalog, error) {
+	if locale == "" {
+		locale = i18n.DefaultLocale
+	}
+	read := func(l string) ([]byte, error) {
+		if dir != "" {
+			b, err := ioutil.ReadFile(filepath.Join(dir, l+".json"))
+			if !os.IsNotExist(err) {
+				return b, err
+			}
+		}
+		return box.Bytes(l + ".json")
+	}
+
+	base, err := read(i18n.DefaultLocale)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := read(locale)
+	if err != nil {
+		return nil, fmt.Errorf("unknown locale %q", locale)
+	}
+	return i18n.New(locale, base, msgs)
+}
+
 func (a *App) getTpl() (*template.Template, error) {
 	if a.jit {
-		return a.buildTpl()
+		a.reloadTpl()
+	}
+
+	a.tplMu.RLock()
+	defer a.tplMu.RUnlock()
+	if a.tplErr != nil {
+		return nil, a.tplErr
 	}
 	return a.tpl, nil
 }
 
+// reloadTpl rebuilds the templates. If they fail to compile, the last ones
+// that did are kept, and served if jit_fallback is set.
+func (a *App) reloadTpl() error {
+	tpl, err := a.buildTpl()
+
+	a.tplMu.Lock()
+	defer a.tplMu.Unlock()
+	if err != nil {
+		if a.cfg.JITFallback {
+			a.logger.Errorf("error compiling templates, serving the last good ones: %v", err)
+		} else {
+			a.tplErr = err
+		}
+		return err
+	}
+	a.tpl, a.tplErr = tpl, nil
+	return nil
+}
+
+// Template changes are picked up once no more changes have been made for
+// this long, as editors often write files in several steps.
+const tplReloadDelay = time.Millisecond * 100
+
+// watchTemplates rebuilds the templates when the files in the template
+// directory change. Templates embedded in the binary can't be watched.
+func (a *App) watchTemplates() error {
+	if a.tplBox.IsEmbedded() || a.tplBox.IsAppended() {
+		return errors.New("templates are embedded")
+	}
+	dir, err := filepath.Abs(a.tplBox.Name())
+	if err != nil {
+		return err
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		var t *time.Timer
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				a.logger.Debugf("template %q was modified", ev.Name)
+				if t == nil {
+					t = time.AfterFunc(tplReloadDelay, func() {
+						if err := a.reloadTpl(); err == nil {
+							a.logger.Infof("reloaded templates")
+						}
+					})
+				} else {
+					t.Reset(tplReloadDelay)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				a.logger.Warnf("template watcher error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
 func (a *App) buildTpl() (*template.Template, error) {
-	tpl := template.New("")
+	tpl := template.New("").Funcs(template.FuncMap{
+		"asset": a.assets.url,
+	})
 	err := a.tplBox.Walk("/", func(path string, info os.FileInfo, err error) error {
 		if info.IsDir() {
 			return nil
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/knadh/koanf"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	const (
+		base = `
+[app]
+address = "0.0.0.0:9000"
+name = "Niltalk"
+origins = ["https://a.example"]
+
+[store]
+type = "redis"
+`
+		over = `
+[app]
+name = "Chat"
+origins = ["https://b.example"]
+`
+	)
+
+	dir, err := ioutil.TempDir("", "niltalk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		basePath = filepath.Join(dir, "base.toml")
+		overPath = filepath.Join(dir, "over.toml")
+	)
+	if err := ioutil.WriteFile(basePath, []byte(base), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(overPath, []byte(over), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		strategy string
+		address  string
+		name     string
+		origins  []string
+	}{
+		{mergeOverride, "", "Chat", []string{"https://b.example"}},
+		{mergeMerge, "0.0.0.0:9000", "Chat", []string{"https://b.example"}},
+		{mergeDeep, "0.0.0.0:9000", "Chat", []string{"https://a.example", "https://b.example"}},
+	}
+	for _, c := range cases {
+		t.Run(c.strategy, func(t *testing.T) {
+			ko = koanf.New(".")
+			for _, p := range []string{basePath, overPath} {
+				if err := loadConfigFile(p, c.strategy); err != nil {
+					t.Fatalf("error loading %s: %v", p, err)
+				}
+			}
+
+			if got := ko.String("app.address"); got != c.address {
+				t.Errorf("app.address = %q, want %q", got, c.address)
+			}
+			if got := ko.String("app.name"); got != c.name {
+				t.Errorf("app.name = %q, want %q", got, c.name)
+			}
+			if got := ko.Strings("app.origins"); !reflect.DeepEqual(got, c.origins) {
+				t.Errorf("app.origins = %v, want %v", got, c.origins)
+			}
+
+			// Blocks missing from the later file are kept.
+			if got := ko.String("store.type"); got != "redis" {
+				t.Errorf("store.type = %q, want redis", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// originChecker checks the Origin of WebSocket upgrades, which browsers send
+// with the cookies of the chat's domain whatever the site that opened the
+// connection. Unchecked, any site can open chats on behalf of its visitors.
+type originChecker struct {
+	patterns []string
+}
+
+// newOriginChecker returns a checker that allows the chat's own origin and
+// those matching any of the given patterns, eg: https://chat.example.com or
+// https://*.example.com.
+func newOriginChecker(patterns []string) *originChecker {
+	return &originChecker{patterns: lowerOrigins(patterns)}
+}
+
+// allowed checks whether a request can be upgraded to a WebSocket. Requests
+// without an Origin don't come from browsers and are allowed.
+func (o *originChecker) allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	origin = strings.ToLower(origin)
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return matchOrigin(o.patterns, origin)
+}
+
+// lowerOrigins normalizes origin patterns for matchOrigin.
+func lowerOrigins(patterns []string) []string {
+	out := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		out = append(out, strings.TrimRight(strings.ToLower(p), "/"))
+	}
+	return out
+}
+
+// matchOrigin checks whether a lowercase origin matches any of the patterns.
+// "*" matches any origin.
+func matchOrigin(patterns []string, origin string) bool {
+	for _, p := range patterns {
+		if p == "*" {
+			return true
+		}
+		if ok, _ := path.Match(p, origin); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Idle limiters are dropped after this long.
+const ipLimiterTTL = time.Minute * 10
+
+var errHTTPRateLimited = errors.New("too many requests, try again later")
+
+// ipLimiter rate limits HTTP requests by the client's IP address.
+type ipLimiter struct {
+	limit rate.Limit
+	burst int
+	ips   *ipResolver
+
+	mu       sync.Mutex
+	limiters map[string]*ipRate
+}
+
+type ipRate struct {
+	limiter *rate.Limiter
+	expire  time.Time
+}
+
+// newIPLimiter returns a limiter that allows n requests per interval from
+// each client IP.
+func newIPLimiter(n int, interval time.Duration, ips *ipResolver) *ipLimiter {
+	l := &ipLimiter{
+		limit:    rate.Every(interval / time.Duration(n)),
+		burst:    n,
+		ips:      ips,
+		limiters: make(map[string]*ipRate),
+	}
+	go func() {
+		t := time.NewTicker(ipLimiterTTL)
+		defer t.Stop()
+		for range t.C {
+			now := time.Now()
+			l.mu.Lock()
+			for ip, r := range l.limiters {
+				if r.expire.Before(now) {
+					delete(l.limiters, ip)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+	return l
+}
+
+// handler rate limits the requests to next, rejecting those over the limit
+// with a 429 and the seconds to retry after.
+func (l *ipLimiter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := l.ips.clientIP(r)
+
+		l.mu.Lock()
+		x, ok := l.limiters[ip]
+		if !ok {
+			x = &ipRate{limiter: rate.NewLimiter(l.limit, l.burst)}
+			l.limiters[ip] = x
+		}
+		x.expire = time.Now().Add(ipLimiterTTL)
+		res := x.limiter.Reserve()
+		l.mu.Unlock()
+
+		if d := res.Delay(); d > 0 {
+			res.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+			respondJSON(w, nil, errHTTPRateLimited, http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
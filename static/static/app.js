@@ -5,6 +5,80 @@ const notifType = {
 };
 const typingDebounceInterval = 3000;
 
+// Scripts and globals of the hosted captcha providers.
+const captchaAPIs = {
+    hcaptcha: { src: "https://js.hcaptcha.com/1/api.js", global: "hcaptcha" },
+    recaptcha: { src: "https://www.google.com/recaptcha/api.js", global: "grecaptcha" }
+};
+
+// SHA-256 round constants.
+const sha256K = [
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+];
+
+// sha256Word0 returns the first 32 bits of the SHA-256 hash of an ASCII
+// string, which is all that proof-of-work challenges check. It doesn't need
+// WebCrypto, which isn't available over plain HTTP, eg: onion services.
+function sha256Word0(str) {
+    const ror = (x, n) => (x >>> n) | (x << (32 - n));
+    const n = str.length;
+    const words = new Array((((n + 8) >> 6) + 1) * 16).fill(0);
+    for (let i = 0; i < n; i++) {
+        words[i >> 2] |= str.charCodeAt(i) << (24 - (i % 4) * 8);
+    }
+    words[n >> 2] |= 0x80 << (24 - (n % 4) * 8);
+    words[words.length - 1] = n * 8;
+
+    const h = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+    const w = new Array(64);
+    for (let j = 0; j < words.length; j += 16) {
+        for (let i = 0; i < 64; i++) {
+            if (i < 16) {
+                w[i] = words[j + i];
+                continue;
+            }
+            const s0 = ror(w[i - 15], 7) ^ ror(w[i - 15], 18) ^ (w[i - 15] >>> 3);
+            const s1 = ror(w[i - 2], 17) ^ ror(w[i - 2], 19) ^ (w[i - 2] >>> 10);
+            w[i] = (w[i - 16] + s0 + w[i - 7] + s1) | 0;
+        }
+
+        let [a, b, c, d, e, f, g, k] = h;
+        for (let i = 0; i < 64; i++) {
+            const t1 = (k + (ror(e, 6) ^ ror(e, 11) ^ ror(e, 25)) + ((e & f) ^ (~e & g)) + sha256K[i] + w[i]) | 0;
+            const t2 = ((ror(a, 2) ^ ror(a, 13) ^ ror(a, 22)) + ((a & b) ^ (a & c) ^ (b & c))) | 0;
+            k = g; g = f; f = e; e = (d + t1) | 0;
+            d = c; c = b; b = a; a = (t1 + t2) | 0;
+        }
+        [a, b, c, d, e, f, g, k].forEach((v, i) => { h[i] = (h[i] + v) | 0; });
+    }
+    return h[0] >>> 0;
+}
+
+// solvePoW finds the nonce for which the hash of "challenge:nonce" starts
+// with difficulty zero bits, hashing in batches to keep the page responsive.
+function solvePoW(challenge, difficulty) {
+    return new Promise(resolve => {
+        let nonce = 0;
+        const batch = () => {
+            for (const end = nonce + 5000; nonce < end; nonce++) {
+                if (Math.clz32(sha256Word0(challenge + ":" + nonce)) >= difficulty) {
+                    resolve(challenge + ":" + nonce);
+                    return;
+                }
+            }
+            setTimeout(batch, 0);
+        };
+        batch();
+    });
+}
+
 Vue.component("expand-link", {
     props: ["link"],
     data: function () {
@@ -38,6 +112,46 @@ var commands = {
     "help": "Send a message to a specific user",
     "usage": "/whisper [user] [message]",
   },
+  "kick": {
+    "help": "Kick an user out of the room (moderators only)",
+    "usage": "/kick [user]",
+  },
+  "ban": {
+    "help": "Kick an user out of the room and ban them for a duration (moderators only)",
+    "usage": "/ban [user] [duration, eg: 30m]",
+  },
+  "push": {
+    "help": "Get browser notifications of mentions and direct messages, even with the room closed",
+    "usage": "/push",
+  },
+  "me": {
+    "help": "Send an action, eg: /me waves",
+    "usage": "/me [action]",
+  },
+  "nick": {
+    "help": "Change your handle",
+    "usage": "/nick [handle]",
+  },
+  "shrug": {
+    "help": "Send a message with a shrug",
+    "usage": "/shrug [message]?",
+  },
+  "status": {
+    "help": "Set your status shown to others",
+    "usage": "/status [online|away|busy]",
+  },
+  "avatar": {
+    "help": "Set your avatar to the URL of an image uploaded to the room, or reset it without one",
+    "usage": "/avatar [url]?",
+  },
+  "search": {
+    "help": "Search the room's message history",
+    "usage": "/search [text]",
+  },
+  "export": {
+    "help": "Download the room's message history (moderators only)",
+    "usage": "/export [txt|json|html]?",
+  },
   "help": {
     "help": "Show commands help",
     "usage": "/help [command]?",
@@ -68,6 +182,9 @@ var app = new Vue({
         typingTimer: null,
         typingPeers: new Map(),
 
+        // ID of the hosted captcha widget on the create form.
+        captchaWidget: null,
+
         // Form fields.
         roomName: "",
         handle: "",
@@ -75,10 +192,18 @@ var app = new Vue({
         userpwd: "",
         message: "",
 
+        // Message being replied to.
+        replyTo: null,
+
         // Chat data.
         self: {},
         messages: [],
         peers: [],
+        pins: [],
+
+        // IDs of messages the peer was mentioned in. Mentions may arrive
+        // before the messages.
+        mentioned: {},
 
         // upload
         isDraggingOver: false,
@@ -93,6 +218,9 @@ var app = new Vue({
             Client.connect();
         }
     },
+    mounted: function () {
+        this.initCaptcha();
+    },
     computed: {
         Client() {
             return window.Client;
@@ -101,18 +229,22 @@ var app = new Vue({
     methods: {
         // Handle room creation.
         handleCreateRoom() {
-            fetch("/api/rooms", {
-                method: "post",
-                body: JSON.stringify({
-                    name: this.roomName,
-                    password: this.password
-                }),
-                headers: { "Content-Type": "application/json; charset=utf-8" }
-            })
+            this.getCaptcha()
+                .then(captcha => fetch("/api/rooms", {
+                    method: "post",
+                    body: JSON.stringify({
+                        name: this.roomName,
+                        password: this.password,
+                        captcha: captcha
+                    }),
+                    headers: { "Content-Type": "application/json; charset=utf-8" }
+                }))
                 .then(resp => resp.json())
                 .then(resp => {
                     this.toggleBusy();
                     if (resp.error) {
+                        // Captcha tokens can only be used once.
+                        this.resetCaptcha();
                         this.notify(resp.error, notifType.error);
                     } else {
                         document.location.replace("/r/" + resp.data.id);
@@ -124,6 +256,50 @@ var app = new Vue({
                 });
         },
 
+        // Load the hosted captcha widget on the create form, if enabled.
+        initCaptcha() {
+            if (!window._captcha || !captchaAPIs[_captcha.provider] || !this.$refs.captcha) {
+                return;
+            }
+            const api = captchaAPIs[_captcha.provider];
+            window._onCaptchaLoad = () => {
+                this.captchaWidget = window[api.global].render(this.$refs.captcha, { sitekey: _captcha.siteKey });
+            };
+
+            const s = document.createElement("script");
+            s.src = api.src + "?render=explicit&onload=_onCaptchaLoad";
+            s.async = true;
+            document.head.appendChild(s);
+        },
+
+        // Get the captcha token to create a room with, solving a
+        // proof-of-work challenge if the provider is pow.
+        getCaptcha() {
+            if (!window._captcha) {
+                return Promise.resolve("");
+            }
+            if (_captcha.provider === "pow") {
+                return fetch("/api/captcha")
+                    .then(resp => resp.json())
+                    .then(resp => {
+                        if (resp.error) {
+                            throw resp.error;
+                        }
+                        return solvePoW(resp.data.challenge, resp.data.difficulty);
+                    });
+            }
+            if (this.captchaWidget === null) {
+                return Promise.resolve("");
+            }
+            return Promise.resolve(window[captchaAPIs[_captcha.provider].global].getResponse(this.captchaWidget));
+        },
+
+        resetCaptcha() {
+            if (this.captchaWidget !== null) {
+                window[captchaAPIs[_captcha.provider].global].reset(this.captchaWidget);
+            }
+        },
+
         // Login to a room.
         handleLogin() {
             const handle = this.handle.replace(/[^a-z0-9_\-\.@]/ig, "");
@@ -200,7 +376,12 @@ var app = new Vue({
 
           // no command provided, handle a regular message
           if (commandName.length<1) {
-            Client.sendMessage(Client.MsgType["message"], msg);
+            if (this.replyTo) {
+              Client.sendMessage(Client.MsgType["message"], {message: msg, reply_to: this.replyTo.id});
+              this.replyTo = null;
+            } else {
+              Client.sendMessage(Client.MsgType["message"], msg);
+            }
 
           }else if (commandName=="help"){
             var message = "";
@@ -234,10 +415,142 @@ var app = new Vue({
             var matches = msg.match(re);
             Client.sendMessage(Client.MsgType["ping"], {to:matches[2], msg:matches[3],from: this.self.handle});
 
+          }else if (commandName=="kick"){
+            var re = new RegExp("^(/"+commandName+")\\s+([^\\s]+)");
+            var matches = msg.match(re);
+            if (!matches) {
+                return;
+            }
+            var peer = this.peers.find((p) => p.handle === matches[2]);
+            if (!peer) {
+                this.notify("Unknown user " + matches[2], notifType.error);
+                return;
+            }
+            Client.sendMessage(Client.MsgType["peer.kick"], peer.id);
+
+          }else if (commandName=="ban"){
+            var re = new RegExp("^(/"+commandName+")\\s+([^\\s]+)\\s+([^\\s]+)");
+            var matches = msg.match(re);
+            if (!matches) {
+                return;
+            }
+            var peer = this.peers.find((p) => p.handle === matches[2]);
+            if (!peer) {
+                this.notify("Unknown user " + matches[2], notifType.error);
+                return;
+            }
+            Client.sendMessage(Client.MsgType["peer.ban"], {id: peer.id, duration: matches[3]});
+
           }else if (commandName=="whisper"){
+            var re = new RegExp("^(/"+commandName+")\\s+([^\\s]+)\\s+(.*)");
+            var matches = msg.match(re);
+            if (!matches) {
+                return;
+            }
+            var peer = this.peers.find((p) => p.handle === matches[2]);
+            if (!peer) {
+                this.notify("Unknown user " + matches[2], notifType.error);
+                return;
+            }
+            Client.sendMessage(Client.MsgType["message.direct"], {to: peer.id, message: matches[3]});
+
+          }else if (commandName=="push"){
+            this.subscribePush();
+
+          }else if (commandName=="status"){
+            var re = new RegExp("^(/"+commandName+")\\s+(online|away|busy)\\s*$");
+            var matches = msg.match(re);
+            if (!matches) {
+                this.notify("Usage: " + commands[commandName].usage, notifType.error);
+                return;
+            }
+            Client.sendMessage(Client.MsgType["peer.status"], matches[2]);
+
+          }else if (commandName=="avatar"){
+            var re = new RegExp("^(/"+commandName+")(\\s+([^\\s]+))?\\s*$");
+            var matches = msg.match(re);
+            if (!matches) {
+                this.notify("Usage: " + commands[commandName].usage, notifType.error);
+                return;
+            }
+            Client.sendMessage(Client.MsgType["peer.avatar"], matches[3] || "");
+
+          }else if (commandName=="search"){
+            var re = new RegExp("^(/"+commandName+")\\s+(.+)");
+            var matches = msg.match(re);
+            if (!matches) {
+                this.notify("Usage: " + commands[commandName].usage, notifType.error);
+                return;
+            }
+            this.searchMessages(matches[2]);
+
+          }else if (commandName=="export"){
+            var re = new RegExp("^(/"+commandName+")(\\s+(txt|json|html))?\\s*$");
+            var matches = msg.match(re);
+            if (!matches) {
+                this.notify("Usage: " + commands[commandName].usage, notifType.error);
+                return;
+            }
+            window.location = "/r/" + _room.id + "/export?format=" + (matches[3] || "txt");
+
+          }else{
+            // Commands run by the server.
+            Client.sendMessage(Client.MsgType["message"], msg);
           }
         },
 
+        // Search the room's message history and show the matches.
+        searchMessages(q) {
+            fetch("/r/" + _room.id + "/search?q=" + encodeURIComponent(q))
+                .then(resp => resp.json())
+                .then(resp => {
+                    if (resp.error) {
+                        this.notify(resp.error, notifType.error);
+                        return;
+                    }
+
+                    var message = "<b>Search results for " + this.formatMessage(q) + "</b><br/>";
+                    if (resp.data.length === 0) {
+                        message += "No messages found";
+                    }
+                    resp.data.map((m) => {
+                        message += "<br/>" + this.formatDate(m.timestamp)
+                            + " <b>" + this.formatMessage(m.handle) + "</b>: "
+                            + this.formatMessage(m.message);
+                    });
+                    this.messages.push({
+                        type: Client.MsgType["help"],
+                        message: message
+                    });
+                    this.scrollToNewester();
+                })
+                .catch(err => {
+                    this.notify("Search is not available", notifType.error);
+                });
+        },
+
+        // Subscribe the browser to push notifications with the service worker.
+        subscribePush() {
+            if (!_room.vapidPublicKey || !("serviceWorker" in navigator) || !("PushManager" in window)) {
+                this.notify("Push notifications are not available", notifType.error);
+                return;
+            }
+
+            // The VAPID key is base64url encoded.
+            const b64 = _room.vapidPublicKey.replace(/-/g, "+").replace(/_/g, "/");
+            const key = Uint8Array.from(atob(b64), (c) => c.charCodeAt(0));
+
+            navigator.serviceWorker.register("/static/sw.js")
+                .then((reg) => reg.pushManager.subscribe({ userVisibleOnly: true, applicationServerKey: key }))
+                .then((sub) => axios.post("/r/" + _room.id + "/push/subscribe", sub.toJSON()))
+                .then(() => {
+                    this.notify("Push notifications enabled", notifType.notice);
+                })
+                .catch((err) => {
+                    this.notify("Error enabling push notifications: " + err, notifType.error);
+                });
+        },
+
         handleLogout() {
             if (!confirm("Logout?")) {
                 return;
@@ -296,6 +609,18 @@ var app = new Vue({
             return colour;
         },
 
+        // avatarStyle returns the style of a peer's avatar, its image over
+        // its colour.
+        avatarStyle(peer) {
+            const style = { 'background-color': peer.avatar };
+            const p = this.peers.find((p) => p.id === (peer.id || peer.peer_id));
+            const image = p ? p.image : peer.image;
+            if (image) {
+                style['background-image'] = 'url("' + encodeURI(image) + '")';
+            }
+            return style;
+        },
+
         formatDate(ts) {
             var t = new Date(ts),
                 h = t.getHours(),
@@ -382,6 +707,31 @@ var app = new Vue({
                     this.toggleChat();
                     break;
 
+                case Client.MsgType["peer.kicked"]:
+                    this.notify("You were kicked out of the room", notifType.error);
+                    this.toggleChat();
+                    break;
+
+                case Client.MsgType["session.evicted"]:
+                    this.notify("You logged in elsewhere", notifType.error);
+                    this.toggleChat();
+                    break;
+
+                case Client.MsgType["room.locked"]:
+                    this.notify("Room is locked", notifType.error);
+                    this.toggleChat();
+                    break;
+
+                case Client.MsgType["handle.taken"]:
+                    this.notify("Someone in the room already has this handle", notifType.error);
+                    this.toggleChat();
+                    break;
+
+                case Client.MsgType["client.outdated"]:
+                    this.notify("This client is outdated. Please reload the page to update", notifType.error);
+                    this.toggleChat();
+                    break;
+
                 case Client.MsgType["room.dispose"]:
                     this.notify("Room diposed", notifType.error);
                     this.toggleChat();
@@ -398,6 +748,7 @@ var app = new Vue({
         onPeerSelf(data) {
             this.self = {
                 ...data.data,
+                image: data.data.avatar,
                 avatar: this.hashColor(data.data.id)
             };
         },
@@ -415,6 +766,7 @@ var app = new Vue({
             this.onPeers(peers);
 
             // Notice in the message area;
+            peer.image = peer.avatar;
             peer.avatar = this.hashColor(peer.id);
             if (peer.id!==this.self.id){
               this.messages.push({
@@ -438,6 +790,9 @@ var app = new Vue({
             });
 
             peers.forEach(p => {
+                if (!p.image) {
+                    p.image = p.avatar;
+                }
                 p.avatar = this.hashColor(p.id);
             });
 
@@ -452,6 +807,12 @@ var app = new Vue({
             this.$forceUpdate();
         },
 
+        onTypingStop(data) {
+            if (this.typingPeers.delete(data.data.id)) {
+                this.$forceUpdate();
+            }
+        },
+
         onMessage(data) {
             // If the window isn't in focus, start the "new activity" animation
             // in the title bar.
@@ -461,10 +822,22 @@ var app = new Vue({
             }
 
             this.typingPeers.delete(data.data.peer_id);
+
+            // Burn after reading.
+            if (data.data.burn) {
+                window.setTimeout(() => { this.onMessageDelete(data.data.id); }, data.data.burn * 1000);
+            }
+
             this.messages.push({
+                id: data.data.id,
+                history: data.history,
+                direct: data.direct,
+                mentioned: !!this.mentioned[data.data.id],
+                edited: false,
                 type: data.type,
                 timestamp: data.timestamp,
                 message: data.data.message,
+                replyTo: data.data.reply_to,
                 peer: {
                     id: data.data.peer_id,
                     handle: data.data.peer_handle,
@@ -474,13 +847,173 @@ var app = new Vue({
             this.scrollToNewester();
         },
 
+        // Answer the challenge sent before the first message is posted.
+        onVerify(data) {
+            if (data.data.verified) {
+                return;
+            }
+            const answer = window.prompt(data.data.question);
+            if (answer !== null) {
+                Client.sendMessage(Client.MsgType["verify"], answer);
+            }
+        },
+
+        onMention(data) {
+            this.mentioned[data.data.id] = true;
+            this.messages.forEach((m) => {
+                if (m.id === data.data.id) {
+                    m.mentioned = true;
+                }
+            });
+            if (!document.hasFocus()) {
+                this.notify(data.data.peer_handle + " mentioned you", notifType.notice);
+            }
+        },
+
+        // System messages from the server.
+        // Pins carry the pinned message's payload.
+        onPins(data) {
+            this.pins = data.data.map(this.makePin);
+        },
+
+        onPin(data) {
+            this.pins.push(this.makePin(data.data));
+        },
+
+        onUnpin(data) {
+            this.pins = this.pins.filter((p) => p.id !== data.data.id);
+        },
+
+        makePin(m) {
+            return {
+                id: m.data.id,
+                message: m.data.message,
+                peer: {
+                    id: m.data.peer_id,
+                    handle: m.data.peer_handle,
+                    avatar: this.hashColor(m.data.peer_id)
+                }
+            };
+        },
+
+        pin(m) {
+            Client.sendMessage(Client.MsgType["message.pin"], m.id);
+        },
+
+        unpin(m) {
+            Client.sendMessage(Client.MsgType["message.unpin"], m.id);
+        },
+
+        onStatus(data) {
+            const peer = data.data;
+            if (peer.id === this.self.id) {
+                this.self.status = peer.status;
+            }
+            this.peers.forEach((p) => {
+                if (p.id === peer.id) {
+                    p.status = peer.status;
+                }
+            });
+            this.$forceUpdate();
+        },
+
+        onAvatar(data) {
+            const peer = data.data;
+            if (peer.id === this.self.id) {
+                this.self.image = peer.avatar;
+            }
+            this.peers.forEach((p) => {
+                if (p.id === peer.id) {
+                    p.image = peer.avatar;
+                }
+            });
+            this.$forceUpdate();
+        },
+
+        onHandle(data) {
+            const peer = data.data;
+            if (peer.id === this.self.id) {
+                this.self.handle = peer.handle;
+                this.self.image = peer.avatar;
+            }
+            this.peers.forEach((p) => {
+                if (p.id === peer.id) {
+                    p.handle = peer.handle;
+                    p.image = peer.avatar;
+                }
+            });
+            this.messages.push({
+                type: Client.MsgType["notice"],
+                timestamp: data.timestamp,
+                message: peer.old_handle + " is now " + peer.handle
+            });
+            this.scrollToNewester();
+        },
+
+        onNotice(data) {
+            this.messages.push({
+                type: Client.MsgType["notice"],
+                timestamp: data.timestamp,
+                message: data.data.message
+            });
+            this.scrollToNewester();
+        },
+
+        // Direct messages are shown as regular messages marked as private.
+        onDirectMessage(data) {
+            this.onMessage({ ...data, type: Client.MsgType["message"], direct: true });
+        },
+
+        onMessageEdit(data) {
+            this.messages.forEach((m) => {
+                if (m.id === data.data.id) {
+                    m.message = data.data.message;
+                    m.edited = true;
+                }
+            });
+        },
+
+        // Reply to a message with the next message sent.
+        reply(m) {
+            this.replyTo = m;
+            this.$refs["form-message"].focus();
+        },
+
+        // Returns the message replied to by a message if it's still shown.
+        parentMessage(m) {
+            return this.messages.find((p) => p.id && p.id === m.replyTo);
+        },
+
+        // Prompt for the new text of one of the peer's own messages.
+        editMessage(m) {
+            const msg = window.prompt("Edit message", m.message);
+            if (msg === null || msg.trim() === "" || msg === m.message) {
+                return;
+            }
+            Client.sendMessage(Client.MsgType["message.edit"], { id: m.id, message: msg });
+        },
+
+        deleteMessage(m) {
+            if (!window.confirm("Delete this message?")) {
+                return;
+            }
+            Client.sendMessage(Client.MsgType["message.delete"], m.id);
+        },
+
+        onMessageDelete(id) {
+            this.messages = this.messages.filter((m) => !m.id || m.id !== id);
+        },
+
         onUpload(data) {
           var d = data.data.data;
           if (data.type==Client.MsgType["uploading"]) {
             var found = false;
             this.messages.map((m) => {
               if (m.uid===d.uid){
-                m.files=d.files;
+                // Progress sent in binary frames doesn't repeat the files.
+                if (d.files) {
+                  m.files=d.files;
+                }
                 m.percent=d.percent;
                 m.type=data.type;
                 found=true;
@@ -491,7 +1024,7 @@ var app = new Vue({
                 type: data.type,
                 timestamp: data.timestamp,
                 uid: d.uid,
-                files: d.files,
+                files: d.files || [],
                 percent: d.percent,
                 peer: {
                   id: data.data.peer_id,
@@ -557,6 +1090,11 @@ var app = new Vue({
             Client.on(Client.MsgType["peer.ratelimited"], (data) => { this.onDisconnect(Client.MsgType["peer.ratelimited"]); });
             Client.on(Client.MsgType["room.dispose"], (data) => { this.onDisconnect(Client.MsgType["room.dispose"]); });
             Client.on(Client.MsgType["room.full"], (data) => { this.onDisconnect(Client.MsgType["room.full"]); });
+            Client.on(Client.MsgType["room.locked"], (data) => { this.onDisconnect(Client.MsgType["room.locked"]); });
+            Client.on(Client.MsgType["handle.taken"], (data) => { this.onDisconnect(Client.MsgType["handle.taken"]); });
+            Client.on(Client.MsgType["peer.kicked"], (data) => { this.onDisconnect(Client.MsgType["peer.kicked"]); });
+            Client.on(Client.MsgType["session.evicted"], (data) => { this.onDisconnect(Client.MsgType["session.evicted"]); });
+            Client.on(Client.MsgType["client.outdated"], (data) => { this.onDisconnect(Client.MsgType["client.outdated"]); });
             Client.on(Client.MsgType["reconnecting"], this.onReconnecting);
 
             Client.on(Client.MsgType["peer.info"], this.onPeerSelf);
@@ -565,10 +1103,25 @@ var app = new Vue({
             Client.on(Client.MsgType["peer.leave"], (data) => { this.onPeerJoinLeave(data, Client.MsgType["peer.leave"]); });
             Client.on(Client.MsgType["message"], this.onMessage);
             Client.on(Client.MsgType["motd"], this.onMessage);
+            Client.on(Client.MsgType["message.action"], this.onMessage);
+            Client.on(Client.MsgType["handle"], this.onHandle);
+            Client.on(Client.MsgType["peer.status"], this.onStatus);
+            Client.on(Client.MsgType["peer.avatar"], this.onAvatar);
+            Client.on(Client.MsgType["message.pins"], this.onPins);
+            Client.on(Client.MsgType["message.pin"], this.onPin);
+            Client.on(Client.MsgType["message.unpin"], this.onUnpin);
+            Client.on(Client.MsgType["message.delete"], (data) => { this.onMessageDelete(data.data.id); });
+            Client.on(Client.MsgType["message.edit"], this.onMessageEdit);
+            Client.on(Client.MsgType["message.direct"], this.onDirectMessage);
+            Client.on(Client.MsgType["mention"], this.onMention);
+            Client.on(Client.MsgType["notice"], this.onNotice);
             Client.on(Client.MsgType["uploading"], this.onUpload);
             Client.on(Client.MsgType["upload"], this.onUpload);
             Client.on(Client.MsgType["typing"], this.onTyping);
+            Client.on(Client.MsgType["typing.stop"], this.onTypingStop);
             Client.on(Client.MsgType["ping"], this.onPing);
+            Client.on(Client.MsgType["error"], (data) => { this.notify(data.data.error, notifType.error); });
+            Client.on(Client.MsgType["verify"], this.onVerify);
         },
 
         initTimers() {
@@ -589,8 +1142,12 @@ var app = new Vue({
                 document.title = this.pageTitle;
             };
 
-            // Sweep "typing" statuses at regular intervals.
+            // Sweep "typing" statuses at regular intervals unless the server
+            // says when peers stop typing.
             window.setInterval(() => {
+                if (window._room && _room.typingStop) {
+                    return;
+                }
                 let changed = false;
                 this.typingPeers.forEach((p) => {
                     if ((p.time + typingDebounceInterval) < Date.now()) {
@@ -623,6 +1180,11 @@ var app = new Vue({
           var ok = true;
           let formData = new FormData();
           var files = [];
+          var size = ([...droppedFiles]).reduce((n, f) => n + f.size, 0);
+          if (_room.maxUploadSize && size > _room.maxUploadSize) {
+            this.notify("Files are too large to upload", notifType.error);
+            return
+          }
           ([...droppedFiles]).forEach((f,x) => {
             if (x>=20) {
               this.notify("Too much files to upload", notifType.error);
@@ -644,7 +1206,7 @@ var app = new Vue({
               },
               onUploadProgress: function( progressEvent ) {
                 var p = parseInt( Math.round( ( progressEvent.loaded / progressEvent.total ) * 100 ) );
-                Client.sendMessage(Client.MsgType["uploading"], {uid:uid,files:files,percent:p});
+                Client.sendUploadProgress(uid, p);
               }
             }
           ).then(res => {
@@ -5,24 +5,52 @@ var Client = new function () {
 		"reconnecting": "reconnecting",
 		"room.dispose": "room.dispose",
 		"room.full": "room.full",
+		"room.locked": "room.locked",
+		"handle.taken": "handle.taken",
+		"client.outdated": "client.outdated",
 		"message": "message",
+		"message.delete": "message.delete",
+		"message.edit": "message.edit",
+		"message.direct": "message.direct",
+		"message.action": "message.action",
+		"message.pin": "message.pin",
+		"message.unpin": "message.unpin",
+		"message.pins": "message.pins",
+		"mention": "mention",
+		"peer.kick": "peer.kick",
+		"peer.kicked": "peer.kicked",
+		"session.evicted": "session.evicted",
+		"peer.ban": "peer.ban",
 		"uploading": "uploading",
 		"upload": "upload",
 		"typing": "typing",
+		"typing.stop": "typing.stop",
 		"peer.list": "peer.list",
 		"peer.info": "peer.info",
 		"peer.join": "peer.join",
 		"peer.leave": "peer.leave",
+		"peer.status": "peer.status",
+		"peer.avatar": "peer.avatar",
 		"peer.ratelimited": "peer.ratelimited",
 		"notice": "notice",
 		"handle": "handle",
 		"growl": "growl",
 		"ping": "ping",
 		"motd": "motd",
+		"error": "error",
+		"verify": "verify",
 		"help": "help"
 	};
 	this.MsgType = MsgType;
 
+	// Types of binary frames, given by their first byte.
+	const BinaryType = {
+		"uploading": 1
+	};
+
+	// Version of the WS protocol spoken by the client.
+	const protocolVersion = 1;
+
 	var wsURL = null,
 		pingInterval = 5, // seconds
 		reconnectInterval = 4000;
@@ -32,13 +60,15 @@ var Client = new function () {
 		triggers = {},
 		ping_timer = null,
 		reconnect_timer = null,
+		resumeToken = null,
+		lastSeq = 0,
 		peer = { id: null, handle: null };
 
 
 	// Initialize and connect the websocket.
 	this.init = function (roomID) {
 		wsURL = document.location.protocol.replace(/http(s?):/, "ws$1:") +
-			document.location.host + "/r/" + roomID + "/ws";
+			document.location.host + "/r/" + roomID + "/ws?version=" + protocolVersion;
 	};
 
 	// Peer identification info.
@@ -48,7 +78,15 @@ var Client = new function () {
 
 	// websocket hooks
 	this.connect = function () {
-		ws = new WebSocket(wsURL);
+		// Pick up missed messages when reconnecting.
+		var url = wsURL;
+		if (resumeToken) {
+			url += "&resume=" + resumeToken;
+		}
+		if (lastSeq) {
+			url += "&last_seq=" + lastSeq;
+		}
+		ws = new WebSocket(url);
 		ws.onopen = function () {
 			trigger(MsgType["connect"]);
 		};
@@ -60,6 +98,12 @@ var Client = new function () {
 			} catch (e) {
 				return null;
 			}
+			if (data.type == MsgType["peer.info"] && data.data.resume_token) {
+				resumeToken = data.data.resume_token;
+			}
+			if (data.seq) {
+				lastSeq = data.seq;
+			}
 			trigger(data.type, data);
 		};
 
@@ -100,6 +144,17 @@ var Client = new function () {
 		send({ "type": typ, "data": data });
 	}
 
+	// send upload progress in a binary frame: the type, the upload's uid
+	// as a big endian uint64, and the percentage.
+	this.sendUploadProgress = function (uid, percent) {
+		var b = new DataView(new ArrayBuffer(10));
+		b.setUint8(0, BinaryType["uploading"]);
+		b.setUint32(1, Math.floor(uid / 4294967296));
+		b.setUint32(5, uid % 4294967296);
+		b.setUint8(9, percent);
+		send(b.buffer);
+	}
+
 	// ___ private
 	// send a message via the socket
 	// automatically encodes json if possible
@@ -107,7 +162,7 @@ var Client = new function () {
 		if (!ws || ws.readyState == ws.CLOSED || ws.readyState == ws.CLOSING) return;
 
 		try {
-			if (typeof (message) == "object") {
+			if (typeof (message) == "object" && !(message instanceof ArrayBuffer)) {
 				message = JSON.stringify(message);
 			}
 			ws.send(message);
@@ -0,0 +1,18 @@
+// Service worker that shows push notifications of mentions and direct
+// messages, and opens the room when they're clicked.
+self.addEventListener("push", (e) => {
+    if (!e.data) {
+        return;
+    }
+    const data = e.data.json();
+    e.waitUntil(self.registration.showNotification(data.title, {
+        body: data.body,
+        icon: "/static/images/favicon.png",
+        data: { url: data.url }
+    }));
+});
+
+self.addEventListener("notificationclick", (e) => {
+    e.notification.close();
+    e.waitUntil(clients.openWindow(e.notification.data.url));
+});
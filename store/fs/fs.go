@@ -1,20 +1,34 @@
 package fs
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/knadh/niltalk/internal/log"
 	"github.com/knadh/niltalk/store"
 )
 
 // Config represents the file store config structure.
 type Config struct {
 	Path string `koanf:"path"`
+
+	// Directory with the append-only message logs of rooms.
+	// Defaults to Path + ".messages".
+	MessagesDir string `koanf:"messages_dir"`
+
+	// Number of messages kept per room.
+	MaxMessages int `koanf:"max_messages"`
 }
 
 // File represents the file implementation of the Store interface.
@@ -25,21 +39,84 @@ type File struct {
 	mu    sync.Mutex
 	dirty bool
 	log   *log.Logger
+
+	// Message logs and the number of lines in them.
+	logMu    sync.Mutex
+	logLines map[string]int
 }
 
 type room struct {
 	store.Room
 	Sessions map[string]string
 	Expire   time.Time
+
+	// When sessions expire and when they were created. Sessions without an
+	// expiry have expired.
+	SessionExpiry  map[string]time.Time
+	SessionCreated map[string]time.Time
+
+	// Banned subjects and when their bans expire.
+	Bans map[string]time.Time
+
+	// Push subscriptions of handles by their endpoints.
+	Push map[string]map[string]store.PushSubscription
+
+	// Payloads of the pinned messages.
+	Pins [][]byte
+
+	// Resume tokens of peers that left.
+	Resume map[string]store.ResumeToken
+}
+
+// Validate checks the config for missing and invalid values, returning an
+// error that lists all the problems found, one per line.
+func (c Config) Validate() error {
+	var errs []string
+	if c.Path == "" {
+		errs = append(errs, "store.path is required with the fs storage, eg: db.json")
+	} else if err := checkWritable(filepath.Dir(c.Path)); err != nil {
+		errs = append(errs, fmt.Sprintf("store.path: directory of %q is not writable: %v", c.Path, err))
+	}
+	if c.MessagesDir != "" {
+		if err := checkWritable(c.MessagesDir); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Sprintf("store.messages_dir: %q is not writable: %v", c.MessagesDir, err))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "\n"))
+}
+
+// checkWritable checks whether files can be created in a directory.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".niltalk-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
 }
 
 // New returns a new Redis store.
 func New(cfg Config, log *log.Logger) (*File, error) {
+	if cfg.MessagesDir == "" {
+		cfg.MessagesDir = cfg.Path + ".messages"
+	}
+	if cfg.MaxMessages < 1 {
+		cfg.MaxMessages = store.DefaultMaxMessages
+	}
+	if err := os.MkdirAll(cfg.MessagesDir, 0755); err != nil {
+		return nil, err
+	}
+
 	store := &File{
-		cfg:   &cfg,
-		rooms: map[string]*room{},
-		data:  map[string][]byte{},
-		log:   log,
+		cfg:      &cfg,
+		rooms:    map[string]*room{},
+		data:     map[string][]byte{},
+		log:      log,
+		logLines: map[string]int{},
 	}
 	err := store.load()
 	go store.watch()
@@ -66,9 +143,24 @@ func (m *File) cleanup() {
 	for id, r := range m.rooms {
 		if r.Expire.Before(now) {
 			delete(m.rooms, id)
+			m.removeLog(id)
 			m.dirty = true
 			continue
 		}
+		for s, exp := range r.Bans {
+			if exp.Before(now) {
+				delete(r.Bans, s)
+				m.dirty = true
+			}
+		}
+		for s := range r.Sessions {
+			if r.SessionExpiry[s].Before(now) {
+				delete(r.Sessions, s)
+				delete(r.SessionExpiry, s)
+				delete(r.SessionCreated, s)
+				m.dirty = true
+			}
+		}
 	}
 }
 
@@ -110,7 +202,7 @@ func (m *File) save() error {
 			m.dirty = false
 			err = ioutil.WriteFile(m.cfg.Path, data, os.ModePerm)
 			if err != nil {
-				m.log.Printf("error writing file %q: %v", m.cfg.Path, err)
+				m.log.Errorf("error writing file %q: %v", m.cfg.Path, err)
 			}
 		}
 		return err
@@ -139,6 +231,25 @@ func (m *File) AddRoom(r store.Room, ttl time.Duration) error {
 	return nil
 }
 
+// CreateRoomIfNotExists adds a room to the store unless one with its ID
+// exists.
+func (m *File) CreateRoomIfNotExists(r store.Room, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.rooms[r.ID]; ok {
+		return false, nil
+	}
+	m.rooms[r.ID] = &room{
+		Room:     r,
+		Expire:   r.CreatedAt.Add(ttl),
+		Sessions: map[string]string{},
+	}
+	m.dirty = true
+
+	return true, nil
+}
+
 // AddPredefinedRoom adds a room to the store.
 func (m *File) AddPredefinedRoom(r store.Room) error {
 	m.mu.Lock()
@@ -170,6 +281,21 @@ func (m *File) ExtendRoomTTL(id string, ttl time.Duration) error {
 	return nil
 }
 
+// SetRoomPassword replaces the password hash of a room.
+func (m *File) SetRoomPassword(id string, password []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[id]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	room.Password = password
+	m.dirty = true
+	return nil
+}
+
 // GetRoom gets a room from the store.
 func (m *File) GetRoom(id string) (store.Room, error) {
 	m.mu.Lock()
@@ -200,6 +326,7 @@ func (m *File) RemoveRoom(id string) error {
 
 	if _, ok := m.rooms[id]; ok {
 		delete(m.rooms, id)
+		m.removeLog(id)
 		m.dirty = true
 	}
 
@@ -217,7 +344,16 @@ func (m *File) AddSession(sessID, handle, roomID string, ttl time.Duration) erro
 		return store.ErrRoomNotFound
 	}
 
+	now := time.Now()
 	room.Sessions[sessID] = handle
+	if room.SessionExpiry == nil {
+		room.SessionExpiry = map[string]time.Time{}
+		room.SessionCreated = map[string]time.Time{}
+	}
+	room.SessionExpiry[sessID] = now.Add(ttl)
+	if _, ok := room.SessionCreated[sessID]; !ok {
+		room.SessionCreated[sessID] = now
+	}
 	m.rooms[roomID] = room
 	m.dirty = true
 
@@ -237,7 +373,7 @@ func (m *File) GetSession(sessID, roomID string) (store.Sess, error) {
 
 	handle, ok := room.Sessions[sessID]
 
-	if !ok {
+	if !ok || room.SessionExpiry[sessID].Before(time.Now()) {
 		return store.Sess{}, nil
 	}
 
@@ -247,6 +383,53 @@ func (m *File) GetSession(sessID, roomID string) (store.Sess, error) {
 	}, nil
 }
 
+// ExtendSession renews a session's TTL, if it exists.
+func (m *File) ExtendSession(sessID, roomID string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	now := time.Now()
+	if exp, ok := room.SessionExpiry[sessID]; ok && exp.After(now) {
+		room.SessionExpiry[sessID] = now.Add(ttl)
+		m.dirty = true
+	}
+
+	return nil
+}
+
+// HandleSessions returns the IDs of the live sessions of a handle in a
+// room, oldest first.
+func (m *File) HandleSessions(roomID, handle string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return nil, store.ErrRoomNotFound
+	}
+
+	var (
+		now = time.Now()
+		out []string
+	)
+	for id, h := range room.Sessions {
+		if h == handle && room.SessionExpiry[id].After(now) {
+			out = append(out, id)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return room.SessionCreated[out[i]].Before(room.SessionCreated[out[j]])
+	})
+	return out, nil
+}
+
 // RemoveSession deletes a session ID from a room.
 func (m *File) RemoveSession(sessID, roomID string) error {
 	m.mu.Lock()
@@ -260,6 +443,8 @@ func (m *File) RemoveSession(sessID, roomID string) error {
 
 	if _, ok := room.Sessions[sessID]; ok {
 		delete(room.Sessions, sessID)
+		delete(room.SessionExpiry, sessID)
+		delete(room.SessionCreated, sessID)
 		m.rooms[roomID] = room
 		m.dirty = true
 	}
@@ -279,6 +464,8 @@ func (m *File) ClearSessions(roomID string) error {
 	}
 
 	room.Sessions = map[string]string{}
+	room.SessionExpiry = map[string]time.Time{}
+	room.SessionCreated = map[string]time.Time{}
 
 	m.rooms[roomID] = room
 	m.dirty = true
@@ -286,6 +473,367 @@ func (m *File) ClearSessions(roomID string) error {
 	return nil
 }
 
+// AppendMessage appends a message to a room's log. Once the log grows to twice
+// the number of messages kept, it's compacted. Each line in the log is the
+// message ID and the message separated by a tab.
+func (m *File) AppendMessage(roomID, msgID string, msg []byte) error {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+
+	n, ok := m.logLines[roomID]
+	if !ok {
+		lines, err := m.readLog(roomID)
+		if err != nil {
+			return err
+		}
+		n = len(lines)
+	}
+
+	f, err := os.OpenFile(m.logPath(roomID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	line := make([]byte, 0, len(msgID)+len(msg)+2)
+	line = append(append(append(line, msgID...), '\t'), msg...)
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	n++
+
+	if n >= m.cfg.MaxMessages*2 {
+		lines, err := m.readLog(roomID)
+		if err != nil {
+			return err
+		}
+		lines = lines[len(lines)-m.cfg.MaxMessages:]
+		if err := m.writeLog(roomID, lines); err != nil {
+			return err
+		}
+		n = len(lines)
+	}
+	m.logLines[roomID] = n
+	return nil
+}
+
+// GetMessages retrieves up to the last limit messages in a room's log.
+func (m *File) GetMessages(roomID string, limit int) ([][]byte, error) {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+
+	lines, err := m.readLog(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(lines) > limit {
+		lines = lines[len(lines)-limit:]
+	}
+
+	out := make([][]byte, len(lines))
+	for i, l := range lines {
+		if n := bytes.IndexByte(l, '\t'); n >= 0 {
+			l = l[n+1:]
+		}
+		out[i] = l
+	}
+	return out, nil
+}
+
+// DeleteMessage deletes a message, and the events logged with its ID, from a
+// room's log by rewriting it.
+func (m *File) DeleteMessage(roomID, msgID string) error {
+	if msgID == "" {
+		return nil
+	}
+
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+
+	lines, err := m.readLog(roomID)
+	if err != nil {
+		return err
+	}
+
+	prefix := []byte(msgID + "\t")
+	out := lines[:0]
+	for _, l := range lines {
+		if !bytes.HasPrefix(l, prefix) {
+			out = append(out, l)
+		}
+	}
+	if len(out) == len(lines) {
+		return nil
+	}
+
+	if err := m.writeLog(roomID, out); err != nil {
+		return err
+	}
+	m.logLines[roomID] = len(out)
+	return nil
+}
+
+// WalkMessages reads a room's log line by line, calling fn with each message,
+// oldest first. Messages appended while walking are left out.
+func (m *File) WalkMessages(roomID string, fn func(msg []byte) error) error {
+	m.logMu.Lock()
+	f, err := os.Open(m.logPath(roomID))
+	if err != nil {
+		m.logMu.Unlock()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	// Logs are rewritten by renaming, so the open file stays as it is, but
+	// it may still be appended to.
+	st, err := f.Stat()
+	m.logMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	rd := bufio.NewReader(io.LimitReader(f, st.Size()))
+	for {
+		l, err := rd.ReadBytes('\n')
+		if l = bytes.TrimSuffix(l, []byte{'\n'}); len(l) > 0 {
+			if n := bytes.IndexByte(l, '\t'); n >= 0 {
+				l = l[n+1:]
+			}
+			if err := fn(l); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// logPath returns the path to a room's message log.
+func (m *File) logPath(roomID string) string {
+	return filepath.Join(m.cfg.MessagesDir, filepath.Base(roomID)+".log")
+}
+
+// readLog reads the messages in a room's log.
+func (m *File) readLog(roomID string) ([][]byte, error) {
+	b, err := ioutil.ReadFile(m.logPath(roomID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var out [][]byte
+	for _, l := range bytes.Split(b, []byte{'\n'}) {
+		if len(l) > 0 {
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
+
+// writeLog replaces a room's log with the given messages.
+func (m *File) writeLog(roomID string, lines [][]byte) error {
+	var b bytes.Buffer
+	for _, l := range lines {
+		b.Write(l)
+		b.WriteByte('\n')
+	}
+
+	// Write to a temporary file first so that the log isn't lost midway.
+	tmp := m.logPath(roomID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.logPath(roomID))
+}
+
+// removeLog deletes a room's message log.
+func (m *File) removeLog(roomID string) {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+
+	delete(m.logLines, roomID)
+	if err := os.Remove(m.logPath(roomID)); err != nil && !os.IsNotExist(err) {
+		m.log.Errorf("error removing message log %q: %v", m.logPath(roomID), err)
+	}
+}
+
+// Ping checks that the directories of the data file and the message logs
+// are accessible.
+func (m *File) Ping() error {
+	for _, d := range []string{filepath.Dir(m.cfg.Path), m.cfg.MessagesDir} {
+		if _, err := os.Stat(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddBan bans a subject from a room for the given duration.
+func (m *File) AddBan(roomID, subject string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	if room.Bans == nil {
+		room.Bans = make(map[string]time.Time)
+	}
+	room.Bans[subject] = time.Now().Add(ttl)
+	m.dirty = true
+	return nil
+}
+
+// IsBanned checks whether a subject is banned from a room.
+func (m *File) IsBanned(roomID, subject string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return false, store.ErrRoomNotFound
+	}
+	exp, ok := room.Bans[subject]
+	return ok && exp.After(time.Now()), nil
+}
+
+// AddPushSubscription adds a handle's push subscription to a room.
+func (m *File) AddPushSubscription(roomID, handle string, s store.PushSubscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	if room.Push == nil {
+		room.Push = make(map[string]map[string]store.PushSubscription)
+	}
+	if room.Push[handle] == nil {
+		room.Push[handle] = make(map[string]store.PushSubscription)
+	}
+	room.Push[handle][s.Endpoint] = s
+	m.dirty = true
+	return nil
+}
+
+// GetPushSubscriptions returns a handle's push subscriptions in a room.
+func (m *File) GetPushSubscriptions(roomID, handle string) ([]store.PushSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, store.ErrRoomNotFound
+	}
+	out := make([]store.PushSubscription, 0, len(room.Push[handle]))
+	for _, s := range room.Push[handle] {
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// RemovePushSubscription removes a handle's push subscription from a room.
+func (m *File) RemovePushSubscription(roomID, handle, endpoint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	if subs, ok := room.Push[handle]; ok {
+		delete(subs, endpoint)
+		if len(subs) == 0 {
+			delete(room.Push, handle)
+		}
+		m.dirty = true
+	}
+	return nil
+}
+
+// SetResumeToken stores a peer's resume token in a room for ttl.
+func (m *File) SetResumeToken(roomID, token string, t store.ResumeToken, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	if room.Resume == nil {
+		room.Resume = make(map[string]store.ResumeToken)
+	}
+
+	// Drop the expired tokens of peers that never came back.
+	now := time.Now()
+	for k, t := range room.Resume {
+		if t.Expires.Before(now) {
+			delete(room.Resume, k)
+		}
+	}
+	t.Expires = now.Add(ttl)
+	room.Resume[token] = t
+	m.dirty = true
+	return nil
+}
+
+// ClaimResumeToken returns and removes a peer's resume token in a room.
+func (m *File) ClaimResumeToken(roomID, token string) (store.ResumeToken, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ResumeToken{}, false, store.ErrRoomNotFound
+	}
+	t, ok := room.Resume[token]
+	if !ok {
+		return store.ResumeToken{}, false, nil
+	}
+	delete(room.Resume, token)
+	m.dirty = true
+	return t, t.Expires.After(time.Now()), nil
+}
+
+// SetPins replaces the pinned messages of a room.
+func (m *File) SetPins(roomID string, pins [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	room.Pins = pins
+	m.dirty = true
+	return nil
+}
+
+// GetPins returns the pinned messages of a room.
+func (m *File) GetPins(roomID string) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, store.ErrRoomNotFound
+	}
+	return room.Pins, nil
+}
+
 // Get value from a key.
 func (m *File) Get(key string) ([]byte, error) {
 	m.mu.Lock()
@@ -306,3 +854,16 @@ func (m *File) Set(key string, data []byte) error {
 	m.dirty = true
 	return nil
 }
+
+// SetIfNotExists sets a value unless the key exists.
+func (m *File) SetIfNotExists(key string, data []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[key]; ok {
+		return false, nil
+	}
+	m.data[key] = make([]byte, len(data), len(data))
+	copy(m.data[key], data)
+	m.dirty = true
+	return true, nil
+}
@@ -2,6 +2,7 @@ package mem
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -9,7 +10,10 @@ import (
 )
 
 // Config represents the InMemory store config structure.
-type Config struct{}
+type Config struct {
+	// Number of messages kept per room.
+	MaxMessages int `koanf:"max_messages"`
+}
 
 // InMemory represents the in-memory implementation of the Store interface.
 type InMemory struct {
@@ -23,10 +27,88 @@ type room struct {
 	store.Room
 	Sessions map[string]string
 	Expire   time.Time
+	Messages *ring
+
+	// When sessions expire and when they were created. Sessions without an
+	// expiry have expired.
+	SessionExpiry  map[string]time.Time
+	SessionCreated map[string]time.Time
+
+	// Banned subjects and when their bans expire.
+	Bans map[string]time.Time
+
+	// Push subscriptions of handles by their endpoints.
+	Push map[string]map[string]store.PushSubscription
+
+	// Payloads of the pinned messages.
+	Pins [][]byte
+
+	// Resume tokens of peers that left.
+	Resume map[string]store.ResumeToken
+}
+
+// ring is a fixed size ring buffer of messages.
+type ring struct {
+	buf  []message
+	next int
+}
+
+type message struct {
+	id string
+	b  []byte
+}
+
+// add adds a message to the ring, overwriting the oldest one if it's full.
+func (r *ring) add(m message, size int) {
+	if len(r.buf) < size {
+		r.buf = append(r.buf, m)
+		return
+	}
+	r.buf[r.next] = m
+	r.next = (r.next + 1) % size
+}
+
+// ordered returns the messages in the ring, oldest first.
+func (r *ring) ordered() []message {
+	return append(append([]message{}, r.buf[r.next:]...), r.buf[:r.next]...)
+}
+
+// last returns up to the last n messages, oldest first.
+func (r *ring) last(n int) [][]byte {
+	msgs := r.ordered()
+	if n > 0 && len(msgs) > n {
+		msgs = msgs[len(msgs)-n:]
+	}
+
+	out := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.b
+	}
+	return out
+}
+
+// remove removes the messages with the given ID from the ring.
+func (r *ring) remove(id string) {
+	var (
+		msgs = r.ordered()
+		out  = msgs[:0]
+	)
+	for _, m := range msgs {
+		if m.id != id {
+			out = append(out, m)
+		}
+	}
+	if len(out) < len(msgs) {
+		r.buf = out
+		r.next = 0
+	}
 }
 
 // New returns a new Redis store.
 func New(cfg Config) (*InMemory, error) {
+	if cfg.MaxMessages < 1 {
+		cfg.MaxMessages = store.DefaultMaxMessages
+	}
 	store := &InMemory{
 		cfg:   &cfg,
 		rooms: map[string]*room{},
@@ -57,6 +139,18 @@ func (m *InMemory) cleanup() {
 			delete(m.rooms, id)
 			continue
 		}
+		for s, exp := range r.Bans {
+			if exp.Before(now) {
+				delete(r.Bans, s)
+			}
+		}
+		for s := range r.Sessions {
+			if r.SessionExpiry[s].Before(now) {
+				delete(r.Sessions, s)
+				delete(r.SessionExpiry, s)
+				delete(r.SessionCreated, s)
+			}
+		}
 	}
 }
 
@@ -69,11 +163,31 @@ func (m *InMemory) AddRoom(r store.Room, ttl time.Duration) error {
 		Room:     r,
 		Expire:   r.CreatedAt.Add(ttl),
 		Sessions: map[string]string{},
+		Messages: &ring{},
 	}
 
 	return nil
 }
 
+// CreateRoomIfNotExists adds a room to the store unless one with its ID
+// exists.
+func (m *InMemory) CreateRoomIfNotExists(r store.Room, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.rooms[r.ID]; ok {
+		return false, nil
+	}
+	m.rooms[r.ID] = &room{
+		Room:     r,
+		Expire:   r.CreatedAt.Add(ttl),
+		Sessions: map[string]string{},
+		Messages: &ring{},
+	}
+
+	return true, nil
+}
+
 // AddPredefinedRoom adds a room to the store.
 func (m *InMemory) AddPredefinedRoom(r store.Room) error {
 	m.mu.Lock()
@@ -83,6 +197,7 @@ func (m *InMemory) AddPredefinedRoom(r store.Room) error {
 	m.rooms[key] = &room{
 		Room:     r,
 		Sessions: map[string]string{},
+		Messages: &ring{},
 	}
 
 	return nil
@@ -103,6 +218,20 @@ func (m *InMemory) ExtendRoomTTL(id string, ttl time.Duration) error {
 	return nil
 }
 
+// SetRoomPassword replaces the password hash of a room.
+func (m *InMemory) SetRoomPassword(id string, password []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[id]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	room.Password = password
+	return nil
+}
+
 // GetRoom gets a room from the store.
 func (m *InMemory) GetRoom(id string) (store.Room, error) {
 	m.mu.Lock()
@@ -147,7 +276,16 @@ func (m *InMemory) AddSession(sessID, handle, roomID string, ttl time.Duration)
 		return store.ErrRoomNotFound
 	}
 
+	now := time.Now()
 	room.Sessions[sessID] = handle
+	if room.SessionExpiry == nil {
+		room.SessionExpiry = map[string]time.Time{}
+		room.SessionCreated = map[string]time.Time{}
+	}
+	room.SessionExpiry[sessID] = now.Add(ttl)
+	if _, ok := room.SessionCreated[sessID]; !ok {
+		room.SessionCreated[sessID] = now
+	}
 	m.rooms[roomID] = room
 
 	return nil
@@ -166,7 +304,7 @@ func (m *InMemory) GetSession(sessID, roomID string) (store.Sess, error) {
 
 	handle, ok := room.Sessions[sessID]
 
-	if !ok {
+	if !ok || room.SessionExpiry[sessID].Before(time.Now()) {
 		return store.Sess{}, nil
 	}
 
@@ -176,6 +314,52 @@ func (m *InMemory) GetSession(sessID, roomID string) (store.Sess, error) {
 	}, nil
 }
 
+// ExtendSession renews a session's TTL, if it exists.
+func (m *InMemory) ExtendSession(sessID, roomID string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	now := time.Now()
+	if exp, ok := room.SessionExpiry[sessID]; ok && exp.After(now) {
+		room.SessionExpiry[sessID] = now.Add(ttl)
+	}
+
+	return nil
+}
+
+// HandleSessions returns the IDs of the live sessions of a handle in a
+// room, oldest first.
+func (m *InMemory) HandleSessions(roomID, handle string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return nil, store.ErrRoomNotFound
+	}
+
+	var (
+		now = time.Now()
+		out []string
+	)
+	for id, h := range room.Sessions {
+		if h == handle && room.SessionExpiry[id].After(now) {
+			out = append(out, id)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return room.SessionCreated[out[i]].Before(room.SessionCreated[out[j]])
+	})
+	return out, nil
+}
+
 // RemoveSession deletes a session ID from a room.
 func (m *InMemory) RemoveSession(sessID, roomID string) error {
 	m.mu.Lock()
@@ -188,6 +372,8 @@ func (m *InMemory) RemoveSession(sessID, roomID string) error {
 	}
 
 	delete(room.Sessions, sessID)
+	delete(room.SessionExpiry, sessID)
+	delete(room.SessionCreated, sessID)
 	m.rooms[roomID] = room
 
 	return nil
@@ -205,12 +391,230 @@ func (m *InMemory) ClearSessions(roomID string) error {
 	}
 
 	room.Sessions = map[string]string{}
+	room.SessionExpiry = map[string]time.Time{}
+	room.SessionCreated = map[string]time.Time{}
 
 	m.rooms[roomID] = room
 
 	return nil
 }
 
+// AppendMessage appends a message to a room's history.
+func (m *InMemory) AppendMessage(roomID, msgID string, msg []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	room.Messages.add(message{id: msgID, b: msg}, m.cfg.MaxMessages)
+	return nil
+}
+
+// DeleteMessage deletes a message, and the events stored with its ID, from a
+// room's history.
+func (m *InMemory) DeleteMessage(roomID, msgID string) error {
+	if msgID == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	room.Messages.remove(msgID)
+	return nil
+}
+
+// GetMessages retrieves up to the last limit messages in a room's history.
+func (m *InMemory) GetMessages(roomID string, limit int) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, store.ErrRoomNotFound
+	}
+	return room.Messages.last(limit), nil
+}
+
+// WalkMessages calls fn with each message in a room's history, oldest first.
+func (m *InMemory) WalkMessages(roomID string, fn func(msg []byte) error) error {
+	m.mu.Lock()
+	room, ok := m.rooms[roomID]
+	if !ok {
+		m.mu.Unlock()
+		return store.ErrRoomNotFound
+	}
+	msgs := room.Messages.ordered()
+	m.mu.Unlock()
+
+	for _, msg := range msgs {
+		if err := fn(msg.b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping always succeeds as the store lives in memory.
+func (m *InMemory) Ping() error {
+	return nil
+}
+
+// AddBan bans a subject from a room for the given duration.
+func (m *InMemory) AddBan(roomID, subject string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	if room.Bans == nil {
+		room.Bans = make(map[string]time.Time)
+	}
+	room.Bans[subject] = time.Now().Add(ttl)
+	return nil
+}
+
+// IsBanned checks whether a subject is banned from a room.
+func (m *InMemory) IsBanned(roomID, subject string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return false, store.ErrRoomNotFound
+	}
+	exp, ok := room.Bans[subject]
+	return ok && exp.After(time.Now()), nil
+}
+
+// AddPushSubscription adds a handle's push subscription to a room.
+func (m *InMemory) AddPushSubscription(roomID, handle string, s store.PushSubscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	if room.Push == nil {
+		room.Push = make(map[string]map[string]store.PushSubscription)
+	}
+	if room.Push[handle] == nil {
+		room.Push[handle] = make(map[string]store.PushSubscription)
+	}
+	room.Push[handle][s.Endpoint] = s
+	return nil
+}
+
+// GetPushSubscriptions returns a handle's push subscriptions in a room.
+func (m *InMemory) GetPushSubscriptions(roomID, handle string) ([]store.PushSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, store.ErrRoomNotFound
+	}
+	out := make([]store.PushSubscription, 0, len(room.Push[handle]))
+	for _, s := range room.Push[handle] {
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// RemovePushSubscription removes a handle's push subscription from a room.
+func (m *InMemory) RemovePushSubscription(roomID, handle, endpoint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	if subs, ok := room.Push[handle]; ok {
+		delete(subs, endpoint)
+		if len(subs) == 0 {
+			delete(room.Push, handle)
+		}
+	}
+	return nil
+}
+
+// SetResumeToken stores a peer's resume token in a room for ttl.
+func (m *InMemory) SetResumeToken(roomID, token string, t store.ResumeToken, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	if room.Resume == nil {
+		room.Resume = make(map[string]store.ResumeToken)
+	}
+
+	// Drop the expired tokens of peers that never came back.
+	now := time.Now()
+	for k, t := range room.Resume {
+		if t.Expires.Before(now) {
+			delete(room.Resume, k)
+		}
+	}
+	t.Expires = now.Add(ttl)
+	room.Resume[token] = t
+	return nil
+}
+
+// ClaimResumeToken returns and removes a peer's resume token in a room.
+func (m *InMemory) ClaimResumeToken(roomID, token string) (store.ResumeToken, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ResumeToken{}, false, store.ErrRoomNotFound
+	}
+	t, ok := room.Resume[token]
+	if !ok {
+		return store.ResumeToken{}, false, nil
+	}
+	delete(room.Resume, token)
+	return t, t.Expires.After(time.Now()), nil
+}
+
+// SetPins replaces the pinned messages of a room.
+func (m *InMemory) SetPins(roomID string, pins [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	room.Pins = pins
+	return nil
+}
+
+// GetPins returns the pinned messages of a room.
+func (m *InMemory) GetPins(roomID string) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, store.ErrRoomNotFound
+	}
+	return room.Pins, nil
+}
+
 // Get value from a key.
 func (m *InMemory) Get(key string) ([]byte, error) {
 	m.mu.Lock()
@@ -230,3 +634,15 @@ func (m *InMemory) Set(key string, data []byte) error {
 	copy(m.data[key], data)
 	return nil
 }
+
+// SetIfNotExists sets a value unless the key exists.
+func (m *InMemory) SetIfNotExists(key string, data []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[key]; ok {
+		return false, nil
+	}
+	m.data[key] = make([]byte, len(data), len(data))
+	copy(m.data[key], data)
+	return true, nil
+}
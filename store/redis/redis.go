@@ -1,13 +1,80 @@
 package redis
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/knadh/niltalk/store"
 )
 
+// appendMessage appends a message to the history of a room that exists,
+// trimming it, and gives the history the room's TTL so that it doesn't
+// outlive the room. Predefined rooms don't expire.
+var appendMessage = redis.NewScript(2, `
+local ttl = redis.call("PTTL", KEYS[2])
+if ttl == -2 then
+	return 0
+end
+redis.call("RPUSH", KEYS[1], ARGV[1])
+redis.call("LTRIM", KEYS[1], -tonumber(ARGV[2]), -1)
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return 1`)
+
+// Number of messages read at a time when walking a room's history.
+const walkPageSize = 100
+
+// setPassword sets a room's password only if the room exists, as HSET would
+// otherwise create a room without a TTL.
+var setPassword = redis.NewScript(1, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "password", ARGV[1])
+return 1`)
+
+// createRoom adds a room only if it doesn't exist, so that rooms created
+// concurrently with the same ID don't overwrite each other.
+var createRoom = redis.NewScript(1, `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("HMSET", KEYS[1], "name", ARGV[1], "created_at", ARGV[2], "password", ARGV[3], "creator_id", ARGV[4])
+redis.call("EXPIRE", KEYS[1], ARGV[5])
+return 1`)
+
+// claimKey gets a key and deletes it, so that only one of concurrent claims
+// gets the value.
+var claimKey = redis.NewScript(1, `
+local v = redis.call("GET", KEYS[1])
+if v then
+	redis.call("DEL", KEYS[1])
+end
+return v`)
+
+// nextSeq increments a room's sequence, keeping it past ARGV[1], the
+// highest sequence number the caller has seen, and expires it along with the
+// room. Predefined rooms don't expire.
+var nextSeq = redis.NewScript(2, `
+local n = redis.call("INCR", KEYS[1])
+local floor = tonumber(ARGV[1])
+if n <= floor then
+	n = floor + 1
+	redis.call("SET", KEYS[1], n)
+end
+local ttl = redis.call("PTTL", KEYS[2])
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return n
+`)
+
 // Config represents the Redis store config structure.
 type Config struct {
 	Address     string        `koanf:"address"`
@@ -17,14 +84,54 @@ type Config struct {
 	IdleConns   int           `koanf:"idle_conns"`
 	Timeout     time.Duration `koanf:"timeout"`
 
-	PrefixRoom    string `koanf:"prefix_room"`
-	PrefixSession string `koanf:"prefix_session"`
+	// Pool tuning. Connections in MinIdleConns are opened at startup so the
+	// first requests don't pay for dialing. Idle connections are closed after
+	// IdleTimeout and all connections after MaxConnLifetime, 0 for never.
+	MinIdleConns    int           `koanf:"min_idle_conns"`
+	IdleTimeout     time.Duration `koanf:"idle_timeout"`
+	MaxConnLifetime time.Duration `koanf:"max_conn_lifetime"`
+
+	// Timeouts of dialing, reads and writes, which default to Timeout.
+	DialTimeout  time.Duration `koanf:"dial_timeout"`
+	ReadTimeout  time.Duration `koanf:"read_timeout"`
+	WriteTimeout time.Duration `koanf:"write_timeout"`
+
+	// Times a failed dial is retried, with a growing delay, before giving
+	// up. Commands aren't retried as they may not be idempotent.
+	MaxRetries int `koanf:"max_retries"`
+
+	// Address of a replica (or a proxy in front of replicas) that read-heavy
+	// queries that can lag behind writes are sent to: history exports,
+	// presence and push subscriptions. Everything else goes to Address, which
+	// is used for all queries if it's empty.
+	ReadAddress string `koanf:"read_address"`
+
+	PrefixRoom     string `koanf:"prefix_room"`
+	PrefixSession  string `koanf:"prefix_session"`
+	PrefixPresence string `koanf:"prefix_presence"`
+	PrefixMessages string `koanf:"prefix_messages"`
+	PrefixBan      string `koanf:"prefix_ban"`
+	PrefixPush     string `koanf:"prefix_push"`
+	PrefixPin      string `koanf:"prefix_pin"`
+	PrefixResume   string `koanf:"prefix_resume"`
+
+	// Pub/sub channel of a room's broadcasts shared across instances.
+	PrefixBroadcast string `koanf:"prefix_broadcast"`
+
+	// Sequence of a room's broadcasts shared across instances.
+	PrefixSeq string `koanf:"prefix_seq"`
+
+	// Number of messages kept per room.
+	MaxMessages int `koanf:"max_messages"`
 }
 
 // Redis represents the Redis implementation of the Store interface.
 type Redis struct {
 	cfg  *Config
 	pool *redis.Pool
+
+	// Pool of connections to the replica, or pool if there's none.
+	readPool *redis.Pool
 }
 
 type room struct {
@@ -32,35 +139,190 @@ type room struct {
 	Name      string `redis:"name"`
 	Password  []byte `redis:"password"`
 	CreatedAt string `redis:"created_at"`
+	CreatorID string `redis:"creator_id"`
+}
+
+// withDefaults returns the config with the default key prefixes filled in
+// for the ones that aren't set, eg: in configs written before they were
+// added.
+func (c Config) withDefaults() Config {
+	for _, p := range []struct {
+		val *string
+		def string
+	}{
+		{&c.PrefixRoom, "NIL:ROOM:%s"},
+		{&c.PrefixSession, "NIL:SESS:ROOM:%s"},
+		{&c.PrefixPresence, "NIL:PRESENCE:ROOM:%s"},
+		{&c.PrefixMessages, "NIL:MSG:ROOM:%s"},
+		{&c.PrefixBan, "NIL:BAN:ROOM:%s"},
+		{&c.PrefixPush, "NIL:PUSH:ROOM:%s"},
+		{&c.PrefixPin, "NIL:PIN:ROOM:%s"},
+		{&c.PrefixResume, "NIL:RESUME:ROOM:%s"},
+		{&c.PrefixBroadcast, "NIL:BROADCAST:ROOM:%s"},
+		{&c.PrefixSeq, "NIL:SEQ:ROOM:%s"},
+	} {
+		if *p.val == "" {
+			*p.val = p.def
+		}
+	}
+	return c
+}
+
+// Validate checks the config for missing and invalid values, returning an
+// error that lists all the problems found, one per line. Key prefixes that
+// aren't set get their defaults.
+func (c Config) Validate() error {
+	c = c.withDefaults()
+
+	var errs []string
+	if c.Address == "" {
+		errs = append(errs, "store.address is required with the redis storage, eg: 127.0.0.1:6379")
+	}
+	if c.DB < 0 {
+		errs = append(errs, "store.db should be >= 0")
+	}
+	if c.ActiveConns < 0 || c.IdleConns < 0 {
+		errs = append(errs, "store.active_conns and store.idle_conns should be >= 0")
+	}
+	if c.MinIdleConns < 0 || c.MinIdleConns > c.IdleConns {
+		errs = append(errs, "store.min_idle_conns should be >= 0 and <= store.idle_conns")
+	}
+	if c.ActiveConns > 0 && c.MinIdleConns > c.ActiveConns {
+		errs = append(errs, "store.min_idle_conns should be <= store.active_conns")
+	}
+	if c.MaxRetries < 0 {
+		errs = append(errs, "store.max_retries should be >= 0")
+	}
+	for _, t := range []struct {
+		key string
+		val time.Duration
+	}{
+		{"timeout", c.Timeout},
+		{"dial_timeout", c.DialTimeout},
+		{"read_timeout", c.ReadTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"max_conn_lifetime", c.MaxConnLifetime},
+	} {
+		if t.val < 0 {
+			errs = append(errs, fmt.Sprintf("store.%s should be >= 0, eg: 3s", t.key))
+		}
+	}
+
+	for _, p := range []struct {
+		key, val string
+	}{
+		{"prefix_room", c.PrefixRoom},
+		{"prefix_session", c.PrefixSession},
+		{"prefix_presence", c.PrefixPresence},
+		{"prefix_messages", c.PrefixMessages},
+		{"prefix_ban", c.PrefixBan},
+		{"prefix_push", c.PrefixPush},
+		{"prefix_pin", c.PrefixPin},
+		{"prefix_resume", c.PrefixResume},
+		{"prefix_broadcast", c.PrefixBroadcast},
+		{"prefix_seq", c.PrefixSeq},
+	} {
+		if strings.Count(p.val, "%s") != 1 {
+			errs = append(errs, fmt.Sprintf("store.%s should have exactly one %%s for the room ID, eg: NIL:ROOM:%%s", p.key))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "\n"))
 }
 
 // New returns a new Redis store.
 func New(cfg Config) (*Redis, error) {
-	pool := &redis.Pool{
-		Wait:      true,
-		MaxActive: cfg.ActiveConns,
-		MaxIdle:   cfg.IdleConns,
+	cfg = cfg.withDefaults()
+	if cfg.MaxMessages < 1 {
+		cfg.MaxMessages = store.DefaultMaxMessages
+	}
+	for _, t := range []*time.Duration{&cfg.DialTimeout, &cfg.ReadTimeout, &cfg.WriteTimeout} {
+		if *t == 0 {
+			*t = cfg.Timeout
+		}
+	}
+
+	pool := newPool(cfg, cfg.Address)
+	if err := warmUp(pool, cfg.MinIdleConns); err != nil {
+		return nil, err
+	}
+
+	readPool := pool
+	if cfg.ReadAddress != "" {
+		readPool = newPool(cfg, cfg.ReadAddress)
+		if err := warmUp(readPool, cfg.MinIdleConns); err != nil {
+			return nil, fmt.Errorf("error connecting to the read replica: %v", err)
+		}
+	}
+	return &Redis{cfg: &cfg, pool: pool, readPool: readPool}, nil
+}
+
+// Config returns the store's config with the defaults filled in.
+func (r *Redis) Config() Config {
+	return *r.cfg
+}
+
+// newPool returns a connection pool to the server at addr.
+func newPool(cfg Config, addr string) *redis.Pool {
+	return &redis.Pool{
+		Wait:            true,
+		MaxActive:       cfg.ActiveConns,
+		MaxIdle:         cfg.IdleConns,
+		IdleTimeout:     cfg.IdleTimeout,
+		MaxConnLifetime: cfg.MaxConnLifetime,
 		Dial: func() (redis.Conn, error) {
-			return redis.Dial(
-				"tcp",
-				cfg.Address,
-				redis.DialPassword(cfg.Password),
-				redis.DialConnectTimeout(cfg.Timeout),
-				redis.DialReadTimeout(cfg.Timeout),
-				redis.DialWriteTimeout(cfg.Timeout),
-				redis.DialDatabase(cfg.DB),
-			)
+			for i := 0; ; i++ {
+				c, err := redis.Dial(
+					"tcp",
+					addr,
+					redis.DialPassword(cfg.Password),
+					redis.DialConnectTimeout(cfg.DialTimeout),
+					redis.DialReadTimeout(cfg.ReadTimeout),
+					redis.DialWriteTimeout(cfg.WriteTimeout),
+					redis.DialDatabase(cfg.DB),
+				)
+				if err == nil || i >= cfg.MaxRetries {
+					return c, err
+				}
+				time.Sleep(retryDelay(i))
+			}
 		},
 	}
+}
 
-	// Test connection.
-	c := pool.Get()
-	defer c.Close()
+// retryDelay returns the delay before the nth retry of a dial, doubling from
+// 100ms up to 2s.
+func retryDelay(n int) time.Duration {
+	if n > 4 {
+		return time.Second * 2
+	}
+	return time.Millisecond * 100 << uint(n)
+}
 
-	if err := c.Err(); err != nil {
-		return nil, err
+// warmUp checks that connections can be made, opening n connections and
+// leaving them idle in the pool.
+func warmUp(pool *redis.Pool, n int) error {
+	if n < 1 {
+		n = 1
+	}
+	conns := make([]redis.Conn, 0, n)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		c := pool.Get()
+		conns = append(conns, c)
+		if err := c.Err(); err != nil {
+			return err
+		}
 	}
-	return &Redis{cfg: &cfg, pool: pool}, nil
+	return nil
 }
 
 // AddRoom adds a room to the store.
@@ -72,11 +334,22 @@ func (r *Redis) AddRoom(room store.Room, ttl time.Duration) error {
 	c.Send("HMSET", key,
 		"name", room.Name,
 		"created_at", room.CreatedAt.Format(time.RFC3339),
-		"password", room.Password)
+		"password", room.Password,
+		"creator_id", room.CreatorID)
 	c.Send("EXPIRE", key, int(ttl.Seconds()))
 	return c.Flush()
 }
 
+// CreateRoomIfNotExists adds a room to the store unless one with its ID
+// exists.
+func (r *Redis) CreateRoomIfNotExists(room store.Room, ttl time.Duration) (bool, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	return redis.Bool(createRoom.Do(c, fmt.Sprintf(r.cfg.PrefixRoom, room.ID),
+		room.Name, room.CreatedAt.Format(time.RFC3339), room.Password, room.CreatorID, int(ttl.Seconds())))
+}
+
 // AddPredefinedRoom adds a room to the store.
 func (r *Redis) AddPredefinedRoom(room store.Room) error {
 	c := r.pool.Get()
@@ -96,10 +369,26 @@ func (r *Redis) ExtendRoomTTL(id string, ttl time.Duration) error {
 	defer c.Close()
 
 	c.Send("EXPIRE", fmt.Sprintf(r.cfg.PrefixRoom, id), int(ttl.Seconds()))
-	c.Send("EXPIRE", fmt.Sprintf(r.cfg.PrefixSession, id), int(ttl.Seconds()))
+	c.Send("EXPIRE", fmt.Sprintf(r.cfg.PrefixMessages, id), int(ttl.Seconds()))
+	c.Send("EXPIRE", fmt.Sprintf(r.cfg.PrefixPin, id), int(ttl.Seconds()))
 	return c.Flush()
 }
 
+// SetRoomPassword replaces the password hash of a room.
+func (r *Redis) SetRoomPassword(id string, password []byte) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	ok, err := redis.Bool(setPassword.Do(c, fmt.Sprintf(r.cfg.PrefixRoom, id), password))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	return nil
+}
+
 // GetRoom gets a room from the store.
 func (r *Redis) GetRoom(id string) (store.Room, error) {
 	c := r.pool.Get()
@@ -130,6 +419,7 @@ func (r *Redis) GetRoom(id string) (store.Room, error) {
 		Name:      room.Name,
 		Password:  room.Password,
 		CreatedAt: t,
+		CreatorID: room.CreatorID,
 	}, nil
 }
 
@@ -150,7 +440,8 @@ func (r *Redis) RemoveRoom(id string) error {
 	c := r.pool.Get()
 	defer c.Close()
 
-	_, err := redis.Bool(c.Do("DEL", fmt.Sprintf(r.cfg.PrefixRoom, id)))
+	_, err := redis.Bool(c.Do("DEL", fmt.Sprintf(r.cfg.PrefixRoom, id), fmt.Sprintf(r.cfg.PrefixMessages, id),
+		fmt.Sprintf(r.cfg.PrefixPin, id), fmt.Sprintf(r.cfg.PrefixSeq, id)))
 	return err
 }
 
@@ -159,9 +450,10 @@ func (r *Redis) AddSession(sessID, handle, roomID string, ttl time.Duration) err
 	c := r.pool.Get()
 	defer c.Close()
 
-	key := fmt.Sprintf(r.cfg.PrefixSession, roomID)
-	c.Send("HMSET", key, sessID, handle)
-	c.Send("EXPIRE", key, ttl.Seconds)
+	key := r.handleKey(handle, roomID)
+	c.Send("SET", r.sessionKey(sessID, roomID), handle, "EX", int(ttl.Seconds()))
+	c.Send("ZADD", key, "NX", time.Now().UnixNano(), sessID)
+	c.Send("EXPIRE", key, int(ttl.Seconds()))
 	return c.Flush()
 }
 
@@ -170,7 +462,7 @@ func (r *Redis) GetSession(sessID, roomID string) (store.Sess, error) {
 	c := r.pool.Get()
 	defer c.Close()
 
-	h, err := redis.String(c.Do("HGET", fmt.Sprintf(r.cfg.PrefixSession, roomID), sessID))
+	h, err := redis.String(c.Do("GET", r.sessionKey(sessID, roomID)))
 	if err != nil && err != redis.ErrNil {
 		return store.Sess{}, err
 	}
@@ -184,24 +476,376 @@ func (r *Redis) GetSession(sessID, roomID string) (store.Sess, error) {
 	}, nil
 }
 
+// ExtendSession renews a session's TTL, if it exists.
+func (r *Redis) ExtendSession(sessID, roomID string, ttl time.Duration) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	h, err := redis.String(c.Do("GET", r.sessionKey(sessID, roomID)))
+	if err == redis.ErrNil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	c.Send("EXPIRE", r.sessionKey(sessID, roomID), int(ttl.Seconds()))
+	c.Send("EXPIRE", r.handleKey(h, roomID), int(ttl.Seconds()))
+	return c.Flush()
+}
+
+// HandleSessions returns the IDs of the live sessions of a handle in a
+// room, oldest first. IDs of sessions that have expired are removed from the
+// handle's set.
+func (r *Redis) HandleSessions(roomID, handle string) ([]string, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := r.handleKey(handle, roomID)
+	ids, err := redis.Strings(c.Do("ZRANGE", key, 0, -1))
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	keys := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = r.sessionKey(id, roomID)
+	}
+	handles, err := redis.Strings(c.Do("MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+
+	var out, stale []string
+	for i, id := range ids {
+		if handles[i] == handle {
+			out = append(out, id)
+		} else {
+			stale = append(stale, id)
+		}
+	}
+	if len(stale) > 0 {
+		if _, err := c.Do("ZREM", redis.Args{}.Add(key).AddFlat(stale)...); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
 // RemoveSession deletes a session ID from a room.
 func (r *Redis) RemoveSession(sessID, roomID string) error {
 	c := r.pool.Get()
 	defer c.Close()
 
-	_, err := redis.Bool(c.Do("HDEL", fmt.Sprintf(r.cfg.PrefixSession, roomID), sessID))
+	_, err := c.Do("DEL", r.sessionKey(sessID, roomID))
 	return err
 }
 
-// ClearSessions deletes all the sessions in a room.
+// ClearSessions deletes all the sessions in a room and the handles' session
+// sets.
 func (r *Redis) ClearSessions(roomID string) error {
 	c := r.pool.Get()
 	defer c.Close()
 
-	_, err := redis.Bool(c.Do("DEL", fmt.Sprintf(r.cfg.PrefixSession, roomID)))
+	var (
+		cursor  = 0
+		pattern = fmt.Sprintf(r.cfg.PrefixSession, roomID) + "[:#]*"
+	)
+	for {
+		res, err := redis.Values(c.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		if err != nil {
+			return err
+		}
+		keys, err := redis.Strings(res[1], nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if _, err := c.Do("DEL", redis.Args{}.AddFlat(keys)...); err != nil {
+				return err
+			}
+		}
+
+		cursor, err = redis.Int(res[0], nil)
+		if err != nil {
+			return err
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// sessionKey returns the key of a session. Each session has its own key so
+// that it expires on its own.
+func (r *Redis) sessionKey(sessID, roomID string) string {
+	return fmt.Sprintf(r.cfg.PrefixSession, roomID) + ":" + sessID
+}
+
+// handleKey returns the key of the sorted set of a handle's session IDs,
+// scored by when the sessions were created.
+func (r *Redis) handleKey(handle, roomID string) string {
+	return fmt.Sprintf(r.cfg.PrefixSession, roomID) + "#" + handle
+}
+
+// AppendMessage appends a message to a room's history, trimming it to the
+// number of messages kept, and expiring it along with the room. Each item in
+// the list is the message ID and the message separated by a tab.
+func (r *Redis) AppendMessage(roomID, msgID string, msg []byte) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	_, err := appendMessage.Do(c, fmt.Sprintf(r.cfg.PrefixMessages, roomID), fmt.Sprintf(r.cfg.PrefixRoom, roomID),
+		append([]byte(msgID+"\t"), msg...), r.cfg.MaxMessages)
 	return err
 }
 
+// GetMessages retrieves up to the last limit messages in a room's history.
+// It reads from the primary as rooms read their history back right after
+// writing it, to replay it, pin from it and pick up their sequence.
+func (r *Redis) GetMessages(roomID string, limit int) ([][]byte, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	out, err := redis.ByteSlices(c.Do("LRANGE", fmt.Sprintf(r.cfg.PrefixMessages, roomID), -limit, -1))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	for i, b := range out {
+		if n := bytes.IndexByte(b, '\t'); n >= 0 {
+			out[i] = b[n+1:]
+		}
+	}
+	return out, nil
+}
+
+// DeleteMessage deletes a message, and the events stored with its ID, from a
+// room's history.
+func (r *Redis) DeleteMessage(roomID, msgID string) error {
+	if msgID == "" {
+		return nil
+	}
+
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixMessages, roomID)
+	items, err := redis.ByteSlices(c.Do("LRANGE", key, 0, -1))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	var (
+		prefix = []byte(msgID + "\t")
+		n      int
+	)
+	for _, b := range items {
+		if bytes.HasPrefix(b, prefix) {
+			c.Send("LREM", key, 1, b)
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if _, err := c.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkMessages reads a room's history in pages, calling fn with each
+// message, oldest first. Messages trimmed off the history while walking may
+// shift the pages.
+func (r *Redis) WalkMessages(roomID string, fn func(msg []byte) error) error {
+	c := r.readPool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixMessages, roomID)
+	for start := 0; ; start += walkPageSize {
+		items, err := redis.ByteSlices(c.Do("LRANGE", key, start, start+walkPageSize-1))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		for _, b := range items {
+			if n := bytes.IndexByte(b, '\t'); n >= 0 {
+				b = b[n+1:]
+			}
+			if err := fn(b); err != nil {
+				return err
+			}
+		}
+		if len(items) < walkPageSize {
+			return nil
+		}
+	}
+}
+
+// Ping checks that the Redis server, and the replica if there's one, are
+// reachable.
+func (r *Redis) Ping() error {
+	if r.readPool != r.pool {
+		rc := r.readPool.Get()
+		defer rc.Close()
+		if _, err := rc.Do("PING"); err != nil {
+			return err
+		}
+	}
+
+	c := r.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("PING")
+	return err
+}
+
+// AddBan bans a subject from a room for the given duration.
+func (r *Redis) AddBan(roomID, subject string, ttl time.Duration) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	// PX takes whole milliseconds and rejects 0, so bans are rounded up.
+	ms := int64((ttl + time.Millisecond - 1) / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	key := fmt.Sprintf(r.cfg.PrefixBan, roomID) + ":" + subject
+	_, err := c.Do("SET", key, 1, "PX", ms)
+	return err
+}
+
+// IsBanned checks whether a subject is banned from a room.
+func (r *Redis) IsBanned(roomID, subject string) (bool, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	return redis.Bool(c.Do("EXISTS", fmt.Sprintf(r.cfg.PrefixBan, roomID)+":"+subject))
+}
+
+// AddPushSubscription adds a handle's push subscription to a room. The
+// subscriptions expire along with the room.
+func (r *Redis) AddPushSubscription(roomID, handle string, s store.PushSubscription) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ttl, err := redis.Int64(c.Do("PTTL", fmt.Sprintf(r.cfg.PrefixRoom, roomID)))
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf(r.cfg.PrefixPush, roomID) + ":" + handle
+	c.Send("HSET", key, s.Endpoint, b)
+	if ttl > 0 {
+		c.Send("PEXPIRE", key, ttl)
+	}
+	return c.Flush()
+}
+
+// GetPushSubscriptions returns a handle's push subscriptions in a room.
+func (r *Redis) GetPushSubscriptions(roomID, handle string) ([]store.PushSubscription, error) {
+	c := r.readPool.Get()
+	defer c.Close()
+
+	res, err := redis.ByteSlices(c.Do("HVALS", fmt.Sprintf(r.cfg.PrefixPush, roomID)+":"+handle))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]store.PushSubscription, 0, len(res))
+	for _, b := range res {
+		var s store.PushSubscription
+		if err := json.Unmarshal(b, &s); err != nil {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// RemovePushSubscription removes a handle's push subscription from a room.
+func (r *Redis) RemovePushSubscription(roomID, handle, endpoint string) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("HDEL", fmt.Sprintf(r.cfg.PrefixPush, roomID)+":"+handle, endpoint)
+	return err
+}
+
+// SetResumeToken stores a peer's resume token in a room for ttl.
+func (r *Redis) SetResumeToken(roomID, token string, t store.ResumeToken, ttl time.Duration) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	t.Expires = time.Now().Add(ttl)
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf(r.cfg.PrefixResume, roomID) + ":" + token
+	_, err = c.Do("SET", key, b, "PX", int64(ttl/time.Millisecond)+1)
+	return err
+}
+
+// ClaimResumeToken returns and removes a peer's resume token in a room.
+func (r *Redis) ClaimResumeToken(roomID, token string) (store.ResumeToken, bool, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	var t store.ResumeToken
+	b, err := redis.Bytes(claimKey.Do(c, fmt.Sprintf(r.cfg.PrefixResume, roomID)+":"+token))
+	if err == redis.ErrNil {
+		return t, false, nil
+	}
+	if err != nil {
+		return t, false, err
+	}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return t, false, err
+	}
+	return t, true, nil
+}
+
+// SetPins replaces the pinned messages of a room.
+func (r *Redis) SetPins(roomID string, pins [][]byte) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	ttl, err := redis.Int64(c.Do("PTTL", fmt.Sprintf(r.cfg.PrefixRoom, roomID)))
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf(r.cfg.PrefixPin, roomID)
+	c.Send("DEL", key)
+	if len(pins) > 0 {
+		args := redis.Args{}.Add(key)
+		for _, b := range pins {
+			args = args.Add(b)
+		}
+		c.Send("RPUSH", args...)
+		if ttl > 0 {
+			c.Send("PEXPIRE", key, ttl)
+		}
+	}
+	return c.Flush()
+}
+
+// GetPins returns the pinned messages of a room. It reads from the primary
+// so that a pin shows up in the list right after it's made.
+func (r *Redis) GetPins(roomID string) ([][]byte, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	return redis.ByteSlices(c.Do("LRANGE", fmt.Sprintf(r.cfg.PrefixPin, roomID), 0, -1))
+}
+
 // Get value from a key.
 func (r *Redis) Get(key string) ([]byte, error) {
 	c := r.pool.Get()
@@ -216,3 +860,159 @@ func (r *Redis) Set(key string, data []byte) error {
 	_, err := c.Do("SET", key, data)
 	return err
 }
+
+// SetIfNotExists sets a value unless the key exists.
+func (r *Redis) SetIfNotExists(key string, data []byte) (bool, error) {
+	c := r.pool.Get()
+	defer c.Close()
+	res, err := c.Do("SET", key, data, "NX")
+	if err != nil {
+		return false, err
+	}
+	return res != nil, nil
+}
+
+// SetPresence sets the presence of a room's peers connected to an instance.
+func (r *Redis) SetPresence(roomID, instanceID string, p store.Presence, ttl time.Duration) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	p.Expires = time.Now().Add(ttl)
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf(r.cfg.PrefixPresence, roomID)
+	c.Send("HSET", key, instanceID, b)
+	c.Send("EXPIRE", key, int(ttl.Seconds())+1)
+	return c.Flush()
+}
+
+// GetPresence retrieves the presence of a room's peers across all instances.
+// Expired presence of instances that are down is cleaned up.
+func (r *Redis) GetPresence(roomID string) (map[string]store.Presence, error) {
+	c := r.readPool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixPresence, roomID)
+	res, err := redis.StringMap(c.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		now     = time.Now()
+		out     = make(map[string]store.Presence, len(res))
+		expired []string
+	)
+	for id, v := range res {
+		var p store.Presence
+		if err := json.Unmarshal([]byte(v), &p); err != nil || p.Expires.Before(now) {
+			expired = append(expired, id)
+			continue
+		}
+		out[id] = p
+	}
+
+	// Replicas are read-only, so the cleanup goes to the primary.
+	if len(expired) > 0 {
+		w := r.pool.Get()
+		defer w.Close()
+		w.Do("HDEL", redis.Args{}.Add(key).AddFlat(expired)...)
+	}
+	return out, nil
+}
+
+// RemovePresence removes the presence of a room's peers connected to an instance.
+func (r *Redis) RemovePresence(roomID, instanceID string) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("HDEL", fmt.Sprintf(r.cfg.PrefixPresence, roomID), instanceID)
+	return err
+}
+
+// Broadcast subscriptions ping the server this often, and are considered
+// dead if nothing is received for twice as long.
+const subscribePing = time.Second * 30
+
+// NextSeq returns the next number in a room's sequence shared across
+// instances, which is always after floor.
+func (r *Redis) NextSeq(roomID string, floor uint64) (uint64, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	n, err := redis.Uint64(nextSeq.Do(c, fmt.Sprintf(r.cfg.PrefixSeq, roomID), fmt.Sprintf(r.cfg.PrefixRoom, roomID), floor))
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Publish sends a broadcast to the instances subscribed to a room.
+func (r *Redis) Publish(roomID string, msg []byte) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("PUBLISH", fmt.Sprintf(r.cfg.PrefixBroadcast, roomID), msg)
+	return err
+}
+
+// Subscribe calls fn with the broadcasts published to all rooms until stop
+// is closed or the subscription fails. The subscription has a connection of
+// its own, outside the pool.
+func (r *Redis) Subscribe(stop <-chan struct{}, fn func(roomID string, msg []byte)) error {
+	c, err := r.pool.Dial()
+	if err != nil {
+		return err
+	}
+	psc := redis.PubSubConn{Conn: c}
+	defer psc.Close()
+
+	// Room IDs are the part of the channel name that matches the %s.
+	var (
+		parts  = strings.SplitN(r.cfg.PrefixBroadcast, "%s", 2)
+		prefix = parts[0]
+		suffix = parts[1]
+	)
+	if err := psc.PSubscribe(prefix + "*" + suffix); err != nil {
+		return err
+	}
+
+	// Ping the server to detect dead connections and unsubscribe on stop,
+	// which ends the receive loop.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(subscribePing)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			case <-stop:
+				psc.PUnsubscribe()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(subscribePing * 2).(type) {
+		case redis.Message:
+			id := strings.TrimSuffix(strings.TrimPrefix(v.Channel, prefix), suffix)
+			fn(id, v.Data)
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+		case error:
+			return v
+		}
+	}
+}
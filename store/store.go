@@ -9,18 +9,84 @@ import (
 type Store interface {
 	AddPredefinedRoom(room Room) error
 	AddRoom(r Room, ttl time.Duration) error
+
+	// CreateRoomIfNotExists atomically adds a room unless one with its ID
+	// exists, reporting whether it was added.
+	CreateRoomIfNotExists(r Room, ttl time.Duration) (bool, error)
 	GetRoom(id string) (Room, error)
 	ExtendRoomTTL(id string, ttl time.Duration) error
+	SetRoomPassword(id string, password []byte) error
 	RoomExists(id string) (bool, error)
 	RemoveRoom(id string) error
 
 	AddSession(sessID, handle, roomID string, ttl time.Duration) error
 	GetSession(sessID, roomID string) (Sess, error)
+
+	// ExtendSession renews a session's TTL, if it exists.
+	ExtendSession(sessID, roomID string, ttl time.Duration) error
+
+	// HandleSessions returns the IDs of the live sessions of a handle in a
+	// room, oldest first.
+	HandleSessions(roomID, handle string) ([]string, error)
 	RemoveSession(sessID, roomID string) error
 	ClearSessions(roomID string) error
 
+	AppendMessage(roomID, msgID string, msg []byte) error
+	GetMessages(roomID string, limit int) ([][]byte, error)
+	DeleteMessage(roomID, msgID string) error
+
+	// WalkMessages calls fn with each message in a room's history, oldest
+	// first, stopping at the first error.
+	WalkMessages(roomID string, fn func(msg []byte) error) error
+
+	AddBan(roomID, subject string, ttl time.Duration) error
+	IsBanned(roomID, subject string) (bool, error)
+
+	AddPushSubscription(roomID, handle string, s PushSubscription) error
+	GetPushSubscriptions(roomID, handle string) ([]PushSubscription, error)
+	RemovePushSubscription(roomID, handle, endpoint string) error
+
+	// SetResumeToken stores the resume token of a peer that left a room
+	// for ttl, and ClaimResumeToken returns and removes it, returning
+	// false if it doesn't exist or has expired.
+	SetResumeToken(roomID, token string, t ResumeToken, ttl time.Duration) error
+	ClaimResumeToken(roomID, token string) (ResumeToken, bool, error)
+
+	SetPins(roomID string, pins [][]byte) error
+	GetPins(roomID string) ([][]byte, error)
+
 	Get(key string) ([]byte, error)
 	Set(key string, value []byte) error
+
+	// SetIfNotExists atomically sets a value unless the key exists,
+	// reporting whether it was set.
+	SetIfNotExists(key string, value []byte) (bool, error)
+
+	// Ping checks that the store's backend is reachable.
+	Ping() error
+}
+
+// PresenceStore is implemented by stores that are shared across instances
+// and can hold the presence of the peers connected to each instance.
+type PresenceStore interface {
+	SetPresence(roomID, instanceID string, p Presence, ttl time.Duration) error
+	GetPresence(roomID string) (map[string]Presence, error)
+	RemovePresence(roomID, instanceID string) error
+}
+
+// BroadcastStore is implemented by stores that are shared across instances
+// and can relay room broadcasts between them.
+type BroadcastStore interface {
+	// Publish sends a broadcast to the instances subscribed to a room.
+	Publish(roomID string, msg []byte) error
+
+	// Subscribe calls fn with the broadcasts published to all rooms, from
+	// one goroutine, until stop is closed or the subscription fails.
+	Subscribe(stop <-chan struct{}, fn func(roomID string, msg []byte)) error
+
+	// NextSeq returns the next number in a room's sequence shared by all
+	// instances, which is always after floor.
+	NextSeq(roomID string, floor uint64) (uint64, error)
 }
 
 // Room represents the properties of a room in the store.
@@ -29,6 +95,9 @@ type Room struct {
 	Name      string    `json:"name"`
 	Password  []byte    `json:"password"`
 	CreatedAt time.Time `json:"created_at"`
+
+	// Secret token of the room's creator, who can dispose of it.
+	CreatorID string `json:"creator_id"`
 }
 
 // Sess represents an authenticated peer session.
@@ -37,5 +106,42 @@ type Sess struct {
 	Handle string `json:"name"`
 }
 
+// PushSubscription represents a browser's Web Push subscription, and the
+// session it was made in.
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	SessID   string `json:"sess_id"`
+
+	// Base64url encoded public key and auth secret of the browser.
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// ResumeToken represents the resume token of a peer that left a room, which
+// it can present when it reconnects to get the messages it missed.
+type ResumeToken struct {
+	SessID string `json:"sess_id"`
+
+	// Sequence number of the last message in the room when the peer left.
+	Seq uint64 `json:"seq"`
+
+	Expires time.Time `json:"expires"`
+}
+
+// Presence represents the peers of a room connected to an instance.
+type Presence struct {
+	Peers []Sess `json:"peers"`
+
+	// IDs of the peers that have been typing.
+	Typing []string `json:"typing"`
+
+	// Presence of instances that stop refreshing it (are down) expires.
+	Expires time.Time `json:"expires"`
+}
+
 // ErrRoomNotFound indicates that the requested room was not found.
 var ErrRoomNotFound = errors.New("room not found")
+
+// DefaultMaxMessages is the number of messages kept per room by stores when
+// it's not configured.
+const DefaultMaxMessages = 1000
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/knadh/niltalk/internal/hub"
+)
+
+type connCtxKey struct{}
+
+// newHTTPServer returns a server for h with the configured timeouts. The
+// server's deadlines are replaced on the routes that need longer ones with
+// extendDeadlines.
+func newHTTPServer(cfg *hub.Config, h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connCtxKey{}, c)
+		},
+	}
+}
+
+// extendDeadlines replaces the server's read and write deadlines of the
+// requests to next with d from now, or clears them if d is 0, for requests
+// that take longer than the server's timeouts allow: uploads, history
+// exports and imports, and WebSockets and event streams that stay open for
+// as long as the peer is in the room.
+func extendDeadlines(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c, ok := r.Context().Value(connCtxKey{}).(net.Conn); ok {
+				var t time.Time
+				if d > 0 {
+					t = time.Now().Add(d)
+				}
+				c.SetDeadline(t)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -5,15 +5,19 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/x509"
+	"encoding/base32"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/clementauger/tor-prebuilt/embedded"
+	"github.com/cretz/bine/control"
 	"github.com/cretz/bine/tor"
 	"github.com/cretz/bine/torutil"
 	tued25519 "github.com/cretz/bine/torutil/ed25519"
@@ -21,7 +25,23 @@ import (
 	"github.com/knadh/niltalk/store"
 )
 
+// Key of the onion private key in the store.
+const onionKeyStoreKey = "onionkey"
+
 func loadTorPK(cfg *hub.Config, store store.Store) (pk ed25519.PrivateKey, err error) {
+	// An explicit key path is expected to be provided (eg: a mounted
+	// secret) so that the onion address stays the same.
+	if cfg.TorKeyPath != "" {
+		d, err := ioutil.ReadFile(cfg.TorKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading onion key %q: %v", cfg.TorKeyPath, err)
+		}
+		pk, err := parsePK(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid onion key %q: %v", cfg.TorKeyPath, err)
+		}
+		return pk, nil
+	}
 	if cfg.PrivateKey != "" {
 		return getOrCreatePKFile(cfg.PrivateKey)
 	}
@@ -29,88 +49,146 @@ func loadTorPK(cfg *hub.Config, store store.Store) (pk ed25519.PrivateKey, err e
 }
 
 func getOrCreatePK(store store.Store) (privateKey ed25519.PrivateKey, err error) {
-	key := "onionkey"
-	d, err := store.Get(key)
+	d, err := store.Get(onionKeyStoreKey)
 	if len(d) == 0 || err != nil {
-		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
-		if err != nil {
-			return nil, err
-		}
-		var x509Encoded []byte
-		x509Encoded, err = x509.MarshalPKCS8PrivateKey(privateKey)
-		if err != nil {
-			return nil, err
-		}
-		pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "ED25519 PRIVATE KEY", Bytes: x509Encoded})
-		err = store.Set(key, pemEncoded)
-	} else {
-		block, _ := pem.Decode(d)
-		x509Encoded := block.Bytes
-		var tPk interface{}
-		tPk, err = x509.ParsePKCS8PrivateKey(x509Encoded)
+		var pemEncoded []byte
+		privateKey, pemEncoded, err = generatePK()
 		if err != nil {
 			return nil, err
 		}
-		if x, ok := tPk.(ed25519.PrivateKey); ok {
-			privateKey = x
-		} else {
-			err = fmt.Errorf("invalid key type %T wanted ed25519.PrivateKey", tPk)
-		}
+		err = store.Set(onionKeyStoreKey, pemEncoded)
+		return privateKey, err
 	}
-	return privateKey, err
+	return parsePK(d)
 }
 
 func getOrCreatePKFile(fpath string) (privateKey ed25519.PrivateKey, err error) {
 	if _, err := os.Stat(fpath); os.IsNotExist(err) {
-		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
-		if err != nil {
-			return nil, err
-		}
-		var x509Encoded []byte
-		x509Encoded, err = x509.MarshalPKCS8PrivateKey(privateKey)
+		var pemEncoded []byte
+		privateKey, pemEncoded, err = generatePK()
 		if err != nil {
 			return nil, err
 		}
-		pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "ED25519 PRIVATE KEY", Bytes: x509Encoded})
-		ioutil.WriteFile(fpath, pemEncoded, os.ModePerm)
-	} else {
-		var d []byte
-		d, err = ioutil.ReadFile(fpath)
-		if err != nil {
-			return nil, err
-		}
-		block, _ := pem.Decode(d)
-		x509Encoded := block.Bytes
-		var tPk interface{}
-		tPk, err = x509.ParsePKCS8PrivateKey(x509Encoded)
-		if err != nil {
-			return nil, err
-		}
-		if x, ok := tPk.(ed25519.PrivateKey); ok {
-			privateKey = x
-		} else {
-			return nil, fmt.Errorf("invalid key type %T wanted ed25519.PrivateKey", tPk)
-		}
+		ioutil.WriteFile(fpath, pemEncoded, 0600)
+		return privateKey, nil
+	}
+
+	d, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return parsePK(d)
+}
+
+// generatePK generates an ed25519 private key and returns it along with its
+// PKCS8 PEM encoding.
+func generatePK() (ed25519.PrivateKey, []byte, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	x509Encoded, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
 	}
-	return privateKey, nil
+	pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "ED25519 PRIVATE KEY", Bytes: x509Encoded})
+	return privateKey, pemEncoded, nil
+}
+
+// parsePK parses a PKCS8 PEM encoded ed25519 private key.
+func parsePK(d []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(d)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+		return nil, fmt.Errorf("unexpected PEM block type %q, wanted a private key", block.Type)
+	}
+	tPk, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("not a PKCS8 private key: %v", err)
+	}
+	x, ok := tPk.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid key type %T wanted ed25519.PrivateKey", tPk)
+	}
+	return x, nil
+}
+
+// rotateTorPK generates a new onion private key, overwriting the one in the
+// configured key file or the store.
+func rotateTorPK(cfg *hub.Config, store store.Store) (ed25519.PrivateKey, error) {
+	pk, pemEncoded, err := generatePK()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case cfg.TorKeyPath != "":
+		err = ioutil.WriteFile(cfg.TorKeyPath, pemEncoded, 0600)
+	case cfg.PrivateKey != "":
+		err = ioutil.WriteFile(cfg.PrivateKey, pemEncoded, 0600)
+	default:
+		err = store.Set(onionKeyStoreKey, pemEncoded)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pk, nil
 }
 
 type torServer struct {
-	Handler http.Handler
+	Server *http.Server
 	// PrivateKey path to a pem encoded ed25519 private key
 	PrivateKey ed25519.PrivateKey
+	// RemotePort is the port the onion service is published on.
+	RemotePort int
+	// ClientAuth are the base32 x25519 public keys of the clients authorized
+	// to connect. The service is public if it's empty.
+	ClientAuth []string
 }
 
 func onionAddr(pk ed25519.PrivateKey) string {
 	return torutil.OnionServiceIDFromV3PublicKey(tued25519.PublicKey([]byte(pk.Public().(ed25519.PublicKey))))
 }
 
-func (ts *torServer) Serve(ln net.Listener) error {
+// onionURL returns the URL of the onion service, with the port if it's not
+// the default.
+func onionURL(pk ed25519.PrivateKey, port int) string {
+	if port == 0 || port == 80 {
+		return fmt.Sprintf("http://%v.onion", onionAddr(pk))
+	}
+	return fmt.Sprintf("http://%v.onion:%d", onionAddr(pk), port)
+}
+
+// parseClientAuthKey validates a client's base32 encoded x25519 public key,
+// optionally in the "descriptor:x25519:<key>" form of .auth files, and
+// returns the key.
+func parseClientAuthKey(s string) (string, error) {
+	k := strings.ToUpper(strings.TrimPrefix(strings.TrimSpace(s), "descriptor:x25519:"))
+	b, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(k)
+	if err != nil || len(b) != 32 {
+		return "", fmt.Errorf("invalid client auth key %q", s)
+	}
+	return k, nil
+}
+
+// Serve publishes the onion service and serves it until the server is shut
+// down. The service gets its own loopback listener, which tor forwards the
+// onion connections to, so that they don't compete with the direct ones
+// (which may be TLS) for the app's listener.
+func (ts *torServer) Serve() error {
 	d, err := ioutil.TempDir("", "")
 	if err != nil {
 		return err
 	}
 
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("unable to listen for the onion service: %v", err)
+	}
+	defer ln.Close()
+
 	// Start tor with default config (can set start conf's DebugWriter to os.Stdout for debug logs)
 	// fmt.Println("Starting and registering onion service, please wait a couple of minutes...")
 	t, err := tor.Start(nil, &tor.StartConf{TempDataDirBase: d, ProcessCreator: embedded.NewCreator(), NoHush: true})
@@ -122,8 +200,31 @@ func (ts *torServer) Serve(ln net.Listener) error {
 	// Wait at most a few minutes to publish the service
 	listenCtx, listenCancel := context.WithTimeout(context.Background(), 3*time.Minute)
 	defer listenCancel()
-	// Create a v3 onion service to listen on any port but show as 80
-	onion, err := t.Listen(listenCtx, &tor.ListenConf{LocalListener: ln, Key: ts.PrivateKey, Version3: true, RemotePorts: []int{80}})
+	port := ts.RemotePort
+	if port == 0 {
+		port = 80
+	}
+
+	// bine only supports v2 (basic) client authorization, so private v3
+	// services are added with a raw ADD_ONION command.
+	if len(ts.ClientAuth) > 0 {
+		if err := t.EnableNetwork(listenCtx, true); err != nil {
+			return fmt.Errorf("unable to enable the Tor network: %v", err)
+		}
+		key := &control.ED25519Key{KeyPair: tued25519.FromCryptoPrivateKey(ts.PrivateKey)}
+		cmd := fmt.Sprintf("ADD_ONION %s:%s Flags=V3Auth Port=%d,%s", key.Type(), key.Blob(), port, ln.Addr().String())
+		for _, k := range ts.ClientAuth {
+			cmd += " ClientAuthV3=" + k
+		}
+		if _, err := t.Control.SendRequest("%s", cmd); err != nil {
+			return fmt.Errorf("unable to create onion service: %v", err)
+		}
+		defer t.Control.DelOnion(onionAddr(ts.PrivateKey))
+		return ts.Server.Serve(ln)
+	}
+
+	// Create a v3 onion service to listen on any port but show as the remote port
+	onion, err := t.Listen(listenCtx, &tor.ListenConf{LocalListener: ln, Key: ts.PrivateKey, Version3: true, RemotePorts: []int{port}})
 	if err != nil {
 		return fmt.Errorf("unable to create onion service: %v", err)
 	}
@@ -131,5 +232,5 @@ func (ts *torServer) Serve(ln net.Listener) error {
 
 	// fmt.Printf("server listening at http://%v.onion\n", onion.ID)
 
-	return http.Serve(onion, ts.Handler)
+	return ts.Server.Serve(onion)
 }